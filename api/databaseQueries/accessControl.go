@@ -0,0 +1,156 @@
+package databaseQueries
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyHeader is the header callers send their api key in. The key may also
+// be given as the api_key query parameter for clients that can't set headers
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyContextKey is the key under which the APIKeyConfig for the request is
+// stored in the gin context once the api key has been checked
+const apiKeyContextKey = "api_key"
+
+// Reasons a request is rejected by the access control middleware, recorded in
+// the rejected requests metric
+const (
+	rejectedMissingKey = "missing_api_key"
+	rejectedInvalidKey = "invalid_api_key"
+	rejectedIPRate     = "ip_rate_limit"
+	rejectedKeyRate    = "key_rate_limit"
+	rejectedQuota      = "daily_quota"
+)
+
+// APIKeyAuth is gin middleware checking the api key sent with each request
+// against the keys in the access configuration. A request with a key that isn't
+// known is always rejected, while a request without a key is only rejected if
+// keys are required. The APIKeyConfig for a valid key is stored in the context
+// for RateLimit to use
+func APIKeyAuth() gin.HandlerFunc {
+	return apiKeyAuth(currentConfig.Access)
+}
+
+// apiKeyAuth returns the APIKeyAuth middleware for the given access configuration
+func apiKeyAuth(accessConfig AccessConfig) gin.HandlerFunc {
+
+	apiKeys := map[string]APIKeyConfig{}
+	for _, apiKey := range accessConfig.APIKeys {
+		apiKeys[apiKey.Key] = apiKey
+	}
+
+	return func(c *gin.Context) {
+
+		key := c.GetHeader(apiKeyHeader)
+		if key == "" {
+			key = c.Query("api_key")
+		}
+
+		if key == "" {
+			if accessConfig.RequireAPIKey {
+				rejectedRequests.WithLabelValues(rejectedMissingKey).Inc()
+				c.AbortWithStatusJSON(http.StatusUnauthorized, "An api key is required")
+				return
+			}
+			c.Next()
+			return
+		}
+
+		apiKey, ok := apiKeys[key]
+		if !ok {
+			rejectedRequests.WithLabelValues(rejectedInvalidKey).Inc()
+			LoggerFromContext(c.Request.Context()).Warn("rejected invalid api key", "client_ip", c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid api key")
+			return
+		}
+
+		c.Set(apiKeyContextKey, apiKey)
+		c.Request = c.Request.WithContext(ContextWithLogger(c.Request.Context(),
+			LoggerFromContext(c.Request.Context()).With("api_key_name", apiKey.Name)))
+		c.Next()
+	}
+}
+
+// RateLimit is gin middleware applying a token bucket rate limit to each
+// request, per api key for requests made with a key checked by APIKeyAuth and
+// per IP address otherwise. Requests made with a key are also counted against
+// its daily quota. The limit, requests remaining and seconds until the bucket
+// is full again are returned in the RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers, along with Retry-After once the limit is reached
+func RateLimit() gin.HandlerFunc {
+	return rateLimit(currentConfig.Access, NewQuotaTracker())
+}
+
+// rateLimit returns the RateLimit middleware for the given access configuration
+// counting daily quotas with the given QuotaTracker
+func rateLimit(accessConfig AccessConfig, quotas *QuotaTracker) gin.HandlerFunc {
+
+	ipLimiter := NewRateLimiter(accessConfig.IPRateLimit.RequestsPerMinute, accessConfig.IPRateLimit.Burst)
+	keyLimiter := NewRateLimiter(accessConfig.KeyRateLimit.RequestsPerMinute, accessConfig.KeyRateLimit.Burst)
+
+	return func(c *gin.Context) {
+
+		value, hasKey := c.Get(apiKeyContextKey)
+		if !hasKey {
+			if accessConfig.IPRateLimit.RequestsPerMinute <= 0 {
+				c.Next()
+				return
+			}
+			result := ipLimiter.Allow(c.ClientIP())
+			if !applyRateLimitResult(c, result, rejectedIPRate) {
+				return
+			}
+			c.Next()
+			return
+		}
+
+		apiKey := value.(APIKeyConfig)
+		limit := accessConfig.KeyRateLimit
+		if apiKey.RateLimit != nil {
+			limit = *apiKey.RateLimit
+		}
+		if limit.RequestsPerMinute > 0 {
+			result := keyLimiter.AllowWithRate(apiKey.Key, limit.RequestsPerMinute, limit.Burst)
+			if !applyRateLimitResult(c, result, rejectedKeyRate) {
+				return
+			}
+		}
+
+		allowed, remaining, untilReset := quotas.Use(apiKey.Key, apiKey.DailyQuota)
+		if apiKey.DailyQuota > 0 {
+			c.Header("X-Quota-Limit", strconv.FormatInt(apiKey.DailyQuota, 10))
+			c.Header("X-Quota-Remaining", strconv.FormatInt(remaining, 10))
+			c.Header("X-Quota-Reset", strconv.Itoa(int(secondsDuration(untilReset.Seconds()).Seconds())))
+		}
+		if !allowed {
+			rejectedRequests.WithLabelValues(rejectedQuota).Inc()
+			c.Header("Retry-After", strconv.Itoa(int(secondsDuration(untilReset.Seconds()).Seconds())))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, "Daily quota for this api key has been used up")
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// applyRateLimitResult sets the rate limit headers for the result and, if the
+// request isn't allowed, rejects it with a 429 and returns false
+func applyRateLimitResult(c *gin.Context, result RateLimitResult, reason string) bool {
+
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(int(result.Reset/time.Second)))
+
+	if !result.Allowed {
+		rejectedRequests.WithLabelValues(reason).Inc()
+		c.Header("Retry-After", strconv.Itoa(int(result.RetryAfter/time.Second)))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, "Rate limit exceeded, try again later")
+		return false
+	}
+
+	return true
+}
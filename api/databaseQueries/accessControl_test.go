@@ -0,0 +1,101 @@
+package databaseQueries
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newAccessTestRouter returns a router serving /test behind the api key and
+// rate limit middleware for the given access configuration
+func newAccessTestRouter(accessConfig AccessConfig) *gin.Engine {
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/test", apiKeyAuth(accessConfig), rateLimit(accessConfig, NewQuotaTracker()),
+		func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	return router
+}
+
+// accessTestRequest makes a request to /test with the api key, if one is given
+func accessTestRequest(router *gin.Engine, key string) *httptest.ResponseRecorder {
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	if key != "" {
+		request.Header.Set(apiKeyHeader, key)
+	}
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	return recorder
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+
+	accessConfig := AccessConfig{
+		APIKeys:      []APIKeyConfig{{Name: "web", Key: "web-key"}},
+		IPRateLimit:  RateLimitConfig{RequestsPerMinute: 60, Burst: 10},
+		KeyRateLimit: RateLimitConfig{RequestsPerMinute: 60, Burst: 10},
+	}
+
+	router := newAccessTestRouter(accessConfig)
+	if code := accessTestRequest(router, "").Code; code != http.StatusOK {
+		t.Log("A request without a key should be allowed when keys aren't required, got", code)
+		t.Fail()
+	}
+	if code := accessTestRequest(router, "wrong").Code; code != http.StatusUnauthorized {
+		t.Log("A request with an unknown key should be rejected, got", code)
+		t.Fail()
+	}
+	if code := accessTestRequest(router, "web-key").Code; code != http.StatusOK {
+		t.Log("A request with a valid key should be allowed, got", code)
+		t.Fail()
+	}
+
+	accessConfig.RequireAPIKey = true
+	router = newAccessTestRouter(accessConfig)
+	if code := accessTestRequest(router, "").Code; code != http.StatusUnauthorized {
+		t.Log("A request without a key should be rejected when keys are required, got", code)
+		t.Fail()
+	}
+}
+
+func TestRateLimitHeadersAndRejection(t *testing.T) {
+
+	router := newAccessTestRouter(AccessConfig{IPRateLimit: RateLimitConfig{RequestsPerMinute: 6, Burst: 1}})
+
+	first := accessTestRequest(router, "")
+	if first.Code != http.StatusOK || first.Header().Get("RateLimit-Limit") != "1" ||
+		first.Header().Get("RateLimit-Remaining") != "0" || first.Header().Get("RateLimit-Reset") != "10" {
+		t.Log("Unexpected response to the first request:", first.Code, first.Header())
+		t.Fail()
+	}
+
+	second := accessTestRequest(router, "")
+	if second.Code != http.StatusTooManyRequests || second.Header().Get("Retry-After") != "10" {
+		t.Log("The second request should be rate limited with Retry-After, got", second.Code, second.Header())
+		t.Fail()
+	}
+}
+
+func TestRateLimitDailyQuota(t *testing.T) {
+
+	router := newAccessTestRouter(AccessConfig{
+		APIKeys:      []APIKeyConfig{{Name: "partner", Key: "partner-key", DailyQuota: 1}},
+		KeyRateLimit: RateLimitConfig{RequestsPerMinute: 600, Burst: 10},
+	})
+
+	first := accessTestRequest(router, "partner-key")
+	if first.Code != http.StatusOK || first.Header().Get("X-Quota-Remaining") != "0" {
+		t.Log("The first request should be allowed with no quota left, got", first.Code, first.Header())
+		t.Fail()
+	}
+	if code := accessTestRequest(router, "partner-key").Code; code != http.StatusTooManyRequests {
+		t.Log("A request over the daily quota should be rejected, got", code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,478 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"googlemaps.github.io/maps"
+)
+
+// elevationSampleRadiusMetres is the furthest an elevation sample may be from a
+// point for it to be taken as the elevation of that point
+const elevationSampleRadiusMetres = 150.0
+
+// elevationCellDegrees is the size of the grid cells that elevation samples are
+// kept in, so that only the samples in the cells around a point are searched.
+// It is larger than the sample radius in both directions at Dublin's latitude
+const elevationCellDegrees = 0.005
+
+// routeOptionsContextKey is the key under which RouteOptions are stored in a
+// context
+type routeOptionsContextKey struct{}
+
+// RouteOptions holds the options of a journey planning request that change
+// which stops and trips may be used. In wheelchair mode stops and trips marked
+// as inaccessible are left out, as are stops too far or too steep to walk to
+type RouteOptions struct {
+	Wheelchair bool `json:"wheelchair"`
+}
+
+// ParseRouteOptions reads the wheelchair query parameter of a journey planning
+// request, which is off when it is empty
+func ParseRouteOptions(wheelchair string) (RouteOptions, error) {
+
+	if wheelchair == "" {
+		return RouteOptions{}, nil
+	}
+
+	parsed, err := strconv.ParseBool(wheelchair)
+	if err != nil {
+		return RouteOptions{}, errors.New("wheelchair must be true or false")
+	}
+
+	return RouteOptions{Wheelchair: parsed}, nil
+}
+
+// ContextWithRouteOptions returns a copy of the context carrying the options
+func ContextWithRouteOptions(ctx context.Context, options RouteOptions) context.Context {
+	return context.WithValue(ctx, routeOptionsContextKey{}, options)
+}
+
+// RouteOptionsFromContext returns the RouteOptions carried by the context, or
+// the default options if it carries none
+func RouteOptionsFromContext(ctx context.Context) RouteOptions {
+
+	if ctx != nil {
+		if options, ok := ctx.Value(routeOptionsContextKey{}).(RouteOptions); ok {
+			return options
+		}
+	}
+
+	return RouteOptions{}
+}
+
+// TripAccessibility holds whether each trip in a GTFS trips.txt file can be
+// boarded by wheelchair, as one of the WheelchairBoarding values
+type TripAccessibility struct {
+	trips map[string]string
+}
+
+// NewTripAccessibility returns an empty TripAccessibility
+func NewTripAccessibility() *TripAccessibility {
+	return &TripAccessibility{trips: map[string]string{}}
+}
+
+// Lookup returns whether the trip can be boarded by wheelchair, reporting false
+// if the trip isn't known
+func (accessibility *TripAccessibility) Lookup(tripId string) (string, bool) {
+
+	if accessibility == nil {
+		return "", false
+	}
+
+	value, ok := accessibility.trips[tripId]
+	return value, ok
+}
+
+// timetableUpdates returns the updates that copy the value of each trip onto
+// its documents in the timetable, sorted by trip id. Documents that already say
+// whether the trip is accessible are left alone, as the timetable takes
+// precedence over the trips file
+func (accessibility *TripAccessibility) timetableUpdates() []mongo.WriteModel {
+
+	tripIds := []string{}
+	if accessibility != nil {
+		for tripId := range accessibility.trips {
+			tripIds = append(tripIds, tripId)
+		}
+	}
+	sort.Strings(tripIds)
+
+	updates := []mongo.WriteModel{}
+	for _, tripId := range tripIds {
+		updates = append(updates, mongo.NewUpdateManyModel().
+			SetFilter(bson.D{
+				{Key: "trip_id", Value: tripId},
+				{Key: "wheelchair_accessible", Value: bson.D{{Key: "$nin", Value: bson.A{
+					WheelchairBoardingAccessible, WheelchairBoardingNotAccessible, accessibility.trips[tripId]}}}},
+			}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{
+				{Key: "wheelchair_accessible", Value: accessibility.trips[tripId]}}}}))
+	}
+
+	return updates
+}
+
+// Len returns the number of trips held
+func (accessibility *TripAccessibility) Len() int {
+
+	if accessibility == nil {
+		return 0
+	}
+
+	return len(accessibility.trips)
+}
+
+// ReadTripAccessibility reads a GTFS trips.txt file, keeping the trips whose
+// wheelchair_accessible field is set
+func ReadTripAccessibility(reader io.Reader) (*TripAccessibility, error) {
+
+	accessibility := NewTripAccessibility()
+	err := readGTFSTable(reader, []string{"trip_id", "wheelchair_accessible"}, func(field func(string) string) {
+		if value := parseWheelchairAccess(field("wheelchair_accessible")); value != "" {
+			accessibility.trips[field("trip_id")] = value
+		}
+	})
+	if err != nil {
+		return nil, errors.New("invalid trips.txt: " + err.Error())
+	}
+
+	return accessibility, nil
+}
+
+// ElevationModel gives the elevation in metres of points in Dublin from a set
+// of samples, such as those taken from a digital elevation model
+type ElevationModel struct {
+	cells map[[2]int][]elevationSample
+}
+
+// elevationSample is the elevation in metres at a point
+type elevationSample struct {
+	lat       float64
+	lon       float64
+	elevation float64
+}
+
+// NewElevationModel returns an ElevationModel without any samples, which knows
+// the elevation of nowhere
+func NewElevationModel() *ElevationModel {
+	return &ElevationModel{cells: map[[2]int][]elevationSample{}}
+}
+
+// elevationCell returns the grid cell that a point falls in
+func elevationCell(lat float64, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / elevationCellDegrees)), int(math.Floor(lon / elevationCellDegrees))}
+}
+
+// Add adds a sample of the elevation at a point
+func (model *ElevationModel) Add(lat float64, lon float64, elevation float64) {
+	cell := elevationCell(lat, lon)
+	model.cells[cell] = append(model.cells[cell], elevationSample{lat: lat, lon: lon, elevation: elevation})
+}
+
+// Len returns the number of samples held
+func (model *ElevationModel) Len() int {
+
+	if model == nil {
+		return 0
+	}
+
+	samples := 0
+	for _, cell := range model.cells {
+		samples += len(cell)
+	}
+
+	return samples
+}
+
+// ElevationAt returns the elevation of the sample nearest to the point,
+// reporting false if there isn't one within elevationSampleRadiusMetres
+func (model *ElevationModel) ElevationAt(lat float64, lon float64) (float64, bool) {
+
+	if model == nil {
+		return 0, false
+	}
+
+	center := elevationCell(lat, lon)
+	nearestDistance := elevationSampleRadiusMetres
+	elevation, found := 0.0, false
+	for latCell := center[0] - 1; latCell <= center[0]+1; latCell++ {
+		for lonCell := center[1] - 1; lonCell <= center[1]+1; lonCell++ {
+			for _, sample := range model.cells[[2]int{latCell, lonCell}] {
+				if distance := distanceMetres(lat, lon, sample.lat, sample.lon); distance <= nearestDistance {
+					nearestDistance, elevation, found = distance, sample.elevation, true
+				}
+			}
+		}
+	}
+
+	return elevation, found
+}
+
+// ReadElevationModel reads elevation samples from a CSV file with lat, lon and
+// elevation columns, the elevation being in metres
+func ReadElevationModel(reader io.Reader) (*ElevationModel, error) {
+
+	model := NewElevationModel()
+	var invalid error
+	err := readGTFSTable(reader, []string{"lat", "lon", "elevation"}, func(field func(string) string) {
+		lat, latErr := strconv.ParseFloat(field("lat"), 64)
+		lon, lonErr := strconv.ParseFloat(field("lon"), 64)
+		elevation, elevationErr := strconv.ParseFloat(field("elevation"), 64)
+		if latErr != nil || lonErr != nil || elevationErr != nil {
+			if invalid == nil {
+				invalid = errors.New("invalid elevation sample at " + field("lat") + "," + field("lon"))
+			}
+			return
+		}
+		model.Add(lat, lon, elevation)
+	})
+	if err == nil {
+		err = invalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return model, nil
+}
+
+// loadConfiguredTripAccessibility loads the trips file named in the
+// configuration, logging rather than failing if it can't be read so that trips
+// are only left out where the timetable itself marks them as inaccessible
+func loadConfiguredTripAccessibility(accessibilityConfig AccessibilityConfig) *TripAccessibility {
+
+	if accessibilityConfig.TripsFile == "" {
+		return NewTripAccessibility()
+	}
+
+	file, err := os.Open(accessibilityConfig.TripsFile)
+	if err == nil {
+		defer file.Close()
+		var accessibility *TripAccessibility
+		if accessibility, err = ReadTripAccessibility(file); err == nil {
+			defaultLogger.Info("loaded trip accessibility", "file", accessibilityConfig.TripsFile,
+				"trips", accessibility.Len())
+			return accessibility
+		}
+	}
+
+	defaultLogger.Error("could not load trip accessibility", "file", accessibilityConfig.TripsFile, "error", err)
+	return NewTripAccessibility()
+}
+
+// loadConfiguredElevationModel loads the elevation file named in the
+// configuration, logging rather than failing if it can't be read so that the
+// slope of walks is simply not checked
+func loadConfiguredElevationModel(accessibilityConfig AccessibilityConfig) *ElevationModel {
+
+	if accessibilityConfig.ElevationFile == "" {
+		return NewElevationModel()
+	}
+
+	file, err := os.Open(accessibilityConfig.ElevationFile)
+	if err == nil {
+		defer file.Close()
+		var model *ElevationModel
+		if model, err = ReadElevationModel(file); err == nil {
+			defaultLogger.Info("loaded elevation samples", "file", accessibilityConfig.ElevationFile,
+				"samples", model.Len())
+			return model
+		}
+	}
+
+	defaultLogger.Error("could not load elevation samples", "file", accessibilityConfig.ElevationFile, "error", err)
+	return NewElevationModel()
+}
+
+var sharedTripAccessibility *TripAccessibility
+var sharedTripAccessibilityOnce sync.Once
+
+// tripAccessibility returns the TripAccessibility shared by the package,
+// loading it from the configured file the first time it is called unless
+// SetTripAccessibility has already been used to provide it
+func tripAccessibility() *TripAccessibility {
+	sharedTripAccessibilityOnce.Do(func() {
+		if sharedTripAccessibility == nil {
+			sharedTripAccessibility = loadConfiguredTripAccessibility(currentConfig.Accessibility)
+		}
+	})
+	return sharedTripAccessibility
+}
+
+// SetTripAccessibility replaces the TripAccessibility shared by the package
+func SetTripAccessibility(accessibility *TripAccessibility) {
+	sharedTripAccessibilityOnce.Do(func() {})
+	sharedTripAccessibility = accessibility
+}
+
+var sharedElevationModel *ElevationModel
+var sharedElevationModelOnce sync.Once
+
+// elevationModel returns the ElevationModel shared by the package, loading it
+// from the configured file the first time it is called unless
+// SetElevationModel has already been used to provide it
+func elevationModel() *ElevationModel {
+	sharedElevationModelOnce.Do(func() {
+		if sharedElevationModel == nil {
+			sharedElevationModel = loadConfiguredElevationModel(currentConfig.Accessibility)
+		}
+	})
+	return sharedElevationModel
+}
+
+// SetElevationModel replaces the ElevationModel shared by the package
+func SetElevationModel(model *ElevationModel) {
+	sharedElevationModelOnce.Do(func() {})
+	sharedElevationModel = model
+}
+
+// stopWheelchairBoarding returns whether a stop can be boarded by wheelchair,
+// taken from the timetable where it says and from the stop metadata otherwise.
+// It is empty when neither has a value
+func stopWheelchairBoarding(stopId string, stopNumber string, timetableValue string) string {
+
+	value := parseWheelchairAccess(timetableValue)
+	if value == WheelchairBoardingAccessible || value == WheelchairBoardingNotAccessible {
+		return value
+	}
+	if amenities, ok := stopMetadata().Lookup(stopId, stopNumber); ok && amenities.WheelchairBoarding != "" {
+		return amenities.WheelchairBoarding
+	}
+
+	return value
+}
+
+// tripWheelchairAccessible returns whether a trip can be boarded by wheelchair,
+// taken from the timetable where it says and from the trips file otherwise. It
+// is empty when neither has a value
+func tripWheelchairAccessible(tripId string, timetableValue string) string {
+
+	value := parseWheelchairAccess(timetableValue)
+	if value == WheelchairBoardingAccessible || value == WheelchairBoardingNotAccessible {
+		return value
+	}
+	if fromFile, ok := tripAccessibility().Lookup(tripId); ok {
+		return fromFile
+	}
+
+	return value
+}
+
+// AccessibleWalk reports whether a walk between a location and a stop is short
+// enough for a wheelchair user and, where the elevation of both ends is known,
+// whether its average slope is gentle enough
+func AccessibleWalk(location maps.LatLng, stop StopWithCoordinates, accessibilityConfig AccessibilityConfig,
+	elevations *ElevationModel) bool {
+
+	distance := distanceMetres(location.Lat, location.Lng, stop.StopLat, stop.StopLon)
+	if distance > accessibilityConfig.MaxWalkMetres {
+		return false
+	}
+
+	fromElevation, fromKnown := elevations.ElevationAt(location.Lat, location.Lng)
+	toElevation, toKnown := elevations.ElevationAt(stop.StopLat, stop.StopLon)
+	if !fromKnown || !toKnown || distance == 0 {
+		return true
+	}
+
+	return math.Abs(toElevation-fromElevation)/distance <= accessibilityConfig.MaxSlope
+}
+
+// FilterAccessibleStops takes in the stops near a location and the options of
+// the request and, in wheelchair mode, returns the stops without those marked
+// as inaccessible or that can't be walked to from the location by wheelchair.
+// The stops are returned as they are otherwise
+func FilterAccessibleStops(stops []StopWithCoordinates, location maps.LatLng,
+	options RouteOptions) []StopWithCoordinates {
+
+	if !options.Wheelchair {
+		return stops
+	}
+
+	accessible := []StopWithCoordinates{}
+	for _, stop := range stops {
+		if stop.WheelchairBoarding == WheelchairBoardingNotAccessible {
+			continue
+		}
+		if !AccessibleWalk(location, stop, currentConfig.Accessibility, elevationModel()) {
+			continue
+		}
+		accessible = append(accessible, stop)
+	}
+
+	return accessible
+}
+
+// ImportTripAccessibility copies whether each trip in the configured trips file
+// can be boarded by wheelchair onto the trip's documents in the timetable where
+// the timetable doesn't already say, so that wheelchair mode can filter trips
+// on the field alone. It returns the number of documents changed and, when any
+// were, invalidates the cached timetable results. It is run by the admin after
+// each re-import of the timetable, see PostTripAccessibilityImport
+func ImportTripAccessibility(requestCtx context.Context) (int64, error) {
+
+	updates := tripAccessibility().timetableUpdates()
+	if len(updates) == 0 {
+		return 0, nil
+	}
+
+	collection, ctx, closeTimetable, err := openTimetable(requestCtx)
+	if err != nil {
+		return 0, err
+	}
+	defer closeTimetable()
+
+	result, err := collection.BulkWrite(ctx, updates, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, err
+	}
+	if result.ModifiedCount > 0 {
+		if _, err = resultCache().InvalidateTimetable(); err != nil {
+			return result.ModifiedCount, err
+		}
+	}
+
+	return result.ModifiedCount, nil
+}
+
+// PostTripAccessibilityImport imports whether each trip can be boarded by
+// wheelchair from the configured trips file into the timetable, returning the
+// number of trip documents changed. It is called once the timetable has been
+// re-imported into Mongo, as that replaces the trip documents
+func PostTripAccessibilityImport(c *gin.Context) {
+
+	imported, err := ImportTripAccessibility(c.Request.Context())
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not import trip accessibility", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Trip accessibility could not be imported")
+		return
+	}
+
+	LoggerFromContext(c.Request.Context()).Info("imported trip accessibility", "documents", imported)
+	c.IndentedJSON(http.StatusOK, gin.H{"documents": imported})
+}
+
+// tripAccessibilityFilter returns the conditions added to the match on trips
+// in wheelchair mode, leaving out the trips marked as inaccessible. Values from
+// the trips file are imported into the timetable by ImportTripAccessibility.
+// Trips without a value are kept
+func tripAccessibilityFilter(options RouteOptions) bson.D {
+
+	if !options.Wheelchair {
+		return bson.D{}
+	}
+
+	return bson.D{{Key: "wheelchair_accessible", Value: bson.D{{Key: "$ne", Value: WheelchairBoardingNotAccessible}}}}
+}
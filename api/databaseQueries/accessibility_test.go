@@ -0,0 +1,183 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"googlemaps.github.io/maps"
+)
+
+func TestParseRouteOptions(t *testing.T) {
+
+	for value, expected := range map[string]bool{"": false, "true": true, "1": true, "false": false} {
+		options, err := ParseRouteOptions(value)
+		if err != nil || options.Wheelchair != expected {
+			t.Log("Expected wheelchair", value, "to be", expected, "got", options, err)
+			t.Fail()
+		}
+	}
+	if _, err := ParseRouteOptions("sometimes"); err == nil {
+		t.Log("Expected an invalid wheelchair value to be refused")
+		t.Fail()
+	}
+
+	ctx := ContextWithRouteOptions(context.Background(), RouteOptions{Wheelchair: true})
+	if !RouteOptionsFromContext(ctx).Wheelchair || RouteOptionsFromContext(context.Background()).Wheelchair {
+		t.Log("Expected the route options to be carried by the context alone")
+		t.Fail()
+	}
+}
+
+func TestReadTripAccessibility(t *testing.T) {
+
+	tripsFile := "route_id,service_id,trip_id,wheelchair_accessible\n" +
+		"60-46A-b12,y1001,trip-3,2\n" +
+		"60-46A-b12,y1001,trip-1,1\n" +
+		"60-46A-b12,y1001,trip-2,2\n" +
+		"60-46A-b12,y1001,trip-4,\n"
+
+	accessibility, err := ReadTripAccessibility(strings.NewReader(tripsFile))
+	if err != nil {
+		t.Log("Could not read trips file:", err)
+		t.FailNow()
+	}
+	if accessibility.Len() != 3 {
+		t.Log("Expected the trips without a value to be skipped, got", accessibility.Len())
+		t.Fail()
+	}
+	updates := accessibility.timetableUpdates()
+	if len(updates) != 3 {
+		t.Log("Expected an update for each trip with a value, got", len(updates))
+		t.FailNow()
+	}
+	update := updates[1].(*mongo.UpdateManyModel)
+	if update.Filter.(bson.D)[0].Value != "trip-2" ||
+		update.Update.(bson.D)[0].Value.(bson.D)[0].Value != WheelchairBoardingNotAccessible {
+		t.Log("Expected trip 2 to be set as inaccessible, got", update.Filter, update.Update)
+		t.Fail()
+	}
+
+	SetTripAccessibility(accessibility)
+	defer SetTripAccessibility(NewTripAccessibility())
+	for _, test := range []struct {
+		tripId         string
+		timetableValue string
+		expected       string
+	}{
+		{"trip-1", "", WheelchairBoardingAccessible},
+		{"trip-2", "", WheelchairBoardingNotAccessible},
+		{"trip-2", "1", WheelchairBoardingAccessible},
+		{"trip-4", "0", WheelchairBoardingUnknown},
+		{"trip-5", "", ""},
+	} {
+		if value := tripWheelchairAccessible(test.tripId, test.timetableValue); value != test.expected {
+			t.Log("Expected", test.tripId, "with", test.timetableValue, "to be", test.expected, "got", value)
+			t.Fail()
+		}
+	}
+
+	filter := tripAccessibilityFilter(RouteOptions{Wheelchair: true})
+	if len(filter) != 1 || filter[0].Key != "wheelchair_accessible" {
+		t.Log("Expected the inaccessible trips to be left out in wheelchair mode, got", filter)
+		t.Fail()
+	}
+	if filter = tripAccessibilityFilter(RouteOptions{}); len(filter) != 0 {
+		t.Log("Expected no trips to be left out otherwise, got", filter)
+		t.Fail()
+	}
+
+	if _, err = ReadTripAccessibility(strings.NewReader("route_id,trip_id\n46A,trip-1\n")); err == nil {
+		t.Log("Expected a trips file without wheelchair_accessible to be refused")
+		t.Fail()
+	}
+}
+
+func TestPostTripAccessibilityImport(t *testing.T) {
+
+	// Without a trips file there is nothing to import, so Mongo isn't needed
+	SetTripAccessibility(NewTripAccessibility())
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/accessibility/import", PostTripAccessibilityImport)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/accessibility/import", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"documents": 0`) {
+		t.Log("Expected nothing to be imported without a trips file, got", recorder.Code, recorder.Body.String())
+		t.Fail()
+	}
+}
+
+func TestElevationModel(t *testing.T) {
+
+	model, err := ReadElevationModel(strings.NewReader("lat,lon,elevation\n53.3400,-6.2600,20\n53.3420,-6.2600,35\n"))
+	if err != nil {
+		t.Log("Could not read elevation samples:", err)
+		t.FailNow()
+	}
+
+	for _, test := range []struct {
+		lat       float64
+		lon       float64
+		elevation float64
+		found     bool
+	}{
+		{53.3400, -6.2600, 20, true},
+		{53.3405, -6.2600, 20, true},
+		{53.3418, -6.2600, 35, true},
+		{53.3500, -6.2600, 0, false},
+	} {
+		elevation, found := model.ElevationAt(test.lat, test.lon)
+		if elevation != test.elevation || found != test.found {
+			t.Log("Expected the elevation at", test.lat, test.lon, "to be", test.elevation, test.found,
+				"got", elevation, found)
+			t.Fail()
+		}
+	}
+
+	if _, err = ReadElevationModel(strings.NewReader("lat,lon,elevation\n53.34,-6.26,high\n")); err == nil {
+		t.Log("Expected an invalid elevation to be refused")
+		t.Fail()
+	}
+}
+
+func TestFilterAccessibleStops(t *testing.T) {
+
+	location := maps.LatLng{Lat: 53.3400, Lng: -6.2600}
+	stops := []StopWithCoordinates{
+		{StopNumber: "1", StopLat: 53.3410, StopLon: -6.2600, WheelchairBoarding: WheelchairBoardingAccessible},
+		{StopNumber: "2", StopLat: 53.3401, StopLon: -6.2600, WheelchairBoarding: WheelchairBoardingNotAccessible},
+		{StopNumber: "3", StopLat: 53.3450, StopLon: -6.2600},
+		{StopNumber: "4", StopLat: 53.3390, StopLon: -6.2600},
+		{StopNumber: "5", StopLat: 53.3400, StopLon: -6.2620, WheelchairBoarding: WheelchairBoardingUnknown},
+	}
+
+	// Stop 4 is about 111 metres away and 10 metres higher, a slope of 1 in 11
+	model := NewElevationModel()
+	model.Add(53.3400, -6.2600, 20)
+	model.Add(53.3410, -6.2600, 22)
+	model.Add(53.3390, -6.2600, 30)
+	SetElevationModel(model)
+	defer SetElevationModel(NewElevationModel())
+
+	accessible := FilterAccessibleStops(stops, location, RouteOptions{Wheelchair: true})
+	stopNumbers := []string{}
+	for _, stop := range accessible {
+		stopNumbers = append(stopNumbers, stop.StopNumber)
+	}
+	if strings.Join(stopNumbers, ",") != "1,5" {
+		t.Log("Expected only stops 1 and 5 to be used in wheelchair mode, got", stopNumbers)
+		t.Fail()
+	}
+
+	if len(FilterAccessibleStops(stops, location, RouteOptions{})) != len(stops) {
+		t.Log("Expected every stop to be used outside wheelchair mode")
+		t.Fail()
+	}
+}
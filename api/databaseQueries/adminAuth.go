@@ -0,0 +1,40 @@
+package databaseQueries
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminAuth is gin middleware guarding the admin endpoints, which expose the
+// Mongo databases and can invalidate the cache. Callers must send the admin
+// token as a bearer token in the Authorization header. The token is taken from
+// the admin configuration and if it isn't set the admin endpoints are disabled
+// altogether rather than left open
+func AdminAuth() gin.HandlerFunc {
+	return adminAuth(currentConfig.Admin.Token)
+}
+
+// adminAuth returns the AdminAuth middleware for the given token
+func adminAuth(adminToken string) gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		if adminToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, "Admin endpoints are disabled")
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			LoggerFromContext(c.Request.Context()).Warn("rejected admin request", "path", c.Request.URL.Path)
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+
+		c.Next()
+	}
+}
@@ -0,0 +1,46 @@
+package databaseQueries
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminAuth(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(adminToken string) *gin.Engine {
+		router := gin.New()
+		router.GET("/databases", adminAuth(adminToken), func(c *gin.Context) { c.Status(http.StatusOK) })
+		return router
+	}
+
+	testCases := []struct {
+		adminToken    string
+		authorization string
+		expected      int
+	}{
+		{"", "Bearer anything", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, testCase := range testCases {
+		request := httptest.NewRequest(http.MethodGet, "/databases", nil)
+		if testCase.authorization != "" {
+			request.Header.Set("Authorization", testCase.authorization)
+		}
+		recorder := httptest.NewRecorder()
+		newRouter(testCase.adminToken).ServeHTTP(recorder, request)
+
+		if recorder.Code != testCase.expected {
+			t.Log("Token", testCase.adminToken, "with header", testCase.authorization,
+				"should return", testCase.expected, "but returned", recorder.Code)
+			t.Fail()
+		}
+	}
+}
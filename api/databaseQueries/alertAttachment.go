@@ -0,0 +1,113 @@
+package databaseQueries
+
+import (
+	"context"
+	"time"
+)
+
+// appliesToRoute reports whether an entity informs about the route in the given
+// direction. Entities naming a trip don't apply, as a matched route doesn't
+// carry the trip it was matched on, and neither do entities for a stop
+func (entity AlertEntity) appliesToRoute(routeNum string, direction string) bool {
+
+	if entity.TripId != "" || entity.StopId != "" {
+		return false
+	}
+
+	return entity.appliesToRouteAtStop(routeNum, direction)
+}
+
+// appliesToStop reports whether an entity informs about the stop as served by
+// the route in the given direction
+func (entity AlertEntity) appliesToStop(stop RouteStop, routeNum string, direction string) bool {
+
+	if entity.TripId != "" || entity.StopId == "" || entity.StopId != stop.StopId {
+		return false
+	}
+
+	return entity.appliesToRouteAtStop(routeNum, direction)
+}
+
+// appliesToRouteAtStop reports whether the route and direction of an entity, if
+// given, are those of the route
+func (entity AlertEntity) appliesToRouteAtStop(routeNum string, direction string) bool {
+
+	if entity.RouteId != "" && entity.RouteNum != routeNum {
+		return false
+	}
+
+	return entity.DirectionId == "" || entity.DirectionId == direction
+}
+
+// AttachServiceAlerts takes in the routes matched for a query, the alerts and the
+// time of the query and returns the routes with the alerts active at their
+// departure attached to each route and stop they apply to. Routes that have no
+// service, or whose boarding or alighting stop has no service, are left out.
+// The departure of each route is found on the service day of the query,
+// falling back to the time of the query itself
+func AttachServiceAlerts(routes []busRouteJSON, alerts []ServiceAlert, requestTime time.Time) []busRouteJSON {
+
+	serviceDate, _ := ServiceDay(requestTime)
+
+	attached := []busRouteJSON{}
+	for _, route := range routes {
+		instant, ok := Itinerary{Route: route, ServiceDate: serviceDate}.Departure()
+		if !ok {
+			instant = requestTime
+		}
+
+		closed := false
+		route.Alerts = nil
+		stops := make([]RouteStop, len(route.Stops))
+		copy(stops, route.Stops)
+		for stopIndex := range stops {
+			stops[stopIndex].Alerts = nil
+		}
+
+		for _, alert := range alerts {
+			if !alert.ActiveAt(instant) {
+				continue
+			}
+
+			for _, entity := range alert.InformedEntities {
+				if entity.appliesToRoute(route.RouteNum, route.Direction) {
+					route.Alerts = append(route.Alerts, alert.Notice())
+					closed = closed || alert.Effect == AlertEffectNoService
+					break
+				}
+			}
+
+			for stopIndex, stop := range stops {
+				for _, entity := range alert.InformedEntities {
+					if entity.appliesToStop(stop, route.RouteNum, route.Direction) {
+						stops[stopIndex].Alerts = append(stops[stopIndex].Alerts, alert.Notice())
+						boardingOrAlighting := stopIndex == 0 || stopIndex == len(stops)-1
+						closed = closed || (boardingOrAlighting && alert.Effect == AlertEffectNoService)
+						break
+					}
+				}
+			}
+		}
+
+		if closed {
+			continue
+		}
+		route.Stops = stops
+		attached = append(attached, route)
+	}
+
+	return attached
+}
+
+// attachActiveServiceAlerts works as AttachServiceAlerts with the alerts in the
+// alert store. If the alerts can't be found the routes are returned as they are
+func attachActiveServiceAlerts(ctx context.Context, routes []busRouteJSON, requestTime time.Time) []busRouteJSON {
+
+	alerts, err := alertStore().FindAlerts(ctx)
+	if err != nil {
+		LoggerFromContext(ctx).Warn("could not find service alerts, routes returned without them", "error", err)
+		return routes
+	}
+
+	return AttachServiceAlerts(routes, alerts, requestTime)
+}
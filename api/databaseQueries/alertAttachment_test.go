@@ -0,0 +1,72 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttachServiceAlerts(t *testing.T) {
+
+	route := testItinerary().Route
+	route.Stops[0].StopId = "8250DB002039"
+	route.Stops[1].StopId = "8250DB002040"
+	requestTime := time.Date(2022, time.June, 15, 7, 0, 0, 0, dublinLocation)
+	laterStart := time.Date(2022, time.June, 15, 9, 0, 0, 0, dublinLocation)
+
+	alerts := []ServiceAlert{
+		{Id: "network", Effect: "REDUCED_SERVICE", InformedEntities: []AlertEntity{{AgencyId: "978"}}},
+		{Id: "other-route", InformedEntities: []AlertEntity{{RouteId: "r39", RouteNum: "39A"}}},
+		{Id: "other-direction", InformedEntities: []AlertEntity{{RouteId: "r46", RouteNum: "46A", DirectionId: "0"}}},
+		{Id: "stop", Effect: "STOP_MOVED", InformedEntities: []AlertEntity{{StopId: "8250DB002040"}}},
+		{Id: "trip", Effect: AlertEffectNoService, InformedEntities: []AlertEntity{{TripId: "t", RouteNum: "46A"}}},
+		{Id: "later", Effect: AlertEffectNoService, ActivePeriods: []AlertPeriod{{Start: &laterStart}},
+			InformedEntities: []AlertEntity{{RouteId: "r46", RouteNum: "46A"}}},
+	}
+
+	attached := AttachServiceAlerts([]busRouteJSON{route}, alerts, requestTime)
+	if len(attached) != 1 {
+		t.Log("Expected the route to be kept, got", attached)
+		t.FailNow()
+	}
+	if len(attached[0].Alerts) != 1 || attached[0].Alerts[0].Id != "network" {
+		t.Log("Expected only the network alert on the route, got", attached[0].Alerts)
+		t.Fail()
+	}
+	if len(attached[0].Stops[0].Alerts) != 0 || len(attached[0].Stops[1].Alerts) != 1 ||
+		attached[0].Stops[1].Alerts[0].Id != "stop" {
+		t.Log("Expected the stop alert on the alighting stop only, got", attached[0].Stops)
+		t.Fail()
+	}
+	if len(route.Stops[1].Alerts) != 0 {
+		t.Log("Expected the routes passed in to be left unchanged")
+		t.Fail()
+	}
+}
+
+func TestAttachServiceAlertsExcludesClosedRoutes(t *testing.T) {
+
+	route := testItinerary().Route
+	route.Stops[0].StopId = "8250DB002039"
+	requestTime := time.Date(2022, time.June, 15, 7, 0, 0, 0, dublinLocation)
+
+	cases := []struct {
+		name   string
+		entity AlertEntity
+		kept   bool
+	}{
+		{"route closed", AlertEntity{RouteId: "r46", RouteNum: "46A"}, false},
+		{"boarding stop closed", AlertEntity{StopId: "8250DB002039"}, false},
+		{"boarding stop closed for another route", AlertEntity{StopId: "8250DB002039", RouteId: "r39", RouteNum: "39A"}, true},
+		{"other route closed", AlertEntity{RouteId: "r39", RouteNum: "39A"}, true},
+	}
+
+	for _, testCase := range cases {
+		alerts := []ServiceAlert{{Id: testCase.name, Effect: AlertEffectNoService,
+			InformedEntities: []AlertEntity{testCase.entity}}}
+		attached := AttachServiceAlerts([]busRouteJSON{route}, alerts, requestTime)
+		if (len(attached) == 1) != testCase.kept {
+			t.Log("Expected the route to be kept", testCase.kept, "when", testCase.name, "got", attached)
+			t.Fail()
+		}
+	}
+}
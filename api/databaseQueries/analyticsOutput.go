@@ -0,0 +1,91 @@
+package databaseQueries
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Formats that analytics can be returned in
+const (
+	AnalyticsFormatJSON = "json"
+	AnalyticsFormatCSV  = "csv"
+)
+
+// csvTable is analytics laid out as rows of a CSV file under a header
+type csvTable struct {
+	header []string
+	rows   [][]string
+}
+
+// negotiateAnalyticsFormat takes in the format query parameter and the Accept
+// header of a request and returns the format asked for. The parameter takes
+// precedence and must name a known format, otherwise CSV is returned if the
+// Accept header names text/csv and JSON if it doesn't
+func negotiateAnalyticsFormat(format string, accept string) (string, error) {
+
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "":
+	case AnalyticsFormatJSON:
+		return AnalyticsFormatJSON, nil
+	case AnalyticsFormatCSV:
+		return AnalyticsFormatCSV, nil
+	default:
+		return "", errors.New("unknown analytics format '" + format + "'")
+	}
+
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(mediaRange, ";")[0]))
+		if mediaType == "text/csv" {
+			return AnalyticsFormatCSV, nil
+		}
+	}
+
+	return AnalyticsFormatJSON, nil
+}
+
+// renderCSV writes the table as a CSV file
+func renderCSV(table csvTable) ([]byte, error) {
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if err := writer.Write(table.header); err != nil {
+		return nil, err
+	}
+	if err := writer.WriteAll(table.rows); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// writeAnalytics writes the analytics as the response, either as JSON or as a
+// CSV file download named after the kind of analytics
+func writeAnalytics(c *gin.Context, format string, name string, results interface{}, table csvTable) {
+
+	if format != AnalyticsFormatCSV {
+		c.IndentedJSON(http.StatusOK, results)
+		return
+	}
+
+	body, err := renderCSV(table)
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not write analytics as CSV", "analytics", name,
+			"error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Analytics could not be written as CSV")
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+	c.Data(http.StatusOK, "text/csv; charset=utf-8", body)
+}
+
+// formatCSVFloat formats a number for a CSV file without trailing zeros
+func formatCSVFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
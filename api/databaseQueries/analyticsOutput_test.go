@@ -0,0 +1,38 @@
+package databaseQueries
+
+import "testing"
+
+func TestNegotiateAnalyticsFormat(t *testing.T) {
+
+	for _, test := range []struct {
+		format   string
+		accept   string
+		expected string
+	}{
+		{"", "", AnalyticsFormatJSON},
+		{"", "application/json", AnalyticsFormatJSON},
+		{"", "text/html, text/csv;q=0.9", AnalyticsFormatCSV},
+		{"CSV", "application/json", AnalyticsFormatCSV},
+		{"json", "text/csv", AnalyticsFormatJSON},
+	} {
+		if format, err := negotiateAnalyticsFormat(test.format, test.accept); err != nil || format != test.expected {
+			t.Log("Expected", test.expected, "for", test.format, test.accept, "got", format, err)
+			t.Fail()
+		}
+	}
+
+	if _, err := negotiateAnalyticsFormat("xml", ""); err == nil {
+		t.Log("Expected an unknown format to be refused")
+		t.Fail()
+	}
+}
+
+func TestRenderCSV(t *testing.T) {
+
+	body, err := renderCSV(csvTable{header: []string{"route_num", "name"},
+		rows: [][]string{{"46A", "Dún Laoghaire, Phoenix Park"}}})
+	if err != nil || string(body) != "route_num,name\n46A,\"Dún Laoghaire, Phoenix Park\"\n" {
+		t.Log("Expected the table to be written as CSV, got", string(body), err)
+		t.Fail()
+	}
+}
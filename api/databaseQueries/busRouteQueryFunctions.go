@@ -2,13 +2,10 @@ package databaseQueries
 
 import (
 	"errors"
-	"fmt"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"googlemaps.github.io/maps"
-	"log"
 	"math"
-	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,25 +14,15 @@ import (
 // ConnectToMongo is a function used specifically to handle the database connection
 // within the backend and remove some boilerplate code from individual function calls
 // elsewhere. It requires no parameters but returns a pointer to a Mongo client as well
-// as an error
+// as an error. The connection details are taken from the Mongo configuration
 func ConnectToMongo() (*mongo.Client, error) {
 
-	mongoHost = os.Getenv("MONGO_INITDB_ROOT_HOST")
-	mongoPassword = os.Getenv("MONGO_INITDB_ROOT_PASSWORD")
-	mongoUsername = os.Getenv("MONGO_INITDB_ROOT_USERNAME")
-	mongoPort = os.Getenv("MONGO_INITDB_ROOT_PORT")
-
 	// Create connection to mongo server and log any resulting error
 	client, err := mongo.NewClient(options.Client().
-		ApplyURI(
-			fmt.Sprintf(
-				"mongodb://%s:%s@%s:%s/?retryWrites=true&w=majority",
-				mongoUsername,
-				mongoPassword,
-				mongoHost,
-				mongoPort)))
+		ApplyURI(currentConfig.Mongo.ConnectionURI()).
+		SetMonitor(mongoMonitor))
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("could not create Mongo client", "error", err)
 	}
 
 	return client, err
@@ -81,6 +68,8 @@ func CreateStopsSlice(origin string, destination string,
 		stop.DepartureTime = initialStopDescription.DepartureTime
 		stop.DistanceTravelled, _ =
 			strconv.ParseFloat(initialStopDescription.DistanceTravelled, 64)
+		stop.WheelchairBoarding = stopWheelchairBoarding(initialStopDescription.StopId,
+			initialStopDescription.StopNumber, initialStopDescription.WheelchairBoarding)
 
 		// Stop sequences used to assign values to other variables needed for travel
 		// time prediction later
@@ -104,27 +93,55 @@ func CreateStopsSlice(origin string, destination string,
 	return transformedStops
 }
 
-// CreateShapesSlice is a function that takes in a busRoute object and then returns
-// a slice of ShapeJSON objects that are then used for the final creation of the
-// busRouteJSON objects that are returned to the frontend following a successful route
-// finding operation.
-func CreateShapesSlice(route busRoute) []ShapeJSON {
-
-	shapes = []ShapeJSON{}
-	for _, currentShape := range route.Shapes {
-		currentDistTravelled, _ := strconv.ParseFloat(currentShape.ShapeDistTravel, 64)
-		if currentDistTravelled >= originDistTravelled && currentDistTravelled <= destinationDistTravelled {
-			shape.ShapePtLat, _ = strconv.ParseFloat(currentShape.ShapePtLat, 64)
-			shape.ShapePtLon, _ = strconv.ParseFloat(currentShape.ShapePtLon, 64)
-			shape.ShapePtSequence = currentShape.ShapePtSequence
-			shape.ShapeDistTravel = currentShape.ShapeDistTravel
-			shapes = append(shapes, shape)
+// CreateShapesSlice is a function that takes in a busRoute object along with the
+// origin and destination stop numbers and then returns a slice of ShapeJSON objects
+// that are then used for the final creation of the busRouteJSON objects that are
+// returned to the frontend following a successful route finding operation. The
+// shape is cut exactly where the origin and destination stops project onto it,
+// falling back to the distance travelled of each point if either stop is missing,
+// in which case the shape runs from the start or to the end for the missing stop
+func CreateShapesSlice(route busRoute, origin string, destination string) []ShapeJSON {
+
+	points := ShapesToJSON(route.Shapes)
+
+	originStop, originFound := findBusStop(route.Stops, origin)
+	destinationStop, destinationFound := findBusStop(route.Stops, destination)
+	if originFound && destinationFound && len(points) >= 2 {
+		return CutShapeAtStops(points, originStop, destinationStop)
+	}
+
+	fromDistance, toDistance := 0.0, math.Inf(1)
+	if originFound {
+		fromDistance, _ = strconv.ParseFloat(originStop.DistanceTravelled, 64)
+	}
+	if destinationFound {
+		toDistance, _ = strconv.ParseFloat(destinationStop.DistanceTravelled, 64)
+	}
+
+	shapes := []ShapeJSON{}
+	for _, point := range points {
+		currentDistTravelled, _ := strconv.ParseFloat(point.ShapeDistTravel, 64)
+		if currentDistTravelled >= fromDistance && currentDistTravelled <= toDistance {
+			shapes = append(shapes, point)
 		}
 	}
 
 	return shapes
 }
 
+// findBusStop returns the stop with the given stop number from the stops of a
+// trip, reporting false if the trip doesn't call there
+func findBusStop(stops []BusStop, stopNumber string) (BusStop, bool) {
+
+	for _, stop := range stops {
+		if stop.StopNumber == stopNumber {
+			return stop, true
+		}
+	}
+
+	return BusStop{}, false
+}
+
 // CurateStopsSlice is a function that takes in the origin and destination
 // bus stop numbers on a journey as strings and then returns integers for their
 // respective indexes in the route object that is to be added to the resultJSON object
@@ -203,7 +220,6 @@ func GetTimeStringAsHoursAndMinutes(timeString string) string {
 func FindNearestStop(nearbyStops []StopWithCoordinates,
 	stopsOnRoute []BusStop, location maps.LatLng) (string, error) {
 
-	log.Println("Finding Nearest stop:")
 	var closeStops []StopWithCoordinates
 
 	for _, stopToCheck := range nearbyStops {
@@ -213,8 +229,7 @@ func FindNearestStop(nearbyStops []StopWithCoordinates,
 			}
 		}
 	}
-	log.Println("Stops on route found in nearby stop array:")
-	log.Println(closeStops)
+	defaultLogger.Debug("nearby stops found on route", "stops", len(closeStops))
 
 	if len(closeStops) < 1 {
 		return "error", errors.New("none of origin stops were on given route")
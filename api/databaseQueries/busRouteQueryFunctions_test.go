@@ -208,7 +208,7 @@ func TestCreateShapesSlice(t *testing.T) {
 	testRoute.Shapes = testShapes
 	testRoute.Direction = testDirection
 
-	testShapesJSON := CreateShapesSlice(testRoute)
+	testShapesJSON := CreateShapesSlice(testRoute, "1", "3")
 
 	for _, shape := range testShapesJSON {
 
@@ -11,19 +11,12 @@ import (
 	//"encoding/json"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
-	"log"
 	"net/http"
 	"time"
 )
 
-// Variables to hold connection string values
-var mongoUsername string
-var mongoPassword string
-var mongoHost string
-var mongoPort string
-
 // GetDatabases returns the databases present in the MongoDB connection.
-// Useful as a debugging query.
+// Useful as a debugging query, so it is only served to admins.
 func GetDatabases(c *gin.Context) {
 
 	client, err := ConnectToMongo()
@@ -33,12 +26,17 @@ func GetDatabases(c *gin.Context) {
 	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
 	err = client.Connect(ctx)
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("could not connect to Mongo", "error", err)
 	}
 	defer client.Disconnect(ctx) // defer has rest of function complete before this disconnect
 
 	// Create list of databases and return as JSON
 	databases, err := client.ListDatabases(ctx, bson.D{})
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not list databases", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Databases could not be listed")
+		return
+	}
 
 	c.IndentedJSON(http.StatusOK, databases)
 }
@@ -56,21 +54,21 @@ func GetStopByName(stopName string) []StopWithCoordinates {
 	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
 	err = client.Connect(ctx)
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("could not connect to Mongo", "error", err)
 	}
 	defer client.Disconnect(ctx) // defer has rest of function done before disconnect
 
 	var matchingStops []StopWithCoordinates
 
-	dbPointer := client.Database("BusData")
-	collectionPointer := dbPointer.Collection("stops")
+	dbPointer := client.Database(currentConfig.Mongo.Database)
+	collectionPointer := dbPointer.Collection(currentConfig.Mongo.Collections.Stops)
 
 	// Use regex to search for a pattern in the bus stop names to locate stops
 	// with similar names to help users find stops by their name
 	busStops, err := collectionPointer.Find(ctx, bson.D{{"stop_name", bson.M{
 		"$regex": primitive.Regex{Pattern: stopName, Options: "i"}}}})
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("stop name query failed", "error", err)
 	}
 
 	// Iteratively go through returned options and add them to slice to return
@@ -79,7 +77,7 @@ func GetStopByName(stopName string) []StopWithCoordinates {
 	var stopWithCoordinates StopWithCoordinates
 	for busStops.Next(ctx) {
 		if err := busStops.Decode(&stop); err != nil {
-			log.Print(err)
+			defaultLogger.Error("could not decode stop", "error", err)
 		}
 		stopWithCoordinates.StopID = stop.StopId
 		stopWithCoordinates.StopNumber = stop.StopNumber
@@ -117,11 +115,69 @@ func GetStopsList(c *gin.Context) {
 // determined to be close to the coordinates provided in the variable 'location'
 // in order of distance from that point. Once this has been done, the ten
 // nearest stops are returned as a result of this function from using a subslice
-// of the then sorted input list of stops
-func CurateNearbyStops(stopsList []StopWithCoordinates, location maps.LatLng) []StopWithCoordinates {
+// of the then sorted input list of stops. When a pedestrian graph is loaded the
+// distance is that walked along it, avoiding steps in wheelchair mode, and stops
+// that can't be walked to within the longest walk are left out
+func CurateNearbyStops(stopsList []StopWithCoordinates, location maps.LatLng,
+	options RouteOptions) []StopWithCoordinates {
 
 	closestStops := []StopWithCoordinates{}
 
+	if walkable, ok := sortStopsByWalk(stopsList, location, options); ok {
+		stopsList = walkable
+	} else {
+		sortStopsByDegrees(stopsList, location)
+	}
+
+	if len(stopsList) < 10 {
+		closestStops = stopsList
+	} else {
+		closestStops = append(closestStops, stopsList[:10]...)
+	}
+
+	return closestStops
+}
+
+// sortStopsByWalk sorts the stops by how far they are to walk to from the
+// location, leaving out those that are too far. It reports false when there is
+// no pedestrian graph or the location isn't near it, so that the stops can be
+// sorted by straight line distance instead
+func sortStopsByWalk(stopsList []StopWithCoordinates, location maps.LatLng,
+	options RouteOptions) ([]StopWithCoordinates, bool) {
+
+	targets := make([]maps.LatLng, len(stopsList))
+	for index, stop := range stopsList {
+		targets[index] = maps.LatLng{Lat: stop.StopLat, Lng: stop.StopLon}
+	}
+	distances, err := pedestrianGraph().WalkDistances(location, targets, longestWalkMetres(options), options)
+	if err != nil {
+		return nil, false
+	}
+
+	type walkableStop struct {
+		stop   StopWithCoordinates
+		metres float64
+	}
+	walkable := []walkableStop{}
+	for index, stop := range stopsList {
+		if !math.IsInf(distances[index], 1) {
+			walkable = append(walkable, walkableStop{stop: stop, metres: distances[index]})
+		}
+	}
+	sort.SliceStable(walkable, func(i, j int) bool { return walkable[i].metres < walkable[j].metres })
+
+	sorted := []StopWithCoordinates{}
+	for _, stop := range walkable {
+		sorted = append(sorted, stop.stop)
+	}
+
+	return sorted, true
+}
+
+// sortStopsByDegrees sorts the stops by their straight line distance from the
+// location, measured in degrees
+func sortStopsByDegrees(stopsList []StopWithCoordinates, location maps.LatLng) {
+
 	// Distance from one point to another on a 2d plane is the root of
 	// (x2-x1)^2 + (y2-y1)^2. This is given to the sort function that is built
 	// in to then determine the order in which to sort the stops
@@ -132,12 +188,4 @@ func CurateNearbyStops(stopsList []StopWithCoordinates, location maps.LatLng) []
 			math.Pow(stopsList[j].StopLat-location.Lat, 2))
 		return distanceForPointI < distanceForPointJ
 	})
-
-	if len(stopsList) < 10 {
-		closestStops = stopsList
-	} else {
-		closestStops = append(closestStops, stopsList[:10]...)
-	}
-
-	return closestStops
 }
@@ -1,6 +1,7 @@
 package databaseQueries
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -11,3 +12,45 @@ func TestGetBusStop(t *testing.T) {
 func TestGetAllStops(t *testing.T) {
 	return
 }
+
+func TestCurateNearbyStops(t *testing.T) {
+
+	location := testWalkingNodes[5]
+	stops := []StopWithCoordinates{
+		{StopNumber: "far", StopLat: testWalkingNodes[19].Lat, StopLon: testWalkingNodes[19].Lng},
+		{StopNumber: "dawson", StopLat: testWalkingNodes[8].Lat, StopLon: testWalkingNodes[8].Lng},
+		{StopNumber: "grafton", StopLat: 53.3412, StopLon: -6.2604},
+	}
+	stopNumbers := func(stops []StopWithCoordinates) string {
+		numbers := []string{}
+		for _, stop := range stops {
+			numbers = append(numbers, stop.StopNumber)
+		}
+		return strings.Join(numbers, ",")
+	}
+
+	// Grafton Street is nearer in degrees, but Dawson Street is the shorter walk
+	// and the stop on the unconnected footway can't be walked to at all
+	SetPedestrianGraph(NewPedestrianGraph(DefaultConfig().Walking))
+	if curated := stopNumbers(CurateNearbyStops(append([]StopWithCoordinates{}, stops...), location,
+		RouteOptions{})); curated != "grafton,dawson,far" {
+		t.Log("Expected the stops in order of degrees without a pedestrian graph, got", curated)
+		t.Fail()
+	}
+
+	SetPedestrianGraph(loadTestPedestrianGraph(t))
+	defer SetPedestrianGraph(NewPedestrianGraph(DefaultConfig().Walking))
+	if curated := stopNumbers(CurateNearbyStops(append([]StopWithCoordinates{}, stops...), location,
+		RouteOptions{})); curated != "dawson,grafton" {
+		t.Log("Expected the stops in order of walking distance, got", curated)
+		t.Fail()
+	}
+
+	// When none of the stops can be walked to there are no nearby stops, rather
+	// than ones that can't be reached
+	if curated := CurateNearbyStops(append([]StopWithCoordinates{}, stops[0]), location,
+		RouteOptions{}); len(curated) != 0 {
+		t.Log("Expected no stops when none can be walked to, got", stopNumbers(curated))
+		t.Fail()
+	}
+}
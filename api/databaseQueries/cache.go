@@ -0,0 +1,377 @@
+package databaseQueries
+
+import (
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Kinds of results held in the cache, used as the first part of each cache
+// key and to separate the hit and miss counts for each kind of lookup
+const (
+	cacheKindNearbyStops     = "nearby_stops"
+	cacheKindRouteCandidates = "route_candidates"
+	cacheKindRouteTrips      = "route_trips"
+	cacheKindPredictions     = "predictions"
+	cacheKindRouteCatalogue  = "route_catalogue"
+)
+
+// timetableGenerationKey is the key under which the timetable generation is
+// kept in the cache backend. Every key for a result derived from the timetable
+// includes the generation, so incrementing it invalidates all of those results
+const timetableGenerationKey = "timetable_generation"
+
+// Time to live for each kind of cached result, as well as the width of the
+// time bucket used when caching the route candidates for a query
+var (
+	NearbyStopsCacheTTL     = 24 * time.Hour
+	RouteCandidatesCacheTTL = 6 * time.Hour
+	RouteTripsCacheTTL      = time.Hour
+	PredictionCacheTTL      = 30 * time.Minute
+	RouteCatalogueCacheTTL  = 24 * time.Hour
+	RouteCandidatesBucket   = time.Hour
+)
+
+// CacheBackend is the interface that a store for cached results must satisfy.
+// Values are passed in and out as raw bytes so that both the in-memory LRU and a
+// Redis compatible server can be used interchangeably. Get reports whether the
+// key was found, Set stores a value that expires after the ttl and Increment
+// atomically adds one to the integer stored at a key and returns the new value
+type CacheBackend interface {
+	Get(key string) ([]byte, bool, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Increment(key string) (int64, error)
+}
+
+// CacheKindStats contains the number of hits and misses for a kind of
+// cached result since the api was started
+type CacheKindStats struct {
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// cacheCounter holds the hit and miss counters for one kind of result and is
+// updated atomically as lookups may happen from several goroutines at once
+type cacheCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+// ResultCache sits in front of a CacheBackend and is used by the route matching
+// and prediction functions to store their results as JSON. It keeps count of the
+// hits and misses for each kind of result and builds the keys for results
+// derived from the timetable so that they can be invalidated together
+type ResultCache struct {
+	backend      CacheBackend
+	countersLock sync.Mutex
+	counters     map[string]*cacheCounter
+}
+
+// NewResultCache takes in a CacheBackend and returns a ResultCache storing its
+// results in that backend. A nil backend disables caching altogether, with every
+// lookup counted as a miss
+func NewResultCache(backend CacheBackend) *ResultCache {
+	return &ResultCache{backend: backend, counters: map[string]*cacheCounter{}}
+}
+
+var sharedCache *ResultCache
+var sharedCacheOnce sync.Once
+
+// resultCache returns the ResultCache shared by the whole package, creating it
+// from the cache configuration the first time it is called unless SetResultCache
+// has already been used to provide one
+func resultCache() *ResultCache {
+	sharedCacheOnce.Do(func() {
+		if sharedCache == nil {
+			sharedCache = NewResultCache(newCacheBackend(currentConfig.Cache))
+		}
+	})
+	return sharedCache
+}
+
+// SetResultCache replaces the ResultCache shared by the package, which allows
+// the backend to be chosen at startup or swapped out within tests
+func SetResultCache(cache *ResultCache) {
+	sharedCacheOnce.Do(func() {})
+	sharedCache = cache
+}
+
+// newCacheBackend creates the cache backend described by the cache configuration.
+// The backend may be "memory" (the default), "redis" or "none", with the size
+// setting the number of entries kept in memory and the Redis settings describing
+// the Redis compatible server to use
+func newCacheBackend(cacheConfig CacheConfig) CacheBackend {
+
+	switch strings.ToLower(cacheConfig.Backend) {
+	case "none":
+		return nil
+	case "redis":
+		return NewRedisCache(cacheConfig.RedisAddress, cacheConfig.RedisPassword, cacheConfig.RedisDB)
+	default:
+		cacheSize := cacheConfig.Size
+		if cacheSize <= 0 {
+			cacheSize = 10000
+		}
+		return NewMemoryCache(cacheSize)
+	}
+}
+
+// counter returns the counter for a kind of result, creating it if necessary
+func (cache *ResultCache) counter(kind string) *cacheCounter {
+
+	cache.countersLock.Lock()
+	defer cache.countersLock.Unlock()
+
+	kindCounter, ok := cache.counters[kind]
+	if !ok {
+		kindCounter = &cacheCounter{}
+		cache.counters[kind] = kindCounter
+	}
+
+	return kindCounter
+}
+
+// GetJSON looks up the key for a kind of result and, if it is found, decodes the
+// stored JSON into the value pointed to by out and returns true. Any error from
+// the backend is logged and treated as a miss so that the caller falls back to
+// computing the result itself
+func (cache *ResultCache) GetJSON(kind string, key string, out interface{}) bool {
+
+	kindCounter := cache.counter(kind)
+	if cache.backend == nil {
+		atomic.AddUint64(&kindCounter.misses, 1)
+		return false
+	}
+
+	value, found, err := cache.backend.Get(kind + ":" + key)
+	if err != nil {
+		defaultLogger.Warn("could not read from cache", "error", err)
+	}
+	if !found || err != nil {
+		atomic.AddUint64(&kindCounter.misses, 1)
+		return false
+	}
+
+	if err = json.Unmarshal(value, out); err != nil {
+		defaultLogger.Warn("could not decode cached value", "error", err)
+		atomic.AddUint64(&kindCounter.misses, 1)
+		return false
+	}
+
+	atomic.AddUint64(&kindCounter.hits, 1)
+	return true
+}
+
+// SetJSON stores a value as JSON under the key for a kind of result, expiring
+// after the ttl given. Errors are logged rather than returned as a failure to
+// cache a result shouldn't fail the request that produced it
+func (cache *ResultCache) SetJSON(kind string, key string, value interface{}, ttl time.Duration) {
+
+	if cache.backend == nil {
+		return
+	}
+
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		defaultLogger.Warn("could not encode value for cache", "error", err)
+		return
+	}
+
+	if err = cache.backend.Set(kind+":"+key, encodedValue, ttl); err != nil {
+		defaultLogger.Warn("could not write to cache", "error", err)
+	}
+}
+
+// TimetableKey joins the parts of a key for a result derived from the timetable
+// together with the current timetable generation, so that all such results are
+// invalidated when InvalidateTimetable is called
+func (cache *ResultCache) TimetableKey(parts ...string) string {
+
+	generation := "0"
+	if cache.backend != nil {
+		value, found, err := cache.backend.Get(timetableGenerationKey)
+		if err != nil {
+			defaultLogger.Warn("could not read timetable generation from cache", "error", err)
+		}
+		if found {
+			generation = string(value)
+		}
+	}
+
+	return "tt" + generation + ":" + strings.Join(parts, ":")
+}
+
+// InvalidateTimetable increments the timetable generation so that every cached
+// result derived from the timetable is ignored from then on. It should be called
+// whenever the timetable is re-imported into Mongo
+func (cache *ResultCache) InvalidateTimetable() (int64, error) {
+
+	if cache.backend == nil {
+		return 0, nil
+	}
+
+	return cache.backend.Increment(timetableGenerationKey)
+}
+
+// Stats returns the hits and misses for each kind of result looked up so far
+func (cache *ResultCache) Stats() map[string]CacheKindStats {
+
+	cache.countersLock.Lock()
+	defer cache.countersLock.Unlock()
+
+	stats := map[string]CacheKindStats{}
+	for kind, kindCounter := range cache.counters {
+		stats[kind] = CacheKindStats{
+			Hits:   atomic.LoadUint64(&kindCounter.hits),
+			Misses: atomic.LoadUint64(&kindCounter.misses),
+		}
+	}
+
+	return stats
+}
+
+// timeBucket takes in a request date string and returns the start of the time
+// bucket of the given width that it falls in, in the same format, so that
+// queries made within the same bucket can share a cached result
+func timeBucket(date string, width time.Duration) string {
+
+	requestTime, err := ParseRequestTime(date)
+	if err != nil {
+		return date
+	}
+
+	return FormatRequestTime(requestTime.Truncate(width))
+}
+
+// GetCacheStats returns the hit and miss counts for each kind of cached result
+func GetCacheStats(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, resultCache().Stats())
+}
+
+// InvalidateCache invalidates all cached results derived from the timetable and
+// returns the new timetable generation. It is called once the timetable has
+// been re-imported into Mongo
+func InvalidateCache(c *gin.Context) {
+
+	generation, err := resultCache().InvalidateTimetable()
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not invalidate cache", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Cache could not be invalidated")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, gin.H{"timetable_generation": generation})
+}
+
+// memoryCacheEntry is an entry held in the MemoryCache along with its expiry
+type memoryCacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// MemoryCache is a CacheBackend holding up to a fixed number of entries in
+// memory, evicting the least recently used entry once that number is reached.
+// Counters used with Increment are kept apart from the entries so that they
+// are never evicted
+type MemoryCache struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	counters map[string]int64
+	now      func() time.Time
+}
+
+// NewMemoryCache returns a MemoryCache that holds up to capacity entries
+func NewMemoryCache(capacity int) *MemoryCache {
+	return &MemoryCache{
+		capacity: capacity,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+		counters: map[string]int64{},
+		now:      time.Now,
+	}
+}
+
+// Get returns the value stored at key if it is present and hasn't expired,
+// marking it as the most recently used entry
+func (cache *MemoryCache) Get(key string) ([]byte, bool, error) {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if counter, ok := cache.counters[key]; ok {
+		return []byte(strconv.FormatInt(counter, 10)), true, nil
+	}
+
+	element, ok := cache.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+
+	entry := element.Value.(*memoryCacheEntry)
+	if cache.now().After(entry.expiresAt) {
+		cache.order.Remove(element)
+		delete(cache.entries, key)
+		return nil, false, nil
+	}
+
+	cache.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+// Set stores the value at key until the ttl has passed, evicting the least
+// recently used entry if the cache is full
+func (cache *MemoryCache) Set(key string, value []byte, ttl time.Duration) error {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	expiresAt := cache.now().Add(ttl)
+	if element, ok := cache.entries[key]; ok {
+		entry := element.Value.(*memoryCacheEntry)
+		entry.value = value
+		entry.expiresAt = expiresAt
+		cache.order.MoveToFront(element)
+		return nil
+	}
+
+	element := cache.order.PushFront(&memoryCacheEntry{key: key, value: value, expiresAt: expiresAt})
+	cache.entries[key] = element
+
+	for cache.order.Len() > cache.capacity {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+
+	return nil
+}
+
+// Increment adds one to the counter stored at key and returns the new value
+func (cache *MemoryCache) Increment(key string) (int64, error) {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.counters[key]++
+	return cache.counters[key], nil
+}
+
+// Len returns the number of entries currently held, including any that have
+// expired but not yet been looked up or evicted
+func (cache *MemoryCache) Len() int {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return cache.order.Len()
+}
@@ -0,0 +1,229 @@
+package databaseQueries
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisCache is a CacheBackend that stores results on a Redis compatible
+// server (Redis, KeyDB, Valkey etc.) so that several api instances can share
+// one cache. Only the handful of commands needed by the cache are implemented
+// and a single connection is used, opened lazily and reopened after any error
+type RedisCache struct {
+	Address  string
+	Password string
+	DB       int
+	Timeout  time.Duration
+
+	lock       sync.Mutex
+	connection net.Conn
+	reader     *bufio.Reader
+}
+
+// NewRedisCache returns a RedisCache for the server at the given address,
+// authenticating with the password if one is given and selecting the
+// numbered database
+func NewRedisCache(address string, password string, db int) *RedisCache {
+
+	if address == "" {
+		address = "localhost:6379"
+	}
+
+	return &RedisCache{Address: address, Password: password, DB: db, Timeout: 2 * time.Second}
+}
+
+// Get returns the value stored at key, reporting false if there is none
+func (cache *RedisCache) Get(key string) ([]byte, bool, error) {
+
+	reply, err := cache.do("GET", key)
+	if err != nil || reply == nil {
+		return nil, false, err
+	}
+
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, false, fmt.Errorf("unexpected reply to GET: %v", reply)
+	}
+
+	return value, true, nil
+}
+
+// Set stores the value at key with an expiry of ttl, rounded to milliseconds
+func (cache *RedisCache) Set(key string, value []byte, ttl time.Duration) error {
+
+	milliseconds := ttl.Milliseconds()
+	if milliseconds < 1 {
+		milliseconds = 1
+	}
+
+	_, err := cache.do("SET", key, string(value), "PX", strconv.FormatInt(milliseconds, 10))
+	return err
+}
+
+// Increment atomically adds one to the integer stored at key and returns it
+func (cache *RedisCache) Increment(key string) (int64, error) {
+
+	reply, err := cache.do("INCR", key)
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to INCR: %v", reply)
+	}
+
+	return value, nil
+}
+
+// Close closes the connection to the server if one is open
+func (cache *RedisCache) Close() error {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.connection == nil {
+		return nil
+	}
+
+	err := cache.connection.Close()
+	cache.connection = nil
+	return err
+}
+
+// do sends a command to the server and returns its reply, connecting first if
+// there is no open connection. On any error the connection is closed so that
+// the next command starts again with a new one
+func (cache *RedisCache) do(args ...string) (interface{}, error) {
+
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if cache.connection == nil {
+		if err := cache.connect(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := cache.roundTrip(args...)
+	if err != nil {
+		var serverError redisError
+		if !errors.As(err, &serverError) {
+			cache.connection.Close()
+			cache.connection = nil
+		}
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// connect dials the server and authenticates and selects the database as
+// configured. It must be called with the lock held
+func (cache *RedisCache) connect() error {
+
+	connection, err := net.DialTimeout("tcp", cache.Address, cache.Timeout)
+	if err != nil {
+		return err
+	}
+	cache.connection = connection
+	cache.reader = bufio.NewReader(connection)
+
+	if cache.Password != "" {
+		if _, err = cache.roundTrip("AUTH", cache.Password); err != nil {
+			cache.connection.Close()
+			cache.connection = nil
+			return err
+		}
+	}
+	if cache.DB != 0 {
+		if _, err = cache.roundTrip("SELECT", strconv.Itoa(cache.DB)); err != nil {
+			cache.connection.Close()
+			cache.connection = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// roundTrip writes a command as a RESP array of bulk strings and reads back the
+// reply. It must be called with the lock held and an open connection
+func (cache *RedisCache) roundTrip(args ...string) (interface{}, error) {
+
+	if cache.Timeout > 0 {
+		cache.connection.SetDeadline(time.Now().Add(cache.Timeout))
+	}
+
+	command := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		command += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := io.WriteString(cache.connection, command); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(cache.reader)
+}
+
+// redisError is an error reply returned by the server, which unlike network
+// errors leaves the connection usable
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// readRedisReply reads a single RESP reply. Simple strings are returned as
+// strings, integers as int64, bulk strings as []byte (or nil if missing) and
+// arrays as []interface{}, while error replies are returned as a redisError
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	prefix, content := line[0], line[1:len(line)-2]
+
+	switch prefix {
+	case '+':
+		return content, nil
+	case '-':
+		return nil, redisError(content)
+	case ':':
+		return strconv.ParseInt(content, 10, 64)
+	case '$':
+		length, err := strconv.Atoi(content)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		value := make([]byte, length+2)
+		if _, err = io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:length], nil
+	case '*':
+		length, err := strconv.Atoi(content)
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, length)
+		for index := range values {
+			if values[index], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+
+	return nil, errors.New("redis: unknown reply type " + string(prefix))
+}
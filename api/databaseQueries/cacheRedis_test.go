@@ -0,0 +1,99 @@
+package databaseQueries
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveFakeRedis accepts connections on the listener and answers the GET, SET
+// and INCR commands from an in-memory map, which is enough to exercise the
+// RESP handling of RedisCache without a real server
+func serveFakeRedis(listener net.Listener) {
+
+	values := map[string]string{}
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(connection net.Conn) {
+			defer connection.Close()
+			reader := bufio.NewReader(connection)
+			for {
+				reply, err := readRedisReply(reader)
+				if err != nil {
+					return
+				}
+				args := []string{}
+				for _, arg := range reply.([]interface{}) {
+					args = append(args, string(arg.([]byte)))
+				}
+				switch strings.ToUpper(args[0]) {
+				case "GET":
+					value, ok := values[args[1]]
+					if !ok {
+						connection.Write([]byte("$-1\r\n"))
+					} else {
+						connection.Write([]byte("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"))
+					}
+				case "SET":
+					values[args[1]] = args[2]
+					connection.Write([]byte("+OK\r\n"))
+				case "INCR":
+					current, _ := strconv.Atoi(values[args[1]])
+					values[args[1]] = strconv.Itoa(current + 1)
+					connection.Write([]byte(":" + values[args[1]] + "\r\n"))
+				default:
+					connection.Write([]byte("-ERR unknown command\r\n"))
+				}
+			}
+		}(connection)
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("Could not listen on localhost:", err)
+	}
+	defer listener.Close()
+	go serveFakeRedis(listener)
+
+	testCache := NewRedisCache(listener.Addr().String(), "", 0)
+	defer testCache.Close()
+
+	if _, found, err := testCache.Get("missing"); found || err != nil {
+		t.Log("Missing key should not be found and should not error but got", found, err)
+		t.Fail()
+	}
+
+	if err = testCache.Set("key", []byte("value\r\nwith newline"), time.Minute); err != nil {
+		t.Log("Set should succeed but returned", err)
+		t.Fail()
+	}
+	value, found, err := testCache.Get("key")
+	if !found || err != nil || string(value) != "value\r\nwith newline" {
+		t.Log("Stored value should be returned unchanged but got", string(value), found, err)
+		t.Fail()
+	}
+
+	generation, err := testCache.Increment(timetableGenerationKey)
+	if err != nil || generation != 1 {
+		t.Log("Increment should return 1 but returned", generation, err)
+		t.Fail()
+	}
+
+	if _, err = testCache.do("FLUSHALL"); err == nil {
+		t.Log("Error reply from server should be returned as an error")
+		t.Fail()
+	}
+	if _, _, err = testCache.Get("key"); err != nil {
+		t.Log("Connection should still be usable after an error reply but got", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,125 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+
+	testCache := NewMemoryCache(2)
+	testCache.Set("one", []byte("1"), time.Minute)
+	testCache.Set("two", []byte("2"), time.Minute)
+
+	// Reading "one" makes "two" the least recently used entry
+	testCache.Get("one")
+	testCache.Set("three", []byte("3"), time.Minute)
+
+	if _, found, _ := testCache.Get("two"); found {
+		t.Log("Least recently used entry 'two' should have been evicted")
+		t.Fail()
+	}
+	if value, found, _ := testCache.Get("one"); !found || string(value) != "1" {
+		t.Log("Entry 'one' should still be cached with value '1'")
+		t.Fail()
+	}
+	if testCache.Len() != 2 {
+		t.Log("Cache should hold 2 entries but holds", testCache.Len())
+		t.Fail()
+	}
+}
+
+func TestMemoryCacheExpiry(t *testing.T) {
+
+	testNow := time.Date(2022, 8, 12, 10, 0, 0, 0, time.UTC)
+	testCache := NewMemoryCache(10)
+	testCache.now = func() time.Time { return testNow }
+
+	testCache.Set("key", []byte("value"), time.Minute)
+	if _, found, _ := testCache.Get("key"); !found {
+		t.Log("Entry should be found before its ttl has passed")
+		t.Fail()
+	}
+
+	testNow = testNow.Add(2 * time.Minute)
+	if _, found, _ := testCache.Get("key"); found {
+		t.Log("Entry should have expired after its ttl")
+		t.Fail()
+	}
+}
+
+func TestResultCacheHitsAndMisses(t *testing.T) {
+
+	testCache := NewResultCache(NewMemoryCache(10))
+	testStops := []StopWithCoordinates{{StopNumber: "1", StopName: "First", StopLat: 53.1, StopLon: -6.0}}
+
+	var cachedStops []StopWithCoordinates
+	if testCache.GetJSON(cacheKindNearbyStops, "53.1,-6.0", &cachedStops) {
+		t.Log("Lookup before anything was stored should miss")
+		t.Fail()
+	}
+
+	testCache.SetJSON(cacheKindNearbyStops, "53.1,-6.0", testStops, time.Minute)
+	if !testCache.GetJSON(cacheKindNearbyStops, "53.1,-6.0", &cachedStops) ||
+		len(cachedStops) != 1 || cachedStops[0].StopName != "First" {
+		t.Log("Lookup after storing should hit and return the stored stops but got", cachedStops)
+		t.Fail()
+	}
+
+	stats := testCache.Stats()[cacheKindNearbyStops]
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Log("Stats should show 1 hit and 1 miss but show", stats)
+		t.Fail()
+	}
+}
+
+func TestResultCacheInvalidateTimetable(t *testing.T) {
+
+	testCache := NewResultCache(NewMemoryCache(10))
+
+	keyBefore := testCache.TimetableKey("46A", "1")
+	testCache.SetJSON(cacheKindRouteTrips, keyBefore, "trip", time.Minute)
+
+	generation, err := testCache.InvalidateTimetable()
+	if err != nil || generation != 1 {
+		t.Log("Timetable generation should be 1 after invalidating but is", generation, err)
+		t.Fail()
+	}
+
+	keyAfter := testCache.TimetableKey("46A", "1")
+	if keyAfter == keyBefore {
+		t.Log("Timetable key should change after invalidating but is still", keyAfter)
+		t.Fail()
+	}
+
+	var trip string
+	if testCache.GetJSON(cacheKindRouteTrips, keyAfter, &trip) {
+		t.Log("Result cached before invalidating should no longer be found")
+		t.Fail()
+	}
+}
+
+func TestResultCacheWithoutBackend(t *testing.T) {
+
+	testCache := NewResultCache(nil)
+	testCache.SetJSON(cacheKindPredictions, "46A", 30, time.Minute)
+
+	var prediction int
+	if testCache.GetJSON(cacheKindPredictions, "46A", &prediction) {
+		t.Log("Cache without a backend should never hit")
+		t.Fail()
+	}
+	if testCache.Stats()[cacheKindPredictions].Misses != 1 {
+		t.Log("Cache without a backend should still count misses")
+		t.Fail()
+	}
+}
+
+func TestTimeBucket(t *testing.T) {
+
+	bucket := timeBucket("2022-08-12 10:47:12", time.Hour)
+	if bucket != "2022-08-12 10:00:00" {
+		t.Log("Time bucket should be '2022-08-12 10:00:00' but is", bucket)
+		t.Fail()
+	}
+}
@@ -0,0 +1,293 @@
+package databaseQueries
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stBrigidsDayFirstYear is the first year St Brigid's Day was a public holiday
+const stBrigidsDayFirstYear = 2023
+
+// Holiday is an Irish public holiday. A substitute holiday is the weekday given
+// in place of a holiday that falls at the weekend
+type Holiday struct {
+	Date       string `json:"date"`
+	Name       string `json:"name"`
+	Substitute bool   `json:"substitute,omitempty"`
+}
+
+// DayCalendar tells which days are bank holidays, which fall in a school term
+// and which day of the week's timetable runs on each date
+type DayCalendar interface {
+	// Holiday returns the public holiday on the date, reporting false if the
+	// date isn't one
+	Holiday(date time.Time) (Holiday, bool)
+	// IsBankHoliday reports whether the date is a public holiday
+	IsBankHoliday(date time.Time) bool
+	// IsSchoolTerm reports whether schools are open on the date
+	IsSchoolTerm(date time.Time) bool
+	// ServiceWeekday returns the day of the week whose timetable runs on the
+	// date, which is Sunday on public holidays
+	ServiceWeekday(date time.Time) time.Weekday
+}
+
+// dateRange is an inclusive range of dates, formatted as YYYY-MM-DD so that
+// they compare in order
+type dateRange struct {
+	from string
+	to   string
+}
+
+// IrishCalendar is a DayCalendar working out the Irish public holidays of each
+// year, along with any extra holidays and the school terms in the configuration
+type IrishCalendar struct {
+	extraHolidays map[string]bool
+	schoolTerms   []dateRange
+	lock          sync.Mutex
+	years         map[int]map[string]Holiday
+}
+
+// NewIrishCalendar returns an IrishCalendar from the dates in the configuration,
+// with the extra bank holidays, such as once-off ones, given as YYYY-MM-DD and
+// each school term as its first and last day separated by a slash, e.g.
+// 2022-09-01/2022-12-21. Mid-term breaks are left out by ending a term before
+// the break and starting another after it
+func NewIrishCalendar(calendarConfig CalendarConfig) (*IrishCalendar, error) {
+
+	calendar := &IrishCalendar{extraHolidays: map[string]bool{}, years: map[int]map[string]Holiday{}}
+	for _, holiday := range calendarConfig.BankHolidays {
+		if _, err := time.Parse(analyticsDateLayout, holiday); err != nil {
+			return nil, fmt.Errorf("invalid bank holiday '%s', expected YYYY-MM-DD", holiday)
+		}
+		calendar.extraHolidays[holiday] = true
+	}
+	for _, term := range calendarConfig.SchoolTerms {
+		from, to, found := strings.Cut(term, "/")
+		_, fromErr := time.Parse(analyticsDateLayout, from)
+		_, toErr := time.Parse(analyticsDateLayout, to)
+		if !found || fromErr != nil || toErr != nil || from > to {
+			return nil, fmt.Errorf("invalid school term '%s', expected YYYY-MM-DD/YYYY-MM-DD", term)
+		}
+		calendar.schoolTerms = append(calendar.schoolTerms, dateRange{from: from, to: to})
+	}
+
+	return calendar, nil
+}
+
+// easterSunday returns the date of Easter Sunday in the year, worked out with
+// the anonymous Gregorian algorithm
+func easterSunday(year int) time.Time {
+
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+
+	return time.Date(year, time.Month(month), day, 0, 0, 0, 0, dublinLocation)
+}
+
+// firstMonday returns the first Monday of the month
+func firstMonday(year int, month time.Month) time.Time {
+
+	date := time.Date(year, month, 1, 0, 0, 0, 0, dublinLocation)
+	for date.Weekday() != time.Monday {
+		date = date.AddDate(0, 0, 1)
+	}
+
+	return date
+}
+
+// lastMonday returns the last Monday of the month
+func lastMonday(year int, month time.Month) time.Time {
+
+	date := time.Date(year, month+1, 0, 0, 0, 0, 0, dublinLocation)
+	for date.Weekday() != time.Monday {
+		date = date.AddDate(0, 0, -1)
+	}
+
+	return date
+}
+
+// IrishHolidays returns the public holidays in Ireland in the year, sorted by
+// date. St Brigid's Day, from 2023, is the first Monday in February unless the
+// 1st of February is a Friday, in which case it is that Friday. New Year's Day,
+// St Patrick's Day, Christmas Day and St Stephen's Day falling at the weekend
+// are each given a substitute on the next weekday that isn't already a holiday
+func IrishHolidays(year int) []Holiday {
+
+	date := func(month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 0, 0, 0, 0, dublinLocation)
+	}
+
+	type fixedHoliday struct {
+		date          time.Time
+		name          string
+		substitutable bool
+	}
+	fixed := []fixedHoliday{
+		{date(time.January, 1), "New Year's Day", true},
+		{date(time.March, 17), "St Patrick's Day", true},
+		{easterSunday(year).AddDate(0, 0, 1), "Easter Monday", false},
+		{firstMonday(year, time.May), "May Bank Holiday", false},
+		{firstMonday(year, time.June), "June Bank Holiday", false},
+		{firstMonday(year, time.August), "August Bank Holiday", false},
+		{lastMonday(year, time.October), "October Bank Holiday", false},
+		{date(time.December, 25), "Christmas Day", true},
+		{date(time.December, 26), "St Stephen's Day", true},
+	}
+	if year >= stBrigidsDayFirstYear {
+		brigid := firstMonday(year, time.February)
+		if date(time.February, 1).Weekday() == time.Friday {
+			brigid = date(time.February, 1)
+		}
+		fixed = append(fixed, fixedHoliday{brigid, "St Brigid's Day", false})
+	}
+	sort.Slice(fixed, func(i, j int) bool { return fixed[i].date.Before(fixed[j].date) })
+
+	taken := map[string]bool{}
+	for _, holiday := range fixed {
+		taken[holiday.date.Format(analyticsDateLayout)] = true
+	}
+
+	holidays := []Holiday{}
+	for _, holiday := range fixed {
+		holidays = append(holidays, Holiday{Date: holiday.date.Format(analyticsDateLayout), Name: holiday.name})
+		if !holiday.substitutable || (holiday.date.Weekday() != time.Saturday && holiday.date.Weekday() != time.Sunday) {
+			continue
+		}
+		substitute := holiday.date
+		for substitute.Weekday() == time.Saturday || substitute.Weekday() == time.Sunday ||
+			taken[substitute.Format(analyticsDateLayout)] {
+			substitute = substitute.AddDate(0, 0, 1)
+		}
+		taken[substitute.Format(analyticsDateLayout)] = true
+		holidays = append(holidays, Holiday{Date: substitute.Format(analyticsDateLayout),
+			Name: holiday.name + " (substitute)", Substitute: true})
+	}
+	sort.SliceStable(holidays, func(i, j int) bool { return holidays[i].Date < holidays[j].Date })
+
+	return holidays
+}
+
+// holidays returns the holidays of the year, including the extra ones, keyed
+// by date. They are worked out the first time each year is asked for
+func (calendar *IrishCalendar) holidays(year int) map[string]Holiday {
+
+	calendar.lock.Lock()
+	defer calendar.lock.Unlock()
+
+	if holidays, ok := calendar.years[year]; ok {
+		return holidays
+	}
+
+	holidays := map[string]Holiday{}
+	for _, holiday := range IrishHolidays(year) {
+		holidays[holiday.Date] = holiday
+	}
+	for date := range calendar.extraHolidays {
+		if _, exists := holidays[date]; !exists && strings.HasPrefix(date, fmt.Sprintf("%04d-", year)) {
+			holidays[date] = Holiday{Date: date, Name: "Public holiday"}
+		}
+	}
+	calendar.years[year] = holidays
+
+	return holidays
+}
+
+// Holidays returns the public holidays in the year, including the extra ones,
+// sorted by date
+func (calendar *IrishCalendar) Holidays(year int) []Holiday {
+
+	holidays := []Holiday{}
+	for _, holiday := range calendar.holidays(year) {
+		holidays = append(holidays, holiday)
+	}
+	sort.Slice(holidays, func(i, j int) bool { return holidays[i].Date < holidays[j].Date })
+
+	return holidays
+}
+
+// Holiday returns the public holiday on the date, reporting false if it isn't one
+func (calendar *IrishCalendar) Holiday(date time.Time) (Holiday, bool) {
+	holiday, ok := calendar.holidays(date.Year())[date.Format(analyticsDateLayout)]
+	return holiday, ok
+}
+
+// IsBankHoliday reports whether the date is a public holiday or substitute
+func (calendar *IrishCalendar) IsBankHoliday(date time.Time) bool {
+	_, ok := calendar.Holiday(date)
+	return ok
+}
+
+// IsSchoolTerm reports whether the date falls in a school term on a weekday
+// that isn't a public holiday
+func (calendar *IrishCalendar) IsSchoolTerm(date time.Time) bool {
+
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday || calendar.IsBankHoliday(date) {
+		return false
+	}
+	day := date.Format(analyticsDateLayout)
+	for _, term := range calendar.schoolTerms {
+		if day >= term.from && day <= term.to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServiceWeekday returns Sunday on public holidays, when the Sunday timetable
+// runs, and the day of the week of the date otherwise
+func (calendar *IrishCalendar) ServiceWeekday(date time.Time) time.Weekday {
+
+	if calendar.IsBankHoliday(date) {
+		return time.Sunday
+	}
+
+	return date.Weekday()
+}
+
+var sharedDayCalendar DayCalendar
+var sharedDayCalendarOnce sync.Once
+
+// dayCalendar returns the DayCalendar shared by the whole package, creating it
+// from the calendar configuration the first time it is called unless
+// SetDayCalendar has already been used to provide one
+func dayCalendar() DayCalendar {
+	sharedDayCalendarOnce.Do(func() {
+		if sharedDayCalendar == nil {
+			sharedDayCalendar = newDayCalendar(currentConfig.Calendar)
+		}
+	})
+	return sharedDayCalendar
+}
+
+// SetDayCalendar replaces the DayCalendar shared by the package
+func SetDayCalendar(calendar DayCalendar) {
+	sharedDayCalendarOnce.Do(func() {})
+	sharedDayCalendar = calendar
+}
+
+// newDayCalendar returns the DayCalendar for the configuration. The dates are
+// checked by Validate, so should they still be invalid the error is logged and
+// a calendar with the computed holidays alone is used instead
+func newDayCalendar(calendarConfig CalendarConfig) DayCalendar {
+
+	calendar, err := NewIrishCalendar(calendarConfig)
+	if err != nil {
+		defaultLogger.Error("could not load the calendar", "error", err)
+		calendar, _ = NewIrishCalendar(CalendarConfig{})
+	}
+
+	return calendar
+}
@@ -0,0 +1,98 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIrishHolidays(t *testing.T) {
+
+	for year, expected := range map[int]map[string]string{
+		2021: {
+			"2021-12-25": "Christmas Day",
+			"2021-12-27": "Christmas Day (substitute)",
+			"2021-12-28": "St Stephen's Day (substitute)",
+		},
+		2022: {
+			"2022-03-17": "St Patrick's Day",
+			"2022-04-18": "Easter Monday",
+			"2022-06-06": "June Bank Holiday",
+			"2022-10-31": "October Bank Holiday",
+		},
+		2023: {
+			"2023-01-01": "New Year's Day",
+			"2023-01-02": "New Year's Day (substitute)",
+			"2023-02-06": "St Brigid's Day",
+		},
+		2026: {"2026-02-02": "St Brigid's Day"},
+		2030: {"2030-02-01": "St Brigid's Day"},
+	} {
+		holidays := map[string]string{}
+		for _, holiday := range IrishHolidays(year) {
+			holidays[holiday.Date] = holiday.Name
+		}
+		for date, name := range expected {
+			if holidays[date] != name {
+				t.Log("Expected", date, "to be", name, "got", holidays[date])
+				t.Fail()
+			}
+		}
+	}
+
+	for _, holiday := range IrishHolidays(2022) {
+		if holiday.Name == "St Brigid's Day" {
+			t.Log("Expected no St Brigid's Day before 2023, got", holiday)
+			t.Fail()
+		}
+	}
+	if holidays := IrishHolidays(2021); len(holidays) != 11 {
+		t.Log("Expected 9 holidays and 2 substitutes in 2021, got", holidays)
+		t.Fail()
+	}
+}
+
+func TestIrishCalendar(t *testing.T) {
+
+	calendar := testCalendar(t)
+	for date, expected := range map[string][2]bool{
+		"2022-03-17": {true, false},
+		"2022-03-18": {true, false},
+		"2022-06-06": {true, false},
+		"2022-06-07": {false, true},
+		"2022-06-11": {false, false},
+		"2022-07-01": {false, false},
+	} {
+		day, _ := time.ParseInLocation(analyticsDateLayout, date, dublinLocation)
+		if calendar.IsBankHoliday(day) != expected[0] || calendar.IsSchoolTerm(day) != expected[1] {
+			t.Log("Expected", date, "to be a bank holiday and in term", expected, "got",
+				calendar.IsBankHoliday(day), calendar.IsSchoolTerm(day))
+			t.Fail()
+		}
+	}
+
+	patricks := time.Date(2022, 3, 17, 0, 0, 0, 0, dublinLocation)
+	if calendar.ServiceWeekday(patricks) != time.Sunday ||
+		calendar.ServiceWeekday(patricks.AddDate(0, 0, -1)) != time.Wednesday {
+		t.Log("Expected St Patrick's Day alone to run the Sunday service")
+		t.Fail()
+	}
+	if holiday, ok := calendar.Holiday(patricks.AddDate(0, 0, 1)); !ok || holiday.Name != "Public holiday" {
+		t.Log("Expected the extra holiday to be named as a public holiday, got", holiday)
+		t.Fail()
+	}
+	if holidays := calendar.Holidays(2022); len(holidays) != 12 || holidays[3].Date != "2022-03-18" {
+		t.Log("Expected the extra holiday among the holidays of 2022, got", holidays)
+		t.Fail()
+	}
+
+	for _, calendarConfig := range []CalendarConfig{
+		{BankHolidays: []string{"6 June"}},
+		{SchoolTerms: []string{"2022-04-25"}},
+		{SchoolTerms: []string{"2022-06-30/2022-04-25"}},
+	} {
+		if _, err := NewIrishCalendar(calendarConfig); err == nil {
+			t.Log("Expected the calendar to be refused", calendarConfig)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// journeyUpdateAttempts is how many times a change to saved journeys is tried
+// when other requests keep changing the same profile
+const journeyUpdateAttempts = 3
+
+// commuteMatcher is the signature of FindMatchingRouteForArrival, which
+// matchCommute is set to outside of tests
+type commuteMatcher func(ctx context.Context, origin string, destination string, date string) []busRouteJSON
+
+var matchCommute commuteMatcher = FindMatchingRouteForArrival
+
+// JourneyPlan holds the plan for each saved commute running on a service date
+type JourneyPlan struct {
+	ServiceDate string        `json:"service_date"`
+	Commutes    []CommutePlan `json:"commutes"`
+}
+
+// CommutePlan holds a commute along with its places, the instant it should
+// arrive by and the routes matched to arrive by then
+type CommutePlan struct {
+	Commute  Commute        `json:"commute"`
+	From     SavedPlace     `json:"from"`
+	To       SavedPlace     `json:"to"`
+	ArriveBy string         `json:"arrive_by"`
+	Routes   []busRouteJSON `json:"routes"`
+}
+
+// journeyOwner returns the owner of the saved journeys for the request. Where
+// the api key has a user token secret, the app behind it shares the key between
+// its users and the owner is the user named by the signed user token sent as a
+// bearer token, otherwise the key belongs to a single user and is the owner.
+// Saved journeys can't be used without a named api key, or with a shared key
+// without a valid user token, in which case the request is rejected and false
+// is returned
+func journeyOwner(c *gin.Context) (string, bool) {
+
+	value, hasKey := c.Get(apiKeyContextKey)
+	if !hasKey || value.(APIKeyConfig).Name == "" {
+		c.IndentedJSON(http.StatusUnauthorized, "Saved journeys need an api key")
+		return "", false
+	}
+
+	apiKey := value.(APIKeyConfig)
+	if apiKey.UserTokenSecret == "" {
+		return apiKey.Name, true
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	userID, err := VerifyUserToken(apiKey.UserTokenSecret, apiKey.Name, token, time.Now())
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Warn("rejected user token", "path", c.Request.URL.Path)
+		c.Header("WWW-Authenticate", "Bearer")
+		c.IndentedJSON(http.StatusUnauthorized, "Saved journeys need a valid user token for this api key")
+		return "", false
+	}
+
+	return apiKey.Name + "/" + userID, true
+}
+
+// GetJourneyProfile returns the saved places and commutes of the caller
+func GetJourneyProfile(c *gin.Context) {
+
+	owner, ok := journeyOwner(c)
+	if !ok {
+		return
+	}
+
+	profile, err := journeyStore().GetProfile(c.Request.Context(), owner)
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not load saved journeys", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Saved journeys could not be loaded")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, profile)
+}
+
+// DeleteJourneyProfile removes every place and commute saved by the caller
+func DeleteJourneyProfile(c *gin.Context) {
+
+	owner, ok := journeyOwner(c)
+	if !ok {
+		return
+	}
+
+	if err := journeyStore().DeleteProfile(c.Request.Context(), owner); err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not delete saved journeys", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Saved journeys could not be deleted")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// PutSavedPlace saves the place named in the request URL with the coordinates
+// and address in the request body, replacing any place with the same name
+func PutSavedPlace(c *gin.Context) {
+
+	var place SavedPlace
+	if err := c.ShouldBindJSON(&place); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid place in request: "+err.Error())
+		return
+	}
+	place.Name = c.Param("name")
+
+	updateJourneyProfile(c, func(profile *JourneyProfile) (int, error) {
+		return http.StatusBadRequest, profile.PutPlace(place, currentConfig.Journeys.MaxPlaces)
+	})
+}
+
+// DeleteSavedPlace removes the place named in the request URL, which can't be
+// used by any commute
+func DeleteSavedPlace(c *gin.Context) {
+
+	updateJourneyProfile(c, func(profile *JourneyProfile) (int, error) {
+		removed, err := profile.RemovePlace(c.Param("name"))
+		if err != nil {
+			return http.StatusConflict, err
+		}
+		if !removed {
+			return http.StatusNotFound, errors.New("no place with that name")
+		}
+		return http.StatusOK, nil
+	})
+}
+
+// PutCommute saves the commute named in the request URL with the places,
+// weekdays and arrival time in the request body, replacing any commute with
+// the same name
+func PutCommute(c *gin.Context) {
+
+	var commute Commute
+	if err := c.ShouldBindJSON(&commute); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid commute in request: "+err.Error())
+		return
+	}
+	commute.Name = c.Param("name")
+
+	updateJourneyProfile(c, func(profile *JourneyProfile) (int, error) {
+		return http.StatusBadRequest, profile.PutCommute(commute, currentConfig.Journeys.MaxCommutes)
+	})
+}
+
+// DeleteCommute removes the commute named in the request URL
+func DeleteCommute(c *gin.Context) {
+
+	updateJourneyProfile(c, func(profile *JourneyProfile) (int, error) {
+		if !profile.RemoveCommute(c.Param("name")) {
+			return http.StatusNotFound, errors.New("no commute with that name")
+		}
+		return http.StatusOK, nil
+	})
+}
+
+// updateJourneyProfile loads the caller's profile, applies the change to it and
+// saves it, responding with the saved profile. The change returns the status
+// to respond with if it fails. The whole update is tried again if the profile
+// was changed by another request in the meantime
+func updateJourneyProfile(c *gin.Context, change func(profile *JourneyProfile) (int, error)) {
+
+	owner, ok := journeyOwner(c)
+	if !ok {
+		return
+	}
+	logger := LoggerFromContext(c.Request.Context())
+
+	for attempt := 1; attempt <= journeyUpdateAttempts; attempt++ {
+		profile, err := journeyStore().GetProfile(c.Request.Context(), owner)
+		if err != nil {
+			logger.Error("could not load saved journeys", "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, "Saved journeys could not be loaded")
+			return
+		}
+
+		if status, err := change(&profile); err != nil {
+			c.IndentedJSON(status, err.Error())
+			return
+		}
+
+		err = journeyStore().SaveProfile(c.Request.Context(), profile)
+		if errors.Is(err, ErrJourneyProfileConflict) {
+			logger.Debug("saved journeys changed during update, trying again", "attempt", attempt)
+			continue
+		}
+		if err != nil {
+			logger.Error("could not save journeys", "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, "Saved journeys could not be saved")
+			return
+		}
+
+		profile, err = journeyStore().GetProfile(c.Request.Context(), owner)
+		if err != nil {
+			logger.Error("could not load saved journeys", "error", err)
+			c.IndentedJSON(http.StatusInternalServerError, "Saved journeys could not be loaded")
+			return
+		}
+		c.IndentedJSON(http.StatusOK, profile)
+		return
+	}
+
+	c.IndentedJSON(http.StatusConflict, ErrJourneyProfileConflict.Error())
+}
+
+// GetJourneyPlan returns the plan for each of the caller's commutes running
+// today, or on the service date given with the date query parameter as
+// yyyy-MM-dd. The shape, tolerance and wheelchair query parameters work as they
+// do when matching routes
+func GetJourneyPlan(c *gin.Context) {
+
+	owner, ok := journeyOwner(c)
+	if !ok {
+		return
+	}
+
+	serviceDate, err := parseServiceDate(c.Query("date"), time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid date parameter in request, expected yyyy-MM-dd")
+		return
+	}
+	shapeOptions, err := ParseShapeOptions(c.Query("shape"), c.Query("tolerance"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid shape parameters in request: "+err.Error())
+		return
+	}
+	routeOptions, err := ParseRouteOptions(c.Query("wheelchair"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid wheelchair parameter in request: "+err.Error())
+		return
+	}
+
+	profile, err := journeyStore().GetProfile(c.Request.Context(), owner)
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not load saved journeys", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Saved journeys could not be loaded")
+		return
+	}
+
+	plan := BuildJourneyPlan(ContextWithRouteOptions(c.Request.Context(), routeOptions), profile,
+		serviceDate, matchCommute)
+	for index := range plan.Commutes {
+		plan.Commutes[index].Routes = FormatRouteShapes(plan.Commutes[index].Routes, shapeOptions)
+	}
+
+	c.IndentedJSON(http.StatusOK, plan)
+}
+
+// BuildJourneyPlan takes in the context of the request, a profile, a service
+// date and the function used to match routes and returns the plan for each
+// commute in the profile that runs on the day of the week of the service date,
+// with routes matched to arrive by the commute's target time on that date
+func BuildJourneyPlan(ctx context.Context, profile JourneyProfile, serviceDate time.Time,
+	match commuteMatcher) JourneyPlan {
+
+	serviceDate = serviceDate.In(dublinLocation)
+	plan := JourneyPlan{ServiceDate: serviceDate.Format(serviceDateLayout), Commutes: []CommutePlan{}}
+
+	for _, commute := range profile.Commutes {
+		if !commute.RunsOn(serviceDate.Weekday()) {
+			continue
+		}
+		from, hasFrom := profile.Place(commute.From)
+		to, hasTo := profile.Place(commute.To)
+		targetTime, err := time.Parse(commuteTimeLayout, commute.ArriveBy)
+		if !hasFrom || !hasTo || err != nil {
+			LoggerFromContext(ctx).Warn("skipping commute that can't be planned", "commute", commute.Name)
+			continue
+		}
+
+		arriveBy := time.Date(serviceDate.Year(), serviceDate.Month(), serviceDate.Day(),
+			targetTime.Hour(), targetTime.Minute(), 0, 0, dublinLocation)
+		routes := match(ctx, placeCoordinates(from), placeCoordinates(to), FormatRequestTime(arriveBy))
+		if routes == nil {
+			routes = []busRouteJSON{}
+		}
+
+		plan.Commutes = append(plan.Commutes, CommutePlan{
+			Commute:  commute,
+			From:     from,
+			To:       to,
+			ArriveBy: arriveBy.Format(time.RFC3339),
+			Routes:   routes,
+		})
+	}
+
+	return plan
+}
+
+// placeCoordinates returns the coordinates of a place as latitude,longitude in
+// the form taken by the route matching functions
+func placeCoordinates(place SavedPlace) string {
+	return strconv.FormatFloat(place.Lat, 'f', -1, 64) + "," + strconv.FormatFloat(place.Lon, 'f', -1, 64)
+}
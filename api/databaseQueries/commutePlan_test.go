@@ -0,0 +1,146 @@
+package databaseQueries
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBuildJourneyPlan(t *testing.T) {
+
+	profile := testJourneyProfile()
+	profile.PutCommute(Commute{Name: "to work", From: "home", To: "work",
+		Weekdays: []string{"mon", "wed"}, ArriveBy: "08:45"}, 5)
+	profile.PutCommute(Commute{Name: "home", From: "work", To: "home",
+		Weekdays: []string{"mon"}, ArriveBy: "18:30"}, 5)
+
+	type matchCall struct{ origin, destination, date string }
+	var calls []matchCall
+	match := func(ctx context.Context, origin string, destination string, date string) []busRouteJSON {
+		calls = append(calls, matchCall{origin, destination, date})
+		return []busRouteJSON{{RouteNum: "46A"}}
+	}
+
+	// 15 June 2022 was a Wednesday
+	plan := BuildJourneyPlan(context.Background(), profile,
+		time.Date(2022, time.June, 15, 0, 0, 0, 0, dublinLocation), match)
+
+	if plan.ServiceDate != "2022-06-15" || len(plan.Commutes) != 1 {
+		t.Log("Expected only the commute running on Wednesdays, got", plan)
+		t.FailNow()
+	}
+	if len(calls) != 1 || calls[0] != (matchCall{"53.288,-6.199", "53.321,-6.231", "2022-06-15 08:45:00"}) {
+		t.Log("Expected routes to be matched from home to work arriving by 08:45, got", calls)
+		t.Fail()
+	}
+	if plan.Commutes[0].ArriveBy != "2022-06-15T08:45:00+01:00" || len(plan.Commutes[0].Routes) != 1 {
+		t.Log("Expected the plan to hold the target arrival and the matched routes, got", plan.Commutes[0])
+		t.Fail()
+	}
+}
+
+func TestSavedJourneyEndpoints(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+	SetJourneyStore(NewMemoryJourneyStore())
+
+	matchCommute = func(ctx context.Context, origin string, destination string, date string) []busRouteJSON {
+		return nil
+	}
+	defer func() { matchCommute = FindMatchingRouteForArrival }()
+
+	secret := strings.Repeat("s", minUserTokenSecretLength)
+	accessConfig := AccessConfig{APIKeys: []APIKeyConfig{{Name: "web", Key: "web-key", UserTokenSecret: secret},
+		{Name: "partner", Key: "partner-key"}}}
+	router := gin.New()
+	me := router.Group("/me", apiKeyAuth(accessConfig))
+	me.GET("", GetJourneyProfile)
+	me.PUT("/places/:name", PutSavedPlace)
+	me.DELETE("/places/:name", DeleteSavedPlace)
+	me.PUT("/commutes/:name", PutCommute)
+	me.GET("/plan", GetJourneyPlan)
+
+	userToken := SignUserToken(secret, "web", "alice", time.Now().Add(time.Hour))
+	send := func(method string, path string, key string, body interface{}) *httptest.ResponseRecorder {
+		var payload bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&payload).Encode(body)
+		}
+		request := httptest.NewRequest(method, path, &payload)
+		request.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			request.Header.Set(apiKeyHeader, key)
+		}
+		if key == "web-key" {
+			request.Header.Set("Authorization", "Bearer "+userToken)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if code := send(http.MethodGet, "/me", "", nil).Code; code != http.StatusUnauthorized {
+		t.Log("Expected saved journeys to need an api key, got", code)
+		t.Fail()
+	}
+
+	// A shared key needs a user token, while a key of its own is its owner
+	userToken = SignUserToken(secret, "web", "mallory", time.Now().Add(-time.Minute))
+	if code := send(http.MethodGet, "/me", "web-key", nil).Code; code != http.StatusUnauthorized {
+		t.Log("Expected an expired user token to be refused, got", code)
+		t.Fail()
+	}
+	userToken = SignUserToken(secret, "web", "alice", time.Now().Add(time.Hour))
+	recorder := send(http.MethodGet, "/me", "partner-key", nil)
+	var profile JourneyProfile
+	json.Unmarshal(recorder.Body.Bytes(), &profile)
+	if recorder.Code != http.StatusOK || profile.Owner != "partner" {
+		t.Log("Expected the partner key to own its saved journeys, got", recorder.Code, recorder.Body.String())
+		t.Fail()
+	}
+
+	for _, place := range []string{"home", "work"} {
+		if code := send(http.MethodPut, "/me/places/"+place, "web-key",
+			SavedPlace{Lat: 53.3, Lon: -6.2}).Code; code != http.StatusOK {
+			t.Log("Expected place", place, "to be saved, got", code)
+			t.FailNow()
+		}
+	}
+	if code := send(http.MethodPut, "/me/commutes/to%20work", "web-key",
+		Commute{From: "home", To: "gym", Weekdays: []string{"mon"}, ArriveBy: "08:45"}).Code; code != http.StatusBadRequest {
+		t.Log("Expected a commute to an unsaved place to be rejected, got", code)
+		t.Fail()
+	}
+	if code := send(http.MethodPut, "/me/commutes/to%20work", "web-key",
+		Commute{From: "home", To: "work", Weekdays: []string{"wed"}, ArriveBy: "08:45"}).Code; code != http.StatusOK {
+		t.Log("Expected the commute to be saved, got", code)
+		t.FailNow()
+	}
+	if code := send(http.MethodDelete, "/me/places/home", "web-key", nil).Code; code != http.StatusConflict {
+		t.Log("Expected a place in use to be kept, got", code)
+		t.Fail()
+	}
+
+	recorder = send(http.MethodGet, "/me", "web-key", nil)
+	profile = JourneyProfile{}
+	json.Unmarshal(recorder.Body.Bytes(), &profile)
+	if profile.Owner != "web/alice" || len(profile.Places) != 2 || len(profile.Commutes) != 1 {
+		t.Log("Expected the saved profile for web/alice, got", recorder.Body.String())
+		t.Fail()
+	}
+
+	recorder = send(http.MethodGet, "/me/plan?date=2022-06-15", "web-key", nil)
+	var plan JourneyPlan
+	json.Unmarshal(recorder.Body.Bytes(), &plan)
+	if recorder.Code != http.StatusOK || len(plan.Commutes) != 1 || plan.Commutes[0].Routes == nil {
+		t.Log("Expected a plan for the commute with an empty list of routes, got", recorder.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,884 @@
+package databaseQueries
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultConfigPath is where the configuration file is looked for when no path
+// is given with the -config flag or the API_CONFIG environment variable. It is
+// the directory mounted into the api container by docker-compose. A missing
+// file at this path is ignored, whereas a missing file given explicitly is not
+const DefaultConfigPath = "/app/config/api.json"
+
+// Duration is a time.Duration that is written in the configuration file as a
+// string such as "30s" or "1h30m" rather than a number of nanoseconds
+type Duration time.Duration
+
+// UnmarshalJSON reads a duration from a string such as "30s"
+func (duration *Duration) UnmarshalJSON(data []byte) error {
+
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %s", string(data))
+	}
+
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+
+	*duration = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string such as "30s"
+func (duration Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(duration).String())
+}
+
+// Config holds every setting for the api. It is built by LoadConfig from the
+// defaults, then the configuration file, then environment variables and then
+// command line flags, with each overriding the one before
+type Config struct {
+	Server        ServerConfig        `json:"server"`
+	Mongo         MongoConfig         `json:"mongo"`
+	Prediction    PredictionConfig    `json:"prediction"`
+	Geocoder      GeocoderConfig      `json:"geocoder"`
+	Cache         CacheConfig         `json:"cache"`
+	Log           LogConfig           `json:"log"`
+	Admin         AdminConfig         `json:"admin"`
+	Access        AccessConfig        `json:"access"`
+	Stops         StopsConfig         `json:"stops"`
+	Journeys      JourneysConfig      `json:"journeys"`
+	Alerts        AlertsConfig        `json:"alerts"`
+	Vehicles      VehiclesConfig      `json:"vehicles"`
+	Realtime      RealtimeConfig      `json:"realtime"`
+	DelayArchive  DelayArchiveConfig  `json:"delay_archive"`
+	Weather       WeatherConfig       `json:"weather"`
+	Calendar      CalendarConfig      `json:"calendar"`
+	Accessibility AccessibilityConfig `json:"accessibility"`
+	Walking       WalkingConfig       `json:"walking"`
+	Isochrone     IsochroneConfig     `json:"isochrone"`
+	Matrix        MatrixConfig        `json:"matrix"`
+}
+
+// ServerConfig holds the address the api listens on, the certificate and key
+// used to serve TLS when both are given, the timeouts for each connection and
+// how long in-flight requests are given to finish once the api is stopped. The
+// X-Forwarded-For header is only trusted from the trusted proxies, so that the
+// client IP used for rate limiting can't be set by the client itself
+type ServerConfig struct {
+	ListenAddress     string   `json:"listen_address"`
+	TrustedProxies    []string `json:"trusted_proxies"`
+	TLSCertFile       string   `json:"tls_cert_file"`
+	TLSKeyFile        string   `json:"tls_key_file"`
+	ReadTimeout       Duration `json:"read_timeout"`
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	WriteTimeout      Duration `json:"write_timeout"`
+	IdleTimeout       Duration `json:"idle_timeout"`
+	ShutdownTimeout   Duration `json:"shutdown_timeout"`
+}
+
+// MongoConfig holds the connection details for Mongo along with the database
+// and collection names used. The URI is used as is if given, otherwise one is
+// built from the username, password, host and port
+type MongoConfig struct {
+	URI         string           `json:"uri"`
+	Username    string           `json:"username"`
+	Password    string           `json:"password"`
+	Host        string           `json:"host"`
+	Port        string           `json:"port"`
+	Database    string           `json:"database"`
+	Collections MongoCollections `json:"collections"`
+}
+
+// MongoCollections holds the names of the collections read by the api, along
+// with the collections that saved journeys, service alerts and the state of each
+// realtime trip are written to. The delay archive is kept in one collection for
+// each service day, named after the delay archive prefix
+type MongoCollections struct {
+	Stops         string `json:"stops"`
+	TripsAndStops string `json:"trips_n_stops"`
+	RealtimeData  string `json:"realtime_data"`
+	DelayArchive  string `json:"delay_archive"`
+	SavedJourneys string `json:"saved_journeys"`
+	ServiceAlerts string `json:"service_alerts"`
+}
+
+// PredictionConfig holds the base url of the prediction service, how long route
+// matching waits for predictions, how many are requested at once and how long
+// each prediction is cached for
+type PredictionConfig struct {
+	URL      string   `json:"url"`
+	Deadline Duration `json:"deadline"`
+	Workers  int      `json:"workers"`
+	CacheTTL Duration `json:"cache_ttl"`
+}
+
+// GeocoderConfig holds the Google Maps api key and the region used to bias
+// geocoding results
+type GeocoderConfig struct {
+	APIKey string `json:"api_key"`
+	Region string `json:"region"`
+}
+
+// CacheConfig holds the cache backend ("memory", "redis" or "none"), the number
+// of entries kept in memory, the Redis compatible server to use and how long
+// each kind of result is cached for
+type CacheConfig struct {
+	Backend            string   `json:"backend"`
+	Size               int      `json:"size"`
+	RedisAddress       string   `json:"redis_address"`
+	RedisPassword      string   `json:"redis_password"`
+	RedisDB            int      `json:"redis_db"`
+	NearbyStopsTTL     Duration `json:"nearby_stops_ttl"`
+	RouteCandidatesTTL Duration `json:"route_candidates_ttl"`
+	RouteTripsTTL      Duration `json:"route_trips_ttl"`
+}
+
+// LogConfig holds the minimum level written to the log
+type LogConfig struct {
+	Level string `json:"level"`
+}
+
+// AdminConfig holds the token needed for the admin endpoints, which are
+// disabled if it is empty
+type AdminConfig struct {
+	Token string `json:"token"`
+}
+
+// AccessConfig holds the api keys that may be used with the api, whether one is
+// required, the rate limits applied to each IP address and to each api key that
+// doesn't set its own, and the CORS policy for browser clients
+type AccessConfig struct {
+	RequireAPIKey bool            `json:"require_api_key"`
+	APIKeys       []APIKeyConfig  `json:"api_keys"`
+	IPRateLimit   RateLimitConfig `json:"ip_rate_limit"`
+	KeyRateLimit  RateLimitConfig `json:"key_rate_limit"`
+	CORS          CORSConfig      `json:"cors"`
+}
+
+// APIKeyConfig holds an api key with the name of the client it was issued to,
+// the number of requests it may make each day (zero for no limit) and its rate
+// limit if it differs from the default for api keys. A client sharing its key
+// between its users is given a user token secret to sign a token for each user,
+// see SignUserToken, so that their saved journeys are kept apart
+type APIKeyConfig struct {
+	Name            string           `json:"name"`
+	Key             string           `json:"key"`
+	DailyQuota      int64            `json:"daily_quota"`
+	RateLimit       *RateLimitConfig `json:"rate_limit,omitempty"`
+	UserTokenSecret string           `json:"user_token_secret,omitempty"`
+}
+
+// RateLimitConfig holds the average number of requests allowed per minute and
+// the most allowed at once. A rate of zero disables the limit
+type RateLimitConfig struct {
+	RequestsPerMinute float64 `json:"requests_per_minute"`
+	Burst             int     `json:"burst"`
+}
+
+// CORSConfig holds the origins allowed to call the api from a browser, either
+// exactly, as "*" for any origin or with a wildcard subdomain such as
+// "https://*.dublinbus-diy.site", along with the methods and headers allowed,
+// whether credentials may be sent and how long preflight results are cached.
+// No CORS headers are sent if there are no allowed origins
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           Duration `json:"max_age"`
+}
+
+// StopsConfig holds the GTFS stops.txt file read for the shelter, real time
+// display and wheelchair boarding of each stop, how far in metres a nearby stop
+// may be to be listed for transfers and how many departures are listed by default
+// in the stop details
+type StopsConfig struct {
+	MetadataFile         string  `json:"metadata_file"`
+	TransferRadiusMetres float64 `json:"transfer_radius_metres"`
+	Departures           int     `json:"departures"`
+}
+
+// JourneysConfig holds the store for saved journeys ("mongo" or "memory") and
+// the most places and commutes that each owner can save
+type JourneysConfig struct {
+	Store       string `json:"store"`
+	MaxPlaces   int    `json:"max_places"`
+	MaxCommutes int    `json:"max_commutes"`
+}
+
+// AlertsConfig holds the store for service alerts, either "mongo" or "memory"
+type AlertsConfig struct {
+	Store string `json:"store"`
+}
+
+// VehiclesConfig holds how long a vehicle position is kept without being
+// updated and how often a comment is sent to keep vehicle streams open, which
+// must be more often than the server's write timeout as each write extends it
+type VehiclesConfig struct {
+	MaxAge          Duration `json:"max_age"`
+	StreamHeartbeat Duration `json:"stream_heartbeat"`
+}
+
+// DelayArchiveConfig holds the store for the delay archive ("mongo" or
+// "memory"), how many service days it retains and the most days a single
+// analytics query may span
+type DelayArchiveConfig struct {
+	Store         string `json:"store"`
+	RetentionDays int    `json:"retention_days"`
+	MaxQueryDays  int    `json:"max_query_days"`
+}
+
+// WeatherConfig holds where the weather used for prediction features is read
+// from, either "mongo" for the collections filled by the weather scrapers or
+// "none", along with the database and collections holding the forecast and
+// current weather, the furthest a reading may be from the instant it is used
+// for and how long the readings are cached for
+type WeatherConfig struct {
+	Provider           string   `json:"provider"`
+	Database           string   `json:"database"`
+	ForecastCollection string   `json:"forecast_collection"`
+	CurrentCollection  string   `json:"current_collection"`
+	MaxGap             Duration `json:"max_gap"`
+	CacheTTL           Duration `json:"cache_ttl"`
+}
+
+// CalendarConfig holds the bank holidays on top of those worked out for each
+// year, such as once-off ones, given as YYYY-MM-DD, the school terms, each given
+// as its first and last day such as 2022-09-01/2022-12-21, and the special events
+// that prediction features flag. The GTFS calendar.txt and calendar_dates.txt
+// files say which services run on each day, with the school term services only
+// running in term. Every service runs every day when neither file is given
+type CalendarConfig struct {
+	BankHolidays       []string       `json:"bank_holidays"`
+	SchoolTerms        []string       `json:"school_terms"`
+	Events             []SpecialEvent `json:"events"`
+	ServicesFile       string         `json:"services_file"`
+	ServiceDatesFile   string         `json:"service_dates_file"`
+	SchoolTermServices []string       `json:"school_term_services"`
+}
+
+// AccessibilityConfig holds the GTFS trips.txt file read for whether each trip
+// is wheelchair accessible and a CSV file of lat, lon and elevation samples used
+// to work out the slope of walks, either of which may be left out. In wheelchair
+// mode a walk to or from a stop may be at most the maximum walk in metres, with
+// an average slope of at most the maximum slope where the elevation is known
+type AccessibilityConfig struct {
+	TripsFile     string  `json:"trips_file"`
+	ElevationFile string  `json:"elevation_file"`
+	MaxWalkMetres float64 `json:"max_walk_metres"`
+	MaxSlope      float64 `json:"max_slope"`
+}
+
+// WalkingConfig holds the OpenStreetMap PBF extract that walks are routed over,
+// the walking speed in metres per second, how far a point may be from the
+// nearest walkable way for walks to start or end there and the longest walk
+// to or from a stop. Walks are measured in a straight line when no extract is
+// given
+type WalkingConfig struct {
+	OSMFile              string  `json:"osm_file"`
+	SpeedMetresPerSecond float64 `json:"speed_metres_per_second"`
+	MaxSnapMetres        float64 `json:"max_snap_metres"`
+	MaxWalkMetres        float64 `json:"max_walk_metres"`
+}
+
+// IsochroneConfig holds the most minutes an isochrone may be asked for and the
+// size in metres of the grid cells its area is drawn with
+type IsochroneConfig struct {
+	MaxMinutes int     `json:"max_minutes"`
+	CellMetres float64 `json:"cell_metres"`
+}
+
+// MatrixConfig holds the most cells a travel time matrix request may have, the
+// number of cells above which its rows are streamed, the longest journey in
+// minutes that is searched for and how many origins are searched from at once
+type MatrixConfig struct {
+	MaxCells    int `json:"max_cells"`
+	StreamCells int `json:"stream_cells"`
+	MaxMinutes  int `json:"max_minutes"`
+	Workers     int `json:"workers"`
+}
+
+// RealtimeConfig holds the GTFS-R feed urls polled along with the NTA api key
+// sent with each request, how often they are polled, the timeout for each
+// request, how far polls are pushed back after failures and how long a trip is
+// kept without being updated. Feed files are replayed from the replay path
+// instead of polling the urls when it is given, and the trip states are kept
+// in the store, either "mongo" or "memory"
+type RealtimeConfig struct {
+	Feeds       []string `json:"feeds"`
+	APIKey      string   `json:"api_key"`
+	Interval    Duration `json:"interval"`
+	Timeout     Duration `json:"timeout"`
+	MaxBackoff  Duration `json:"max_backoff"`
+	StateMaxAge Duration `json:"state_max_age"`
+	ReplayPath  string   `json:"replay_path"`
+	Store       string   `json:"store"`
+}
+
+// DefaultConfig returns the configuration used where nothing else is set
+func DefaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			ListenAddress:     "0.0.0.0:8080",
+			TrustedProxies:    []string{"127.0.0.1", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16"},
+			ReadTimeout:       Duration(15 * time.Second),
+			ReadHeaderTimeout: Duration(5 * time.Second),
+			WriteTimeout:      Duration(90 * time.Second),
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownTimeout:   Duration(30 * time.Second),
+		},
+		Mongo: MongoConfig{
+			Host:     "localhost",
+			Port:     "27017",
+			Database: "BusData",
+			Collections: MongoCollections{
+				Stops:         "stops",
+				TripsAndStops: "trips_n_stops",
+				RealtimeData:  "realTimeData",
+				DelayArchive:  "delayArchive",
+				SavedJourneys: "savedJourneys",
+				ServiceAlerts: "serviceAlerts",
+			},
+		},
+		Prediction: PredictionConfig{
+			URL:      "https://dublinbus-diy.site/ml/prediction/",
+			Deadline: Duration(3 * time.Second),
+			Workers:  8,
+			CacheTTL: Duration(30 * time.Minute),
+		},
+		Geocoder: GeocoderConfig{Region: "ie"},
+		Cache: CacheConfig{
+			Backend:            "memory",
+			Size:               10000,
+			RedisAddress:       "localhost:6379",
+			NearbyStopsTTL:     Duration(24 * time.Hour),
+			RouteCandidatesTTL: Duration(6 * time.Hour),
+			RouteTripsTTL:      Duration(time.Hour),
+		},
+		Log: LogConfig{Level: "info"},
+		Access: AccessConfig{
+			IPRateLimit:  RateLimitConfig{RequestsPerMinute: 60, Burst: 30},
+			KeyRateLimit: RateLimitConfig{RequestsPerMinute: 300, Burst: 100},
+			CORS: CORSConfig{
+				AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+				AllowedHeaders: []string{"Content-Type", "Authorization", apiKeyHeader, requestIDHeader},
+				MaxAge:         Duration(10 * time.Minute),
+			},
+		},
+		Stops:    StopsConfig{TransferRadiusMetres: 400, Departures: 10},
+		Journeys: JourneysConfig{Store: "mongo", MaxPlaces: 20, MaxCommutes: 20},
+		Alerts:   AlertsConfig{Store: "mongo"},
+		Vehicles: VehiclesConfig{
+			MaxAge:          Duration(10 * time.Minute),
+			StreamHeartbeat: Duration(20 * time.Second),
+		},
+		Realtime: RealtimeConfig{
+			Interval:    Duration(time.Minute),
+			Timeout:     Duration(20 * time.Second),
+			MaxBackoff:  Duration(10 * time.Minute),
+			StateMaxAge: Duration(2 * time.Hour),
+			Store:       "mongo",
+		},
+		DelayArchive: DelayArchiveConfig{Store: "mongo", RetentionDays: 400, MaxQueryDays: 92},
+		Weather: WeatherConfig{
+			Provider:           "mongo",
+			Database:           "Weather",
+			ForecastCollection: "Forecast",
+			CurrentCollection:  "CurrentWeather",
+			MaxGap:             Duration(3 * time.Hour),
+			CacheTTL:           Duration(15 * time.Minute),
+		},
+		// A slope of 1 in 20 is the steepest that isn't treated as a ramp
+		Accessibility: AccessibilityConfig{MaxWalkMetres: 400, MaxSlope: 0.05},
+		Walking:       WalkingConfig{SpeedMetresPerSecond: 1.3, MaxSnapMetres: 150, MaxWalkMetres: 1000},
+		Isochrone:     IsochroneConfig{MaxMinutes: 120, CellMetres: 100},
+		Matrix:        MatrixConfig{MaxCells: 40000, StreamCells: 2500, MaxMinutes: 120, Workers: 4},
+	}
+}
+
+// ConnectionURI returns the URI used to connect to Mongo
+func (mongoConfig MongoConfig) ConnectionURI() string {
+
+	if mongoConfig.URI != "" {
+		return mongoConfig.URI
+	}
+
+	return fmt.Sprintf("mongodb://%s:%s@%s:%s/?retryWrites=true&w=majority",
+		mongoConfig.Username, mongoConfig.Password, mongoConfig.Host, mongoConfig.Port)
+}
+
+// TLSEnabled reports whether the api should serve TLS
+func (serverConfig ServerConfig) TLSEnabled() bool {
+	return serverConfig.TLSCertFile != "" && serverConfig.TLSKeyFile != ""
+}
+
+// Enabled reports whether GTFS-R feeds should be polled or replayed
+func (realtimeConfig RealtimeConfig) Enabled() bool {
+	return len(realtimeConfig.Feeds) > 0 || realtimeConfig.ReplayPath != ""
+}
+
+// configSetting is a single setting that can be given as an environment
+// variable or command line flag. Each environment variable is checked in turn
+// so that older names, such as the MONGO_INITDB_ROOT_* variables shared with
+// the Mongo container, keep working. field returns a pointer to the setting
+type configSetting struct {
+	flag  string
+	env   []string
+	usage string
+	field func(config *Config) interface{}
+}
+
+// configSettings lists every setting that can be given outside the file
+var configSettings = []configSetting{
+	{"listen", []string{"LISTEN_ADDRESS"}, "address the api listens on",
+		func(config *Config) interface{} { return &config.Server.ListenAddress }},
+	{"trusted-proxies", []string{"TRUSTED_PROXIES"}, "comma separated proxies trusted to set X-Forwarded-For",
+		func(config *Config) interface{} { return &config.Server.TrustedProxies }},
+	{"tls-cert", []string{"TLS_CERT_FILE"}, "certificate file used to serve TLS",
+		func(config *Config) interface{} { return &config.Server.TLSCertFile }},
+	{"tls-key", []string{"TLS_KEY_FILE"}, "key file used to serve TLS",
+		func(config *Config) interface{} { return &config.Server.TLSKeyFile }},
+	{"read-timeout", []string{"READ_TIMEOUT"}, "timeout for reading each request",
+		func(config *Config) interface{} { return &config.Server.ReadTimeout }},
+	{"write-timeout", []string{"WRITE_TIMEOUT"}, "timeout for writing each response",
+		func(config *Config) interface{} { return &config.Server.WriteTimeout }},
+	{"shutdown-timeout", []string{"SHUTDOWN_TIMEOUT"}, "time given to in-flight requests on shutdown",
+		func(config *Config) interface{} { return &config.Server.ShutdownTimeout }},
+	{"mongo-uri", []string{"MONGO_URI"}, "Mongo connection URI",
+		func(config *Config) interface{} { return &config.Mongo.URI }},
+	{"", []string{"MONGO_USERNAME", "MONGO_INITDB_ROOT_USERNAME"}, "",
+		func(config *Config) interface{} { return &config.Mongo.Username }},
+	{"", []string{"MONGO_PASSWORD", "MONGO_INITDB_ROOT_PASSWORD"}, "",
+		func(config *Config) interface{} { return &config.Mongo.Password }},
+	{"mongo-host", []string{"MONGO_HOST", "MONGO_INITDB_ROOT_HOST"}, "Mongo host",
+		func(config *Config) interface{} { return &config.Mongo.Host }},
+	{"mongo-port", []string{"MONGO_PORT", "MONGO_INITDB_ROOT_PORT"}, "Mongo port",
+		func(config *Config) interface{} { return &config.Mongo.Port }},
+	{"mongo-database", []string{"MONGO_DATABASE"}, "Mongo database holding the bus data",
+		func(config *Config) interface{} { return &config.Mongo.Database }},
+	{"prediction-url", []string{"PREDICTION_URL"}, "base url of the prediction service",
+		func(config *Config) interface{} { return &config.Prediction.URL }},
+	{"prediction-deadline", []string{"PREDICTION_DEADLINE"}, "time route matching waits for predictions",
+		func(config *Config) interface{} { return &config.Prediction.Deadline }},
+	{"prediction-workers", []string{"PREDICTION_WORKERS"}, "predictions requested at once",
+		func(config *Config) interface{} { return &config.Prediction.Workers }},
+	{"", []string{"MAPS_API_KEY"}, "",
+		func(config *Config) interface{} { return &config.Geocoder.APIKey }},
+	{"cache-backend", []string{"CACHE_BACKEND"}, "cache backend: memory, redis or none",
+		func(config *Config) interface{} { return &config.Cache.Backend }},
+	{"cache-size", []string{"CACHE_SIZE"}, "entries kept by the memory cache",
+		func(config *Config) interface{} { return &config.Cache.Size }},
+	{"redis-address", []string{"REDIS_ADDRESS"}, "address of the Redis compatible cache server",
+		func(config *Config) interface{} { return &config.Cache.RedisAddress }},
+	{"", []string{"REDIS_PASSWORD"}, "",
+		func(config *Config) interface{} { return &config.Cache.RedisPassword }},
+	{"redis-db", []string{"REDIS_DB"}, "database number on the Redis compatible cache server",
+		func(config *Config) interface{} { return &config.Cache.RedisDB }},
+	{"log-level", []string{"LOG_LEVEL"}, "minimum log level: debug, info, warn or error",
+		func(config *Config) interface{} { return &config.Log.Level }},
+	{"require-api-key", []string{"REQUIRE_API_KEY"}, "reject requests without an api key",
+		func(config *Config) interface{} { return &config.Access.RequireAPIKey }},
+	{"cors-origins", []string{"CORS_ALLOWED_ORIGINS"}, "comma separated origins allowed by CORS",
+		func(config *Config) interface{} { return &config.Access.CORS.AllowedOrigins }},
+	{"stop-metadata", []string{"STOP_METADATA_FILE"}, "GTFS stops.txt file with stop amenities",
+		func(config *Config) interface{} { return &config.Stops.MetadataFile }},
+	{"journey-store", []string{"JOURNEY_STORE"}, "store for saved journeys: mongo or memory",
+		func(config *Config) interface{} { return &config.Journeys.Store }},
+	{"alert-store", []string{"ALERT_STORE"}, "store for service alerts: mongo or memory",
+		func(config *Config) interface{} { return &config.Alerts.Store }},
+	{"realtime-feeds", []string{"GTFSR_FEEDS"}, "comma separated GTFS-R feed urls to poll",
+		func(config *Config) interface{} { return &config.Realtime.Feeds }},
+	{"", []string{"GTFSR_API_KEY"}, "",
+		func(config *Config) interface{} { return &config.Realtime.APIKey }},
+	{"realtime-interval", []string{"GTFSR_INTERVAL"}, "interval between polls of each GTFS-R feed",
+		func(config *Config) interface{} { return &config.Realtime.Interval }},
+	{"realtime-replay", []string{"GTFSR_REPLAY_PATH"}, "GTFS-R feed file or directory replayed instead of polling",
+		func(config *Config) interface{} { return &config.Realtime.ReplayPath }},
+	{"realtime-store", []string{"REALTIME_STORE"}, "store for realtime trips: mongo or memory",
+		func(config *Config) interface{} { return &config.Realtime.Store }},
+	{"delay-archive-store", []string{"DELAY_ARCHIVE_STORE"}, "store for the delay archive: mongo or memory",
+		func(config *Config) interface{} { return &config.DelayArchive.Store }},
+	{"delay-retention-days", []string{"DELAY_RETENTION_DAYS"}, "service days kept in the delay archive",
+		func(config *Config) interface{} { return &config.DelayArchive.RetentionDays }},
+	{"weather-provider", []string{"WEATHER_PROVIDER"}, "weather for prediction features: mongo or none",
+		func(config *Config) interface{} { return &config.Weather.Provider }},
+	{"weather-database", []string{"WEATHER_DATABASE"}, "Mongo database filled by the weather scrapers",
+		func(config *Config) interface{} { return &config.Weather.Database }},
+	{"bank-holidays", []string{"BANK_HOLIDAYS"}, "comma separated extra bank holidays, YYYY-MM-DD",
+		func(config *Config) interface{} { return &config.Calendar.BankHolidays }},
+	{"school-terms", []string{"SCHOOL_TERMS"}, "comma separated school terms, YYYY-MM-DD/YYYY-MM-DD",
+		func(config *Config) interface{} { return &config.Calendar.SchoolTerms }},
+	{"gtfs-calendar", []string{"GTFS_CALENDAR_FILE"}, "GTFS calendar.txt file with the days each service runs",
+		func(config *Config) interface{} { return &config.Calendar.ServicesFile }},
+	{"gtfs-calendar-dates", []string{"GTFS_CALENDAR_DATES_FILE"}, "GTFS calendar_dates.txt file with service exceptions",
+		func(config *Config) interface{} { return &config.Calendar.ServiceDatesFile }},
+	{"school-term-services", []string{"SCHOOL_TERM_SERVICES"}, "comma separated services that only run in school terms",
+		func(config *Config) interface{} { return &config.Calendar.SchoolTermServices }},
+	{"gtfs-trips", []string{"GTFS_TRIPS_FILE"}, "GTFS trips.txt file with trip wheelchair accessibility",
+		func(config *Config) interface{} { return &config.Accessibility.TripsFile }},
+	{"elevation-file", []string{"ELEVATION_FILE"}, "CSV file of lat, lon and elevation samples",
+		func(config *Config) interface{} { return &config.Accessibility.ElevationFile }},
+	{"wheelchair-max-walk", []string{"WHEELCHAIR_MAX_WALK_METRES"}, "longest walk to a stop in wheelchair mode",
+		func(config *Config) interface{} { return &config.Accessibility.MaxWalkMetres }},
+	{"wheelchair-max-slope", []string{"WHEELCHAIR_MAX_SLOPE"}, "steepest average slope of a walk in wheelchair mode",
+		func(config *Config) interface{} { return &config.Accessibility.MaxSlope }},
+	{"osm-file", []string{"OSM_PBF_FILE"}, "OpenStreetMap PBF extract that walks are routed over",
+		func(config *Config) interface{} { return &config.Walking.OSMFile }},
+	{"walking-speed", []string{"WALKING_SPEED"}, "walking speed in metres per second",
+		func(config *Config) interface{} { return &config.Walking.SpeedMetresPerSecond }},
+	{"max-walk", []string{"MAX_WALK_METRES"}, "longest walk to or from a stop",
+		func(config *Config) interface{} { return &config.Walking.MaxWalkMetres }},
+	{"isochrone-max-minutes", []string{"ISOCHRONE_MAX_MINUTES"}, "most minutes an isochrone may be asked for",
+		func(config *Config) interface{} { return &config.Isochrone.MaxMinutes }},
+	{"matrix-max-cells", []string{"MATRIX_MAX_CELLS"}, "most cells a travel time matrix request may have",
+		func(config *Config) interface{} { return &config.Matrix.MaxCells }},
+	{"matrix-workers", []string{"MATRIX_WORKERS"}, "origins a travel time matrix is searched from at once",
+		func(config *Config) interface{} { return &config.Matrix.Workers }},
+	{"", []string{"ADMIN_TOKEN"}, "",
+		func(config *Config) interface{} { return &config.Admin.Token }},
+}
+
+// setConfigValue parses value into the setting that field points to
+func setConfigValue(field interface{}, value string) error {
+
+	switch setting := field.(type) {
+	case *string:
+		*setting = value
+	case *int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*setting = parsed
+	case *float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		*setting = parsed
+	case *bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*setting = parsed
+	case *Duration:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*setting = Duration(parsed)
+	case *[]string:
+		*setting = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*setting = append(*setting, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+
+	return nil
+}
+
+// LoadConfig takes in the command line arguments (without the program name)
+// and a function to look up environment variables, normally os.LookupEnv, and
+// returns the configuration built from the defaults, the configuration file,
+// the environment and the flags in that order. The file is taken from the
+// -config flag, then the API_CONFIG variable and then DefaultConfigPath
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+
+	flagSet := flag.NewFlagSet("api", flag.ContinueOnError)
+	configPath := flagSet.String("config", "", "path to the JSON configuration file")
+
+	// Flag values are collected first and only applied once the file and
+	// environment have been read, so that they take precedence over both
+	type flagValue struct {
+		setting configSetting
+		value   string
+	}
+	var flagValues []flagValue
+	for _, setting := range configSettings {
+		if setting.flag == "" {
+			continue
+		}
+		currentSetting := setting
+		flagSet.Func(setting.flag, setting.usage, func(value string) error {
+			flagValues = append(flagValues, flagValue{currentSetting, value})
+			return nil
+		})
+	}
+	if err := flagSet.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := DefaultConfig()
+
+	path, explicitPath := *configPath, *configPath != ""
+	if !explicitPath {
+		path, _ = lookupEnv("API_CONFIG")
+		explicitPath = path != ""
+	}
+	if !explicitPath {
+		path = DefaultConfigPath
+	}
+	if err := loadConfigFile(&config, path, explicitPath); err != nil {
+		return Config{}, err
+	}
+
+	if err := applyConfigEnv(&config, lookupEnv); err != nil {
+		return Config{}, err
+	}
+
+	for _, flagValue := range flagValues {
+		if err := setConfigValue(flagValue.setting.field(&config), flagValue.value); err != nil {
+			return Config{}, fmt.Errorf("invalid -%s: %w", flagValue.setting.flag, err)
+		}
+	}
+
+	return config, config.Validate()
+}
+
+// applyConfigEnv sets each setting given in the environment, using the first
+// of its environment variables that is set
+func applyConfigEnv(config *Config, lookupEnv func(string) (string, bool)) error {
+
+	for _, setting := range configSettings {
+		for _, name := range setting.env {
+			value, ok := lookupEnv(name)
+			if !ok || value == "" {
+				continue
+			}
+			if err := setConfigValue(setting.field(config), value); err != nil {
+				return fmt.Errorf("invalid %s: %w", name, err)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// loadConfigFile reads the JSON configuration file at path over the top of the
+// config passed in. Settings that aren't known are rejected so that typos don't
+// go unnoticed, and a missing file is only an error if it was asked for
+func loadConfigFile(config *Config, path string, required bool) error {
+
+	contents, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !required {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(config); err != nil {
+		return fmt.Errorf("invalid configuration file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Validate checks that the configuration can be used to run the api
+func (config Config) Validate() error {
+
+	var problems []string
+
+	if config.Server.ListenAddress == "" {
+		problems = append(problems, "listen address must be set")
+	}
+	if (config.Server.TLSCertFile == "") != (config.Server.TLSKeyFile == "") {
+		problems = append(problems, "TLS needs both a certificate and key file")
+	}
+	if config.Mongo.Database == "" {
+		problems = append(problems, "Mongo database must be set")
+	}
+	if config.Prediction.Workers < 1 {
+		problems = append(problems, "prediction workers must be at least 1")
+	}
+	switch strings.ToLower(config.Cache.Backend) {
+	case "memory", "redis", "none":
+	default:
+		problems = append(problems, "unknown cache backend '"+config.Cache.Backend+"'")
+	}
+	if _, err := ParseLogLevel(config.Log.Level); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// Saved journeys are owned by the name of the api key, so names must be unique
+	seenKeys, seenNames := map[string]bool{}, map[string]bool{}
+	for index, apiKey := range config.Access.APIKeys {
+		if apiKey.Key == "" {
+			problems = append(problems, fmt.Sprintf("api key %d has no key", index))
+		} else if seenKeys[apiKey.Key] {
+			problems = append(problems, "api key for '"+apiKey.Name+"' is listed twice")
+		}
+		seenKeys[apiKey.Key] = true
+		if apiKey.Name == "" {
+			problems = append(problems, fmt.Sprintf("api key %d has no name", index))
+		} else if seenNames[apiKey.Name] {
+			problems = append(problems, "api key name '"+apiKey.Name+"' is used by more than one key")
+		}
+		seenNames[apiKey.Name] = true
+		if apiKey.UserTokenSecret != "" && len(apiKey.UserTokenSecret) < minUserTokenSecretLength {
+			problems = append(problems, fmt.Sprintf("user token secret for '%s' must be at least %d characters",
+				apiKey.Name, minUserTokenSecretLength))
+		}
+	}
+	if config.Access.RequireAPIKey && len(config.Access.APIKeys) == 0 {
+		problems = append(problems, "api keys are required but none are configured")
+	}
+	if config.Stops.TransferRadiusMetres < 0 {
+		problems = append(problems, "transfer radius can't be negative")
+	}
+	if config.Stops.Departures < 1 {
+		problems = append(problems, "stop departures must be at least 1")
+	}
+	switch strings.ToLower(config.Journeys.Store) {
+	case "mongo", "memory":
+	default:
+		problems = append(problems, "unknown journey store '"+config.Journeys.Store+"'")
+	}
+	switch strings.ToLower(config.Alerts.Store) {
+	case "mongo", "memory":
+	default:
+		problems = append(problems, "unknown alert store '"+config.Alerts.Store+"'")
+	}
+	switch strings.ToLower(config.Realtime.Store) {
+	case "mongo", "memory":
+	default:
+		problems = append(problems, "unknown realtime store '"+config.Realtime.Store+"'")
+	}
+	switch strings.ToLower(config.DelayArchive.Store) {
+	case "mongo", "memory":
+	default:
+		problems = append(problems, "unknown delay archive store '"+config.DelayArchive.Store+"'")
+	}
+	if config.DelayArchive.RetentionDays < 1 || config.DelayArchive.MaxQueryDays < 1 {
+		problems = append(problems, "delay archive retention and query days must each be at least 1")
+	}
+	switch strings.ToLower(config.Weather.Provider) {
+	case "mongo", "none":
+	default:
+		problems = append(problems, "unknown weather provider '"+config.Weather.Provider+"'")
+	}
+	if _, err := NewIrishCalendar(config.Calendar); err != nil {
+		problems = append(problems, err.Error())
+	}
+	for _, event := range config.Calendar.Events {
+		if !event.End.After(event.Start) {
+			problems = append(problems, "special event '"+event.Name+"' must end after it starts")
+		}
+	}
+	if config.Accessibility.MaxWalkMetres <= 0 || config.Accessibility.MaxSlope <= 0 {
+		problems = append(problems, "wheelchair walk and slope limits must be positive")
+	}
+	if config.Walking.SpeedMetresPerSecond <= 0 || config.Walking.MaxSnapMetres <= 0 ||
+		config.Walking.MaxWalkMetres <= 0 {
+		problems = append(problems, "walking speed, snapping distance and longest walk must be positive")
+	}
+	if config.Isochrone.MaxMinutes < 1 || config.Isochrone.CellMetres <= 0 {
+		problems = append(problems, "isochrone minutes and cell size must be positive")
+	}
+	if config.Matrix.MaxCells < 1 || config.Matrix.StreamCells < 1 || config.Matrix.MaxMinutes < 1 ||
+		config.Matrix.Workers < 1 {
+		problems = append(problems, "matrix cells, minutes and workers must be positive")
+	}
+	if config.Journeys.MaxPlaces < 1 || config.Journeys.MaxCommutes < 1 {
+		problems = append(problems, "saved places and commutes must each allow at least 1")
+	}
+
+	for name, duration := range map[string]Duration{
+		"read timeout":        config.Server.ReadTimeout,
+		"read header timeout": config.Server.ReadHeaderTimeout,
+		"write timeout":       config.Server.WriteTimeout,
+		"shutdown timeout":    config.Server.ShutdownTimeout,
+		"prediction deadline": config.Prediction.Deadline,
+		"vehicle max age":     config.Vehicles.MaxAge,
+		"vehicle heartbeat":   config.Vehicles.StreamHeartbeat,
+		"realtime interval":   config.Realtime.Interval,
+		"realtime timeout":    config.Realtime.Timeout,
+		"realtime backoff":    config.Realtime.MaxBackoff,
+		"realtime state age":  config.Realtime.StateMaxAge,
+		"weather max gap":     config.Weather.MaxGap,
+		"weather cache ttl":   config.Weather.CacheTTL,
+	} {
+		if duration <= 0 {
+			problems = append(problems, name+" must be positive")
+		}
+	}
+	if config.Vehicles.StreamHeartbeat >= config.Server.WriteTimeout {
+		problems = append(problems, "vehicle heartbeat must be shorter than the write timeout")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// currentConfig is the configuration used by the package. Until Configure is
+// called it is the default configuration with any environment variables applied,
+// so that the package still works when used without loading a configuration
+var currentConfig = newConfigFromEnv()
+
+// newConfigFromEnv returns the default configuration with any environment
+// variables applied, falling back to the defaults if they are invalid
+func newConfigFromEnv() Config {
+
+	config := DefaultConfig()
+	if err := applyConfigEnv(&config, os.LookupEnv); err != nil || config.Validate() != nil {
+		return DefaultConfig()
+	}
+
+	return config
+}
+
+// Configure applies the configuration to the package. It should be called once
+// at startup before any requests are served
+func Configure(config Config) {
+
+	currentConfig = config
+
+	level, _ := ParseLogLevel(config.Log.Level)
+	defaultLogger.SetLevel(level)
+
+	PredictionServiceURL = config.Prediction.URL
+	PredictionDeadline = time.Duration(config.Prediction.Deadline)
+	PredictionWorkers = config.Prediction.Workers
+	PredictionCacheTTL = time.Duration(config.Prediction.CacheTTL)
+
+	NearbyStopsCacheTTL = time.Duration(config.Cache.NearbyStopsTTL)
+	RouteCandidatesCacheTTL = time.Duration(config.Cache.RouteCandidatesTTL)
+	RouteTripsCacheTTL = time.Duration(config.Cache.RouteTripsTTL)
+	SetResultCache(NewResultCache(newCacheBackend(config.Cache)))
+
+	SetStopMetadata(loadConfiguredStopMetadata(config.Stops))
+	SetJourneyStore(newJourneyStore(config.Journeys))
+	SetAlertStore(newAlertStore(config.Alerts))
+	SetVehicleTracker(NewVehicleTracker(time.Duration(config.Vehicles.MaxAge)))
+	SetRealtimeStore(newRealtimeStore(config.Realtime))
+	SetDelayArchive(newDelayArchive(config.DelayArchive))
+	SetWeatherProvider(newWeatherProvider(config.Weather))
+	SetDayCalendar(newDayCalendar(config.Calendar))
+	SetServiceCalendar(loadConfiguredServiceCalendar(config.Calendar))
+	SetTripAccessibility(loadConfiguredTripAccessibility(config.Accessibility))
+	SetElevationModel(loadConfiguredElevationModel(config.Accessibility))
+	SetPedestrianGraph(loadConfiguredPedestrianGraph(config.Walking))
+}
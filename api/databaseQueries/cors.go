@@ -0,0 +1,106 @@
+package databaseQueries
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsExposedHeaders are the response headers that browser clients are allowed
+// to read, so that the web client can back off when it is rate limited
+var corsExposedHeaders = []string{
+	requestIDHeader, "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After",
+	"X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset",
+}
+
+// CORS is gin middleware applying the CORS policy from the access configuration.
+// It must be registered on the router itself rather than a group so that it
+// also answers preflight requests, which are made without an api key
+func CORS() gin.HandlerFunc {
+	return cors(currentConfig.Access.CORS)
+}
+
+// cors returns the CORS middleware for the given CORS configuration
+func cors(corsConfig CORSConfig) gin.HandlerFunc {
+
+	allowedMethods := strings.Join(corsConfig.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(corsConfig.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(corsExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(time.Duration(corsConfig.MaxAge) / time.Second))
+
+	return func(c *gin.Context) {
+
+		origin := c.GetHeader("Origin")
+		if origin == "" || len(corsConfig.AllowedOrigins) == 0 {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		if !originAllowed(origin, corsConfig.AllowedOrigins) {
+			if c.Request.Method == http.MethodOptions {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// A wildcard can't be used along with credentials, so the origin is
+		// echoed back instead whenever credentials are allowed
+		if corsConfig.AllowCredentials || !containsString(corsConfig.AllowedOrigins, "*") {
+			c.Header("Access-Control-Allow-Origin", origin)
+		} else {
+			c.Header("Access-Control-Allow-Origin", "*")
+		}
+		if corsConfig.AllowCredentials {
+			c.Header("Access-Control-Allow-Credentials", "true")
+		}
+
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", allowedMethods)
+			c.Header("Access-Control-Allow-Headers", allowedHeaders)
+			c.Header("Access-Control-Max-Age", maxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		c.Header("Access-Control-Expose-Headers", exposedHeaders)
+		c.Next()
+	}
+}
+
+// originAllowed reports whether the origin matches one of the allowed origins,
+// which may be "*" or contain a wildcard for the subdomain
+func originAllowed(origin string, allowedOrigins []string) bool {
+
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if wildcard := strings.Index(allowed, "*."); wildcard >= 0 {
+			prefix, suffix := allowed[:wildcard], allowed[wildcard+1:]
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				len(origin) > len(prefix)+len(suffix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// containsString reports whether the slice contains the value
+func containsString(values []string, value string) bool {
+
+	for _, current := range values {
+		if current == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,62 @@
+package databaseQueries
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCORSPreflightAndOrigins(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(cors(CORSConfig{
+		AllowedOrigins: []string{"https://dublinbus-diy.site", "https://*.dublinbus-diy.site"},
+		AllowedMethods: []string{"GET", "OPTIONS"},
+		AllowedHeaders: []string{apiKeyHeader},
+		MaxAge:         Duration(10 * time.Minute),
+	}))
+	router.GET("/test", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	preflight := httptest.NewRequest(http.MethodOptions, "/test", nil)
+	preflight.Header.Set("Origin", "https://app.dublinbus-diy.site")
+	preflight.Header.Set("Access-Control-Request-Method", "GET")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, preflight)
+
+	if recorder.Code != http.StatusNoContent ||
+		recorder.Header().Get("Access-Control-Allow-Origin") != "https://app.dublinbus-diy.site" ||
+		recorder.Header().Get("Access-Control-Allow-Headers") != apiKeyHeader ||
+		recorder.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Log("Unexpected response to preflight from an allowed subdomain:", recorder.Code, recorder.Header())
+		t.Fail()
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set("Origin", "https://evil.example.com")
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Log("An origin that isn't allowed should get no CORS headers")
+		t.Fail()
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+
+	allowedOrigins := []string{"https://*.dublinbus-diy.site"}
+
+	if originAllowed("https://dublinbus-diy.site.evil.com", allowedOrigins) {
+		t.Log("A wildcard should only match subdomains")
+		t.Fail()
+	}
+	if !originAllowed("https://anything.example.com", []string{"*"}) {
+		t.Log("'*' should allow any origin")
+		t.Fail()
+	}
+}
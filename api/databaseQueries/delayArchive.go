@@ -0,0 +1,668 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Dimensions that archived delays can be grouped by
+const (
+	DelayGroupRoute   = "route"
+	DelayGroupStop    = "stop"
+	DelayGroupHour    = "hour"
+	DelayGroupWeekday = "weekday"
+)
+
+// delayArchivePruneInterval is how often the poller drops expired partitions
+const delayArchivePruneInterval = time.Hour
+
+// analyticsDateLayout is the layout of the dates taken by the analytics endpoints
+const analyticsDateLayout = "2006-01-02"
+
+// DelayObservation is the delay observed at a stop of a trip, kept in the delay
+// archive under the service day of the trip. The archive holds one observation
+// for each stop of each trip, replaced whenever the delay changes, so it ends
+// up with the last delay given before the bus left the stop. The scheduled
+// departure, in seconds from the start of the service day, is taken from the
+// timetable where the trip is found in it. The hour is that of the scheduled
+// departure or, failing that, of the feed the delay was last reported in, in
+// Irish time, and the weekday that of the service day, 0 being Sunday
+type DelayObservation struct {
+	Id             string    `bson:"_id" json:"id"`
+	ServiceDate    string    `bson:"service_date" json:"service_date"`
+	TripId         string    `bson:"trip_id" json:"trip_id"`
+	RouteId        string    `bson:"route_id" json:"route_id"`
+	RouteNum       string    `bson:"route_num" json:"route_num"`
+	DirectionId    string    `bson:"direction_id,omitempty" json:"direction_id,omitempty"`
+	StopSequence   *int      `bson:"stop_sequence,omitempty" json:"stop_sequence,omitempty"`
+	StopId         string    `bson:"stop_id,omitempty" json:"stop_id,omitempty"`
+	ArrivalDelay   *int      `bson:"arrival_delay,omitempty" json:"arrival_delay,omitempty"`
+	DepartureDelay *int      `bson:"departure_delay,omitempty" json:"departure_delay,omitempty"`
+	Delay          int       `bson:"delay" json:"delay"`
+	Scheduled      *int64    `bson:"scheduled_departure,omitempty" json:"scheduled_departure,omitempty"`
+	Hour           int       `bson:"hour" json:"hour"`
+	Weekday        int       `bson:"weekday" json:"weekday"`
+	ObservedAt     time.Time `bson:"observed_at" json:"observed_at"`
+}
+
+// TripObservation is how a trip was scheduled to run on its service day, i.e.
+// SCHEDULED, ADDED or CANCELED, as last given in the feed. The scheduled start,
+// in seconds from the start of the service day, is taken from the feed or the
+// timetable and the direction from the timetable where the feed leaves it out
+type TripObservation struct {
+	Id                   string    `bson:"_id" json:"id"`
+	ServiceDate          string    `bson:"service_date" json:"service_date"`
+	RouteId              string    `bson:"route_id" json:"route_id"`
+	RouteNum             string    `bson:"route_num" json:"route_num"`
+	DirectionId          string    `bson:"direction_id,omitempty" json:"direction_id,omitempty"`
+	ScheduledStart       *int64    `bson:"scheduled_start,omitempty" json:"scheduled_start,omitempty"`
+	ScheduleRelationship string    `bson:"schedule_relationship" json:"schedule_relationship"`
+	ObservedAt           time.Time `bson:"observed_at" json:"observed_at"`
+}
+
+// ArchivedDay holds every trip and delay archived for a service day
+type ArchivedDay struct {
+	ServiceDate string
+	Trips       []TripObservation
+	Delays      []DelayObservation
+}
+
+// DelayQuery selects the archived delays between two service dates, inclusive,
+// optionally narrowed down to a route number and stop id, and names the
+// dimensions they are grouped by
+type DelayQuery struct {
+	From     time.Time
+	To       time.Time
+	RouteNum string
+	StopId   string
+	GroupBy  []string
+}
+
+// DelayAggregate sums up the delays in seconds of one group of archived delays.
+// Only the dimensions grouped by are given
+type DelayAggregate struct {
+	RouteNum     string  `json:"route_num,omitempty"`
+	StopId       string  `json:"stop_id,omitempty"`
+	Hour         *int    `json:"hour,omitempty"`
+	Weekday      string  `json:"weekday,omitempty"`
+	Observations int     `json:"observations"`
+	MeanDelay    float64 `json:"mean_delay"`
+	MinDelay     int     `json:"min_delay"`
+	MaxDelay     int     `json:"max_delay"`
+}
+
+// DelayArchive keeps the delays observed along each trip, partitioned by
+// service day, for as many days as it retains them
+type DelayArchive interface {
+	// ArchiveDelays adds or replaces the observations
+	ArchiveDelays(ctx context.Context, observations []DelayObservation) error
+	// ArchiveTrips adds or replaces the observations
+	ArchiveTrips(ctx context.Context, observations []TripObservation) error
+	// FindDay returns the trips and delays archived for the service date,
+	// formatted as in the GTFS-R feed, on the route number if one is given
+	FindDay(ctx context.Context, serviceDate string, routeNum string) (ArchivedDay, error)
+	// AggregateDelays returns the delays selected by the query, grouped and
+	// summed up
+	AggregateDelays(ctx context.Context, query DelayQuery) ([]DelayAggregate, error)
+	// PruneDelays drops the service days that are no longer retained at now,
+	// returning how many were dropped
+	PruneDelays(ctx context.Context, now time.Time) (int, error)
+}
+
+// delayGroup identifies a group of archived delays. Dimensions that aren't
+// grouped by are left empty, with -1 for the hour and weekday
+type delayGroup struct {
+	RouteNum string `bson:"route_num"`
+	StopId   string `bson:"stop_id"`
+	Hour     int    `bson:"hour"`
+	Weekday  int    `bson:"weekday"`
+}
+
+// delayTotals holds running totals for a group of archived delays, which can be
+// added together across partitions before being turned into a DelayAggregate
+type delayTotals struct {
+	Group delayGroup `bson:"_id"`
+	Count int        `bson:"count"`
+	Sum   int64      `bson:"sum"`
+	Min   int        `bson:"min"`
+	Max   int        `bson:"max"`
+}
+
+// stateServiceDate returns the service date a trip started on or, where the
+// feed doesn't say, the service day of the feed
+func stateServiceDate(state TripState) time.Time {
+
+	serviceDate, err := time.ParseInLocation(feedDateLayout, state.StartDate, dublinLocation)
+	if err != nil {
+		serviceDate, _ = ServiceDay(state.FeedTimestamp)
+	}
+
+	return serviceDate
+}
+
+// findTripStop returns the stop of the trip that a stop delay is for, matched
+// on its sequence or failing that its stop id
+func findTripStop(trip tripStops, stopDelay StopDelay) (BusStop, bool) {
+
+	for _, stop := range trip.Stops {
+		if stopDelay.StopSequence != nil && strconv.Itoa(*stopDelay.StopSequence) == stop.StopSequence {
+			return stop, true
+		}
+	}
+	for _, stop := range trip.Stops {
+		if stopDelay.StopSequence == nil && stopDelay.StopId != "" && stopDelay.StopId == stop.StopId {
+			return stop, true
+		}
+	}
+
+	return BusStop{}, false
+}
+
+// newTripObservation returns the observation of a trip in its state, with the
+// stops of the trip in the timetable if it was found there
+func newTripObservation(state TripState, trip tripStops) TripObservation {
+
+	observation := TripObservation{
+		Id:                   state.TripId,
+		ServiceDate:          stateServiceDate(state).Format(feedDateLayout),
+		RouteId:              state.RouteId,
+		RouteNum:             state.RouteNum,
+		DirectionId:          state.DirectionId,
+		ScheduleRelationship: state.ScheduleRelationship,
+		ObservedAt:           state.FeedTimestamp,
+	}
+	if observation.DirectionId == "" {
+		observation.DirectionId = trip.Direction
+	}
+	if observation.RouteNum == "" {
+		observation.RouteNum = trip.RouteNum
+	}
+
+	if seconds, ok := parseServiceTime(state.StartTime); ok {
+		observation.ScheduledStart = &seconds
+	} else {
+		stops := append([]BusStop{}, trip.Stops...)
+		sortBusStops(stops)
+		if len(stops) > 0 {
+			if seconds, ok = parseServiceTime(stops[0].DepartureTime); ok {
+				observation.ScheduledStart = &seconds
+			}
+		}
+	}
+
+	return observation
+}
+
+// newDelayObservation returns the observation of a stop of a trip in its state,
+// with the stops of the trip in the timetable if it was found there
+func newDelayObservation(state TripState, stopDelay StopDelay, trip tripStops) DelayObservation {
+
+	serviceDate := stateServiceDate(state)
+
+	observation := DelayObservation{
+		Id:             state.TripId + "/" + stopDelay.key(),
+		ServiceDate:    serviceDate.Format(feedDateLayout),
+		TripId:         state.TripId,
+		RouteId:        state.RouteId,
+		RouteNum:       state.RouteNum,
+		DirectionId:    state.DirectionId,
+		StopSequence:   stopDelay.StopSequence,
+		StopId:         stopDelay.StopId,
+		ArrivalDelay:   stopDelay.ArrivalDelay,
+		DepartureDelay: stopDelay.DepartureDelay,
+		Hour:           state.FeedTimestamp.In(dublinLocation).Hour(),
+		Weekday:        int(serviceDate.Weekday()),
+		ObservedAt:     state.FeedTimestamp,
+	}
+	if observation.DirectionId == "" {
+		observation.DirectionId = trip.Direction
+	}
+	if observation.RouteNum == "" {
+		observation.RouteNum = trip.RouteNum
+	}
+	if stopDelay.DepartureDelay != nil {
+		observation.Delay = *stopDelay.DepartureDelay
+	} else if stopDelay.ArrivalDelay != nil {
+		observation.Delay = *stopDelay.ArrivalDelay
+	}
+
+	if stop, ok := findTripStop(trip, stopDelay); ok {
+		if observation.StopId == "" {
+			observation.StopId = stop.StopId
+		}
+		if seconds, ok := parseServiceTime(stop.DepartureTime); ok {
+			observation.Scheduled = &seconds
+			observation.Hour = int(seconds/3600) % 24
+		}
+	}
+
+	return observation
+}
+
+// groupedBy reports whether the query groups by the dimension
+func (query DelayQuery) groupedBy(dimension string) bool {
+
+	for _, grouped := range query.GroupBy {
+		if grouped == dimension {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serviceDates returns each service date covered by the query, formatted as in
+// the GTFS-R feed
+func (query DelayQuery) serviceDates() []string {
+
+	var dates []string
+	for date := query.From; !date.After(query.To); date = date.AddDate(0, 0, 1) {
+		dates = append(dates, date.Format(feedDateLayout))
+	}
+
+	return dates
+}
+
+// matches reports whether the query selects the observation, leaving aside its
+// service date
+func (query DelayQuery) matches(observation DelayObservation) bool {
+
+	if query.RouteNum != "" && !strings.EqualFold(observation.RouteNum, query.RouteNum) {
+		return false
+	}
+
+	return query.StopId == "" || observation.StopId == query.StopId
+}
+
+// group returns the group of the query that the observation falls into
+func (query DelayQuery) group(observation DelayObservation) delayGroup {
+
+	return query.normaliseGroup(delayGroup{
+		RouteNum: observation.RouteNum,
+		StopId:   observation.StopId,
+		Hour:     observation.Hour,
+		Weekday:  observation.Weekday,
+	})
+}
+
+// normaliseGroup clears the dimensions of a group that the query doesn't group
+// by, so that groups read back from Mongo can be used as map keys
+func (query DelayQuery) normaliseGroup(group delayGroup) delayGroup {
+
+	if !query.groupedBy(DelayGroupRoute) {
+		group.RouteNum = ""
+	}
+	if !query.groupedBy(DelayGroupStop) {
+		group.StopId = ""
+	}
+	if !query.groupedBy(DelayGroupHour) {
+		group.Hour = -1
+	}
+	if !query.groupedBy(DelayGroupWeekday) {
+		group.Weekday = -1
+	}
+
+	return group
+}
+
+// add adds other to the totals
+func (totals *delayTotals) add(other delayTotals) {
+
+	if totals.Count == 0 || other.Min < totals.Min {
+		totals.Min = other.Min
+	}
+	if totals.Count == 0 || other.Max > totals.Max {
+		totals.Max = other.Max
+	}
+	totals.Count += other.Count
+	totals.Sum += other.Sum
+}
+
+// mergeDelayTotals adds up the totals of each group across partitions and
+// returns the aggregate of each group, sorted by route, stop, weekday and hour
+func mergeDelayTotals(query DelayQuery, partials []delayTotals) []DelayAggregate {
+
+	merged := map[delayGroup]*delayTotals{}
+	for _, partial := range partials {
+		group := query.normaliseGroup(partial.Group)
+		if merged[group] == nil {
+			merged[group] = &delayTotals{Group: group}
+		}
+		merged[group].add(partial)
+	}
+
+	groups := make([]delayGroup, 0, len(merged))
+	for group := range merged {
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		first, second := groups[i], groups[j]
+		if first.RouteNum != second.RouteNum {
+			return routeNumLess(first.RouteNum, second.RouteNum)
+		}
+		if first.StopId != second.StopId {
+			return first.StopId < second.StopId
+		}
+		if first.Weekday != second.Weekday {
+			return first.Weekday < second.Weekday
+		}
+		return first.Hour < second.Hour
+	})
+
+	aggregates := []DelayAggregate{}
+	for _, group := range groups {
+		totals := merged[group]
+		aggregate := DelayAggregate{
+			RouteNum:     group.RouteNum,
+			StopId:       group.StopId,
+			Observations: totals.Count,
+			MeanDelay:    math.Round(float64(totals.Sum)/float64(totals.Count)*10) / 10,
+			MinDelay:     totals.Min,
+			MaxDelay:     totals.Max,
+		}
+		if group.Hour >= 0 {
+			hour := group.Hour
+			aggregate.Hour = &hour
+		}
+		if group.Weekday >= 0 {
+			aggregate.Weekday = time.Weekday(group.Weekday).String()
+		}
+		aggregates = append(aggregates, aggregate)
+	}
+
+	return aggregates
+}
+
+// retainedSince returns the first service date, formatted as in the GTFS-R
+// feed, still retained at now when the given number of days are kept
+func retainedSince(now time.Time, retentionDays int) string {
+
+	serviceDate, _ := ServiceDay(now)
+	return serviceDate.AddDate(0, 0, 1-retentionDays).Format(feedDateLayout)
+}
+
+// MemoryDelayArchive is a DelayArchive keeping observations in memory, used
+// within tests and when the api runs without Mongo
+type MemoryDelayArchive struct {
+	lock           sync.RWMutex
+	retentionDays  int
+	partitions     map[string]map[string]DelayObservation
+	tripPartitions map[string]map[string]TripObservation
+}
+
+// NewMemoryDelayArchive returns an empty MemoryDelayArchive retaining the given
+// number of service days
+func NewMemoryDelayArchive(retentionDays int) *MemoryDelayArchive {
+	return &MemoryDelayArchive{
+		retentionDays:  retentionDays,
+		partitions:     map[string]map[string]DelayObservation{},
+		tripPartitions: map[string]map[string]TripObservation{},
+	}
+}
+
+// ArchiveDelays adds or replaces the observations
+func (archive *MemoryDelayArchive) ArchiveDelays(ctx context.Context, observations []DelayObservation) error {
+
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+
+	for _, observation := range observations {
+		if archive.partitions[observation.ServiceDate] == nil {
+			archive.partitions[observation.ServiceDate] = map[string]DelayObservation{}
+		}
+		archive.partitions[observation.ServiceDate][observation.Id] = observation
+	}
+
+	return nil
+}
+
+// ArchiveTrips adds or replaces the observations
+func (archive *MemoryDelayArchive) ArchiveTrips(ctx context.Context, observations []TripObservation) error {
+
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+
+	for _, observation := range observations {
+		if archive.tripPartitions[observation.ServiceDate] == nil {
+			archive.tripPartitions[observation.ServiceDate] = map[string]TripObservation{}
+		}
+		archive.tripPartitions[observation.ServiceDate][observation.Id] = observation
+	}
+
+	return nil
+}
+
+// FindDay returns the trips and delays archived for the service date, on the
+// route number if one is given, sorted by id
+func (archive *MemoryDelayArchive) FindDay(ctx context.Context, serviceDate string,
+	routeNum string) (ArchivedDay, error) {
+
+	archive.lock.RLock()
+	defer archive.lock.RUnlock()
+
+	day := ArchivedDay{ServiceDate: serviceDate, Trips: []TripObservation{}, Delays: []DelayObservation{}}
+	for _, trip := range archive.tripPartitions[serviceDate] {
+		if routeNum == "" || strings.EqualFold(trip.RouteNum, routeNum) {
+			day.Trips = append(day.Trips, trip)
+		}
+	}
+	for _, delay := range archive.partitions[serviceDate] {
+		if routeNum == "" || strings.EqualFold(delay.RouteNum, routeNum) {
+			day.Delays = append(day.Delays, delay)
+		}
+	}
+	sort.Slice(day.Trips, func(i, j int) bool { return day.Trips[i].Id < day.Trips[j].Id })
+	sort.Slice(day.Delays, func(i, j int) bool { return day.Delays[i].Id < day.Delays[j].Id })
+
+	return day, nil
+}
+
+// AggregateDelays returns the delays selected by the query, grouped and summed
+// up
+func (archive *MemoryDelayArchive) AggregateDelays(ctx context.Context, query DelayQuery) ([]DelayAggregate, error) {
+
+	archive.lock.RLock()
+	defer archive.lock.RUnlock()
+
+	var partials []delayTotals
+	for _, serviceDate := range query.serviceDates() {
+		for _, observation := range archive.partitions[serviceDate] {
+			if query.matches(observation) {
+				partials = append(partials, delayTotals{Group: query.group(observation), Count: 1,
+					Sum: int64(observation.Delay), Min: observation.Delay, Max: observation.Delay})
+			}
+		}
+	}
+
+	return mergeDelayTotals(query, partials), nil
+}
+
+// PruneDelays drops the service days that are no longer retained at now
+func (archive *MemoryDelayArchive) PruneDelays(ctx context.Context, now time.Time) (int, error) {
+
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+
+	since := retainedSince(now, archive.retentionDays)
+	dropped := 0
+	expired := map[string]bool{}
+	for serviceDate := range archive.partitions {
+		expired[serviceDate] = serviceDate < since
+	}
+	for serviceDate := range archive.tripPartitions {
+		expired[serviceDate] = serviceDate < since
+	}
+	for serviceDate, drop := range expired {
+		if drop {
+			delete(archive.partitions, serviceDate)
+			delete(archive.tripPartitions, serviceDate)
+			dropped++
+		}
+	}
+
+	return dropped, nil
+}
+
+var sharedDelayArchive DelayArchive
+var sharedDelayArchiveOnce sync.Once
+
+// delayArchive returns the DelayArchive shared by the whole package, creating
+// it from the delay archive configuration the first time it is called unless
+// SetDelayArchive has already been used to provide one
+func delayArchive() DelayArchive {
+	sharedDelayArchiveOnce.Do(func() {
+		if sharedDelayArchive == nil {
+			sharedDelayArchive = newDelayArchive(currentConfig.DelayArchive)
+		}
+	})
+	return sharedDelayArchive
+}
+
+// SetDelayArchive replaces the DelayArchive shared by the package
+func SetDelayArchive(archive DelayArchive) {
+	sharedDelayArchiveOnce.Do(func() {})
+	sharedDelayArchive = archive
+}
+
+// newDelayArchive returns the DelayArchive named by the configuration
+func newDelayArchive(archiveConfig DelayArchiveConfig) DelayArchive {
+
+	if strings.ToLower(archiveConfig.Store) == "memory" {
+		return NewMemoryDelayArchive(archiveConfig.RetentionDays)
+	}
+
+	return NewMongoDelayArchive(currentConfig.Mongo.Collections.DelayArchive, archiveConfig.RetentionDays)
+}
+
+// parseAnalyticsDates reads the service dates from the from and to query
+// parameters of a request, given as YYYY-MM-DD. The dates default to the week
+// up to the current service day, and may span at most the given number of days
+func parseAnalyticsDates(c *gin.Context, maxDays int, now time.Time) (time.Time, time.Time, error) {
+
+	to, _ := ServiceDay(now)
+	if toParameter := c.Query("to"); toParameter != "" {
+		parsed, err := time.ParseInLocation(analyticsDateLayout, toParameter, dublinLocation)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid to date, expected YYYY-MM-DD")
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -6)
+	if fromParameter := c.Query("from"); fromParameter != "" {
+		parsed, err := time.ParseInLocation(analyticsDateLayout, fromParameter, dublinLocation)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("invalid from date, expected YYYY-MM-DD")
+		}
+		from = parsed
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, errors.New("from date is after the to date")
+	}
+	if len(DelayQuery{From: from, To: to}.serviceDates()) > maxDays {
+		return time.Time{}, time.Time{}, errors.New("dates span more than the most days allowed")
+	}
+
+	return from, to, nil
+}
+
+// parseDelayQuery reads a DelayQuery from the query parameters of a request,
+// with the dates read by parseAnalyticsDates
+func parseDelayQuery(c *gin.Context, maxDays int, now time.Time) (DelayQuery, error) {
+
+	query := DelayQuery{
+		RouteNum: strings.TrimSpace(c.Query("route")),
+		StopId:   strings.TrimSpace(c.Query("stop")),
+		GroupBy:  []string{DelayGroupRoute},
+	}
+
+	var err error
+	if query.From, query.To, err = parseAnalyticsDates(c, maxDays, now); err != nil {
+		return query, err
+	}
+
+	if groupBy := c.Query("group_by"); groupBy != "" {
+		query.GroupBy = nil
+		for _, dimension := range strings.Split(groupBy, ",") {
+			dimension = strings.ToLower(strings.TrimSpace(dimension))
+			switch dimension {
+			case DelayGroupRoute, DelayGroupStop, DelayGroupHour, DelayGroupWeekday:
+				query.GroupBy = append(query.GroupBy, dimension)
+			default:
+				return query, errors.New("unknown group_by dimension '" + dimension + "'")
+			}
+		}
+	}
+
+	return query, nil
+}
+
+// delayAggregatesTable lays out the aggregates as a CSV file, leaving out the
+// dimensions that weren't grouped by
+func delayAggregatesTable(query DelayQuery, aggregates []DelayAggregate) csvTable {
+
+	table := csvTable{rows: [][]string{}}
+	for _, dimension := range []string{DelayGroupRoute, DelayGroupStop, DelayGroupWeekday, DelayGroupHour} {
+		if query.groupedBy(dimension) {
+			table.header = append(table.header, dimension)
+		}
+	}
+	table.header = append(table.header, "observations", "mean_delay", "min_delay", "max_delay")
+
+	for _, aggregate := range aggregates {
+		var row []string
+		if query.groupedBy(DelayGroupRoute) {
+			row = append(row, aggregate.RouteNum)
+		}
+		if query.groupedBy(DelayGroupStop) {
+			row = append(row, aggregate.StopId)
+		}
+		if query.groupedBy(DelayGroupWeekday) {
+			row = append(row, aggregate.Weekday)
+		}
+		if query.groupedBy(DelayGroupHour) {
+			row = append(row, strconv.Itoa(*aggregate.Hour))
+		}
+		row = append(row, strconv.Itoa(aggregate.Observations), formatCSVFloat(aggregate.MeanDelay),
+			strconv.Itoa(aggregate.MinDelay), strconv.Itoa(aggregate.MaxDelay))
+		table.rows = append(table.rows, row)
+	}
+
+	return table
+}
+
+// GetDelayAnalytics returns the archived delays between the from and to service
+// dates, given as YYYY-MM-DD, grouped by the comma separated dimensions in the
+// group_by query parameter (route, stop, hour and weekday) and optionally
+// narrowed down to a route number and stop id. They are returned as CSV when
+// the format query parameter or the Accept header asks for it
+func GetDelayAnalytics(c *gin.Context) {
+
+	format, err := negotiateAnalyticsFormat(c.Query("format"), c.GetHeader("Accept"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	query, err := parseDelayQuery(c, currentConfig.DelayArchive.MaxQueryDays, time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid delay query: "+err.Error())
+		return
+	}
+
+	aggregates, err := delayArchive().AggregateDelays(c.Request.Context(), query)
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not aggregate archived delays", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Delays could not be aggregated")
+		return
+	}
+
+	writeAnalytics(c, format, "delays", aggregates, delayAggregatesTable(query, aggregates))
+}
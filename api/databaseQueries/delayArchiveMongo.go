@@ -0,0 +1,267 @@
+package databaseQueries
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDelayArchive is a DelayArchive keeping the observations of each service
+// day in their own Mongo collections, named after the prefix and the service
+// date, e.g. delayArchive_20220615 for the delays and delayArchive_trips_20220615
+// for the trips. Expired days are dropped a collection at a time rather than
+// deleted document by document
+type MongoDelayArchive struct {
+	prefix        string
+	retentionDays int
+}
+
+// NewMongoDelayArchive returns a MongoDelayArchive using collections named
+// after the prefix and retaining the given number of service days
+func NewMongoDelayArchive(prefix string, retentionDays int) *MongoDelayArchive {
+	return &MongoDelayArchive{prefix: prefix, retentionDays: retentionDays}
+}
+
+// partition returns the name of the collection holding the delays of a service
+// date
+func (archive *MongoDelayArchive) partition(serviceDate string) string {
+	return archive.prefix + "_" + serviceDate
+}
+
+// tripPartition returns the name of the collection holding the trips of a
+// service date
+func (archive *MongoDelayArchive) tripPartition(serviceDate string) string {
+	return archive.prefix + "_trips_" + serviceDate
+}
+
+// partitionPattern returns the regular expression matching the names of the
+// partitions, with the prefix matched literally
+func (archive *MongoDelayArchive) partitionPattern() string {
+	return "^" + regexp.QuoteMeta(archive.prefix) + "_(trips_)?[0-9]{8}$"
+}
+
+// partitions returns the service date of every partition stored, with each
+// date given once even where both its delays and trips are stored
+func (archive *MongoDelayArchive) partitions(ctx context.Context, database *mongo.Database) ([]string, error) {
+
+	names, err := database.ListCollectionNames(ctx, bson.D{{Key: "name", Value: bson.D{
+		{Key: "$regex", Value: archive.partitionPattern()},
+	}}})
+	if err != nil {
+		return nil, err
+	}
+
+	var serviceDates []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		serviceDate := name[len(name)-len(feedDateLayout):]
+		if !seen[serviceDate] {
+			seen[serviceDate] = true
+			serviceDates = append(serviceDates, serviceDate)
+		}
+	}
+
+	return serviceDates, nil
+}
+
+// archivedDocument is an observation stored in the partition of its service
+// day, replacing the document with the same id
+type archivedDocument interface {
+	DelayObservation | TripObservation
+	archiveKey() (string, string)
+}
+
+// archiveKey returns the id and service date of the delay observation
+func (observation DelayObservation) archiveKey() (string, string) {
+	return observation.Id, observation.ServiceDate
+}
+
+// archiveKey returns the id and service date of the trip observation
+func (observation TripObservation) archiveKey() (string, string) {
+	return observation.Id, observation.ServiceDate
+}
+
+// ArchiveDelays replaces the document of each observation in the partition of
+// its service day, inserting those not yet stored
+func (archive *MongoDelayArchive) ArchiveDelays(requestCtx context.Context, observations []DelayObservation) error {
+	return archiveDocuments(requestCtx, archive, observations, archive.partition)
+}
+
+// ArchiveTrips replaces the document of each observation in the trip partition
+// of its service day, inserting those not yet stored
+func (archive *MongoDelayArchive) ArchiveTrips(requestCtx context.Context, observations []TripObservation) error {
+	return archiveDocuments(requestCtx, archive, observations, archive.tripPartition)
+}
+
+// archiveDocuments replaces each document in the collection named by partition
+// for its service date, inserting those not yet stored, with one unordered bulk
+// write for each service date
+func archiveDocuments[T archivedDocument](requestCtx context.Context, archive *MongoDelayArchive, documents []T,
+	partition func(string) string) error {
+
+	if len(documents) == 0 {
+		return nil
+	}
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, archive.prefix)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	writes := map[string][]mongo.WriteModel{}
+	for _, document := range documents {
+		id, serviceDate := document.archiveKey()
+		writes[serviceDate] = append(writes[serviceDate], mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: id}}).
+			SetReplacement(document).
+			SetUpsert(true))
+	}
+	for serviceDate, partitionWrites := range writes {
+		_, err = collection.Database().Collection(partition(serviceDate)).
+			BulkWrite(ctx, partitionWrites, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// FindDay returns the trips and delays archived for the service date, on the
+// route number if one is given, sorted by id
+func (archive *MongoDelayArchive) FindDay(requestCtx context.Context, serviceDate string,
+	routeNum string) (ArchivedDay, error) {
+
+	day := ArchivedDay{ServiceDate: serviceDate, Trips: []TripObservation{}, Delays: []DelayObservation{}}
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, archive.prefix)
+	if err != nil {
+		return day, err
+	}
+	defer disconnect()
+
+	filter := bson.D{}
+	if routeNum != "" {
+		filter = append(filter, bson.E{Key: "route_num", Value: strings.ToUpper(routeNum)})
+	}
+	sortById := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+
+	cursor, err := collection.Database().Collection(archive.tripPartition(serviceDate)).Find(ctx, filter, sortById)
+	if err != nil {
+		return day, err
+	}
+	if err = cursor.All(ctx, &day.Trips); err != nil {
+		return day, err
+	}
+
+	cursor, err = collection.Database().Collection(archive.partition(serviceDate)).Find(ctx, filter, sortById)
+	if err != nil {
+		return day, err
+	}
+	err = cursor.All(ctx, &day.Delays)
+
+	return day, err
+}
+
+// AggregateDelays groups and sums up the selected delays in each partition
+// covered by the query before adding the totals together
+func (archive *MongoDelayArchive) AggregateDelays(requestCtx context.Context,
+	query DelayQuery) ([]DelayAggregate, error) {
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, archive.prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	stored, err := archive.partitions(ctx, collection.Database())
+	if err != nil {
+		return nil, err
+	}
+	storedDates := map[string]bool{}
+	for _, serviceDate := range stored {
+		storedDates[serviceDate] = true
+	}
+
+	match := bson.D{}
+	if query.RouteNum != "" {
+		match = append(match, bson.E{Key: "route_num", Value: strings.ToUpper(query.RouteNum)})
+	}
+	if query.StopId != "" {
+		match = append(match, bson.E{Key: "stop_id", Value: query.StopId})
+	}
+	group := bson.D{}
+	for dimension, field := range map[string]string{DelayGroupRoute: "route_num", DelayGroupStop: "stop_id",
+		DelayGroupHour: "hour", DelayGroupWeekday: "weekday"} {
+		if query.groupedBy(dimension) {
+			group = append(group, bson.E{Key: field, Value: "$" + field})
+		}
+	}
+	pipeline := bson.A{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: group},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "sum", Value: bson.D{{Key: "$sum", Value: "$delay"}}},
+			{Key: "min", Value: bson.D{{Key: "$min", Value: "$delay"}}},
+			{Key: "max", Value: bson.D{{Key: "$max", Value: "$delay"}}},
+		}}},
+	}
+
+	var partials []delayTotals
+	for _, serviceDate := range query.serviceDates() {
+		if !storedDates[serviceDate] {
+			continue
+		}
+		cursor, err := collection.Database().Collection(archive.partition(serviceDate)).Aggregate(ctx, pipeline)
+		if err != nil {
+			return nil, err
+		}
+		var partitionTotals []delayTotals
+		if err = cursor.All(ctx, &partitionTotals); err != nil {
+			return nil, err
+		}
+		partials = append(partials, partitionTotals...)
+	}
+
+	return mergeDelayTotals(query, partials), nil
+}
+
+// PruneDelays drops the delay and trip partitions of the service days no longer
+// retained
+func (archive *MongoDelayArchive) PruneDelays(requestCtx context.Context, now time.Time) (int, error) {
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, archive.prefix)
+	if err != nil {
+		return 0, err
+	}
+	defer disconnect()
+
+	stored, err := archive.partitions(ctx, collection.Database())
+	if err != nil {
+		return 0, err
+	}
+
+	since := retainedSince(now, archive.retentionDays)
+	dropped := 0
+	for _, serviceDate := range stored {
+		if serviceDate >= since {
+			continue
+		}
+		if err = collection.Database().Collection(archive.partition(serviceDate)).Drop(ctx); err != nil {
+			return dropped, err
+		}
+		if err = collection.Database().Collection(archive.tripPartition(serviceDate)).Drop(ctx); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+
+	return dropped, nil
+}
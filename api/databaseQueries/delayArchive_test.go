@@ -0,0 +1,193 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testDelayObservations returns delays for two routes on two service days,
+// with one stop of route 46A observed twice on the first day
+func testDelayObservations() []DelayObservation {
+
+	return []DelayObservation{
+		{Id: "trip-46/1", ServiceDate: "20220615", RouteNum: "46A", StopId: "stop-1", Delay: 60, Hour: 8, Weekday: 3},
+		{Id: "trip-46/2", ServiceDate: "20220615", RouteNum: "46A", StopId: "stop-2", Delay: 120, Hour: 8, Weekday: 3},
+		{Id: "trip-46/2", ServiceDate: "20220615", RouteNum: "46A", StopId: "stop-2", Delay: 180, Hour: 9, Weekday: 3},
+		{Id: "trip-39/1", ServiceDate: "20220615", RouteNum: "39A", StopId: "stop-1", Delay: -30, Hour: 8, Weekday: 3},
+		{Id: "trip-46/1", ServiceDate: "20220616", RouteNum: "46A", StopId: "stop-1", Delay: 300, Hour: 8, Weekday: 4},
+	}
+}
+
+func TestMemoryDelayArchiveAggregatesByRoute(t *testing.T) {
+
+	archive := NewMemoryDelayArchive(36500)
+	archive.ArchiveDelays(context.Background(), testDelayObservations())
+
+	delays, err := archive.AggregateDelays(context.Background(), DelayQuery{
+		From:    time.Date(2022, 6, 15, 0, 0, 0, 0, dublinLocation),
+		To:      time.Date(2022, 6, 16, 0, 0, 0, 0, dublinLocation),
+		GroupBy: []string{DelayGroupRoute},
+	})
+	if err != nil || len(delays) != 2 {
+		t.Log("Expected a group for each route, got", delays, err)
+		t.FailNow()
+	}
+
+	// The repeated observation replaces the first, so 46A has three delays
+	if delays[0].RouteNum != "39A" || delays[1].RouteNum != "46A" || delays[1].Observations != 3 ||
+		delays[1].MeanDelay != 180 || delays[1].MinDelay != 60 || delays[1].MaxDelay != 300 {
+		t.Log("Expected the delays of each route to be summed up, got", delays)
+		t.Fail()
+	}
+}
+
+func TestMemoryDelayArchiveAggregatesByHourAndWeekday(t *testing.T) {
+
+	archive := NewMemoryDelayArchive(36500)
+	archive.ArchiveDelays(context.Background(), testDelayObservations())
+
+	delays, _ := archive.AggregateDelays(context.Background(), DelayQuery{
+		From:     time.Date(2022, 6, 15, 0, 0, 0, 0, dublinLocation),
+		To:       time.Date(2022, 6, 16, 0, 0, 0, 0, dublinLocation),
+		RouteNum: "46a",
+		GroupBy:  []string{DelayGroupWeekday, DelayGroupHour},
+	})
+	if len(delays) != 3 || delays[0].Weekday != "Wednesday" || *delays[0].Hour != 8 || delays[0].RouteNum != "" ||
+		*delays[1].Hour != 9 || delays[2].Weekday != "Thursday" {
+		t.Log("Expected the delays of 46A by weekday and hour, got", delays)
+		t.Fail()
+	}
+}
+
+func TestMemoryDelayArchivePrunesExpiredDays(t *testing.T) {
+
+	archive := NewMemoryDelayArchive(1)
+	archive.ArchiveDelays(context.Background(), testDelayObservations())
+
+	dropped, _ := archive.PruneDelays(context.Background(), time.Date(2022, 6, 16, 12, 0, 0, 0, dublinLocation))
+	day := time.Date(2022, 6, 15, 0, 0, 0, 0, dublinLocation)
+	delays, _ := archive.AggregateDelays(context.Background(), DelayQuery{From: day, To: day.AddDate(0, 0, 1)})
+	if dropped != 1 || len(delays) != 1 || delays[0].Observations != 1 {
+		t.Log("Expected only the last service day to be retained, got", dropped, delays)
+		t.Fail()
+	}
+}
+
+func TestNewDelayObservation(t *testing.T) {
+
+	arrival, departure, sequence := 60, 90, 4
+	state := TripState{TripId: "trip-46", RouteNum: "46A", StartDate: "20220615",
+		FeedTimestamp: time.Date(2022, 6, 16, 0, 30, 0, 0, dublinLocation)}
+
+	stopDelay := StopDelay{StopSequence: &sequence, ArrivalDelay: &arrival, DepartureDelay: &departure}
+
+	observation := newDelayObservation(state, stopDelay, tripStops{})
+	if observation.Id != "trip-46/4" || observation.ServiceDate != "20220615" || observation.Delay != departure ||
+		observation.Hour != 0 || observation.Weekday != int(time.Wednesday) || observation.Scheduled != nil {
+		t.Log("Expected an observation on the service day the trip started, got", observation)
+		t.Fail()
+	}
+
+	trip := tripStops{TripId: "trip-46", RouteNum: "46A", Direction: "1", Stops: []BusStop{
+		{StopId: "stop-4", StopSequence: "4", DepartureTime: "23:55:00"},
+	}}
+	observation = newDelayObservation(state, stopDelay, trip)
+	if observation.StopId != "stop-4" || observation.DirectionId != "1" || observation.Scheduled == nil ||
+		*observation.Scheduled != 86100 || observation.Hour != 23 {
+		t.Log("Expected the scheduled departure to be taken from the timetable, got", observation)
+		t.Fail()
+	}
+}
+
+func TestNewTripObservation(t *testing.T) {
+
+	state := TripState{TripId: "trip-46", RouteNum: "46A", StartDate: "20220615",
+		ScheduleRelationship: "CANCELED", FeedTimestamp: time.Date(2022, 6, 15, 9, 0, 0, 0, dublinLocation)}
+	trip := tripStops{TripId: "trip-46", Direction: "0", Stops: []BusStop{
+		{StopId: "stop-2", StopSequence: "2", DepartureTime: "08:10:00"},
+		{StopId: "stop-1", StopSequence: "1", DepartureTime: "08:00:00"},
+	}}
+
+	observation := newTripObservation(state, trip)
+	if observation.Id != "trip-46" || observation.ServiceDate != "20220615" || observation.DirectionId != "0" ||
+		observation.ScheduledStart == nil || *observation.ScheduledStart != 8*3600 {
+		t.Log("Expected the trip to start at its first stop in the timetable, got", observation)
+		t.Fail()
+	}
+
+	state.StartTime = "25:30:00"
+	if observation = newTripObservation(state, trip); *observation.ScheduledStart != 25*3600+1800 {
+		t.Log("Expected the start time in the feed to be used, got", observation)
+		t.Fail()
+	}
+}
+
+func TestMemoryDelayArchiveFindsDay(t *testing.T) {
+
+	archive := NewMemoryDelayArchive(36500)
+	archive.ArchiveDelays(context.Background(), testDelayObservations())
+	archive.ArchiveTrips(context.Background(), []TripObservation{
+		{Id: "trip-46", ServiceDate: "20220615", RouteNum: "46A", ScheduleRelationship: "SCHEDULED"},
+		{Id: "trip-39", ServiceDate: "20220615", RouteNum: "39A", ScheduleRelationship: "CANCELED"},
+	})
+
+	day, err := archive.FindDay(context.Background(), "20220615", "46a")
+	if err != nil || len(day.Trips) != 1 || day.Trips[0].Id != "trip-46" || len(day.Delays) != 2 {
+		t.Log("Expected the trips and delays of 46A on the day, got", day, err)
+		t.Fail()
+	}
+}
+
+func TestParseDelayQuery(t *testing.T) {
+
+	now := time.Date(2022, 6, 15, 12, 0, 0, 0, dublinLocation)
+	for target, valid := range map[string]bool{
+		"/analytics/delays": true,
+		"/analytics/delays?from=2022-06-01&to=2022-06-10":         true,
+		"/analytics/delays?group_by=stop,hour":                    true,
+		"/analytics/delays?from=2022-06-10&to=2022-06-01":         false,
+		"/analytics/delays?from=2022-01-01&to=2022-06-10":         false,
+		"/analytics/delays?from=June":                             false,
+		"/analytics/delays?group_by=route,minute":                 false,
+		"/analytics/delays?from=2022-06-01&to=2022-06-01&stop=x1": true,
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", target, nil)
+
+		query, err := parseDelayQuery(c, 31, now)
+		if (err == nil) != valid {
+			t.Log("Unexpected result for", target, query, err)
+			t.Fail()
+		}
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/analytics/delays", nil)
+	query, _ := parseDelayQuery(c, 31, now)
+	if len(query.serviceDates()) != 7 || query.serviceDates()[6] != "20220615" || !query.groupedBy(DelayGroupRoute) {
+		t.Log("Expected the week up to today grouped by route by default, got", query)
+		t.Fail()
+	}
+}
+
+func TestMongoDelayArchivePartitionPattern(t *testing.T) {
+
+	archive := NewMongoDelayArchive("delay.archive", 30)
+	pattern := regexp.MustCompile(archive.partitionPattern())
+	for name, matches := range map[string]bool{
+		archive.partition("20220615"):     true,
+		archive.tripPartition("20220615"): true,
+		"delayXarchive_20220615":          false,
+		"delay.archive_2022061":           false,
+	} {
+		if pattern.MatchString(name) != matches {
+			t.Log("Expected", name, "to be matched", matches)
+			t.Fail()
+		}
+	}
+}
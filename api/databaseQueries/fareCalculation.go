@@ -3,7 +3,6 @@ package databaseQueries
 import "strconv"
 
 // Declare initial variables to be used during function call
-var express bool
 var XpressRoutes = []string{"27x", "33d", "33x", "39x", "41x",
 	"51x", "51d", "51x", "69x", "77x", "84x"}
 
@@ -42,12 +41,31 @@ func CalculateFare(route busRoute,
 	// this function
 	var originDist float64
 	var destDist float64
+
+	// The distance between the two stops is compared against the short zone
+	// limiter, unless the route is an express route
+	for _, stopCounter := range route.Stops {
+		if stopCounter.StopNumber == originStop {
+			originDist, _ = strconv.ParseFloat(stopCounter.DistanceTravelled, 64)
+		} else if stopCounter.StopNumber == destinationStop {
+			destDist, _ = strconv.ParseFloat(stopCounter.DistanceTravelled, 64)
+		}
+	}
+
+	return fareForDistance(string(route.Id), destDist-originDist)
+}
+
+// fareForDistance returns the fares of a ride of the given metres on the route,
+// which are those of an Xpresso route or of the short or long zone
+func fareForDistance(routeNum string, metres float64) busFares {
+
 	var calculatedFares busFares
 
-	// Boolean condition defaults to false unless determined otherwise
-	express = false
-	for _, routeNum := range XpressRoutes {
-		if string(route.Id) == routeNum {
+	// Boolean condition defaults to false unless determined otherwise. It is
+	// kept local so that fares can be worked out from several goroutines at once
+	express := false
+	for _, xpressRoute := range XpressRoutes {
+		if routeNum == xpressRoute {
 			express = true
 		}
 	}
@@ -62,23 +80,10 @@ func CalculateFare(route busRoute,
 		return calculatedFares
 	} else {
 
-		// If route was not express, the distance between two stops must be
-		// calculated and compared against the short zone limiter
-
-		for _, stopCounter := range route.Stops {
-			if stopCounter.StopNumber == originStop {
-				originDist, _ = strconv.ParseFloat(stopCounter.DistanceTravelled, 64)
-			} else if stopCounter.StopNumber == destinationStop {
-				destDist, _ = strconv.ParseFloat(stopCounter.DistanceTravelled, 64)
-			}
-		}
-
-		totalDist := destDist - originDist
-
 		// Use comparison of distance travelled against the short zone
 		// limit to determine the appropriate fares and return
 
-		if totalDist < ShortZoneDistance {
+		if metres < ShortZoneDistance {
 			calculatedFares.AdultLeap = ShortZoneAdultLeap
 			calculatedFares.AdultCash = ShortZoneAdultCash
 			calculatedFares.StudentLeap = ShortZoneStudentLeap
@@ -95,3 +100,15 @@ func CalculateFare(route busRoute,
 		}
 	}
 }
+
+// addFares returns the sum of two fares, as paid for a journey taking two buses
+func addFares(fares busFares, other busFares) busFares {
+
+	return busFares{
+		AdultLeap:   fares.AdultLeap + other.AdultLeap,
+		AdultCash:   fares.AdultCash + other.AdultCash,
+		StudentLeap: fares.StudentLeap + other.StudentLeap,
+		ChildLeap:   fares.ChildLeap + other.ChildLeap,
+		ChildCash:   fares.ChildCash + other.ChildCash,
+	}
+}
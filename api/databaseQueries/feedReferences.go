@@ -0,0 +1,108 @@
+package databaseQueries
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// feedReferences holds the route numbers that the route ids and trip ids of a
+// GTFS-R feed resolve to and the stop numbers that its stop ids resolve to
+type feedReferences struct {
+	RouteNums     map[string]string
+	TripRouteNums map[string]string
+	StopNumbers   map[string]string
+}
+
+// feedReferenceResolver is the signature of FindFeedReferences, which
+// resolveFeedReferences is set to outside of tests
+type feedReferenceResolver func(ctx context.Context, routeIds []string, tripIds []string,
+	stopIds []string) (feedReferences, error)
+
+var resolveFeedReferences feedReferenceResolver = FindFeedReferences
+
+// routeNumFromRouteId returns the route number within a Dublin Bus route id of
+// the form "60-46A-b12-1", or an empty string for any other form of id
+func routeNumFromRouteId(routeId string) string {
+
+	parts := strings.Split(routeId, "-")
+	if len(parts) != 4 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// FindFeedReferences takes in the context of the request and the route ids,
+// trip ids and stop ids given in a GTFS-R feed and returns the route and stop
+// numbers they resolve to in the timetable and stops collections
+func FindFeedReferences(requestCtx context.Context, routeIds []string, tripIds []string,
+	stopIds []string) (feedReferences, error) {
+
+	references := feedReferences{
+		RouteNums:     map[string]string{},
+		TripRouteNums: map[string]string{},
+		StopNumbers:   map[string]string{},
+	}
+
+	if len(routeIds) > 0 || len(tripIds) > 0 {
+		collection, ctx, disconnect, err := openTimetable(requestCtx)
+		if err != nil {
+			return references, err
+		}
+		defer disconnect()
+
+		cursor, err := collection.Aggregate(ctx, bson.A{
+			bson.D{{Key: "$match", Value: bson.D{{Key: "$or", Value: bson.A{
+				bson.D{{Key: "route.route_id", Value: bson.D{{Key: "$in", Value: routeIds}}}},
+				bson.D{{Key: "trip_id", Value: bson.D{{Key: "$in", Value: tripIds}}}},
+			}}}}},
+			bson.D{{Key: "$project", Value: bson.D{
+				{Key: "_id", Value: 0},
+				{Key: "route_id", Value: "$route.route_id"},
+				{Key: "route_num", Value: "$route.route_short_name"},
+				{Key: "trip_id", Value: 1},
+			}}},
+		})
+		if err != nil {
+			return references, err
+		}
+
+		var trips []struct {
+			RouteId  string `bson:"route_id"`
+			RouteNum string `bson:"route_num"`
+			TripId   string `bson:"trip_id"`
+		}
+		if err = cursor.All(ctx, &trips); err != nil {
+			return references, err
+		}
+		for _, trip := range trips {
+			references.RouteNums[trip.RouteId] = trip.RouteNum
+			references.TripRouteNums[trip.TripId] = trip.RouteNum
+		}
+	}
+
+	if len(stopIds) > 0 {
+		collection, ctx, disconnect, err := openCollection(requestCtx, currentConfig.Mongo.Collections.Stops)
+		if err != nil {
+			return references, err
+		}
+		defer disconnect()
+
+		cursor, err := collection.Find(ctx, bson.D{{Key: "stop_id", Value: bson.D{{Key: "$in", Value: stopIds}}}})
+		if err != nil {
+			return references, err
+		}
+
+		var stops []GeolocatedStop
+		if err = cursor.All(ctx, &stops); err != nil {
+			return references, err
+		}
+		for _, stop := range stops {
+			references.StopNumbers[stop.StopId] = stop.StopNumber
+		}
+	}
+
+	return references, nil
+}
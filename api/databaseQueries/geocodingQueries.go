@@ -5,9 +5,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 	"googlemaps.github.io/maps"
-	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -42,25 +40,34 @@ func GetCoordinates(stopSearch string) (Lat float64, Lon float64) {
 
 	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
 
-	client, err := maps.NewClient(maps.WithAPIKey(os.Getenv("MAPS_API_KEY")))
+	client, err := maps.NewClient(maps.WithAPIKey(currentConfig.Geocoder.APIKey))
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("could not create geocoding client", "error", err)
+		geocoderCalls.WithLabelValues("error").Inc()
+		return 0, 0
 	}
 
 	// The geocoding process is done entirely externally and only providing the
 	// necessary variables is of concern with this function call
 
-	geo := &maps.GeocodingRequest{Address: stopSearch, Bounds: &DublinMapBounds, Region: "ie"}
+	geo := &maps.GeocodingRequest{Address: stopSearch, Bounds: &DublinMapBounds, Region: currentConfig.Geocoder.Region}
 
-	result, _ := client.Geocode(ctx, geo)
+	result, err := client.Geocode(ctx, geo)
+	if err != nil {
+		defaultLogger.Warn("geocoding request failed", "error", err)
+		geocoderCalls.WithLabelValues("error").Inc()
+		return 0, 0
+	}
 
 	// This is a very simple check to make sure that some kind of response was
 	// returned. The geocoding request always returns an array with either nothing
 	// in it (meaning that an address couldn't be geocoded) or an array with one
 	// element with the geocoding information contained within
 	if len(result) < 1 {
+		geocoderCalls.WithLabelValues("no_result").Inc()
 		return 0, 0
 	}
+	geocoderCalls.WithLabelValues("success").Inc()
 
 	queryLat := result[0].Geometry.Location.Lat
 	queryLon := result[0].Geometry.Location.Lng
@@ -93,7 +100,7 @@ func FindNearbyStops(stopSearch string) []StopWithCoordinates {
 	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
 	err = client.Connect(ctx)
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("could not connect to Mongo", "error", err)
 	}
 	defer client.Disconnect(ctx) // defer has rest of function complete before this disconnect
 
@@ -101,12 +108,12 @@ func FindNearbyStops(stopSearch string) []StopWithCoordinates {
 	var currentStop BusStop
 	var currentStopWithCoordinates StopWithCoordinates
 
-	dbPointer := client.Database("BusData")
-	collectionPointer := dbPointer.Collection("stops")
+	dbPointer := client.Database(currentConfig.Mongo.Database)
+	collectionPointer := dbPointer.Collection(currentConfig.Mongo.Collections.Stops)
 
 	stops, err := collectionPointer.Find(ctx, bson.D{{}})
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("stops query failed", "error", err)
 	}
 
 	// The coordinates from the database are read in a string
@@ -141,6 +148,15 @@ func FindNearbyStops(stopSearch string) []StopWithCoordinates {
 // all the bus stops within a half mile of that location
 func FindNearbyStopsV2(stopCoordinates maps.LatLng) []StopWithCoordinates {
 
+	// The stops near a location only change when the timetable is re-imported,
+	// so the result for a location is cached against the timetable generation
+	var matchingStops []StopWithCoordinates
+	cacheKey := resultCache().TimetableKey(strconv.FormatFloat(stopCoordinates.Lat, 'f', 5, 64),
+		strconv.FormatFloat(stopCoordinates.Lng, 'f', 5, 64))
+	if resultCache().GetJSON(cacheKindNearbyStops, cacheKey, &matchingStops) {
+		return matchingStops
+	}
+
 	halfMileAdjustment := 0.008
 
 	minLat := stopCoordinates.Lat - halfMileAdjustment
@@ -174,20 +190,20 @@ func FindNearbyStopsV2(stopCoordinates maps.LatLng) []StopWithCoordinates {
 	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
 	err = client.Connect(ctx)
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("could not connect to Mongo", "error", err)
 	}
 	defer client.Disconnect(ctx) // defer has rest of function complete before this disconnect
 
-	var matchingStops []StopWithCoordinates
 	var currentStop GeolocatedStop
 	var currentStopWithCoordinates StopWithCoordinates
 
-	dbPointer := client.Database("BusData")
-	collectionPointer := dbPointer.Collection("stops")
+	dbPointer := client.Database(currentConfig.Mongo.Database)
+	collectionPointer := dbPointer.Collection(currentConfig.Mongo.Collections.Stops)
 
 	stops, err := collectionPointer.Find(ctx, stopsFilter)
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("stops query failed", "error", err)
+		return matchingStops
 	}
 
 	// The coordinates from the database are read in a string
@@ -195,9 +211,12 @@ func FindNearbyStopsV2(stopCoordinates maps.LatLng) []StopWithCoordinates {
 	// into floats, so they have to be read in as a BusStop before
 	// being read in as a StopWithCoordinates
 	for stops.Next(ctx) {
+		// Fields left out of a stop, such as wheelchair_boarding, mustn't be
+		// carried over from the stop before it
+		currentStop = GeolocatedStop{}
 		err = stops.Decode(&currentStop)
 		if err != nil {
-			log.Println(err)
+			defaultLogger.Error("could not decode stop", "error", err)
 		}
 		currentLat, _ := strconv.ParseFloat(currentStop.StopLat, 64)
 		currentLon, _ := strconv.ParseFloat(currentStop.StopLon, 64)
@@ -206,9 +225,12 @@ func FindNearbyStopsV2(stopCoordinates maps.LatLng) []StopWithCoordinates {
 		currentStopWithCoordinates.StopName = currentStop.StopName
 		currentStopWithCoordinates.StopLat = currentLat
 		currentStopWithCoordinates.StopLon = currentLon
+		currentStopWithCoordinates.WheelchairBoarding = stopWheelchairBoarding(currentStop.StopId,
+			currentStop.StopNumber, currentStop.WheelchairBoarding)
 		matchingStops = append(matchingStops, currentStopWithCoordinates)
 	}
 
+	resultCache().SetJSON(cacheKindNearbyStops, cacheKey, matchingStops, NearbyStopsCacheTTL)
 	return matchingStops
 }
 
@@ -266,7 +288,7 @@ func FindNearbyStopsAPI(c *gin.Context) {
 	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
 	err = client.Connect(ctx)
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("could not connect to Mongo", "error", err)
 	}
 	defer client.Disconnect(ctx) // defer has rest of function complete before this disconnect
 
@@ -274,12 +296,12 @@ func FindNearbyStopsAPI(c *gin.Context) {
 	var currentStop GeolocatedStop
 	var currentStopWithCoordinates StopWithCoordinates
 
-	dbPointer := client.Database("BusData")
-	collectionPointer := dbPointer.Collection("stops")
+	dbPointer := client.Database(currentConfig.Mongo.Database)
+	collectionPointer := dbPointer.Collection(currentConfig.Mongo.Collections.Stops)
 
 	stops, err := collectionPointer.Find(ctx, stopsFilter)
 	if err != nil {
-		log.Print(err)
+		defaultLogger.Error("stops query failed", "error", err)
 	}
 
 	// The coordinates from the database are read in a string
@@ -287,9 +309,12 @@ func FindNearbyStopsAPI(c *gin.Context) {
 	// into floats, so they have to be read in as a BusStop before
 	// being read in as a StopWithCoordinates
 	for stops.Next(ctx) {
+		// Fields left out of a stop, such as wheelchair_boarding, mustn't be
+		// carried over from the stop before it
+		currentStop = GeolocatedStop{}
 		err = stops.Decode(&currentStop)
 		if err != nil {
-			log.Println(err)
+			defaultLogger.Error("could not decode stop", "error", err)
 		}
 		currentLat, _ := strconv.ParseFloat(currentStop.StopLat, 64)
 		currentLon, _ := strconv.ParseFloat(currentStop.StopLon, 64)
@@ -298,6 +323,8 @@ func FindNearbyStopsAPI(c *gin.Context) {
 		currentStopWithCoordinates.StopName = currentStop.StopName
 		currentStopWithCoordinates.StopLat = currentLat
 		currentStopWithCoordinates.StopLon = currentLon
+		currentStopWithCoordinates.WheelchairBoarding = stopWheelchairBoarding(currentStop.StopId,
+			currentStop.StopNumber, currentStop.WheelchairBoarding)
 		matchingStops = append(matchingStops, currentStopWithCoordinates)
 	}
 
@@ -0,0 +1,192 @@
+package databaseQueries
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FeedMessage is a GTFS-R feed as served in JSON by the NTA, whose field names
+// are capitalised ("Header", "Entity" and so on). Field names are matched
+// without regard to case, so feeds with the lower case protobuf JSON names
+// decode as well
+type FeedMessage struct {
+	Header FeedHeader   `json:"Header"`
+	Entity []FeedEntity `json:"Entity"`
+}
+
+// FeedHeader is the header of a GTFS-R feed
+type FeedHeader struct {
+	GtfsRealtimeVersion string   `json:"GtfsRealtimeVersion"`
+	Incrementality      string   `json:"Incrementality"`
+	Timestamp           FeedTime `json:"Timestamp"`
+}
+
+// FeedEntity is a single entity of a GTFS-R feed, holding one of a trip update,
+// vehicle position or alert
+type FeedEntity struct {
+	Id         string               `json:"Id"`
+	IsDeleted  bool                 `json:"IsDeleted"`
+	TripUpdate *FeedTripUpdate      `json:"TripUpdate,omitempty"`
+	Vehicle    *FeedVehiclePosition `json:"Vehicle,omitempty"`
+	Alert      *FeedAlert           `json:"Alert,omitempty"`
+}
+
+// FeedTripUpdate is a GTFS-R trip update with the delays at the stops of the
+// trip. A delay is taken to carry on to the stops after it until another is given
+type FeedTripUpdate struct {
+	Trip           FeedTripDescriptor     `json:"Trip"`
+	Vehicle        *FeedVehicleDescriptor `json:"Vehicle,omitempty"`
+	StopTimeUpdate []FeedStopTimeUpdate   `json:"StopTimeUpdate"`
+	Timestamp      FeedTime               `json:"Timestamp"`
+}
+
+// FeedStopTimeUpdate is the arrival and departure delay of a trip at a stop,
+// given by either its sequence in the trip or its stop id
+type FeedStopTimeUpdate struct {
+	StopSequence         *int           `json:"StopSequence,omitempty"`
+	StopId               string         `json:"StopId"`
+	Arrival              *FeedStopEvent `json:"Arrival,omitempty"`
+	Departure            *FeedStopEvent `json:"Departure,omitempty"`
+	ScheduleRelationship string         `json:"ScheduleRelationship"`
+}
+
+// FeedStopEvent is the delay in seconds or the absolute time of an arrival or
+// departure
+type FeedStopEvent struct {
+	Delay *int     `json:"Delay,omitempty"`
+	Time  FeedTime `json:"Time"`
+}
+
+// FeedVehiclePosition is the position of a vehicle and the trip it is making
+type FeedVehiclePosition struct {
+	Trip          *FeedTripDescriptor    `json:"Trip,omitempty"`
+	Vehicle       *FeedVehicleDescriptor `json:"Vehicle,omitempty"`
+	Position      *FeedPosition          `json:"Position,omitempty"`
+	StopId        string                 `json:"StopId"`
+	CurrentStatus string                 `json:"CurrentStatus"`
+	Timestamp     FeedTime               `json:"Timestamp"`
+}
+
+// FeedVehicleDescriptor identifies a vehicle in a GTFS-R feed
+type FeedVehicleDescriptor struct {
+	Id           string `json:"Id"`
+	Label        string `json:"Label"`
+	LicensePlate string `json:"LicensePlate"`
+}
+
+// FeedPosition is the position of a vehicle, with its bearing in degrees
+// clockwise from north and its speed in metres per second where given
+type FeedPosition struct {
+	Latitude  float64  `json:"Latitude"`
+	Longitude float64  `json:"Longitude"`
+	Bearing   *float64 `json:"Bearing,omitempty"`
+	Speed     *float64 `json:"Speed,omitempty"`
+}
+
+// FeedAlert is a GTFS-R service alert with the periods it is active for and
+// the routes, stops and trips it informs about
+type FeedAlert struct {
+	ActivePeriod    []FeedTimeRange      `json:"ActivePeriod"`
+	InformedEntity  []FeedEntitySelector `json:"InformedEntity"`
+	Cause           string               `json:"Cause"`
+	Effect          string               `json:"Effect"`
+	Url             FeedTranslatedString `json:"Url"`
+	HeaderText      FeedTranslatedString `json:"HeaderText"`
+	DescriptionText FeedTranslatedString `json:"DescriptionText"`
+}
+
+// FeedTimeRange is a period of time, either end of which may be left open
+type FeedTimeRange struct {
+	Start FeedTime `json:"Start"`
+	End   FeedTime `json:"End"`
+}
+
+// FeedEntitySelector selects the agency, route, trip or stop that an alert
+// informs about. Every field given must match
+type FeedEntitySelector struct {
+	AgencyId  string              `json:"AgencyId"`
+	RouteId   string              `json:"RouteId"`
+	RouteType *int                `json:"RouteType,omitempty"`
+	Trip      *FeedTripDescriptor `json:"Trip,omitempty"`
+	StopId    string              `json:"StopId"`
+}
+
+// FeedTripDescriptor identifies a trip in a GTFS-R feed
+type FeedTripDescriptor struct {
+	TripId               string `json:"TripId"`
+	RouteId              string `json:"RouteId"`
+	DirectionId          *int   `json:"DirectionId,omitempty"`
+	StartTime            string `json:"StartTime"`
+	StartDate            string `json:"StartDate"`
+	ScheduleRelationship string `json:"ScheduleRelationship"`
+}
+
+// FeedTranslatedString is a GTFS-R text given in one or more languages
+type FeedTranslatedString struct {
+	Translation []FeedTranslation `json:"Translation"`
+}
+
+// FeedTranslation is a GTFS-R text in a single language
+type FeedTranslation struct {
+	Text     string `json:"Text"`
+	Language string `json:"Language"`
+}
+
+// Text returns the English translation, falling back to one without a language
+// and then to the first one given
+func (translated FeedTranslatedString) Text() string {
+
+	for _, translation := range translated.Translation {
+		if strings.HasPrefix(strings.ToLower(translation.Language), "en") {
+			return translation.Text
+		}
+	}
+	for _, translation := range translated.Translation {
+		if translation.Language == "" {
+			return translation.Text
+		}
+	}
+	if len(translated.Translation) > 0 {
+		return translated.Translation[0].Text
+	}
+
+	return ""
+}
+
+// FeedTime is a GTFS-R timestamp in seconds since the epoch. The NTA feed gives
+// timestamps as strings, so both strings and numbers are accepted. Zero stands
+// for a time that wasn't given
+type FeedTime int64
+
+// UnmarshalJSON reads a timestamp given either as a string or a number
+func (feedTime *FeedTime) UnmarshalJSON(data []byte) error {
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	if value == nil || value == "" {
+		*feedTime = 0
+		return nil
+	}
+
+	timestamp, ok := feedTimestamp(value)
+	if !ok {
+		return fmt.Errorf("invalid GTFS-R timestamp %s", string(data))
+	}
+
+	*feedTime = FeedTime(timestamp.Unix())
+	return nil
+}
+
+// Time returns the timestamp as a time, reporting false if it wasn't given
+func (feedTime FeedTime) Time() (time.Time, bool) {
+
+	if feedTime == 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(feedTime), 0).UTC(), true
+}
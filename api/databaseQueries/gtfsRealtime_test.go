@@ -0,0 +1,80 @@
+package databaseQueries
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testAlertFeed is a GTFS-R feed in the form served by the NTA, with capitalised
+// field names and timestamps as strings
+const testAlertFeed = `{
+  "Header": {"GtfsRealtimeVersion": "2.0", "Incrementality": "FULL_DATASET", "Timestamp": "1655276400"},
+  "Entity": [
+    {
+      "Id": "alert-1",
+      "IsDeleted": false,
+      "Alert": {
+        "ActivePeriod": [{"Start": "1655276400", "End": 1655362800}],
+        "InformedEntity": [{"RouteId": "60-46A-b12-1"}, {"StopId": "8250DB002039", "RouteId": "60-46A-b12-1"}],
+        "Cause": "CONSTRUCTION",
+        "Effect": "DETOUR",
+        "HeaderText": {"Translation": [{"Text": "Atrú", "Language": "ga"}, {"Text": "Diversion", "Language": "en"}]},
+        "DescriptionText": {"Translation": [{"Text": "Route 46A is diverted"}]}
+      }
+    },
+    {"Id": "alert-2", "IsDeleted": true},
+    {"Id": "trip-1", "TripUpdate": {}}
+  ]
+}`
+
+func TestDecodeFeedMessage(t *testing.T) {
+
+	var feed FeedMessage
+	if err := json.Unmarshal([]byte(testAlertFeed), &feed); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if timestamp, ok := feed.Header.Timestamp.Time(); !ok || !timestamp.Equal(time.Unix(1655276400, 0)) {
+		t.Log("Expected the header timestamp to be read from a string, got", feed.Header.Timestamp)
+		t.Fail()
+	}
+	if len(feed.Entity) != 3 || feed.Entity[0].Alert == nil || !feed.Entity[1].IsDeleted {
+		t.Log("Expected three entities with the first an alert and the second deleted, got", feed.Entity)
+		t.FailNow()
+	}
+
+	alert := feed.Entity[0].Alert
+	if alert.ActivePeriod[0].End != 1655362800 {
+		t.Log("Expected the end of the active period to be read from a number, got", alert.ActivePeriod[0].End)
+		t.Fail()
+	}
+	if alert.HeaderText.Text() != "Diversion" || alert.DescriptionText.Text() != "Route 46A is diverted" {
+		t.Log("Expected the English texts, got", alert.HeaderText.Text(), alert.DescriptionText.Text())
+		t.Fail()
+	}
+}
+
+func TestDecodeFeedTime(t *testing.T) {
+
+	var times struct {
+		Missing FeedTime
+		Empty   FeedTime
+		Invalid FeedTime
+	}
+	err := json.Unmarshal([]byte(`{"Empty": "", "Invalid": "soon"}`), &times)
+	if err == nil {
+		t.Log("Expected a timestamp that isn't a number to be rejected")
+		t.Fail()
+	}
+
+	if _, ok := times.Missing.Time(); ok {
+		t.Log("Expected a missing timestamp not to be given")
+		t.Fail()
+	}
+	if _, ok := times.Empty.Time(); ok {
+		t.Log("Expected an empty timestamp not to be given")
+		t.Fail()
+	}
+}
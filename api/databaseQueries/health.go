@@ -0,0 +1,316 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses reported for each dependency and for the api as a whole. A
+// dependency that is degraded still works but needs attention, e.g. stale
+// realtime data, while one that is down can't be used at all
+const (
+	HealthStatusOK       = "ok"
+	HealthStatusDegraded = "degraded"
+	HealthStatusDown     = "down"
+)
+
+// Limits used by the readiness checks. The timetable is re-imported whenever
+// the GTFS static files are published and the realtime feed is polled every
+// minute by default, so data older than these is reported as degraded
+var (
+	HealthCheckTimeout = 5 * time.Second
+	TimetableMaxAge    = 60 * 24 * time.Hour
+	RealtimeFeedMaxAge = 30 * time.Minute
+)
+
+// healthDetailUnavailable is the detail given for a check that failed with an
+// error. The readiness endpoint isn't authenticated, so the error itself, which
+// may name the Mongo hosts, is only logged
+const healthDetailUnavailable = "unavailable"
+
+// HealthCheck is the result of checking a single dependency of the api. Critical
+// dependencies are those without which no journey can be planned, so the api
+// isn't ready while any of them are down. The age of the data is included for
+// the checks on the timetable and realtime feed when it is known
+type HealthCheck struct {
+	Name       string   `json:"name"`
+	Status     string   `json:"status"`
+	Critical   bool     `json:"critical"`
+	Detail     string   `json:"detail,omitempty"`
+	AgeSeconds *float64 `json:"age_seconds,omitempty"`
+	LatencyMs  float64  `json:"latency_ms"`
+}
+
+// HealthReport is returned by the readiness endpoint with the overall status of
+// the api and the result of each check that went into it
+type HealthReport struct {
+	Status    string        `json:"status"`
+	CheckedAt string        `json:"checked_at"`
+	Checks    []HealthCheck `json:"checks"`
+}
+
+// GetHealth reports that the api process is up and able to serve requests. It
+// doesn't touch any dependency so that it can be used as a liveness probe
+// without a Mongo outage causing the api to be restarted
+func GetHealth(c *gin.Context) {
+	c.IndentedJSON(http.StatusOK, gin.H{"status": HealthStatusOK})
+}
+
+// GetReadiness checks every dependency of the api and returns the HealthReport.
+// The status code is 503 if any critical dependency is down, so that a load
+// balancer stops sending requests until it recovers, and 200 otherwise
+func GetReadiness(c *gin.Context) {
+
+	report := CheckReadiness(c.Request.Context())
+	if report.Status == HealthStatusDown {
+		c.IndentedJSON(http.StatusServiceUnavailable, report)
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, report)
+}
+
+// CheckReadiness takes in a context and checks Mongo connectivity, whether the
+// timetable has been loaded and how fresh it is, how old the realtime feed is
+// and whether the prediction service can be reached, returning a HealthReport
+// with the result of each check
+func CheckReadiness(requestCtx context.Context) HealthReport {
+
+	ctx, cancel := context.WithTimeout(requestCtx, HealthCheckTimeout)
+	defer cancel()
+
+	var checks []HealthCheck
+
+	mongoCheck := HealthCheck{Name: "mongo", Status: HealthStatusOK, Critical: true}
+	start := time.Now()
+	client, err := readinessClient()
+	if err == nil {
+		err = client.Ping(ctx, nil)
+	}
+	mongoCheck.LatencyMs = elapsedMilliseconds(start)
+
+	if err != nil {
+		LoggerFromContext(requestCtx).Error("readiness check could not reach Mongo", "error", err)
+		mongoCheck.Status = HealthStatusDown
+		mongoCheck.Detail = healthDetailUnavailable
+		checks = append(checks, mongoCheck,
+			HealthCheck{Name: "timetable", Status: HealthStatusDown, Critical: true, Detail: "Mongo is unavailable"},
+			HealthCheck{Name: "realtime_feed", Status: HealthStatusDown, Detail: "Mongo is unavailable"})
+	} else {
+		database := client.Database(currentConfig.Mongo.Database)
+		checks = append(checks, mongoCheck,
+			checkTimetable(ctx, database.Collection(currentConfig.Mongo.Collections.TripsAndStops)),
+			checkRealtimeFeed(ctx, database.Collection(currentConfig.Mongo.Collections.RealtimeData)))
+	}
+
+	checks = append(checks, checkPredictionService(ctx, PredictionServiceURL))
+	if poller := currentRealtimePoller(); poller != nil {
+		checks = append(checks, checkRealtimePoller(poller))
+	}
+
+	return newHealthReport(checks, time.Now())
+}
+
+var sharedReadinessClient *mongo.Client
+var sharedReadinessClientLock sync.Mutex
+
+// readinessClient returns the Mongo client shared by the readiness checks, so
+// that frequent probes don't each open their own connections. It is created the
+// first time it is called, and again on the next call if that fails
+func readinessClient() (*mongo.Client, error) {
+
+	sharedReadinessClientLock.Lock()
+	defer sharedReadinessClientLock.Unlock()
+
+	if sharedReadinessClient != nil {
+		return sharedReadinessClient, nil
+	}
+
+	client, err := ConnectToMongo()
+	if err == nil {
+		err = client.Connect(context.Background())
+	}
+	if err != nil {
+		return nil, err
+	}
+	sharedReadinessClient = client
+
+	return client, nil
+}
+
+// newHealthReport takes in the result of each check and the time they were
+// made and returns the HealthReport for them. The api is down if any critical
+// check is down and degraded if any other check isn't ok
+func newHealthReport(checks []HealthCheck, checkedAt time.Time) HealthReport {
+
+	status := HealthStatusOK
+	for _, check := range checks {
+		if check.Status == HealthStatusDown && check.Critical {
+			status = HealthStatusDown
+			break
+		}
+		if check.Status != HealthStatusOK {
+			status = HealthStatusDegraded
+		}
+	}
+
+	return HealthReport{
+		Status:    status,
+		CheckedAt: checkedAt.In(dublinLocation).Format(time.RFC3339),
+		Checks:    checks,
+	}
+}
+
+// checkTimetable checks that the trips_n_stops collection holds at least one
+// route. As the collection is re-created on each import, the age of the
+// timetable is taken from the creation time of the newest document id
+func checkTimetable(ctx context.Context, collection *mongo.Collection) HealthCheck {
+
+	check := HealthCheck{Name: "timetable", Status: HealthStatusOK, Critical: true}
+	start := time.Now()
+
+	var newestDocument bson.M
+	err := collection.FindOne(ctx, bson.D{},
+		options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}).SetProjection(bson.D{{Key: "_id", Value: 1}})).
+		Decode(&newestDocument)
+	check.LatencyMs = elapsedMilliseconds(start)
+
+	if err == mongo.ErrNoDocuments {
+		check.Status = HealthStatusDown
+		check.Detail = "No timetable has been loaded"
+		return check
+	}
+	if err != nil {
+		LoggerFromContext(ctx).Error("readiness check could not read the timetable", "error", err)
+		check.Status = HealthStatusDown
+		check.Detail = healthDetailUnavailable
+		return check
+	}
+
+	documentId, ok := newestDocument["_id"].(primitive.ObjectID)
+	if !ok {
+		check.Detail = "Timetable loaded but its age is unknown"
+		return check
+	}
+
+	return applyDataAge(check, documentId.Timestamp(), TimetableMaxAge, time.Now())
+}
+
+// checkRealtimeFeed checks the age of the realtime trip states stored by the
+// poller, using the timestamp of the newest GTFS-R feed they were taken from. A
+// missing or stale feed is reported as degraded rather than down since journeys
+// can still be planned from the timetable without it
+func checkRealtimeFeed(ctx context.Context, collection *mongo.Collection) HealthCheck {
+
+	check := HealthCheck{Name: "realtime_feed", Status: HealthStatusOK}
+	start := time.Now()
+
+	var newestState TripState
+	err := collection.FindOne(ctx, bson.D{},
+		options.FindOne().SetSort(bson.D{{Key: "feed_timestamp", Value: -1}})).
+		Decode(&newestState)
+	check.LatencyMs = elapsedMilliseconds(start)
+
+	if err == mongo.ErrNoDocuments {
+		check.Status = HealthStatusDegraded
+		check.Detail = "No realtime data has been stored"
+		return check
+	}
+	if err != nil {
+		LoggerFromContext(ctx).Warn("readiness check could not read the realtime feed", "error", err)
+		check.Status = HealthStatusDegraded
+		check.Detail = healthDetailUnavailable
+		return check
+	}
+
+	return applyDataAge(check, newestState.FeedTimestamp, RealtimeFeedMaxAge, time.Now())
+}
+
+// feedTimestamp takes in the timestamp from the header of a GTFS-R feed, which
+// the NTA feed gives as a string of seconds since the epoch but may also be
+// stored as a number, and returns it as a time
+func feedTimestamp(value interface{}) (time.Time, bool) {
+
+	var seconds int64
+	switch timestamp := value.(type) {
+	case string:
+		parsed, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		seconds = parsed
+	case int32:
+		seconds = int64(timestamp)
+	case int64:
+		seconds = timestamp
+	case float64:
+		seconds = int64(timestamp)
+	default:
+		return time.Time{}, false
+	}
+
+	return time.Unix(seconds, 0), true
+}
+
+// applyDataAge adds the age of the data to a check, marking it as degraded if
+// the data was last updated longer than maxAge before now
+func applyDataAge(check HealthCheck, updatedAt time.Time, maxAge time.Duration, now time.Time) HealthCheck {
+
+	age := now.Sub(updatedAt).Seconds()
+	check.AgeSeconds = &age
+	if now.Sub(updatedAt) > maxAge {
+		check.Status = HealthStatusDegraded
+		check.Detail = "Data was last updated " + updatedAt.In(dublinLocation).Format(time.RFC3339)
+	}
+
+	return check
+}
+
+// checkPredictionService checks that the prediction service at serviceURL can
+// be reached. Any response below 500 counts as reachable since the base url
+// isn't itself a prediction and so returns a 404. An unreachable service is
+// degraded as travel times fall back to the static timetable
+func checkPredictionService(ctx context.Context, serviceURL string) HealthCheck {
+
+	check := HealthCheck{Name: "prediction_service", Status: HealthStatusOK}
+	start := time.Now()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, serviceURL, nil)
+	if err != nil {
+		LoggerFromContext(ctx).Warn("invalid prediction service url", "error", err)
+		check.Status = HealthStatusDegraded
+		check.Detail = healthDetailUnavailable
+		return check
+	}
+
+	resp, err := predictionClient.Do(request)
+	check.LatencyMs = elapsedMilliseconds(start)
+	if err != nil {
+		LoggerFromContext(ctx).Warn("readiness check could not reach the prediction service", "error", err)
+		check.Status = HealthStatusDegraded
+		check.Detail = healthDetailUnavailable
+		return check
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		check.Status = HealthStatusDegraded
+		check.Detail = "Prediction service returned " + resp.Status
+	}
+
+	return check
+}
+
+// elapsedMilliseconds returns the time since start in milliseconds
+func elapsedMilliseconds(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
@@ -0,0 +1,102 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNewHealthReportStatus(t *testing.T) {
+
+	checkedAt := time.Date(2022, 8, 12, 10, 0, 0, 0, time.UTC)
+
+	degradedReport := newHealthReport([]HealthCheck{
+		{Name: "mongo", Status: HealthStatusOK, Critical: true},
+		{Name: "realtime_feed", Status: HealthStatusDown},
+	}, checkedAt)
+	if degradedReport.Status != HealthStatusDegraded {
+		t.Log("A non critical check that is down should degrade the api, got", degradedReport.Status)
+		t.Fail()
+	}
+
+	downReport := newHealthReport([]HealthCheck{
+		{Name: "realtime_feed", Status: HealthStatusDegraded},
+		{Name: "mongo", Status: HealthStatusDown, Critical: true},
+	}, checkedAt)
+	if downReport.Status != HealthStatusDown {
+		t.Log("A critical check that is down should take the api down, got", downReport.Status)
+		t.Fail()
+	}
+
+	if downReport.CheckedAt != "2022-08-12T11:00:00+01:00" {
+		t.Log("Check time should be given in Dublin time, got", downReport.CheckedAt)
+		t.Fail()
+	}
+}
+
+func TestApplyDataAge(t *testing.T) {
+
+	now := time.Date(2022, 8, 12, 10, 0, 0, 0, time.UTC)
+
+	freshCheck := applyDataAge(HealthCheck{Status: HealthStatusOK}, now.Add(-5*time.Minute), 30*time.Minute, now)
+	if freshCheck.Status != HealthStatusOK || freshCheck.AgeSeconds == nil || *freshCheck.AgeSeconds != 300 {
+		t.Log("Data 5 minutes old should be ok with an age of 300 seconds")
+		t.Fail()
+	}
+
+	staleCheck := applyDataAge(HealthCheck{Status: HealthStatusOK}, now.Add(-time.Hour), 30*time.Minute, now)
+	if staleCheck.Status != HealthStatusDegraded {
+		t.Log("Data an hour old should be degraded when the limit is 30 minutes")
+		t.Fail()
+	}
+}
+
+func TestFeedTimestamp(t *testing.T) {
+
+	expected := time.Unix(1660298400, 0)
+
+	for _, value := range []interface{}{"1660298400", int64(1660298400), float64(1660298400)} {
+		feedTime, ok := feedTimestamp(value)
+		if !ok || !feedTime.Equal(expected) {
+			t.Log("Timestamp", value, "should be read as", expected)
+			t.Fail()
+		}
+	}
+
+	if _, ok := feedTimestamp("yesterday"); ok {
+		t.Log("A timestamp that isn't a number should not be read")
+		t.Fail()
+	}
+}
+
+func TestCheckPredictionService(t *testing.T) {
+
+	notFoundServer := httptest.NewServer(http.NotFoundHandler())
+	defer notFoundServer.Close()
+
+	if check := checkPredictionService(context.Background(), notFoundServer.URL); check.Status != HealthStatusOK {
+		t.Log("A 404 from the prediction service should count as reachable")
+		t.Fail()
+	}
+
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failingServer.Close()
+
+	if check := checkPredictionService(context.Background(), failingServer.URL); check.Status != HealthStatusDegraded {
+		t.Log("A 502 from the prediction service should be degraded")
+		t.Fail()
+	}
+
+	closedServer := httptest.NewServer(http.NotFoundHandler())
+	closedServer.Close()
+
+	check := checkPredictionService(context.Background(), closedServer.URL)
+	if check.Status != HealthStatusDegraded || check.Detail != healthDetailUnavailable {
+		t.Log("An unreachable prediction service should be degraded without the error, got", check)
+		t.Fail()
+	}
+}
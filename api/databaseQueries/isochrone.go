@@ -0,0 +1,326 @@
+package databaseQueries
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"googlemaps.github.io/maps"
+)
+
+// Isochrone is the area that can be reached from a point within a number of
+// minutes of leaving, by walking and taking buses. The stops reached are listed
+// with when they are reached, and the area is a GeoJSON MultiPolygon covering
+// the walks from the origin and from each stop in the time left on arriving
+type Isochrone struct {
+	FromLat   float64         `json:"from_lat"`
+	FromLon   float64         `json:"from_lon"`
+	Departure string          `json:"departure"`
+	Minutes   int             `json:"minutes"`
+	Stops     []ReachedStop   `json:"stops"`
+	Area      GeoJSONGeometry `json:"area"`
+}
+
+// reachCircle is a point and how far can be walked from it
+type reachCircle struct {
+	centre maps.LatLng
+	metres float64
+}
+
+// ParseCoordinates takes in coordinates given as "lat,lng" and returns them,
+// refusing anything that isn't a pair of numbers within range
+func ParseCoordinates(coordinates string) (maps.LatLng, error) {
+
+	lat, lng, found := strings.Cut(coordinates, ",")
+	parsedLat, latErr := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	parsedLng, lngErr := strconv.ParseFloat(strings.TrimSpace(lng), 64)
+	if !found || latErr != nil || lngErr != nil || math.Abs(parsedLat) > 90 || math.Abs(parsedLng) > 180 {
+		return maps.LatLng{}, errors.New("expected coordinates as lat,lng")
+	}
+
+	return maps.LatLng{Lat: parsedLat, Lng: parsedLng}, nil
+}
+
+// GetIsochrone returns the Isochrone of the point given in the from query
+// parameter, leaving at the departure query parameter, or now if it isn't
+// given, with the number of minutes in the minutes query parameter, up to the
+// configured maximum. The wheelchair query parameter works as it does for
+// journey planning
+func GetIsochrone(c *gin.Context) {
+
+	from, err := ParseCoordinates(c.Query("from"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid from parameter in request: "+err.Error())
+		return
+	}
+	departure := time.Now().In(dublinLocation)
+	if c.Query("departure") != "" {
+		if departure, err = ParseRequestTime(c.Query("departure")); err != nil {
+			c.IndentedJSON(http.StatusBadRequest, "Invalid departure parameter in request")
+			return
+		}
+	}
+	minutes, err := strconv.Atoi(c.Query("minutes"))
+	if err != nil || minutes < 1 || minutes > currentConfig.Isochrone.MaxMinutes {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid minutes parameter in request, expected 1 to "+
+			strconv.Itoa(currentConfig.Isochrone.MaxMinutes))
+		return
+	}
+	routeOptions, err := ParseRouteOptions(c.Query("wheelchair"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid wheelchair parameter in request: "+err.Error())
+		return
+	}
+
+	serviceDate, _ := ServiceDay(departure)
+	network, err := transitNetworkFor(c.Request.Context(), serviceDate)
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not load the timetable", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Isochrone could not be found")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, BuildIsochrone(network, from, departure, minutes, routeOptions))
+}
+
+// BuildIsochrone searches the network from the point, leaving at the departure,
+// and returns the Isochrone of the minutes after
+func BuildIsochrone(network *TransitNetwork, from maps.LatLng, departure time.Time, minutes int,
+	options RouteOptions) Isochrone {
+
+	limit := departure.Add(time.Duration(minutes) * time.Minute)
+	reach := network.Reach(from, departure, limit, options)
+	speed := pedestrianGraph().speed
+	maxWalkMetres := longestWalkMetres(options)
+
+	circles := []reachCircle{{centre: from, metres: math.Min(limit.Sub(departure).Seconds()*speed, maxWalkMetres)}}
+	start := ServiceDayStart(network.serviceDate)
+	for index, label := range reach.labels {
+		if !label.reached {
+			continue
+		}
+		left := limit.Sub(start.Add(time.Duration(label.arrival) * time.Second)).Seconds()
+		stop := network.stops[index]
+		circles = append(circles, reachCircle{centre: maps.LatLng{Lat: stop.StopLat, Lng: stop.StopLon},
+			metres: math.Min(left*speed, maxWalkMetres)})
+	}
+
+	return Isochrone{
+		FromLat:   from.Lat,
+		FromLon:   from.Lng,
+		Departure: departure.In(dublinLocation).Format(time.RFC3339),
+		Minutes:   minutes,
+		Stops:     reach.Stops(),
+		Area:      reachArea(circles, from.Lat, currentConfig.Isochrone.CellMetres),
+	}
+}
+
+// gridPoint is a corner of the cells of a grid, as a column and row
+type gridPoint [2]int
+
+// reachArea returns the area covered by the circles as a GeoJSON MultiPolygon.
+// The circles are drawn onto a grid of cells of the size given, with a cell
+// covered when its centre is in a circle, and the outline of the covered cells
+// is traced. Outer rings run anticlockwise and holes clockwise, as GeoJSON asks
+func reachArea(circles []reachCircle, referenceLat float64, cellMetres float64) GeoJSONGeometry {
+
+	metresPerDegree := earthRadiusMetres * math.Pi / 180
+	latStep := cellMetres / metresPerDegree
+	lonStep := cellMetres / (metresPerDegree * math.Cos(referenceLat*math.Pi/180))
+
+	covered := map[gridPoint]bool{}
+	for _, circle := range circles {
+		if circle.metres <= 0 {
+			continue
+		}
+		row := int(math.Floor(circle.centre.Lat / latStep))
+		column := int(math.Floor(circle.centre.Lng / lonStep))
+		rows := int(math.Ceil(circle.metres/cellMetres)) + 1
+		columns := int(math.Ceil(circle.metres/(lonStep*metresPerDegree*math.Cos(circle.centre.Lat*math.Pi/180)))) + 1
+		for y := row - rows; y <= row+rows; y++ {
+			for x := column - columns; x <= column+columns; x++ {
+				lat, lng := (float64(y)+0.5)*latStep, (float64(x)+0.5)*lonStep
+				if distanceMetres(circle.centre.Lat, circle.centre.Lng, lat, lng) <= circle.metres {
+					covered[gridPoint{x, y}] = true
+				}
+			}
+		}
+	}
+
+	polygons := [][][][2]float64{}
+	for _, polygon := range traceCells(covered) {
+		rings := [][][2]float64{}
+		for _, ring := range polygon {
+			coordinates := make([][2]float64, 0, len(ring)+1)
+			for _, point := range append(ring, ring[0]) {
+				coordinates = append(coordinates,
+					[2]float64{float64(point[0]) * lonStep, float64(point[1]) * latStep})
+			}
+			rings = append(rings, coordinates)
+		}
+		polygons = append(polygons, rings)
+	}
+
+	return GeoJSONGeometry{Type: "MultiPolygon", Coordinates: polygons}
+}
+
+// traceCells returns the outline of the covered cells as polygons, each being
+// its outer ring followed by its holes. Each ring is given once around without
+// repeating its first point, with only the corners where it turns
+func traceCells(covered map[gridPoint]bool) [][][]gridPoint {
+
+	// Each side of a covered cell that doesn't border another covered cell is an
+	// edge of the outline, running so that the cell is on its left
+	edges := map[gridPoint][]gridPoint{}
+	for cell := range covered {
+		x, y := cell[0], cell[1]
+		for _, side := range [4]struct {
+			neighbour gridPoint
+			from      gridPoint
+			to        gridPoint
+		}{
+			{gridPoint{x, y - 1}, gridPoint{x, y}, gridPoint{x + 1, y}},
+			{gridPoint{x + 1, y}, gridPoint{x + 1, y}, gridPoint{x + 1, y + 1}},
+			{gridPoint{x, y + 1}, gridPoint{x + 1, y + 1}, gridPoint{x, y + 1}},
+			{gridPoint{x - 1, y}, gridPoint{x, y + 1}, gridPoint{x, y}},
+		} {
+			if !covered[side.neighbour] {
+				edges[side.from] = append(edges[side.from], side.to)
+			}
+		}
+	}
+
+	starts := make([]gridPoint, 0, len(edges))
+	for point := range edges {
+		starts = append(starts, point)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i][1] < starts[j][1] || (starts[i][1] == starts[j][1] && starts[i][0] < starts[j][0])
+	})
+
+	var outers, holes [][]gridPoint
+	for _, start := range starts {
+		for len(edges[start]) > 0 {
+			ring := traceRing(edges, start)
+			if ringArea(ring) > 0 {
+				outers = append(outers, ring)
+			} else {
+				holes = append(holes, ring)
+			}
+		}
+	}
+
+	// Each hole belongs to the smallest outer ring around it
+	polygons := make([][][]gridPoint, len(outers))
+	for index, outer := range outers {
+		polygons[index] = [][]gridPoint{outer}
+	}
+	for _, hole := range holes {
+		inside, smallest := -1, math.Inf(1)
+		for index, outer := range outers {
+			if area := ringArea(outer); area < smallest && ringContains(outer, holeInterior(hole)) {
+				inside, smallest = index, area
+			}
+		}
+		if inside >= 0 {
+			polygons[inside] = append(polygons[inside], hole)
+		}
+	}
+
+	return polygons
+}
+
+// traceRing follows the edges from the start until it comes back around,
+// removing each edge it follows, and returns the corners where the ring turns.
+// Where two edges leave a corner, as happens where covered cells touch only at
+// that corner, the one turning left is taken so that the cells are outlined
+// separately
+func traceRing(edges map[gridPoint][]gridPoint, start gridPoint) []gridPoint {
+
+	points := []gridPoint{}
+	current, direction := start, gridPoint{0, 0}
+	for {
+		next := edges[current]
+		choice := 0
+		for index, to := range next {
+			turn := gridPoint{to[0] - current[0], to[1] - current[1]}
+			if direction[0]*turn[1]-direction[1]*turn[0] > 0 {
+				choice = index
+			}
+		}
+		to := next[choice]
+		edges[current] = append(next[:choice], next[choice+1:]...)
+		if len(edges[current]) == 0 {
+			delete(edges, current)
+		}
+
+		points = append(points, current)
+		current, direction = to, gridPoint{to[0] - current[0], to[1] - current[1]}
+		if current == start {
+			break
+		}
+	}
+
+	ring := []gridPoint{}
+	for index, point := range points {
+		previous := points[(index+len(points)-1)%len(points)]
+		next := points[(index+1)%len(points)]
+		if (point[0]-previous[0])*(next[1]-point[1]) != (point[1]-previous[1])*(next[0]-point[0]) {
+			ring = append(ring, point)
+		}
+	}
+
+	return ring
+}
+
+// ringArea returns twice the signed area of a ring, which is positive when it
+// runs anticlockwise
+func ringArea(ring []gridPoint) float64 {
+
+	area := 0
+	for index, point := range ring {
+		next := ring[(index+1)%len(ring)]
+		area += point[0]*next[1] - next[0]*point[1]
+	}
+
+	return float64(area)
+}
+
+// holeInterior returns a point just inside a hole, beside the middle of its
+// first edge. Holes run clockwise around uncovered cells, so the inside is on
+// the right of each edge
+func holeInterior(hole []gridPoint) [2]float64 {
+
+	from, to := hole[0], hole[1%len(hole)]
+	dx, dy := float64(to[0]-from[0]), float64(to[1]-from[1])
+	length := math.Hypot(dx, dy)
+
+	return [2]float64{
+		float64(from[0]) + dx/2 + 0.25*dy/length,
+		float64(from[1]) + dy/2 - 0.25*dx/length,
+	}
+}
+
+// ringContains reports whether the point is inside the ring, by counting how
+// many of its edges a ray from the point crosses
+func ringContains(ring []gridPoint, point [2]float64) bool {
+
+	inside := false
+	for index, from := range ring {
+		to := ring[(index+1)%len(ring)]
+		fromY, toY := float64(from[1]), float64(to[1])
+		if (fromY > point[1]) != (toY > point[1]) {
+			crossing := float64(from[0]) + (point[1]-fromY)/(toY-fromY)*float64(to[0]-from[0])
+			if point[0] < crossing {
+				inside = !inside
+			}
+		}
+	}
+
+	return inside
+}
@@ -0,0 +1,139 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"googlemaps.github.io/maps"
+)
+
+func TestParseCoordinates(t *testing.T) {
+
+	point, err := ParseCoordinates(" 53.3498, -6.2603")
+	if err != nil || point.Lat != 53.3498 || point.Lng != -6.2603 {
+		t.Log("Expected 53.3498, -6.2603 to be read, got", point, err)
+		t.Fail()
+	}
+	for _, coordinates := range []string{"", "53.3498", "53.3498,west", "91,0", "0,181"} {
+		if _, err := ParseCoordinates(coordinates); err == nil {
+			t.Log("Expected", coordinates, "to be refused")
+			t.Fail()
+		}
+	}
+}
+
+func TestTraceCells(t *testing.T) {
+
+	cells := func(points ...gridPoint) map[gridPoint]bool {
+		covered := map[gridPoint]bool{}
+		for _, point := range points {
+			covered[point] = true
+		}
+		return covered
+	}
+
+	polygons := traceCells(cells(gridPoint{0, 0}, gridPoint{1, 0}))
+	if len(polygons) != 1 || len(polygons[0]) != 1 || len(polygons[0][0]) != 4 || ringArea(polygons[0][0]) != 4 {
+		t.Log("Expected two cells side by side to be outlined by an anticlockwise rectangle, got", polygons)
+		t.Fail()
+	}
+
+	// A ring of cells has the cell in the middle as a hole
+	ring := cells(gridPoint{0, 0}, gridPoint{1, 0}, gridPoint{2, 0}, gridPoint{0, 1}, gridPoint{2, 1},
+		gridPoint{0, 2}, gridPoint{1, 2}, gridPoint{2, 2})
+	polygons = traceCells(ring)
+	if len(polygons) != 1 || len(polygons[0]) != 2 || ringArea(polygons[0][0]) != 18 ||
+		ringArea(polygons[0][1]) != -2 {
+		t.Log("Expected a square with a clockwise hole, got", polygons)
+		t.Fail()
+	}
+
+	// Cells touching only at a corner are outlined separately
+	polygons = traceCells(cells(gridPoint{0, 0}, gridPoint{1, 1}))
+	if len(polygons) != 2 || len(polygons[0][0]) != 4 || len(polygons[1][0]) != 4 {
+		t.Log("Expected two squares for diagonal cells, got", polygons)
+		t.Fail()
+	}
+}
+
+func TestBuildIsochrone(t *testing.T) {
+
+	network := BuildTransitNetwork(testServiceDate, testServiceTrips)
+	from := maps.LatLng{Lat: 53.3400, Lng: -6.2600}
+	departure := time.Date(2022, 11, 2, 7, 55, 0, 0, dublinLocation)
+
+	// Before the first bus leaves, only the walk from the origin is reached
+	isochrone := BuildIsochrone(network, from, departure, 4, RouteOptions{})
+	polygons := isochrone.Area.Coordinates.([][][][2]float64)
+	if len(isochrone.Stops) != 1 || isochrone.Area.Type != "MultiPolygon" || len(polygons) != 1 {
+		t.Log("Expected the origin stop and a single area, got", isochrone)
+		t.Fail()
+	}
+	for _, point := range polygons[0][0] {
+		if distance := distanceMetres(from.Lat, from.Lng, point[1], point[0]); distance > 4*60*1.3+150 {
+			t.Log("Expected the area to stay within a four minute walk, got a point", distance, "metres away")
+			t.Fail()
+			break
+		}
+	}
+
+	// Reaching D with ten minutes to spare adds an area around it
+	isochrone = BuildIsochrone(network, from, departure, 40, RouteOptions{})
+	polygons = isochrone.Area.Coordinates.([][][][2]float64)
+	nearD := false
+	for _, polygon := range polygons {
+		for _, point := range polygon[0] {
+			if distanceMetres(53.3600, -6.2200, point[1], point[0]) < 10*60*1.3+150 {
+				nearD = true
+			}
+		}
+	}
+	if len(isochrone.Stops) != 5 || isochrone.Departure != "2022-11-02T07:55:00Z" || !nearD {
+		t.Log("Expected every stop to be reached with an area around D, got", isochrone.Stops, polygons)
+		t.Fail()
+	}
+}
+
+func TestGetIsochrone(t *testing.T) {
+
+	findServiceTrips = func(ctx context.Context, serviceDates ...time.Time) ([]serviceTrip, error) {
+		return testServiceTrips, nil
+	}
+	sharedTransitNetworks = newTransitNetworkStore()
+	defer func() {
+		findServiceTrips = FindServiceTrips
+		sharedTransitNetworks = newTransitNetworkStore()
+	}()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/isochrone", GetIsochrone)
+
+	for query, status := range map[string]int{
+		"from=53.34,-6.26&departure=2022-11-02T07:55&minutes=40":   http.StatusOK,
+		"from=53.34&departure=2022-11-02T07:55&minutes=40":         http.StatusBadRequest,
+		"from=53.34,-6.26&departure=tomorrow&minutes=40":           http.StatusBadRequest,
+		"from=53.34,-6.26&departure=2022-11-02T07:55&minutes=0":    http.StatusBadRequest,
+		"from=53.34,-6.26&departure=2022-11-02T07:55&minutes=1000": http.StatusBadRequest,
+		"from=53.34,-6.26&minutes=40&wheelchair=maybe":             http.StatusBadRequest,
+	} {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/isochrone?"+query, nil))
+		if recorder.Code != status {
+			t.Log("Expected", status, "for", query, "got", recorder.Code, recorder.Body.String())
+			t.Fail()
+		}
+		if status == http.StatusOK {
+			var isochrone Isochrone
+			if err := json.Unmarshal(recorder.Body.Bytes(), &isochrone); err != nil || len(isochrone.Stops) != 5 {
+				t.Log("Expected every stop to be reached, got", isochrone, err)
+				t.Fail()
+			}
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package databaseQueries
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CalendarAlarmMinutes are the number of minutes before departure that each
+// alarm in an exported calendar event goes off
+var CalendarAlarmMinutes = []int{15, 5}
+
+// calendarNow returns the time that exported calendars are stamped with, and is
+// replaced within tests
+var calendarNow = time.Now
+
+// calendarTimeLayout is the iCalendar format for times in UTC
+const calendarTimeLayout = "20060102T150405Z"
+
+// calendarLineLimit is the most octets allowed on one line of an iCalendar file
+// before it must be folded onto the next
+const calendarLineLimit = 75
+
+// RenderCalendar renders the itineraries as an iCalendar file with an event for
+// each, running from the scheduled departure to the estimated arrival. The
+// description holds the stops, route and fares, and alarms go off before the
+// departure as set by CalendarAlarmMinutes. Itineraries without a departure
+// time are left out
+func RenderCalendar(itineraries []Itinerary) ([]byte, error) {
+
+	var lines []string
+	lines = append(lines,
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//"+exportCreator+"//Journey Planner//EN",
+		"CALSCALE:GREGORIAN",
+		"METHOD:PUBLISH",
+	)
+
+	stamp := calendarNow().UTC().Format(calendarTimeLayout)
+	for _, itinerary := range itineraries {
+		departure, hasDeparture := itinerary.Departure()
+		arrival, hasArrival := itinerary.EstimatedArrival()
+		if !hasDeparture {
+			continue
+		}
+		if !hasArrival || arrival.Before(departure) {
+			arrival = departure
+		}
+		boarding, _ := itinerary.BoardingStop()
+		alighting, _ := itinerary.AlightingStop()
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+calendarEventUID(itinerary, departure),
+			"DTSTAMP:"+stamp,
+			"DTSTART:"+departure.UTC().Format(calendarTimeLayout),
+			"DTEND:"+arrival.UTC().Format(calendarTimeLayout),
+			"SUMMARY:"+escapeCalendarText("Bus "+itinerary.Route.RouteNum+" to "+alighting.StopName),
+			"LOCATION:"+escapeCalendarText(stopLabel(boarding)),
+			"GEO:"+strconv.FormatFloat(boarding.StopLat, 'f', 6, 64)+";"+
+				strconv.FormatFloat(boarding.StopLon, 'f', 6, 64),
+			"DESCRIPTION:"+escapeCalendarText(calendarDescription(itinerary, departure, arrival)),
+		)
+
+		for _, minutes := range CalendarAlarmMinutes {
+			lines = append(lines,
+				"BEGIN:VALARM",
+				"ACTION:DISPLAY",
+				"TRIGGER:-PT"+strconv.Itoa(minutes)+"M",
+				"DESCRIPTION:"+escapeCalendarText(fmt.Sprintf("Bus %s leaves %s in %d minutes",
+					itinerary.Route.RouteNum, boarding.StopName, minutes)),
+				"END:VALARM",
+			)
+		}
+
+		lines = append(lines, "END:VEVENT")
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	var calendar strings.Builder
+	for _, line := range lines {
+		calendar.WriteString(foldCalendarLine(line))
+		calendar.WriteString("\r\n")
+	}
+
+	return []byte(calendar.String()), nil
+}
+
+// calendarEventUID returns a UID for the event that stays the same when the
+// same journey is exported again, so that calendars update it rather than
+// adding a copy
+func calendarEventUID(itinerary Itinerary, departure time.Time) string {
+
+	boarding, _ := itinerary.BoardingStop()
+	alighting, _ := itinerary.AlightingStop()
+
+	return departure.UTC().Format(calendarTimeLayout) + "-" + itinerary.Route.RouteNum + "-" +
+		boarding.StopNumber + "-" + alighting.StopNumber + "@dublinbus-diy.site"
+}
+
+// calendarDescription returns the description of the event for an itinerary,
+// with the route, stops, times and fares on separate lines
+func calendarDescription(itinerary Itinerary, departure time.Time, arrival time.Time) string {
+
+	boarding, _ := itinerary.BoardingStop()
+	alighting, _ := itinerary.AlightingStop()
+	fares := itinerary.Route.Fares
+
+	lines := []string{
+		"Route " + itinerary.Route.RouteNum,
+		"From " + stopLabel(boarding) + " at " + departure.In(dublinLocation).Format("15:04"),
+		"To " + stopLabel(alighting) + ", arriving about " + arrival.In(dublinLocation).Format("15:04"),
+		fmt.Sprintf("Stops travelled: %d", len(itinerary.Route.Stops)-1),
+	}
+	if itinerary.Route.TravelTime.TransitTime > 0 {
+		lines = append(lines, fmt.Sprintf("Travel time %d minutes (%s)",
+			itinerary.Route.TravelTime.TransitTime, itinerary.Route.TravelTime.Source))
+	}
+	var fareLines []string
+	for _, fare := range []struct {
+		name   string
+		amount float64
+	}{
+		{"adult Leap", fares.AdultLeap},
+		{"adult cash", fares.AdultCash},
+		{"student Leap", fares.StudentLeap},
+		{"child Leap", fares.ChildLeap},
+		{"child cash", fares.ChildCash},
+	} {
+		if fare.amount > 0 {
+			fareLines = append(fareLines, fmt.Sprintf("%s €%.2f", fare.name, fare.amount))
+		}
+	}
+	if len(fareLines) > 0 {
+		lines = append(lines, "Fares: "+strings.Join(fareLines, ", "))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// escapeCalendarText escapes text for an iCalendar property value
+func escapeCalendarText(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// foldCalendarLine splits a line longer than calendarLineLimit octets onto
+// continuation lines starting with a space, without splitting a character
+func foldCalendarLine(line string) string {
+
+	var folded strings.Builder
+	lineLength := 0
+	for _, character := range line {
+		size := utf8.RuneLen(character)
+		if lineLength+size > calendarLineLimit {
+			folded.WriteString("\r\n ")
+			lineLength = 1
+		}
+		folded.WriteRune(character)
+		lineLength += size
+	}
+
+	return folded.String()
+}
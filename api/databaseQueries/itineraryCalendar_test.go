@@ -0,0 +1,107 @@
+package databaseQueries
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderCalendar(t *testing.T) {
+
+	calendarNow = func() time.Time { return time.Date(2022, time.June, 14, 12, 0, 0, 0, time.UTC) }
+	defer func() { calendarNow = time.Now }()
+
+	body, err := RenderCalendar([]Itinerary{testItinerary()})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	calendar := string(body)
+
+	for _, expected := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"DTSTAMP:20220614T120000Z\r\n",
+		"DTSTART:20220615T060500Z\r\n",
+		"DTEND:20220615T061700Z\r\n",
+		"SUMMARY:Bus 46A to Donnybrook\r\n",
+		"LOCATION:Stillorgan (2039)\r\n",
+		"GEO:53.290000;-6.200000\r\n",
+		"TRIGGER:-PT15M\r\n",
+		"TRIGGER:-PT5M\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(calendar, expected) {
+			t.Log("Expected calendar to contain", strings.TrimSpace(expected), "got", calendar)
+			t.Fail()
+		}
+	}
+
+	if strings.Count(calendar, "BEGIN:VALARM") != len(CalendarAlarmMinutes) {
+		t.Log("Expected an alarm for each of", CalendarAlarmMinutes)
+		t.Fail()
+	}
+
+	unfolded := strings.ReplaceAll(calendar, "\r\n ", "")
+	for _, expected := range []string{
+		`Route 46A\nFrom Stillorgan (2039) at 07:05`,
+		`To Donnybrook (2040)\, arriving about 07:17`,
+		`\nFares: adult Leap €2.00`,
+	} {
+		if !strings.Contains(unfolded, expected) {
+			t.Log("Expected description to contain", expected, "got", unfolded)
+			t.Fail()
+		}
+	}
+
+	for _, line := range strings.Split(calendar, "\r\n") {
+		if len(line) > calendarLineLimit {
+			t.Log("Expected lines of at most", calendarLineLimit, "octets, got", line)
+			t.Fail()
+		}
+	}
+}
+
+func TestRenderCalendarSkipsItinerariesWithoutDeparture(t *testing.T) {
+
+	itinerary := testItinerary()
+	itinerary.Route.Stops[0].ArrivalTime = ""
+	itinerary.Route.Stops[0].DepartureTime = ""
+
+	body, err := RenderCalendar([]Itinerary{itinerary})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	if strings.Contains(string(body), "BEGIN:VEVENT") {
+		t.Log("Expected no events for an itinerary without a departure, got", string(body))
+		t.Fail()
+	}
+}
+
+func TestEscapeCalendarText(t *testing.T) {
+
+	escaped := escapeCalendarText("Route 46A; from Stillorgan, to Donnybrook\nC:\\")
+	expected := `Route 46A\; from Stillorgan\, to Donnybrook\nC:\\`
+	if escaped != expected {
+		t.Log("Expected", expected, "got", escaped)
+		t.Fail()
+	}
+}
+
+func TestFoldCalendarLine(t *testing.T) {
+
+	line := "DESCRIPTION:" + strings.Repeat("€", 40)
+	folded := foldCalendarLine(line)
+
+	if strings.ReplaceAll(folded, "\r\n ", "") != line {
+		t.Log("Expected folding to be undone by removing the continuations, got", folded)
+		t.Fail()
+	}
+	for _, part := range strings.Split(folded, "\r\n") {
+		if len(part) > calendarLineLimit {
+			t.Log("Expected folded lines of at most", calendarLineLimit, "octets, got", len(part))
+			t.Fail()
+		}
+	}
+}
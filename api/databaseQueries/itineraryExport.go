@@ -0,0 +1,395 @@
+package databaseQueries
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"googlemaps.github.io/maps"
+)
+
+// Formats that planned journeys can be exported in. JSON is the normal
+// response of the journey planner
+const (
+	ExportFormatJSON    = "json"
+	ExportFormatGeoJSON = "geojson"
+	ExportFormatGPX     = "gpx"
+	ExportFormatKML     = "kml"
+	ExportFormatICS     = "ics"
+)
+
+// itineraryExporter renders planned journeys in one export format, served with
+// the given content type and offered for download with the given file extension
+type itineraryExporter struct {
+	contentType string
+	extension   string
+	render      func(itineraries []Itinerary) ([]byte, error)
+}
+
+// itineraryExporters holds the exporter for each format other than JSON
+var itineraryExporters = map[string]itineraryExporter{
+	ExportFormatGeoJSON: {"application/geo+json", "geojson", RenderGeoJSON},
+	ExportFormatGPX:     {"application/gpx+xml", "gpx", RenderGPX},
+	ExportFormatKML:     {"application/vnd.google-earth.kml+xml", "kml", RenderKML},
+	ExportFormatICS:     {"text/calendar; charset=utf-8", "ics", RenderCalendar},
+}
+
+// exportMediaTypes maps the media types that may be given in the Accept header
+// onto the export format they ask for
+var exportMediaTypes = map[string]string{
+	"application/json":                     ExportFormatJSON,
+	"application/geo+json":                 ExportFormatGeoJSON,
+	"application/vnd.geo+json":             ExportFormatGeoJSON,
+	"application/gpx+xml":                  ExportFormatGPX,
+	"application/vnd.google-earth.kml+xml": ExportFormatKML,
+	"text/calendar":                        ExportFormatICS,
+}
+
+// Itinerary is a planned journey: a walk from the origin to the boarding stop,
+// the bus route between the stops and a walk from the alighting stop to the
+// destination. The service date is the day the route's timetable times count from
+type Itinerary struct {
+	Route       busRouteJSON
+	Origin      maps.LatLng
+	Destination maps.LatLng
+	ServiceDate time.Time
+}
+
+// WalkLeg is a walk between two points, following the path walked along the
+// pedestrian graph where there is one and in a straight line otherwise
+type WalkLeg struct {
+	From           maps.LatLng
+	To             maps.LatLng
+	FromName       string
+	ToName         string
+	DistanceMetres float64
+	Path           []maps.LatLng
+}
+
+// Points returns the points the walk passes through, from start to finish
+func (walk WalkLeg) Points() []maps.LatLng {
+
+	if len(walk.Path) > 1 {
+		return walk.Path
+	}
+
+	return []maps.LatLng{walk.From, walk.To}
+}
+
+// walkAlong fills in the distance and path of the walk from the walk found
+// along the pedestrian graph, if there is one
+func (walk WalkLeg) walkAlong(path *WalkPath) WalkLeg {
+
+	if path != nil {
+		walk.DistanceMetres = path.DistanceMetres
+		walk.Path = path.Path
+	}
+
+	return walk
+}
+
+// NegotiateExportFormat takes in the format query parameter and the Accept
+// header of a request and returns the export format asked for. The parameter
+// takes precedence and must name a known format. Otherwise the known media type
+// in the Accept header with the highest quality is used, falling back to JSON
+// so that browsers and clients that accept anything get the normal response
+func NegotiateExportFormat(format string, accept string) (string, error) {
+
+	format = strings.ToLower(strings.TrimSpace(format))
+	if format != "" {
+		if _, ok := itineraryExporters[format]; ok || format == ExportFormatJSON {
+			return format, nil
+		}
+		return "", errors.New("unknown export format '" + format + "'")
+	}
+
+	bestFormat, bestQuality := ExportFormatJSON, 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		parts := strings.Split(mediaRange, ";")
+		mediaFormat, ok := exportMediaTypes[strings.ToLower(strings.TrimSpace(parts[0]))]
+		if !ok {
+			continue
+		}
+
+		quality := 1.0
+		for _, parameter := range parts[1:] {
+			name, value, found := strings.Cut(strings.TrimSpace(parameter), "=")
+			if found && strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = parsed
+				}
+			}
+		}
+
+		if quality > bestQuality {
+			bestFormat, bestQuality = mediaFormat, quality
+		}
+	}
+
+	return bestFormat, nil
+}
+
+// WriteItineraryExport renders the itineraries in the given export format and
+// writes them as the response, as a file download
+func WriteItineraryExport(c *gin.Context, format string, itineraries []Itinerary) {
+
+	exporter, ok := itineraryExporters[format]
+	if !ok {
+		c.IndentedJSON(http.StatusBadRequest, "Unknown export format")
+		return
+	}
+
+	body, err := exporter.render(itineraries)
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not export journeys", "format", format, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Journeys could not be exported")
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="journey.`+exporter.extension+`"`)
+	c.Data(http.StatusOK, exporter.contentType, body)
+}
+
+// NewItineraries takes in the matched routes along with the origin and
+// destination of the journey and the time asked for, and returns an Itinerary
+// for each route
+func NewItineraries(routes []busRouteJSON, origin maps.LatLng, destination maps.LatLng,
+	requestTime time.Time) []Itinerary {
+
+	serviceDate, _ := ServiceDay(requestTime)
+
+	itineraries := []Itinerary{}
+	for _, route := range routes {
+		itineraries = append(itineraries, Itinerary{
+			Route:       route,
+			Origin:      origin,
+			Destination: destination,
+			ServiceDate: serviceDate,
+		})
+	}
+
+	return itineraries
+}
+
+// StopTime returns the instant a timetable time on the route falls on,
+// reporting false if the time can't be read
+func (itinerary Itinerary) StopTime(serviceTime string) (time.Time, bool) {
+
+	seconds, ok := parseServiceTime(serviceTime)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return ServiceDayStart(itinerary.ServiceDate).Add(time.Duration(seconds) * time.Second), true
+}
+
+// Departure returns the scheduled departure from the boarding stop
+func (itinerary Itinerary) Departure() (time.Time, bool) {
+
+	if len(itinerary.Route.Stops) == 0 {
+		return time.Time{}, false
+	}
+
+	boarding := itinerary.Route.Stops[0]
+	if departure, ok := itinerary.StopTime(boarding.DepartureTime); ok {
+		return departure, true
+	}
+
+	return itinerary.StopTime(boarding.ArrivalTime)
+}
+
+// EstimatedArrival returns the estimated arrival at the alighting stop, being
+// the departure plus the predicted travel time, or the timetabled arrival where
+// there is no travel time
+func (itinerary Itinerary) EstimatedArrival() (time.Time, bool) {
+
+	departure, ok := itinerary.Departure()
+	if ok && itinerary.Route.TravelTime.TransitTime > 0 {
+		return departure.Add(time.Duration(itinerary.Route.TravelTime.TransitTime) * time.Minute), true
+	}
+	if len(itinerary.Route.Stops) == 0 {
+		return time.Time{}, false
+	}
+
+	return itinerary.StopTime(itinerary.Route.Stops[len(itinerary.Route.Stops)-1].ArrivalTime)
+}
+
+// BoardingStop returns the stop the bus is boarded at
+func (itinerary Itinerary) BoardingStop() (RouteStop, bool) {
+
+	if len(itinerary.Route.Stops) == 0 {
+		return RouteStop{}, false
+	}
+
+	return itinerary.Route.Stops[0], true
+}
+
+// AlightingStop returns the stop the bus is left at
+func (itinerary Itinerary) AlightingStop() (RouteStop, bool) {
+
+	if len(itinerary.Route.Stops) == 0 {
+		return RouteStop{}, false
+	}
+
+	return itinerary.Route.Stops[len(itinerary.Route.Stops)-1], true
+}
+
+// WalkLegs returns the walk from the origin to the boarding stop and the walk
+// from the alighting stop to the destination, using the walks attached to the
+// route where there are any
+func (itinerary Itinerary) WalkLegs() (WalkLeg, WalkLeg, bool) {
+
+	boarding, ok := itinerary.BoardingStop()
+	if !ok {
+		return WalkLeg{}, WalkLeg{}, false
+	}
+	alighting, _ := itinerary.AlightingStop()
+
+	boardingPoint := maps.LatLng{Lat: boarding.StopLat, Lng: boarding.StopLon}
+	alightingPoint := maps.LatLng{Lat: alighting.StopLat, Lng: alighting.StopLon}
+
+	access := WalkLeg{From: itinerary.Origin, To: boardingPoint, FromName: "Origin", ToName: boarding.StopName,
+		DistanceMetres: math.Round(distanceMetres(itinerary.Origin.Lat, itinerary.Origin.Lng,
+			boardingPoint.Lat, boardingPoint.Lng))}
+	egress := WalkLeg{From: alightingPoint, To: itinerary.Destination, FromName: alighting.StopName,
+		ToName: "Destination", DistanceMetres: math.Round(distanceMetres(alightingPoint.Lat, alightingPoint.Lng,
+			itinerary.Destination.Lat, itinerary.Destination.Lng))}
+
+	return access.walkAlong(itinerary.Route.AccessWalk), egress.walkAlong(itinerary.Route.EgressWalk), true
+}
+
+// RidePath returns the points the bus follows between the boarding and
+// alighting stops, using the stops themselves where the route has no shape
+func (itinerary Itinerary) RidePath() []maps.LatLng {
+
+	path := []maps.LatLng{}
+	for _, point := range itinerary.Route.Shapes {
+		path = append(path, maps.LatLng{Lat: point.ShapePtLat, Lng: point.ShapePtLon})
+	}
+	if len(path) == 0 {
+		for _, stop := range itinerary.Route.Stops {
+			path = append(path, maps.LatLng{Lat: stop.StopLat, Lng: stop.StopLon})
+		}
+	}
+
+	return path
+}
+
+// Title returns a short name for the itinerary, such as "46A at 07:05"
+func (itinerary Itinerary) Title() string {
+
+	title := "Route " + itinerary.Route.RouteNum
+	if departure, ok := itinerary.Departure(); ok {
+		title = itinerary.Route.RouteNum + " at " + departure.In(dublinLocation).Format("15:04")
+	}
+
+	return title
+}
+
+// stopRole describes a stop's place in the itinerary
+func stopRole(index int, stops []RouteStop) string {
+
+	switch index {
+	case 0:
+		return "boarding"
+	case len(stops) - 1:
+		return "alighting"
+	default:
+		return "intermediate"
+	}
+}
+
+// geoJSONFeatureCollection is a GeoJSON FeatureCollection
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// geoJSONFeature is a GeoJSON Feature
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   GeoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// geoJSONPosition returns a point as a GeoJSON position, longitude first
+func geoJSONPosition(point maps.LatLng) [2]float64 {
+	return [2]float64{point.Lng, point.Lat}
+}
+
+// geoJSONLine returns a path as a GeoJSON LineString
+func geoJSONLine(path []maps.LatLng) GeoJSONGeometry {
+
+	coordinates := make([][2]float64, 0, len(path))
+	for _, point := range path {
+		coordinates = append(coordinates, geoJSONPosition(point))
+	}
+
+	return GeoJSONGeometry{Type: "LineString", Coordinates: coordinates}
+}
+
+// RenderGeoJSON renders the itineraries as a GeoJSON FeatureCollection. Each
+// itinerary has LineString features for its walks and bus ride and a Point
+// feature for each stop, with flat properties so that they show as columns
+// in GIS tools. The itinerary property numbers the itinerary each belongs to
+func RenderGeoJSON(itineraries []Itinerary) ([]byte, error) {
+
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: []geoJSONFeature{}}
+	addFeature := func(geometry GeoJSONGeometry, properties map[string]interface{}) {
+		collection.Features = append(collection.Features,
+			geoJSONFeature{Type: "Feature", Geometry: geometry, Properties: properties})
+	}
+	walkProperties := func(index int, walk WalkLeg) map[string]interface{} {
+		return map[string]interface{}{
+			"itinerary": index, "leg": "walk", "from": walk.FromName, "to": walk.ToName,
+			"distance_metres": walk.DistanceMetres,
+		}
+	}
+
+	for index, itinerary := range itineraries {
+		access, egress, hasStops := itinerary.WalkLegs()
+		if !hasStops {
+			continue
+		}
+		boarding, _ := itinerary.BoardingStop()
+		alighting, _ := itinerary.AlightingStop()
+
+		addFeature(geoJSONLine(access.Points()), walkProperties(index, access))
+
+		rideProperties := map[string]interface{}{
+			"itinerary": index, "leg": "bus", "route_num": itinerary.Route.RouteNum,
+			"direction": itinerary.Route.Direction, "from": boarding.StopName, "to": alighting.StopName,
+			"stops": len(itinerary.Route.Stops), "travel_time_minutes": itinerary.Route.TravelTime.TransitTime,
+			"travel_time_source": itinerary.Route.TravelTime.Source,
+			"fare_adult_leap":    itinerary.Route.Fares.AdultLeap, "fare_adult_cash": itinerary.Route.Fares.AdultCash,
+			"fare_student_leap": itinerary.Route.Fares.StudentLeap,
+			"fare_child_leap":   itinerary.Route.Fares.ChildLeap, "fare_child_cash": itinerary.Route.Fares.ChildCash,
+		}
+		if departure, ok := itinerary.Departure(); ok {
+			rideProperties["scheduled_departure"] = departure.In(dublinLocation).Format(time.RFC3339)
+		}
+		if arrival, ok := itinerary.EstimatedArrival(); ok {
+			rideProperties["estimated_arrival"] = arrival.In(dublinLocation).Format(time.RFC3339)
+		}
+		addFeature(geoJSONLine(itinerary.RidePath()), rideProperties)
+
+		for stopIndex, stop := range itinerary.Route.Stops {
+			stopProperties := map[string]interface{}{
+				"itinerary": index, "leg": "stop", "role": stopRole(stopIndex, itinerary.Route.Stops),
+				"stop_number": stop.StopNumber, "stop_name": stop.StopName, "stop_sequence": stop.StopSequence,
+				"arrival_time": stop.ArrivalTime, "departure_time": stop.DepartureTime,
+			}
+			addFeature(GeoJSONGeometry{Type: "Point",
+				Coordinates: geoJSONPosition(maps.LatLng{Lat: stop.StopLat, Lng: stop.StopLon})}, stopProperties)
+		}
+
+		addFeature(geoJSONLine(egress.Points()), walkProperties(index, egress))
+	}
+
+	return json.MarshalIndent(collection, "", "  ")
+}
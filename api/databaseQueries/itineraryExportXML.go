@@ -0,0 +1,235 @@
+package databaseQueries
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+// exportCreator is the name given as the creator of exported files
+const exportCreator = "Dublin Bus DIY"
+
+// gpxDocument is a GPX 1.1 document holding a waypoint for each boarding and
+// alighting stop and a track for each itinerary
+type gpxDocument struct {
+	XMLName   xml.Name      `xml:"gpx"`
+	Version   string        `xml:"version,attr"`
+	Creator   string        `xml:"creator,attr"`
+	Namespace string        `xml:"xmlns,attr"`
+	Metadata  gpxMetadata   `xml:"metadata"`
+	Waypoints []gpxWaypoint `xml:"wpt"`
+	Tracks    []gpxTrack    `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string `xml:"name"`
+}
+
+// gpxWaypoint is a GPX point, used both for waypoints and track points
+type gpxWaypoint struct {
+	Lat         float64 `xml:"lat,attr"`
+	Lon         float64 `xml:"lon,attr"`
+	Time        string  `xml:"time,omitempty"`
+	Name        string  `xml:"name,omitempty"`
+	Description string  `xml:"desc,omitempty"`
+	Type        string  `xml:"type,omitempty"`
+}
+
+// gpxTrack is a GPX track made of the walk to the boarding stop, the bus ride
+// and the walk from the alighting stop, each as its own segment
+type gpxTrack struct {
+	Name        string            `xml:"name"`
+	Description string            `xml:"desc,omitempty"`
+	Segments    []gpxTrackSegment `xml:"trkseg"`
+}
+
+type gpxTrackSegment struct {
+	Points []gpxWaypoint `xml:"trkpt"`
+}
+
+// gpxSegment returns a path as a GPX track segment
+func gpxSegment(path []maps.LatLng) gpxTrackSegment {
+
+	segment := gpxTrackSegment{}
+	for _, point := range path {
+		segment.Points = append(segment.Points, gpxWaypoint{Lat: point.Lat, Lon: point.Lng})
+	}
+
+	return segment
+}
+
+// RenderGPX renders the itineraries as a GPX 1.1 document. The boarding and
+// alighting stops are waypoints with their scheduled times, and each itinerary
+// is a track with separate segments for its walks and bus ride
+func RenderGPX(itineraries []Itinerary) ([]byte, error) {
+
+	document := gpxDocument{
+		Version:   "1.1",
+		Creator:   exportCreator,
+		Namespace: "http://www.topografix.com/GPX/1/1",
+		Metadata:  gpxMetadata{Name: "Planned journeys"},
+	}
+
+	for _, itinerary := range itineraries {
+		access, egress, hasStops := itinerary.WalkLegs()
+		if !hasStops {
+			continue
+		}
+		boarding, _ := itinerary.BoardingStop()
+		alighting, _ := itinerary.AlightingStop()
+
+		boardingPoint := gpxWaypoint{Lat: boarding.StopLat, Lon: boarding.StopLon, Type: "boarding",
+			Name:        stopLabel(boarding),
+			Description: "Board route " + itinerary.Route.RouteNum}
+		if departure, ok := itinerary.Departure(); ok {
+			boardingPoint.Time = departure.UTC().Format(time.RFC3339)
+		}
+		alightingPoint := gpxWaypoint{Lat: alighting.StopLat, Lon: alighting.StopLon, Type: "alighting",
+			Name:        stopLabel(alighting),
+			Description: "Leave route " + itinerary.Route.RouteNum}
+		if arrival, ok := itinerary.EstimatedArrival(); ok {
+			alightingPoint.Time = arrival.UTC().Format(time.RFC3339)
+		}
+		document.Waypoints = append(document.Waypoints, boardingPoint, alightingPoint)
+
+		document.Tracks = append(document.Tracks, gpxTrack{
+			Name:        itinerary.Title(),
+			Description: itineraryDescription(itinerary),
+			Segments: []gpxTrackSegment{
+				gpxSegment(access.Points()),
+				gpxSegment(itinerary.RidePath()),
+				gpxSegment(egress.Points()),
+			},
+		})
+	}
+
+	return marshalExportXML(document)
+}
+
+// kmlDocument is a KML 2.2 document holding a folder for each itinerary
+type kmlDocument struct {
+	XMLName   xml.Name    `xml:"kml"`
+	Namespace string      `xml:"xmlns,attr"`
+	Document  kmlContents `xml:"Document"`
+}
+
+type kmlContents struct {
+	Name    string      `xml:"name"`
+	Folders []kmlFolder `xml:"Folder"`
+}
+
+type kmlFolder struct {
+	Name        string         `xml:"name"`
+	Description string         `xml:"description,omitempty"`
+	Placemarks  []kmlPlacemark `xml:"Placemark"`
+}
+
+// kmlPlacemark is a KML placemark holding either a point or a line
+type kmlPlacemark struct {
+	Name        string          `xml:"name"`
+	Description string          `xml:"description,omitempty"`
+	Point       *kmlCoordinates `xml:"Point,omitempty"`
+	LineString  *kmlCoordinates `xml:"LineString,omitempty"`
+}
+
+// kmlCoordinates holds KML coordinates, written as longitude,latitude pairs
+// separated by spaces
+type kmlCoordinates struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+// newKMLCoordinates returns a path as KML coordinates
+func newKMLCoordinates(path []maps.LatLng) *kmlCoordinates {
+
+	pairs := make([]string, 0, len(path))
+	for _, point := range path {
+		pairs = append(pairs, strconv.FormatFloat(point.Lng, 'f', -1, 64)+","+
+			strconv.FormatFloat(point.Lat, 'f', -1, 64))
+	}
+
+	return &kmlCoordinates{Coordinates: strings.Join(pairs, " ")}
+}
+
+// RenderKML renders the itineraries as a KML 2.2 document, with a folder for
+// each itinerary holding lines for its walks and bus ride and a point for
+// each stop
+func RenderKML(itineraries []Itinerary) ([]byte, error) {
+
+	document := kmlDocument{
+		Namespace: "http://www.opengis.net/kml/2.2",
+		Document:  kmlContents{Name: "Planned journeys"},
+	}
+
+	for _, itinerary := range itineraries {
+		access, egress, hasStops := itinerary.WalkLegs()
+		if !hasStops {
+			continue
+		}
+
+		folder := kmlFolder{Name: itinerary.Title(), Description: itineraryDescription(itinerary)}
+		folder.Placemarks = append(folder.Placemarks,
+			kmlPlacemark{Name: "Walk to " + access.ToName,
+				Description: fmt.Sprintf("%.0f metres", access.DistanceMetres),
+				LineString:  newKMLCoordinates(access.Points())},
+			kmlPlacemark{Name: "Route " + itinerary.Route.RouteNum,
+				LineString: newKMLCoordinates(itinerary.RidePath())})
+
+		for stopIndex, stop := range itinerary.Route.Stops {
+			folder.Placemarks = append(folder.Placemarks, kmlPlacemark{
+				Name:        stopLabel(stop),
+				Description: stopRole(stopIndex, itinerary.Route.Stops) + " stop, scheduled " + stop.DepartureTime,
+				Point:       newKMLCoordinates([]maps.LatLng{{Lat: stop.StopLat, Lng: stop.StopLon}}),
+			})
+		}
+
+		folder.Placemarks = append(folder.Placemarks, kmlPlacemark{Name: "Walk from " + egress.FromName,
+			Description: fmt.Sprintf("%.0f metres", egress.DistanceMetres),
+			LineString:  newKMLCoordinates(egress.Points())})
+
+		document.Document.Folders = append(document.Document.Folders, folder)
+	}
+
+	return marshalExportXML(document)
+}
+
+// marshalExportXML returns the document as indented XML with an XML header
+func marshalExportXML(document interface{}) ([]byte, error) {
+
+	body, err := xml.MarshalIndent(document, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(xml.Header), body...), nil
+}
+
+// stopLabel returns the name of a stop along with its number
+func stopLabel(stop RouteStop) string {
+	return stop.StopName + " (" + stop.StopNumber + ")"
+}
+
+// itineraryDescription returns a line describing the itinerary, with the stops,
+// times and adult Leap fare
+func itineraryDescription(itinerary Itinerary) string {
+
+	boarding, _ := itinerary.BoardingStop()
+	alighting, _ := itinerary.AlightingStop()
+
+	description := "Route " + itinerary.Route.RouteNum + " from " + stopLabel(boarding) +
+		" to " + stopLabel(alighting)
+	if departure, ok := itinerary.Departure(); ok {
+		description += ", departing " + departure.In(dublinLocation).Format("15:04")
+	}
+	if arrival, ok := itinerary.EstimatedArrival(); ok {
+		description += ", arriving about " + arrival.In(dublinLocation).Format("15:04")
+	}
+	if itinerary.Route.Fares.AdultLeap > 0 {
+		description += fmt.Sprintf(", adult Leap fare €%.2f", itinerary.Route.Fares.AdultLeap)
+	}
+
+	return description
+}
@@ -0,0 +1,162 @@
+package databaseQueries
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+// testItinerary returns an itinerary on route 46A between two stops, with a
+// predicted travel time of 12 minutes
+func testItinerary() Itinerary {
+	return Itinerary{
+		Route: busRouteJSON{
+			RouteNum:  "46A",
+			Direction: "1",
+			Stops: []RouteStop{
+				{StopNumber: "2039", StopName: "Stillorgan", StopLat: 53.29, StopLon: -6.2,
+					ArrivalTime: "07:05:00", DepartureTime: "07:05:00"},
+				{StopNumber: "2040", StopName: "Donnybrook", StopLat: 53.32, StopLon: -6.23,
+					ArrivalTime: "07:20:00", DepartureTime: "07:20:00"},
+			},
+			Shapes: []ShapeJSON{
+				{ShapePtLat: 53.29, ShapePtLon: -6.2},
+				{ShapePtLat: 53.30, ShapePtLon: -6.21},
+				{ShapePtLat: 53.32, ShapePtLon: -6.23},
+			},
+			Fares:      busFares{AdultLeap: 2},
+			TravelTime: TravelTimePrediction{Source: "prediction", TransitTime: 12},
+		},
+		Origin:      maps.LatLng{Lat: 53.288, Lng: -6.199},
+		Destination: maps.LatLng{Lat: 53.321, Lng: -6.231},
+		ServiceDate: time.Date(2022, time.June, 15, 0, 0, 0, 0, dublinLocation),
+	}
+}
+
+func TestNegotiateExportFormat(t *testing.T) {
+
+	cases := []struct {
+		format   string
+		accept   string
+		expected string
+	}{
+		{"", "", ExportFormatJSON},
+		{"", "text/html,application/xhtml+xml,*/*;q=0.8", ExportFormatJSON},
+		{"", "application/gpx+xml", ExportFormatGPX},
+		{"", "application/json;q=0.5, application/geo+json", ExportFormatGeoJSON},
+		{"", "application/vnd.google-earth.kml+xml;q=0.9, application/json;q=0.1", ExportFormatKML},
+		{"KML", "application/gpx+xml", ExportFormatKML},
+		{"", "text/calendar", ExportFormatICS},
+	}
+
+	for _, testCase := range cases {
+		format, err := NegotiateExportFormat(testCase.format, testCase.accept)
+		if err != nil || format != testCase.expected {
+			t.Log("Expected", testCase.expected, "for", testCase.format, testCase.accept, "but got", format, err)
+			t.Fail()
+		}
+	}
+
+	if _, err := NegotiateExportFormat("shapefile", ""); err == nil {
+		t.Log("Expected an unknown format to be rejected")
+		t.Fail()
+	}
+}
+
+func TestItineraryTimes(t *testing.T) {
+
+	itinerary := testItinerary()
+
+	departure, ok := itinerary.Departure()
+	if !ok || departure.Format(time.RFC3339) != "2022-06-15T07:05:00+01:00" {
+		t.Log("Unexpected departure", departure, ok)
+		t.Fail()
+	}
+
+	arrival, ok := itinerary.EstimatedArrival()
+	if !ok || arrival.Format(time.RFC3339) != "2022-06-15T07:17:00+01:00" {
+		t.Log("Expected the arrival to use the predicted travel time but got", arrival, ok)
+		t.Fail()
+	}
+
+	itinerary.Route.TravelTime = TravelTimePrediction{}
+	arrival, ok = itinerary.EstimatedArrival()
+	if !ok || arrival.Format(time.RFC3339) != "2022-06-15T07:20:00+01:00" {
+		t.Log("Expected the arrival to fall back to the timetable but got", arrival, ok)
+		t.Fail()
+	}
+}
+
+func TestRenderGeoJSON(t *testing.T) {
+
+	body, err := RenderGeoJSON([]Itinerary{testItinerary()})
+	if err != nil {
+		t.Log("Could not render GeoJSON:", err)
+		t.FailNow()
+	}
+
+	var collection struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Type string `json:"type"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err = json.Unmarshal(body, &collection); err != nil {
+		t.Log("Could not read GeoJSON:", err)
+		t.FailNow()
+	}
+
+	// A walk, the ride, two stops and a walk
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 5 {
+		t.Log("Unexpected feature collection", string(body))
+		t.FailNow()
+	}
+	ride := collection.Features[1]
+	if ride.Geometry.Type != "LineString" || ride.Properties["route_num"] != "46A" ||
+		ride.Properties["scheduled_departure"] != "2022-06-15T07:05:00+01:00" {
+		t.Log("Unexpected ride feature", ride)
+		t.Fail()
+	}
+	if collection.Features[2].Geometry.Type != "Point" || collection.Features[2].Properties["role"] != "boarding" {
+		t.Log("Unexpected stop feature", collection.Features[2])
+		t.Fail()
+	}
+}
+
+func TestRenderGPXAndKML(t *testing.T) {
+
+	gpx, err := RenderGPX([]Itinerary{testItinerary()})
+	if err != nil {
+		t.Log("Could not render GPX:", err)
+		t.FailNow()
+	}
+	var gpxDocument gpxDocument
+	if err = xml.Unmarshal(gpx, &gpxDocument); err != nil {
+		t.Log("Could not read GPX:", err)
+		t.FailNow()
+	}
+	if len(gpxDocument.Waypoints) != 2 || gpxDocument.Waypoints[0].Time != "2022-06-15T06:05:00Z" ||
+		len(gpxDocument.Tracks) != 1 || len(gpxDocument.Tracks[0].Segments) != 3 ||
+		len(gpxDocument.Tracks[0].Segments[1].Points) != 3 {
+		t.Log("Unexpected GPX", string(gpx))
+		t.Fail()
+	}
+
+	kml, err := RenderKML([]Itinerary{testItinerary()})
+	if err != nil {
+		t.Log("Could not render KML:", err)
+		t.FailNow()
+	}
+	if !strings.Contains(string(kml), "<coordinates>-6.2,53.29 -6.21,53.3 -6.23,53.32</coordinates>") ||
+		!strings.Contains(string(kml), "<name>46A at 07:05</name>") {
+		t.Log("Unexpected KML", string(kml))
+		t.Fail()
+	}
+}
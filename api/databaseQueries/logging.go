@@ -0,0 +1,259 @@
+package databaseQueries
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LogLevel is the severity of a log entry. Entries below the level set on a
+// Logger are dropped
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level as written in each log entry
+func (level LogLevel) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLogLevel takes in the name of a level ("debug", "info", "warn" or
+// "error", in any case) and returns the matching LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// requestIDHeader is the header used to pass a request id in from a proxy in
+// front of the api and to return the id used back to the caller
+const requestIDHeader = "X-Request-ID"
+
+// loggerContextKey is the key under which a Logger is stored in a context
+type loggerContextKey struct{}
+
+// loggerOutput is the destination and minimum level shared by a Logger and
+// every Logger derived from it using With
+type loggerOutput struct {
+	lock   sync.Mutex
+	writer io.Writer
+	level  LogLevel
+}
+
+// Logger writes structured log entries as one JSON object per line, each with
+// the time, level and message as well as any fields attached to the Logger
+// using With and any key value pairs passed in with the entry itself
+type Logger struct {
+	output *loggerOutput
+	fields []interface{}
+}
+
+// NewLogger returns a Logger writing entries at or above level to writer
+func NewLogger(writer io.Writer, level LogLevel) *Logger {
+	return &Logger{output: &loggerOutput{writer: writer, level: level}}
+}
+
+// defaultLogger is used wherever there is no request specific Logger, with its
+// level taken from the LOG_LEVEL environment variable
+var defaultLogger = newDefaultLogger()
+
+// newDefaultLogger creates the Logger used to initialise defaultLogger
+func newDefaultLogger() *Logger {
+
+	level, err := ParseLogLevel(os.Getenv("LOG_LEVEL"))
+	logger := NewLogger(os.Stderr, level)
+	if err != nil {
+		logger.Warn("invalid LOG_LEVEL, using info", "error", err)
+	}
+
+	return logger
+}
+
+// DefaultLogger returns the Logger used by the package when no request
+// specific Logger is available
+func DefaultLogger() *Logger {
+	return defaultLogger
+}
+
+// SetLevel changes the minimum level written by the Logger and every Logger
+// sharing its output
+func (logger *Logger) SetLevel(level LogLevel) {
+
+	logger.output.lock.Lock()
+	defer logger.output.lock.Unlock()
+
+	logger.output.level = level
+}
+
+// With returns a Logger that adds the given key value pairs to every entry it
+// writes as well as those already attached to this Logger
+func (logger *Logger) With(keyvals ...interface{}) *Logger {
+
+	fields := make([]interface{}, 0, len(logger.fields)+len(keyvals))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, keyvals...)
+
+	return &Logger{output: logger.output, fields: fields}
+}
+
+// Debug writes an entry at debug level with the given key value pairs
+func (logger *Logger) Debug(message string, keyvals ...interface{}) {
+	logger.write(LevelDebug, message, keyvals)
+}
+
+// Info writes an entry at info level with the given key value pairs
+func (logger *Logger) Info(message string, keyvals ...interface{}) {
+	logger.write(LevelInfo, message, keyvals)
+}
+
+// Warn writes an entry at warn level with the given key value pairs
+func (logger *Logger) Warn(message string, keyvals ...interface{}) {
+	logger.write(LevelWarn, message, keyvals)
+}
+
+// Error writes an entry at error level with the given key value pairs
+func (logger *Logger) Error(message string, keyvals ...interface{}) {
+	logger.write(LevelError, message, keyvals)
+}
+
+// write builds the entry as a JSON object and writes it out if its level is at
+// or above the level of the Logger. Errors are written as their message and a
+// key without a value is given the value "MISSING"
+func (logger *Logger) write(level LogLevel, message string, keyvals []interface{}) {
+
+	logger.output.lock.Lock()
+	defer logger.output.lock.Unlock()
+
+	if level < logger.output.level {
+		return
+	}
+
+	entry := map[string]interface{}{
+		"time":  time.Now().Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   message,
+	}
+
+	allKeyvals := append(append([]interface{}{}, logger.fields...), keyvals...)
+	for index := 0; index < len(allKeyvals); index += 2 {
+		key := fmt.Sprint(allKeyvals[index])
+		var value interface{} = "MISSING"
+		if index+1 < len(allKeyvals) {
+			value = allKeyvals[index+1]
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+
+	encodedEntry, err := json.Marshal(entry)
+	if err != nil {
+		encodedEntry, _ = json.Marshal(map[string]interface{}{
+			"time": entry["time"], "level": entry["level"], "msg": message, "log_error": err.Error()})
+	}
+
+	logger.output.writer.Write(append(encodedEntry, '\n'))
+}
+
+// ContextWithLogger returns a copy of the context carrying the given Logger
+func ContextWithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// LoggerFromContext returns the Logger carried by the context, which for
+// requests to the api includes the request id, or the default Logger if the
+// context carries none
+func LoggerFromContext(ctx context.Context) *Logger {
+
+	if ctx != nil {
+		if logger, ok := ctx.Value(loggerContextKey{}).(*Logger); ok {
+			return logger
+		}
+	}
+
+	return defaultLogger
+}
+
+// newRequestID returns a random 16 character hex string to identify a request
+func newRequestID() string {
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(idBytes)
+}
+
+// RequestLogger is gin middleware that gives each request an id, taken from the
+// X-Request-ID header if the caller sent one and generated otherwise, and returns
+// it in the same header. A Logger carrying the id is attached to the context of
+// the request for handlers to use and a single entry is logged for each request
+// once it has been handled, with its route, status and latency
+func RequestLogger() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" || len(requestID) > 64 {
+			requestID = newRequestID()
+		}
+		c.Header(requestIDHeader, requestID)
+
+		logger := defaultLogger.With("request_id", requestID)
+		c.Request = c.Request.WithContext(ContextWithLogger(c.Request.Context(), logger))
+
+		start := time.Now()
+		c.Next()
+
+		level := LevelInfo
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = LevelError
+		} else if c.Writer.Status() >= http.StatusBadRequest {
+			level = LevelWarn
+		}
+		logger.write(level, "request handled", []interface{}{
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip", c.ClientIP(),
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package databaseQueries
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoggerWritesJSONAtOrAboveLevel(t *testing.T) {
+
+	var output bytes.Buffer
+	testLogger := NewLogger(&output, LevelInfo).With("request_id", "abc")
+
+	testLogger.Debug("dropped")
+	testLogger.Warn("kept", "route", "46A", "error", errors.New("timeout"))
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 1 {
+		t.Log("Expected exactly one entry but got", len(lines))
+		t.FailNow()
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Log("Entry should be valid JSON:", err)
+		t.FailNow()
+	}
+	if entry["level"] != "warn" || entry["msg"] != "kept" {
+		t.Log("Unexpected level or message in entry", entry)
+		t.Fail()
+	}
+	if entry["request_id"] != "abc" || entry["route"] != "46A" || entry["error"] != "timeout" {
+		t.Log("Fields missing from entry", entry)
+		t.Fail()
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+
+	if level, err := ParseLogLevel("DEBUG"); err != nil || level != LevelDebug {
+		t.Log("'DEBUG' should parse as debug level")
+		t.Fail()
+	}
+	if level, err := ParseLogLevel(""); err != nil || level != LevelInfo {
+		t.Log("An empty level should default to info")
+		t.Fail()
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Log("An unknown level should return an error")
+		t.Fail()
+	}
+}
+
+func TestRequestLoggerAttachesRequestID(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	var output bytes.Buffer
+	previousLogger := defaultLogger
+	defaultLogger = NewLogger(&output, LevelDebug)
+	defer func() { defaultLogger = previousLogger }()
+
+	router := gin.New()
+	router.Use(RequestLogger())
+	router.GET("/test", func(c *gin.Context) {
+		LoggerFromContext(c.Request.Context()).Info("handling")
+		c.Status(http.StatusOK)
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "/test", nil)
+	request.Header.Set(requestIDHeader, "test-id")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Header().Get(requestIDHeader) != "test-id" {
+		t.Log("Request id sent in should be returned in the response header")
+		t.Fail()
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 {
+		t.Log("Expected an entry from the handler and one for the request but got", len(lines))
+		t.FailNow()
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `"request_id":"test-id"`) {
+			t.Log("Entry is missing the request id:", line)
+			t.Fail()
+		}
+	}
+	if !strings.Contains(lines[1], `"route":"/test"`) || !strings.Contains(lines[1], `"status":200`) {
+		t.Log("Request entry is missing its route or status:", lines[1])
+		t.Fail()
+	}
+}
@@ -0,0 +1,547 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"googlemaps.github.io/maps"
+)
+
+// matrixStreamType is the content type of a streamed travel time matrix, which
+// is sent as one JSON MatrixRow per line
+const matrixStreamType = "application/x-ndjson"
+
+// statusClientClosedRequest is the status logged for a matrix request given up
+// on by the client before it was planned, as nginx does
+const statusClientClosedRequest = 499
+
+// MatrixPoint is an origin or destination of a travel time matrix, such as the
+// centre of a zone
+type MatrixPoint struct {
+	Id  string  `json:"id"`
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// MatrixRequest is the body of a travel time matrix request. The departure is
+// read as by ParseRequestTime and is now when it isn't given
+type MatrixRequest struct {
+	Origins      []MatrixPoint `json:"origins"`
+	Destinations []MatrixPoint `json:"destinations"`
+	Departure    string        `json:"departure"`
+	Wheelchair   bool          `json:"wheelchair"`
+}
+
+// MatrixQuery is a travel time matrix to be planned, with every journey leaving
+// at the departure and planned with the options
+type MatrixQuery struct {
+	Origins      []MatrixPoint
+	Destinations []MatrixPoint
+	Departure    time.Time
+	Options      RouteOptions
+}
+
+// MatrixCell is the fastest journey found from an origin to a destination, with
+// the fare being the sum of the fares of each bus taken
+type MatrixCell struct {
+	Minutes   int      `json:"minutes"`
+	Transfers int      `json:"transfers"`
+	Fare      busFares `json:"fare"`
+}
+
+// MatrixRow is the journeys from an origin to each destination, in the order
+// the destinations were given, with nil for those that can't be reached within
+// the configured longest journey
+type MatrixRow struct {
+	Origin string        `json:"origin"`
+	Cells  []*MatrixCell `json:"cells"`
+}
+
+// MatrixStreamEnd is the last line of a streamed matrix, giving the number of
+// rows sent and, where the matrix couldn't be finished, why, so that a client
+// can tell a whole matrix from one cut short
+type MatrixStreamEnd struct {
+	Complete bool   `json:"complete"`
+	Rows     int    `json:"rows"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Matrix is a travel time matrix returned in full rather than streamed
+type Matrix struct {
+	Departure    string      `json:"departure"`
+	Destinations []string    `json:"destinations"`
+	Rows         []MatrixRow `json:"rows"`
+}
+
+// Query checks the request and returns the MatrixQuery it asks for. Points
+// without an id are given their place in the list as one
+func (request MatrixRequest) Query() (MatrixQuery, error) {
+
+	query := MatrixQuery{Options: RouteOptions{Wheelchair: request.Wheelchair}}
+	if len(request.Origins) == 0 || len(request.Destinations) == 0 {
+		return query, errors.New("at least one origin and destination are required")
+	}
+
+	query.Departure = time.Now().In(dublinLocation)
+	if request.Departure != "" {
+		departure, err := ParseRequestTime(request.Departure)
+		if err != nil {
+			return query, errors.New("invalid departure")
+		}
+		query.Departure = departure
+	}
+
+	var err error
+	if query.Origins, err = checkMatrixPoints(request.Origins); err != nil {
+		return query, fmt.Errorf("invalid origin: %w", err)
+	}
+	if query.Destinations, err = checkMatrixPoints(request.Destinations); err != nil {
+		return query, fmt.Errorf("invalid destination: %w", err)
+	}
+
+	return query, nil
+}
+
+// checkMatrixPoints returns a copy of the points with their ids filled in,
+// refusing any point out of range
+func checkMatrixPoints(points []MatrixPoint) ([]MatrixPoint, error) {
+
+	checked := make([]MatrixPoint, len(points))
+	for index, point := range points {
+		if math.Abs(point.Lat) > 90 || math.Abs(point.Lon) > 180 {
+			return nil, fmt.Errorf("%d is out of range", index)
+		}
+		if point.Id == "" {
+			point.Id = strconv.Itoa(index)
+		}
+		checked[index] = point
+	}
+
+	return checked, nil
+}
+
+// Cells returns the number of journeys in the matrix
+func (query MatrixQuery) Cells() int {
+	return len(query.Origins) * len(query.Destinations)
+}
+
+// matrixEgress is a stop a destination can be walked to from, with the seconds
+// the walk takes
+type matrixEgress struct {
+	stop    int32
+	seconds int64
+}
+
+// matrixPlanner plans the rows of a matrix over a network. The walks from each
+// destination to its nearby stops are found once and shared by every origin
+type matrixPlanner struct {
+	network *TransitNetwork
+	query   MatrixQuery
+	limit   time.Time
+	egress  [][]matrixEgress
+}
+
+// newMatrixPlanner returns the matrixPlanner of the query over the network
+func newMatrixPlanner(network *TransitNetwork, query MatrixQuery) *matrixPlanner {
+
+	planner := &matrixPlanner{
+		network: network,
+		query:   query,
+		limit:   query.Departure.Add(time.Duration(currentConfig.Matrix.MaxMinutes) * time.Minute),
+		egress:  make([][]matrixEgress, len(query.Destinations)),
+	}
+
+	maxWalkMetres := longestWalkMetres(query.Options)
+	for index, destination := range query.Destinations {
+		point := maps.LatLng{Lat: destination.Lat, Lng: destination.Lon}
+		nearby := network.stopsWithin(point, maxWalkMetres)
+		targets := make([]maps.LatLng, len(nearby))
+		for target, stop := range nearby {
+			targets[target] = maps.LatLng{Lat: network.stops[stop].StopLat, Lng: network.stops[stop].StopLon}
+		}
+		for target, metres := range walkingDistances(point, targets, maxWalkMetres, query.Options) {
+			if !math.IsInf(metres, 1) {
+				planner.egress[index] = append(planner.egress[index],
+					matrixEgress{stop: nearby[target], seconds: walkingSeconds(metres)})
+			}
+		}
+	}
+
+	return planner
+}
+
+// row returns the MatrixRow of the origin. The network is searched once from
+// the origin, and each destination is reached by the quickest of walking from
+// a stop reached or walking all the way from the origin
+func (planner *matrixPlanner) row(origin MatrixPoint) MatrixRow {
+
+	from := maps.LatLng{Lat: origin.Lat, Lng: origin.Lon}
+	reach := planner.network.Reach(from, planner.query.Departure, planner.limit, planner.query.Options)
+	budget := int64(planner.limit.Sub(planner.query.Departure) / time.Second)
+
+	// Destinations close enough are walked to directly
+	maxWalkMetres := longestWalkMetres(planner.query.Options)
+	walkable := []int{}
+	targets := []maps.LatLng{}
+	for index, destination := range planner.query.Destinations {
+		if distanceMetres(from.Lat, from.Lng, destination.Lat, destination.Lon) <= maxWalkMetres {
+			walkable = append(walkable, index)
+			targets = append(targets, maps.LatLng{Lat: destination.Lat, Lng: destination.Lon})
+		}
+	}
+	walks := map[int]int64{}
+	for target, metres := range walkingDistances(from, targets, maxWalkMetres, planner.query.Options) {
+		if !math.IsInf(metres, 1) {
+			walks[walkable[target]] = walkingSeconds(metres)
+		}
+	}
+
+	row := MatrixRow{Origin: origin.Id, Cells: make([]*MatrixCell, len(planner.query.Destinations))}
+	for index := range planner.query.Destinations {
+		best, bestStop := int64(-1), int32(-1)
+		if seconds, ok := walks[index]; ok && seconds <= budget {
+			best = seconds
+		}
+		for _, egress := range planner.egress[index] {
+			label := reach.labels[egress.stop]
+			if !label.reached {
+				continue
+			}
+			seconds := label.arrival - reach.departure + egress.seconds
+			if seconds <= budget && (best < 0 || seconds < best) {
+				best, bestStop = seconds, egress.stop
+			}
+		}
+		if best < 0 {
+			continue
+		}
+
+		cell := &MatrixCell{Minutes: int(best / 60)}
+		if bestStop >= 0 {
+			cell.Transfers, cell.Fare = reach.transfers(bestStop), reach.fare(bestStop)
+		}
+		row.Cells[index] = cell
+	}
+
+	return row
+}
+
+// matrixOutcome is a row planned by a worker, with the index of its origin
+type matrixOutcome struct {
+	index int
+	row   MatrixRow
+}
+
+// PlanMatrix takes in the context of the request and the query and plans the
+// matrix over the timetable of the departure's service day, passing each row to
+// emit in the order of the origins as soon as it and the rows before it are
+// planned. Planning stops at the first error from emit or once the context is
+// done
+func PlanMatrix(ctx context.Context, query MatrixQuery, emit func(MatrixRow) error) error {
+
+	serviceDate, _ := ServiceDay(query.Departure)
+	network, err := transitNetworkFor(ctx, serviceDate)
+	if err != nil {
+		return err
+	}
+
+	return planMatrix(ctx, network, query, currentConfig.Matrix.Workers, emit)
+}
+
+// planMatrix does the work of PlanMatrix over the network with the number of
+// workers passed in. The workers search from the origins in turn, and the rows
+// finished out of order are held until the rows before them are emitted
+func planMatrix(ctx context.Context, network *TransitNetwork, query MatrixQuery, workers int,
+	emit func(MatrixRow) error) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(query.Origins) == 0 {
+		return nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(query.Origins) {
+		workers = len(query.Origins)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	planner := newMatrixPlanner(network, query)
+	jobs := make(chan int)
+	outcomes := make(chan matrixOutcome, workers)
+	go func() {
+		defer close(jobs)
+		for index := range query.Origins {
+			select {
+			case jobs <- index:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for worker := 0; worker < workers; worker++ {
+		go func() {
+			for index := range jobs {
+				select {
+				case outcomes <- matrixOutcome{index: index, row: planner.row(query.Origins[index])}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	waiting := map[int]MatrixRow{}
+	for next := 0; next < len(query.Origins); {
+		select {
+		case outcome := <-outcomes:
+			waiting[outcome.index] = outcome.row
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for row, ok := waiting[next]; ok; row, ok = waiting[next] {
+			if err := emit(row); err != nil {
+				return err
+			}
+			delete(waiting, next)
+			next++
+		}
+	}
+
+	return nil
+}
+
+// PostMatrix returns the travel time matrix of the MatrixRequest given as JSON
+// in the request body, as planned by PlanMatrix. Requests with more cells than
+// the configured stream size, or asking for application/x-ndjson, are streamed
+// as one MatrixRow per line as the rows are planned, followed by a
+// MatrixStreamEnd. The write deadline is extended as each row is sent, so that a
+// large matrix isn't cut off by the server's write timeout. Otherwise the whole
+// Matrix is returned at once
+func PostMatrix(c *gin.Context) {
+
+	var request MatrixRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid matrix request: "+err.Error())
+		return
+	}
+	query, err := request.Query()
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid matrix request: "+err.Error())
+		return
+	}
+	if query.Cells() > currentConfig.Matrix.MaxCells {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid matrix request: at most "+
+			strconv.Itoa(currentConfig.Matrix.MaxCells)+" origin and destination pairs may be asked for")
+		return
+	}
+
+	ctx := c.Request.Context()
+	serviceDate, _ := ServiceDay(query.Departure)
+	network, err := transitNetworkFor(ctx, serviceDate)
+	if err != nil {
+		LoggerFromContext(ctx).Error("could not load the timetable", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Matrix could not be planned")
+		return
+	}
+
+	if query.Cells() > currentConfig.Matrix.StreamCells || strings.Contains(c.GetHeader("Accept"), matrixStreamType) {
+		c.Header("Content-Type", matrixStreamType)
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		writeTimeout := time.Duration(currentConfig.Server.WriteTimeout)
+		encoder := json.NewEncoder(c.Writer)
+		end := MatrixStreamEnd{}
+		err = planMatrix(ctx, network, query, currentConfig.Matrix.Workers, func(row MatrixRow) error {
+			extendWriteDeadline(ctx, writeTimeout)
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+			c.Writer.Flush()
+			end.Rows++
+			return nil
+		})
+		end.Complete = err == nil
+		if err != nil {
+			LoggerFromContext(ctx).Warn("matrix stream ended early", "error", err)
+			end.Error = "Matrix could not be finished"
+		}
+
+		// The end is written whether or not the matrix was finished, and is
+		// lost along with the rows if the connection has failed
+		extendWriteDeadline(ctx, writeTimeout)
+		if encoder.Encode(end) == nil {
+			c.Writer.Flush()
+		}
+		return
+	}
+
+	matrix := Matrix{
+		Departure:    query.Departure.In(dublinLocation).Format(time.RFC3339),
+		Destinations: make([]string, len(query.Destinations)),
+		Rows:         make([]MatrixRow, 0, len(query.Origins)),
+	}
+	for index, destination := range query.Destinations {
+		matrix.Destinations[index] = destination.Id
+	}
+	err = planMatrix(ctx, network, query, currentConfig.Matrix.Workers, func(row MatrixRow) error {
+		matrix.Rows = append(matrix.Rows, row)
+		return nil
+	})
+	if err != nil {
+		LoggerFromContext(ctx).Warn("matrix request ended early", "error", err)
+		status := http.StatusInternalServerError
+		if errors.Is(err, context.Canceled) {
+			status = statusClientClosedRequest
+		}
+		c.IndentedJSON(status, "Matrix could not be planned")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, matrix)
+}
+
+// ReadMatrixPoints reads points from CSV with the columns id, lat and lon. A
+// first line that doesn't hold coordinates is taken to be a header
+func ReadMatrixPoints(reader io.Reader) ([]MatrixPoint, error) {
+
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = 3
+	csvReader.TrimLeadingSpace = true
+	records, err := csvReader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	points := []MatrixPoint{}
+	for index, record := range records {
+		lat, latErr := strconv.ParseFloat(record[1], 64)
+		lon, lonErr := strconv.ParseFloat(record[2], 64)
+		if latErr != nil || lonErr != nil {
+			if index == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: expected coordinates", index+1)
+		}
+		points = append(points, MatrixPoint{Id: record[0], Lat: lat, Lon: lon})
+	}
+
+	return points, nil
+}
+
+// MatrixCommand is a travel time matrix asked for on the command line, with
+// the origins and destinations read from CSV files
+type MatrixCommand struct {
+	OriginsFile      string
+	DestinationsFile string
+	Departure        string
+	Wheelchair       bool
+	Format           string
+}
+
+// ParseMatrixCommand takes in the arguments of the matrix command and returns
+// the MatrixCommand along with the arguments left after them, which are those
+// after "--" and are read as configuration flags
+func ParseMatrixCommand(args []string) (MatrixCommand, []string, error) {
+
+	command := MatrixCommand{}
+	flagSet := flag.NewFlagSet("matrix", flag.ContinueOnError)
+	flagSet.StringVar(&command.OriginsFile, "origins", "", "CSV file of origins as id,lat,lon")
+	flagSet.StringVar(&command.DestinationsFile, "destinations", "",
+		"CSV file of destinations as id,lat,lon, defaulting to the origins")
+	flagSet.StringVar(&command.Departure, "departure", "", "time of leaving, defaulting to now")
+	flagSet.BoolVar(&command.Wheelchair, "wheelchair", false, "plan journeys that can be made by wheelchair")
+	flagSet.StringVar(&command.Format, "format", "csv", "output format, csv or ndjson")
+	if err := flagSet.Parse(args); err != nil {
+		return command, nil, err
+	}
+
+	if command.OriginsFile == "" {
+		return command, nil, errors.New("an origins file is required")
+	}
+	if command.DestinationsFile == "" {
+		command.DestinationsFile = command.OriginsFile
+	}
+	if command.Format != "csv" && command.Format != "ndjson" {
+		return command, nil, errors.New("format must be csv or ndjson")
+	}
+
+	return command, flagSet.Args(), nil
+}
+
+// Run reads the origins and destinations and writes their travel time matrix
+// to the output as each row is planned. As CSV it is written with a line per
+// origin and destination, leaving the journey blank where there is none
+func (command MatrixCommand) Run(ctx context.Context, output io.Writer) error {
+
+	request := MatrixRequest{Departure: command.Departure, Wheelchair: command.Wheelchair}
+	var err error
+	if request.Origins, err = readMatrixPointsFile(command.OriginsFile); err != nil {
+		return err
+	}
+	if request.Destinations, err = readMatrixPointsFile(command.DestinationsFile); err != nil {
+		return err
+	}
+	query, err := request.Query()
+	if err != nil {
+		return err
+	}
+
+	if command.Format == "ndjson" {
+		encoder := json.NewEncoder(output)
+		return PlanMatrix(ctx, query, func(row MatrixRow) error { return encoder.Encode(row) })
+	}
+
+	writer := csv.NewWriter(output)
+	writer.Write([]string{"origin", "destination", "minutes", "transfers", "adult_leap", "adult_cash"})
+	err = PlanMatrix(ctx, query, func(row MatrixRow) error {
+		for index, cell := range row.Cells {
+			record := []string{row.Origin, query.Destinations[index].Id, "", "", "", ""}
+			if cell != nil {
+				record[2], record[3] = strconv.Itoa(cell.Minutes), strconv.Itoa(cell.Transfers)
+				record[4] = strconv.FormatFloat(cell.Fare.AdultLeap, 'f', 2, 64)
+				record[5] = strconv.FormatFloat(cell.Fare.AdultCash, 'f', 2, 64)
+			}
+			writer.Write(record)
+		}
+		writer.Flush()
+		return writer.Error()
+	})
+
+	return err
+}
+
+// readMatrixPointsFile reads the points in the CSV file at path
+func readMatrixPointsFile(path string) ([]MatrixPoint, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	points, err := ReadMatrixPoints(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return points, nil
+}
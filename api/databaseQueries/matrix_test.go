@@ -0,0 +1,260 @@
+package databaseQueries
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testMatrixDestinations are D, C2, a point a short walk from A and a point
+// too far from any stop to be reached
+var testMatrixDestinations = []MatrixPoint{
+	{Id: "D", Lat: 53.3600, Lon: -6.2200},
+	{Id: "C2", Lat: 53.3420, Lon: -6.2200},
+	{Id: "nearA", Lat: 53.3420, Lon: -6.2600},
+	{Id: "far", Lat: 53.4000, Lon: -6.4000},
+}
+
+// useTestTransitNetwork has the timetable served from the test trips until the
+// returned function is called
+func useTestTransitNetwork() func() {
+
+	findServiceTrips = func(ctx context.Context, serviceDates ...time.Time) ([]serviceTrip, error) {
+		return testServiceTrips, nil
+	}
+	sharedTransitNetworks = newTransitNetworkStore()
+
+	return func() {
+		findServiceTrips = FindServiceTrips
+		sharedTransitNetworks = newTransitNetworkStore()
+	}
+}
+
+func TestMatrixRequestQuery(t *testing.T) {
+
+	request := MatrixRequest{
+		Origins:      []MatrixPoint{{Lat: 53.34, Lon: -6.26}, {Id: "B", Lat: 53.34, Lon: -6.24}},
+		Destinations: testMatrixDestinations,
+		Departure:    "2022-11-02T08:00",
+	}
+	query, err := request.Query()
+	if err != nil || query.Origins[0].Id != "0" || query.Origins[1].Id != "B" || query.Cells() != 8 ||
+		!query.Departure.Equal(time.Date(2022, 11, 2, 8, 0, 0, 0, dublinLocation)) {
+		t.Log("Expected the request to be read with the unnamed origin given its place, got", query, err)
+		t.Fail()
+	}
+
+	for _, invalid := range []MatrixRequest{
+		{Destinations: testMatrixDestinations},
+		{Origins: request.Origins, Destinations: testMatrixDestinations, Departure: "soon"},
+		{Origins: []MatrixPoint{{Lat: 91}}, Destinations: testMatrixDestinations},
+	} {
+		if _, err = invalid.Query(); err == nil {
+			t.Log("Expected", invalid, "to be refused")
+			t.Fail()
+		}
+	}
+}
+
+func TestPlanMatrix(t *testing.T) {
+
+	network := BuildTransitNetwork(testServiceDate, testServiceTrips)
+	origins := []MatrixPoint{{Id: "A", Lat: 53.3400, Lon: -6.2600}, {Id: "B", Lat: 53.3400, Lon: -6.2400},
+		{Id: "far", Lat: 53.4000, Lon: -6.4000}}
+	query := MatrixQuery{
+		Origins:      origins,
+		Destinations: testMatrixDestinations,
+		Departure:    time.Date(2022, 11, 2, 7, 55, 0, 0, dublinLocation),
+	}
+
+	rows := []MatrixRow{}
+	err := planMatrix(context.Background(), network, query, 3, func(row MatrixRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil || len(rows) != 3 || rows[0].Origin != "A" || rows[1].Origin != "B" || rows[2].Origin != "far" {
+		t.Log("Expected a row for each origin in order, got", rows, err)
+		t.FailNow()
+	}
+
+	fromA := rows[0].Cells
+	if fromA[0] == nil || fromA[0].Minutes != 30 || fromA[0].Transfers != 0 ||
+		fromA[0].Fare.AdultLeap != ShortZoneAdultLeap {
+		t.Log("Expected D to be reached in 30 minutes on route 3 alone, got", fromA[0])
+		t.Fail()
+	}
+	if fromA[2] == nil || fromA[2].Minutes != 2 || fromA[2].Fare != (busFares{}) {
+		t.Log("Expected the point near A to be walked to for free, got", fromA[2])
+		t.Fail()
+	}
+	if fromA[3] != nil || rows[2].Cells[0] != nil || rows[1].Cells[2] != nil {
+		t.Log("Expected no journeys to or from the far point or back to A, got", fromA[3], rows[2].Cells[0],
+			rows[1].Cells[2])
+		t.Fail()
+	}
+
+	// In wheelchair mode D is reached by changing at C, paying for both buses
+	query.Options = RouteOptions{Wheelchair: true}
+	rows = rows[:0]
+	planMatrix(context.Background(), network, query, 1, func(row MatrixRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if cell := rows[0].Cells[0]; cell == nil || cell.Minutes != 50 || cell.Transfers != 1 ||
+		cell.Fare.AdultLeap != 2*ShortZoneAdultLeap {
+		t.Log("Expected D to be reached in 50 minutes with a transfer in wheelchair mode, got", cell)
+		t.Fail()
+	}
+
+	// An error from emit stops the planning
+	emitted := 0
+	err = planMatrix(context.Background(), network, query, 2, func(row MatrixRow) error {
+		emitted++
+		return context.Canceled
+	})
+	if err != context.Canceled || emitted != 1 {
+		t.Log("Expected planning to stop at the first error, got", err, "after", emitted, "rows")
+		t.Fail()
+	}
+}
+
+func TestPostMatrix(t *testing.T) {
+
+	defer useTestTransitNetwork()()
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/matrix", PostMatrix)
+	post := func(request interface{}, accept string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		httpRequest := httptest.NewRequest(http.MethodPost, "/matrix", bytes.NewReader(body))
+		httpRequest.Header.Set("Content-Type", "application/json")
+		if accept != "" {
+			httpRequest.Header.Set("Accept", accept)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httpRequest)
+		return recorder
+	}
+
+	request := MatrixRequest{
+		Origins:      []MatrixPoint{{Id: "A", Lat: 53.3400, Lon: -6.2600}, {Id: "B", Lat: 53.3400, Lon: -6.2400}},
+		Destinations: testMatrixDestinations,
+		Departure:    "2022-11-02T07:55",
+	}
+	recorder := post(request, "")
+	var matrix Matrix
+	if err := json.Unmarshal(recorder.Body.Bytes(), &matrix); err != nil || recorder.Code != http.StatusOK ||
+		len(matrix.Rows) != 2 || len(matrix.Destinations) != 4 || matrix.Rows[0].Cells[0].Minutes != 30 {
+		t.Log("Expected the whole matrix to be returned, got", recorder.Code, recorder.Body.String())
+		t.Fail()
+	}
+
+	recorder = post(request, matrixStreamType)
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	var row MatrixRow
+	var end MatrixStreamEnd
+	if recorder.Header().Get("Content-Type") != matrixStreamType || len(lines) != 3 ||
+		json.Unmarshal([]byte(lines[1]), &row) != nil || row.Origin != "B" ||
+		json.Unmarshal([]byte(lines[2]), &end) != nil || end != (MatrixStreamEnd{Complete: true, Rows: 2}) {
+		t.Log("Expected a row per line followed by the end when streamed, got", recorder.Body.String())
+		t.Fail()
+	}
+
+	// A matrix given up on is ended with an error rather than a whole matrix
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range []struct {
+		accept   string
+		expected int
+	}{{"", statusClientClosedRequest}, {matrixStreamType, http.StatusOK}} {
+		body, _ := json.Marshal(request)
+		httpRequest := httptest.NewRequest(http.MethodPost, "/matrix", bytes.NewReader(body)).WithContext(ctx)
+		httpRequest.Header.Set("Accept", test.accept)
+		recorder = httptest.NewRecorder()
+		router.ServeHTTP(recorder, httpRequest)
+		if recorder.Code != test.expected {
+			t.Log("Expected a cancelled request accepting", test.accept, "to get", test.expected, "got", recorder.Code)
+			t.Fail()
+		}
+	}
+	if lines = strings.Split(strings.TrimSpace(recorder.Body.String()), "\n"); len(lines) != 1 ||
+		json.Unmarshal([]byte(lines[0]), &end) != nil || end.Complete || end.Rows != 0 || end.Error == "" {
+		t.Log("Expected the cancelled stream to end with an error, got", recorder.Body.String())
+		t.Fail()
+	}
+
+	// Requests over the configured size are refused before anything is planned
+	large := MatrixRequest{Origins: make([]MatrixPoint, currentConfig.Matrix.MaxCells+1),
+		Destinations: []MatrixPoint{{}}}
+	if recorder = post(large, ""); recorder.Code != http.StatusBadRequest {
+		t.Log("Expected a request over the size limit to be refused, got", recorder.Code)
+		t.Fail()
+	}
+	if recorder = post(MatrixRequest{Origins: request.Origins}, ""); recorder.Code != http.StatusBadRequest {
+		t.Log("Expected a request without destinations to be refused, got", recorder.Code)
+		t.Fail()
+	}
+}
+
+func TestReadMatrixPoints(t *testing.T) {
+
+	points, err := ReadMatrixPoints(strings.NewReader("id,lat,lon\nA, 53.34, -6.26\nB,53.34,-6.24\n"))
+	if err != nil || len(points) != 2 || points[0] != (MatrixPoint{Id: "A", Lat: 53.34, Lon: -6.26}) {
+		t.Log("Expected two points read after the header, got", points, err)
+		t.Fail()
+	}
+	for _, invalid := range []string{"A,53.34,-6.26\nB,north,-6.24\n", "A,53.34\n"} {
+		if _, err = ReadMatrixPoints(strings.NewReader(invalid)); err == nil {
+			t.Log("Expected", invalid, "to be refused")
+			t.Fail()
+		}
+	}
+}
+
+func TestMatrixCommand(t *testing.T) {
+
+	if _, _, err := ParseMatrixCommand([]string{"-departure", "2022-11-02T07:55"}); err == nil {
+		t.Log("Expected a command without origins to be refused")
+		t.Fail()
+	}
+	if _, _, err := ParseMatrixCommand([]string{"-origins", "zones.csv", "-format", "xml"}); err == nil {
+		t.Log("Expected an unknown format to be refused")
+		t.Fail()
+	}
+
+	zones := filepath.Join(t.TempDir(), "zones.csv")
+	os.WriteFile(zones, []byte("id,lat,lon\nA,53.3400,-6.2600\nD,53.3600,-6.2200\n"), 0o600)
+	command, configArgs, err := ParseMatrixCommand([]string{"-origins", zones, "-departure", "2022-11-02T07:55",
+		"--", "-config", "api.json"})
+	if err != nil || command.DestinationsFile != zones || len(configArgs) != 2 || configArgs[0] != "-config" {
+		t.Log("Expected the destinations to default to the origins and the configuration flags to be left, got",
+			command, configArgs, err)
+		t.FailNow()
+	}
+
+	defer useTestTransitNetwork()()
+	var output bytes.Buffer
+	if err = command.Run(context.Background(), &output); err != nil {
+		t.Log("Could not run the matrix command:", err)
+		t.FailNow()
+	}
+	expected := "origin,destination,minutes,transfers,adult_leap,adult_cash\n" +
+		"A,A,0,0,0.00,0.00\n" +
+		"A,D,30,0,1.30,1.70\n" +
+		"D,A,,,,\n" +
+		"D,D,0,0,0.00,0.00\n"
+	if output.String() != expected {
+		t.Log("Expected the matrix as CSV, got", output.String())
+		t.Fail()
+	}
+}
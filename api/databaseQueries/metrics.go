@@ -0,0 +1,233 @@
+package databaseQueries
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// Outcomes recorded for each travel time prediction. A route falls back to the
+// static timetable either because its prediction request failed (error) or
+// because there was no usable prediction by the deadline (static_fallback)
+const (
+	predictionOutcomeSuccess        = "success"
+	predictionOutcomeStaticFallback = "static_fallback"
+	predictionOutcomeError          = "error"
+)
+
+// Metrics exposed at /metrics, all registered with metricsRegistry
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dublinbus",
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of requests to the api by route, method and status.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"route", "method", "status"})
+
+	mongoQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dublinbus",
+		Name:      "mongo_query_duration_seconds",
+		Help:      "Duration of commands sent to Mongo by command, collection and status.",
+		Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+	}, []string{"command", "collection", "status"})
+
+	predictionOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dublinbus",
+		Name:      "prediction_outcomes_total",
+		Help:      "Travel time predictions by outcome (success, static_fallback or error).",
+	}, []string{"outcome"})
+
+	geocoderCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dublinbus",
+		Name:      "geocoder_calls_total",
+		Help:      "Calls to the Google Maps geocoder by outcome (success, no_result or error).",
+	}, []string{"outcome"})
+
+	matchedRoutesPerQuery = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "dublinbus",
+		Name:      "matched_routes_per_query",
+		Help:      "Number of routes returned for each route matching query by time type.",
+		Buckets:   []float64{0, 1, 2, 3, 5, 8, 13, 21},
+	}, []string{"time_type"})
+
+	rejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dublinbus",
+		Name:      "rejected_requests_total",
+		Help:      "Requests rejected by the api key, rate limit and quota checks by reason.",
+	}, []string{"reason"})
+
+	realtimePolls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "dublinbus",
+		Name:      "realtime_polls_total",
+		Help:      "Polls of the GTFS-R feeds by outcome (success or error).",
+	}, []string{"outcome"})
+
+	metricsRegistry = prometheus.NewRegistry()
+)
+
+// init registers the api metrics with metricsRegistry along with the standard
+// Go runtime and process metrics and the hit and miss counts of the result
+// cache. This is done in init rather than when metricsRegistry is declared as
+// registering the cache collector needs its descriptions to exist already
+func init() {
+
+	metricsRegistry.MustRegister(
+		httpRequestDuration,
+		mongoQueryDuration,
+		predictionOutcomes,
+		geocoderCalls,
+		matchedRoutesPerQuery,
+		rejectedRequests,
+		realtimePolls,
+		cacheCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// MetricsRegistry returns the registry holding every metric exposed by the api
+// so that other packages can register their own metrics alongside them
+func MetricsRegistry() *prometheus.Registry {
+	return metricsRegistry
+}
+
+// GetMetrics serves every registered metric in the Prometheus text format
+func GetMetrics(c *gin.Context) {
+	promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
+}
+
+// RequestMetrics is gin middleware recording the latency of each request
+// against the route template it matched, e.g. /stop/findByAddress/:stopSearch,
+// rather than the full path so that the number of series stays bounded
+func RequestMetrics() gin.HandlerFunc {
+
+	return func(c *gin.Context) {
+
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequestDuration.
+			WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// mongoCommandExpiry is how long the collection of a started Mongo command is
+// held waiting for it to finish. Commands whose connection is lost may never
+// report finishing, so these are swept out once they are this old
+const mongoCommandExpiry = 10 * time.Minute
+
+// startedMongoCommand is the collection of a Mongo command that has started
+// along with when it started
+type startedMongoCommand struct {
+	collection string
+	started    time.Time
+}
+
+// mongoCommandTracker holds the collection for each Mongo command that has
+// started but not yet finished, keyed by its request id, so that the collection
+// can be added to the duration recorded once the command finishes
+type mongoCommandTracker struct {
+	lock      sync.Mutex
+	commands  map[int64]startedMongoCommand
+	lastSwept time.Time
+}
+
+// mongoCommandCollections tracks the commands of every Mongo client created by
+// ConnectToMongo
+var mongoCommandCollections = &mongoCommandTracker{commands: map[int64]startedMongoCommand{}}
+
+// start records the collection of a command started at the given time and
+// sweeps out the commands that have been waiting longer than mongoCommandExpiry,
+// at most once per expiry period
+func (tracker *mongoCommandTracker) start(requestID int64, collection string, now time.Time) {
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.commands[requestID] = startedMongoCommand{collection: collection, started: now}
+
+	if now.Sub(tracker.lastSwept) < mongoCommandExpiry {
+		return
+	}
+	tracker.lastSwept = now
+	for id, command := range tracker.commands {
+		if now.Sub(command.started) > mongoCommandExpiry {
+			delete(tracker.commands, id)
+		}
+	}
+}
+
+// finish returns the collection of a finished command, or an empty string if
+// it is not known, and stops tracking it
+func (tracker *mongoCommandTracker) finish(requestID int64) string {
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	command := tracker.commands[requestID]
+	delete(tracker.commands, requestID)
+
+	return command.collection
+}
+
+// mongoMonitor is the command monitor attached to every Mongo client created
+// by ConnectToMongo to record the duration of each command
+var mongoMonitor = &event.CommandMonitor{
+	Started: func(ctx context.Context, startedEvent *event.CommandStartedEvent) {
+		collection, _ := startedEvent.Command.Lookup(startedEvent.CommandName).StringValueOK()
+		mongoCommandCollections.start(startedEvent.RequestID, collection, time.Now())
+	},
+	Succeeded: func(ctx context.Context, succeededEvent *event.CommandSucceededEvent) {
+		observeMongoCommand(succeededEvent.CommandFinishedEvent, "success")
+	},
+	Failed: func(ctx context.Context, failedEvent *event.CommandFailedEvent) {
+		observeMongoCommand(failedEvent.CommandFinishedEvent, "error")
+	},
+}
+
+// observeMongoCommand records the duration of a finished Mongo command
+func observeMongoCommand(finishedEvent event.CommandFinishedEvent, status string) {
+
+	collection := mongoCommandCollections.finish(finishedEvent.RequestID)
+
+	mongoQueryDuration.
+		WithLabelValues(finishedEvent.CommandName, collection, status).
+		Observe(time.Duration(finishedEvent.DurationNanos).Seconds())
+}
+
+// cacheCollector exposes the hit and miss counts of the shared result cache
+// as counters, reading them from the cache each time metrics are collected
+type cacheCollector struct{}
+
+var (
+	cacheHitsDesc = prometheus.NewDesc("dublinbus_cache_hits_total",
+		"Lookups in the result cache that found a result, by kind of result.", []string{"kind"}, nil)
+	cacheMissesDesc = prometheus.NewDesc("dublinbus_cache_misses_total",
+		"Lookups in the result cache that found no result, by kind of result.", []string{"kind"}, nil)
+)
+
+// Describe sends the descriptions of the cache metrics to the channel
+func (cacheCollector) Describe(descriptions chan<- *prometheus.Desc) {
+	descriptions <- cacheHitsDesc
+	descriptions <- cacheMissesDesc
+}
+
+// Collect sends the current hit and miss counts for each kind of result
+func (cacheCollector) Collect(metrics chan<- prometheus.Metric) {
+	for kind, stats := range resultCache().Stats() {
+		metrics <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(stats.Hits), kind)
+		metrics <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(stats.Misses), kind)
+	}
+}
@@ -0,0 +1,60 @@
+package databaseQueries
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGetMetricsExposesRequestLatency(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(RequestMetrics())
+	router.GET("/stop/:stopNumber", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET("/metrics", GetMetrics)
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/stop/1234", nil))
+	predictionOutcomes.WithLabelValues(predictionOutcomeStaticFallback).Inc()
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+
+	expectedLines := []string{
+		`dublinbus_http_request_duration_seconds_count{method="GET",route="/stop/:stopNumber",status="200"} 1`,
+		`dublinbus_prediction_outcomes_total{outcome="static_fallback"}`,
+		`go_goroutines`,
+	}
+	for _, expected := range expectedLines {
+		if !strings.Contains(body, expected) {
+			t.Log("Metrics output is missing", expected)
+			t.Fail()
+		}
+	}
+}
+
+func TestMongoCommandTracker(t *testing.T) {
+
+	tracker := &mongoCommandTracker{commands: map[int64]startedMongoCommand{}}
+	start := time.Date(2022, 11, 2, 8, 0, 0, 0, time.UTC)
+
+	tracker.start(1, "trips_n_stops", start)
+	tracker.start(2, "stops", start.Add(time.Minute))
+	if collection := tracker.finish(2); collection != "stops" || tracker.finish(2) != "" {
+		t.Log("Expected the collection of a finished command to be returned once, got", collection)
+		t.Fail()
+	}
+
+	// A command that never finishes is swept out once it is older than the expiry
+	tracker.start(3, "routes", start.Add(mongoCommandExpiry+time.Minute))
+	if _, ok := tracker.commands[1]; ok || len(tracker.commands) != 1 {
+		t.Log("Expected the unfinished command to be swept out, got", tracker.commands)
+		t.Fail()
+	}
+}
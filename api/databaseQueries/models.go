@@ -5,12 +5,15 @@ package databaseQueries
 // busRouteQueries file. The route short name is used as the id feature
 // for each busRoute while this structure contains arrays of nested structures.
 // The Stops array is made of type BusStop while the Shapes array is made of type
-// Shape.
+// Shape. The trip id and its GTFS wheelchair_accessible value are those of the
+// trip chosen for the route
 type busRoute struct {
-	Id        []byte    `bson:"_id" json:"_id"`
-	Direction string    `bson:"direction_id" json:"direction_id"`
-	Stops     []BusStop `bson:"stops" json:"stops"`
-	Shapes    []Shape   `bson:"shapes" json:"shapes"`
+	Id                   []byte    `bson:"_id" json:"_id"`
+	Direction            string    `bson:"direction_id" json:"direction_id"`
+	TripId               string    `bson:"trip_id,omitempty" json:"trip_id,omitempty"`
+	WheelchairAccessible string    `bson:"wheelchair_accessible,omitempty" json:"wheelchair_accessible,omitempty"`
+	Stops                []BusStop `bson:"stops" json:"stops"`
+	Shapes               []Shape   `bson:"shapes" json:"shapes"`
 }
 
 type RouteId struct {
@@ -38,13 +41,24 @@ type busRouteV2 struct {
 // the same also. The main difference between these structures is in the Stops array.
 // In the busRouteJSON this array is made of type RouteStop which as a key difference
 // returns the coordinates of each bus stop as type float as opposed to strings.
+// Depending on the shape format asked for, the shape is given either as the
+// Shapes array, as a Google encoded Polyline or as a GeoJSON LineString. Service
+// alerts that apply to the whole route are listed in Alerts. Whether the trip
+// can be boarded by wheelchair is given where it is known, as are the walks to
+// the first stop and from the last when a pedestrian graph is loaded
 type busRouteJSON struct {
-	RouteNum   string               `bson:"route_num" json:"route_num"`
-	Stops      []RouteStop          `bson:"stops" json:"stops"`
-	Shapes     []ShapeJSON          `bson:"shapes" json:"shapes"`
-	Fares      busFares             `bson:"fares" json:"fares"`
-	TravelTime TravelTimePrediction `bson:"travel_time,omitempty" json:"travel_time,omitempty"`
-	Direction  string               `bson:"direction" json:"direction"`
+	RouteNum             string               `bson:"route_num" json:"route_num"`
+	WheelchairAccessible string               `bson:"wheelchair_accessible,omitempty" json:"wheelchair_accessible,omitempty"`
+	Stops                []RouteStop          `bson:"stops" json:"stops"`
+	Shapes               []ShapeJSON          `bson:"shapes,omitempty" json:"shapes,omitempty"`
+	Polyline             string               `bson:"polyline,omitempty" json:"polyline,omitempty"`
+	ShapeGeoJSON         *GeoJSONGeometry     `bson:"shape_geojson,omitempty" json:"shape_geojson,omitempty"`
+	Fares                busFares             `bson:"fares" json:"fares"`
+	TravelTime           TravelTimePrediction `bson:"travel_time,omitempty" json:"travel_time,omitempty"`
+	Direction            string               `bson:"direction" json:"direction"`
+	Alerts               []AlertNotice        `bson:"alerts,omitempty" json:"alerts,omitempty"`
+	AccessWalk           *WalkPath            `bson:"access_walk,omitempty" json:"access_walk,omitempty"`
+	EgressWalk           *WalkPath            `bson:"egress_walk,omitempty" json:"egress_walk,omitempty"`
 }
 
 // RouteStop represents the stop information contained within the trips_n_stops
@@ -56,17 +70,21 @@ type busRouteJSON struct {
 // correct order on a given route and finally arrival and departure times for
 // when a bus arrived and departed that particular stop for a given trip.
 // All fields are returned as strings from the database, apart from the
-// coordinates of the stop that come back as a float each
+// coordinates of the stop that come back as a float each. Service alerts for
+// the stop are listed in Alerts, and whether the stop can be boarded by
+// wheelchair is given where it is known
 type RouteStop struct {
-	StopId            string  `bson:"stop_id" json:"stop_id"`
-	StopName          string  `bson:"stop_name" json:"stop_name"`
-	StopNumber        string  `bson:"stop_number" json:"stop_number"`
-	StopLat           float64 `bson:"stop_lat" json:"stop_lat"`
-	StopLon           float64 `bson:"stop_lon" json:"stop_lon"`
-	StopSequence      string  `bson:"stop_sequence" json:"stop_sequence"`
-	ArrivalTime       string  `bson:"arrival_time" json:"arrival_time"`
-	DepartureTime     string  `bson:"departure_time" json:"departure_time"`
-	DistanceTravelled float64 `bson:"shape_dist_traveled" json:"shape_dist_traveled"`
+	StopId             string        `bson:"stop_id" json:"stop_id"`
+	StopName           string        `bson:"stop_name" json:"stop_name"`
+	StopNumber         string        `bson:"stop_number" json:"stop_number"`
+	StopLat            float64       `bson:"stop_lat" json:"stop_lat"`
+	StopLon            float64       `bson:"stop_lon" json:"stop_lon"`
+	StopSequence       string        `bson:"stop_sequence" json:"stop_sequence"`
+	ArrivalTime        string        `bson:"arrival_time" json:"arrival_time"`
+	DepartureTime      string        `bson:"departure_time" json:"departure_time"`
+	DistanceTravelled  float64       `bson:"shape_dist_traveled" json:"shape_dist_traveled"`
+	WheelchairBoarding string        `bson:"wheelchair_boarding,omitempty" json:"wheelchair_boarding,omitempty"`
+	Alerts             []AlertNotice `bson:"alerts,omitempty" json:"alerts,omitempty"`
 }
 
 // Shape is struct that contains the coordinates for each turn in a bus
@@ -106,18 +124,23 @@ type BusStop struct {
 	ArrivalTime       string `bson:"arrival_time" json:"arrival_time"`
 	DepartureTime     string `bson:"departure_time" json:"departure_time"`
 	DistanceTravelled string `bson:"shape_dist_traveled" json:"shape_dist_traveled"`
+	// WheelchairBoarding is the GTFS wheelchair_boarding value of the stop,
+	// where the timetable has one
+	WheelchairBoarding string `bson:"wheelchair_boarding,omitempty" json:"wheelchair_boarding,omitempty"`
 }
 
 // StopWithCoordinates contains the fields necessary to map out a route
 // on a map by including identifying information for each stop (its id,
 // name and number) as well as the coordinates for that stop as floating
-// point numbers
+// point numbers. Whether the stop can be boarded by wheelchair is given where
+// either the stops collection or the stop metadata knows
 type StopWithCoordinates struct {
-	StopID     string  `bson:"stop_id,omitempty" json:"stop_id,omitempty"`
-	StopName   string  `bson:"stop_name" json:"stop_name"`
-	StopNumber string  `bson:"stop_number" json:"stop_number"`
-	StopLat    float64 `bson:"stop_lat" json:"stop_lat"`
-	StopLon    float64 `bson:"stop_lon" json:"stop_lon"`
+	StopID             string  `bson:"stop_id,omitempty" json:"stop_id,omitempty"`
+	StopName           string  `bson:"stop_name" json:"stop_name"`
+	StopNumber         string  `bson:"stop_number" json:"stop_number"`
+	StopLat            float64 `bson:"stop_lat" json:"stop_lat"`
+	StopLon            float64 `bson:"stop_lon" json:"stop_lon"`
+	WheelchairBoarding string  `bson:"wheelchair_boarding,omitempty" json:"wheelchair_boarding,omitempty"`
 }
 
 // findByAddressResponse is a simple structure that just contains two arrays
@@ -208,10 +231,77 @@ type MatchedRouteWithOAndD struct {
 // bus stop in string format (i.e. its stop id, stop name, stop number and coordinates
 // on a map) as well as the internal Mongo id for the data entry
 type GeolocatedStop struct {
-	ID         string `bson:"_id,omitempty" json:"_id,omitempty"`
-	StopId     string `bson:"stop_id" json:"stop_id"`
-	StopName   string `bson:"stop_name" json:"stop_name"`
-	StopNumber string `bson:"stop_number" json:"stop_number"`
-	StopLat    string `bson:"stop_lat" json:"stop_lat"`
-	StopLon    string `bson:"stop_lon" json:"stop_lon"`
+	ID                 string `bson:"_id,omitempty" json:"_id,omitempty"`
+	StopId             string `bson:"stop_id" json:"stop_id"`
+	StopName           string `bson:"stop_name" json:"stop_name"`
+	StopNumber         string `bson:"stop_number" json:"stop_number"`
+	StopLat            string `bson:"stop_lat" json:"stop_lat"`
+	StopLon            string `bson:"stop_lon" json:"stop_lon"`
+	WheelchairBoarding string `bson:"wheelchair_boarding,omitempty" json:"wheelchair_boarding,omitempty"`
+}
+
+// RouteSummary is an entry in the route catalogue, holding the route number,
+// its long name where the timetable has one and a summary of each direction
+type RouteSummary struct {
+	RouteNum      string                  `bson:"route_num" json:"route_num"`
+	RouteLongName string                  `bson:"route_long_name,omitempty" json:"route_long_name,omitempty"`
+	Directions    []RouteDirectionSummary `bson:"directions" json:"directions"`
+}
+
+// RouteDirectionSummary summarises one direction of a route with its main
+// headsign, the names of its first and last stops and its number of trips
+type RouteDirectionSummary struct {
+	Direction string `bson:"direction" json:"direction"`
+	Headsign  string `bson:"headsign" json:"headsign"`
+	FirstStop string `bson:"first_stop" json:"first_stop"`
+	LastStop  string `bson:"last_stop" json:"last_stop"`
+	Trips     int    `bson:"trips" json:"trips"`
+}
+
+// RouteDetail holds the stop pattern for each direction of a route
+type RouteDetail struct {
+	RouteNum      string         `bson:"route_num" json:"route_num"`
+	RouteLongName string         `bson:"route_long_name,omitempty" json:"route_long_name,omitempty"`
+	Directions    []RoutePattern `bson:"directions" json:"directions"`
+}
+
+// RoutePattern describes one direction of a route. Its stops and shape are
+// those of the canonical pattern, being the sequence of stops served by the
+// most trips, while every distinct sequence of stops served in that direction
+// (including the canonical one) is listed as a variant. The shape is simplified
+// to keep the response small
+type RoutePattern struct {
+	RouteNum  string         `bson:"route_num" json:"route_num"`
+	Direction string         `bson:"direction" json:"direction"`
+	Headsign  string         `bson:"headsign" json:"headsign"`
+	Headsigns []string       `bson:"headsigns" json:"headsigns"`
+	Trips     int            `bson:"trips" json:"trips"`
+	Stops     []PatternStop  `bson:"stops" json:"stops"`
+	Shape     []ShapeJSON    `bson:"shape" json:"shape"`
+	Variants  []RouteVariant `bson:"variants" json:"variants"`
+}
+
+// RouteVariant is a distinct sequence of stops served by trips on a route in
+// one direction, identified by its position among the variants (0 being the
+// canonical pattern) and listed by stop number
+type RouteVariant struct {
+	Variant     int      `bson:"variant" json:"variant"`
+	Canonical   bool     `bson:"canonical" json:"canonical"`
+	Headsign    string   `bson:"headsign" json:"headsign"`
+	Trips       int      `bson:"trips" json:"trips"`
+	FirstStop   string   `bson:"first_stop" json:"first_stop"`
+	LastStop    string   `bson:"last_stop" json:"last_stop"`
+	StopNumbers []string `bson:"stop_numbers" json:"stop_numbers"`
+}
+
+// PatternStop is a stop in the stop pattern of a route, without the times of
+// any particular trip
+type PatternStop struct {
+	StopId            string  `bson:"stop_id" json:"stop_id"`
+	StopName          string  `bson:"stop_name" json:"stop_name"`
+	StopNumber        string  `bson:"stop_number" json:"stop_number"`
+	StopLat           float64 `bson:"stop_lat" json:"stop_lat"`
+	StopLon           float64 `bson:"stop_lon" json:"stop_lon"`
+	StopSequence      int     `bson:"stop_sequence" json:"stop_sequence"`
+	DistanceTravelled float64 `bson:"shape_dist_traveled" json:"shape_dist_traveled"`
 }
@@ -0,0 +1,432 @@
+package databaseQueries
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// maxOSMBlobHeaderBytes and maxOSMBlobBytes are the largest blob header and
+// blob the OSM PBF format allows
+const (
+	maxOSMBlobHeaderBytes = 64 * 1024
+	maxOSMBlobBytes       = 32 * 1024 * 1024
+)
+
+// supportedOSMFeatures are the required features of an OSM PBF file that
+// ReadOSMPBF understands. Files needing any other are refused
+var supportedOSMFeatures = map[string]bool{"OsmSchema-V0.6": true, "DenseNodes": true}
+
+// OSMNode is a node in an OpenStreetMap extract
+type OSMNode struct {
+	ID  int64
+	Lat float64
+	Lon float64
+}
+
+// OSMWay is a way in an OpenStreetMap extract, with the ids of its nodes in order
+type OSMWay struct {
+	ID    int64
+	Tags  map[string]string
+	Nodes []int64
+}
+
+// ReadOSMPBF reads an OpenStreetMap extract in the PBF format, calling node for
+// each node and way for each way in the order they appear. Relations and the
+// tags of nodes aren't needed for walking, so are skipped. Extracts list their
+// nodes before their ways, so every node of a way has been seen by the time
+// the way is
+func ReadOSMPBF(reader io.Reader, node func(OSMNode), way func(OSMWay)) error {
+
+	for {
+		var headerSize uint32
+		err := binary.Read(reader, binary.BigEndian, &headerSize)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if headerSize > maxOSMBlobHeaderBytes {
+			return fmt.Errorf("blob header of %d bytes is too large", headerSize)
+		}
+
+		header := make([]byte, headerSize)
+		if _, err = io.ReadFull(reader, header); err != nil {
+			return err
+		}
+		blobType, blobSize, err := decodeOSMBlobHeader(header)
+		if err != nil {
+			return err
+		}
+		if blobSize > maxOSMBlobBytes {
+			return fmt.Errorf("blob of %d bytes is too large", blobSize)
+		}
+
+		blob := make([]byte, blobSize)
+		if _, err = io.ReadFull(reader, blob); err != nil {
+			return err
+		}
+		data, err := decodeOSMBlob(blob)
+		if err != nil {
+			return err
+		}
+
+		switch blobType {
+		case "OSMHeader":
+			err = checkOSMHeader(data)
+		case "OSMData":
+			err = decodeOSMPrimitiveBlock(data, node, way)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s blob: %w", blobType, err)
+		}
+	}
+}
+
+// protobufField is a field of a protocol buffer message. The value of a varint
+// field is in varint and that of a length delimited one in bytes. Fixed width
+// fields aren't used by OSM PBF, so their values are skipped
+type protobufField struct {
+	number   protowire.Number
+	wireType protowire.Type
+	varint   uint64
+	bytes    []byte
+}
+
+// forEachProtobufField calls field for each field of a protocol buffer message
+// in turn, stopping at the first error
+func forEachProtobufField(message []byte, field func(protobufField) error) error {
+
+	for len(message) > 0 {
+		number, wireType, length := protowire.ConsumeTag(message)
+		if length < 0 {
+			return protowire.ParseError(length)
+		}
+		message = message[length:]
+
+		current := protobufField{number: number, wireType: wireType}
+		switch wireType {
+		case protowire.VarintType:
+			current.varint, length = protowire.ConsumeVarint(message)
+		case protowire.BytesType:
+			current.bytes, length = protowire.ConsumeBytes(message)
+		default:
+			length = protowire.ConsumeFieldValue(number, wireType, message)
+		}
+		if length < 0 {
+			return protowire.ParseError(length)
+		}
+		message = message[length:]
+
+		if err := field(current); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// varints returns the values of a repeated varint field, which may be packed
+// into a single length delimited field or given one at a time
+func (field protobufField) varints() ([]uint64, error) {
+
+	if field.wireType == protowire.VarintType {
+		return []uint64{field.varint}, nil
+	}
+	if field.wireType != protowire.BytesType {
+		return nil, fmt.Errorf("field %d is not a varint", field.number)
+	}
+
+	values := []uint64{}
+	for packed := field.bytes; len(packed) > 0; {
+		value, length := protowire.ConsumeVarint(packed)
+		if length < 0 {
+			return nil, protowire.ParseError(length)
+		}
+		values = append(values, value)
+		packed = packed[length:]
+	}
+
+	return values, nil
+}
+
+// appendSigned appends the values of a repeated sint64 field to values
+func appendSigned(values []int64, field protobufField) ([]int64, error) {
+
+	encoded, err := field.varints()
+	for _, value := range encoded {
+		values = append(values, protowire.DecodeZigZag(value))
+	}
+
+	return values, err
+}
+
+// appendUnsigned appends the values of a repeated uint32 field to values
+func appendUnsigned(values []uint32, field protobufField) ([]uint32, error) {
+
+	encoded, err := field.varints()
+	for _, value := range encoded {
+		values = append(values, uint32(value))
+	}
+
+	return values, err
+}
+
+// decodeOSMBlobHeader returns the type and size of the blob following a header
+func decodeOSMBlobHeader(header []byte) (string, int, error) {
+
+	blobType, blobSize := "", -1
+	err := forEachProtobufField(header, func(field protobufField) error {
+		switch field.number {
+		case 1:
+			blobType = string(field.bytes)
+		case 3:
+			blobSize = int(field.varint)
+		}
+		return nil
+	})
+	if err == nil && (blobType == "" || blobSize < 0) {
+		err = errors.New("blob header is missing the type or size")
+	}
+
+	return blobType, blobSize, err
+}
+
+// decodeOSMBlob returns the contents of a blob, which are either stored as
+// they are or compressed with zlib
+func decodeOSMBlob(blob []byte) ([]byte, error) {
+
+	var raw, compressed []byte
+	rawSize := -1
+	err := forEachProtobufField(blob, func(field protobufField) error {
+		switch field.number {
+		case 1:
+			raw = field.bytes
+		case 2:
+			rawSize = int(field.varint)
+		case 3:
+			compressed = field.bytes
+		case 4, 5, 6, 7:
+			return errors.New("only uncompressed and zlib compressed blobs are supported")
+		}
+		return nil
+	})
+	if err != nil || raw != nil {
+		return raw, err
+	}
+	if compressed == nil {
+		return nil, errors.New("blob holds no data")
+	}
+	if rawSize < 0 || rawSize > maxOSMBlobBytes {
+		return nil, fmt.Errorf("invalid uncompressed blob size %d", rawSize)
+	}
+
+	decompressor, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer decompressor.Close()
+
+	data := make([]byte, rawSize)
+	if _, err = io.ReadFull(decompressor, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// checkOSMHeader refuses a file needing features that aren't supported
+func checkOSMHeader(header []byte) error {
+	return forEachProtobufField(header, func(field protobufField) error {
+		if field.number == 4 && !supportedOSMFeatures[string(field.bytes)] {
+			return fmt.Errorf("unsupported required feature %s", field.bytes)
+		}
+		return nil
+	})
+}
+
+// osmBlockContext holds what is needed to turn the values in a primitive block
+// into tags and coordinates
+type osmBlockContext struct {
+	strings     [][]byte
+	granularity int64
+	latOffset   int64
+	lonOffset   int64
+}
+
+// coordinate returns the degrees of a latitude or longitude stored in a block
+func (block osmBlockContext) coordinate(offset int64, value int64) float64 {
+	return float64(offset+block.granularity*value) / 1e9
+}
+
+// tags returns the tags given as indexes into the string table
+func (block osmBlockContext) tags(keys []uint32, values []uint32) (map[string]string, error) {
+
+	if len(keys) != len(values) {
+		return nil, errors.New("tags have a different number of keys and values")
+	}
+
+	tags := map[string]string{}
+	for index, key := range keys {
+		if int(key) >= len(block.strings) || int(values[index]) >= len(block.strings) {
+			return nil, errors.New("tag refers past the end of the string table")
+		}
+		tags[string(block.strings[key])] = string(block.strings[values[index]])
+	}
+
+	return tags, nil
+}
+
+// decodeOSMPrimitiveBlock decodes the nodes and ways in a primitive block. The
+// string table and coordinate settings may come after the groups, so the groups
+// are decoded once the whole block has been read
+func decodeOSMPrimitiveBlock(data []byte, node func(OSMNode), way func(OSMWay)) error {
+
+	block := osmBlockContext{granularity: 100}
+	groups := [][]byte{}
+	err := forEachProtobufField(data, func(field protobufField) error {
+		switch field.number {
+		case 1:
+			return forEachProtobufField(field.bytes, func(entry protobufField) error {
+				if entry.number == 1 {
+					block.strings = append(block.strings, entry.bytes)
+				}
+				return nil
+			})
+		case 2:
+			groups = append(groups, field.bytes)
+		case 17:
+			block.granularity = int64(field.varint)
+		case 19:
+			block.latOffset = int64(field.varint)
+		case 20:
+			block.lonOffset = int64(field.varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		err = forEachProtobufField(group, func(field protobufField) error {
+			switch field.number {
+			case 1:
+				return decodeOSMNode(block, field.bytes, node)
+			case 2:
+				return decodeOSMDenseNodes(block, field.bytes, node)
+			case 3:
+				return decodeOSMWay(block, field.bytes, way)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeOSMNode decodes a node stored on its own
+func decodeOSMNode(block osmBlockContext, data []byte, node func(OSMNode)) error {
+
+	var id, lat, lon int64
+	err := forEachProtobufField(data, func(field protobufField) error {
+		switch field.number {
+		case 1:
+			id = protowire.DecodeZigZag(field.varint)
+		case 8:
+			lat = protowire.DecodeZigZag(field.varint)
+		case 9:
+			lon = protowire.DecodeZigZag(field.varint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	node(OSMNode{ID: id, Lat: block.coordinate(block.latOffset, lat), Lon: block.coordinate(block.lonOffset, lon)})
+	return nil
+}
+
+// decodeOSMDenseNodes decodes a run of nodes whose ids and coordinates are each
+// stored as the difference from those of the node before
+func decodeOSMDenseNodes(block osmBlockContext, data []byte, node func(OSMNode)) error {
+
+	var ids, lats, lons []int64
+	err := forEachProtobufField(data, func(field protobufField) error {
+		var err error
+		switch field.number {
+		case 1:
+			ids, err = appendSigned(ids, field)
+		case 8:
+			lats, err = appendSigned(lats, field)
+		case 9:
+			lons, err = appendSigned(lons, field)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(lats) != len(ids) || len(lons) != len(ids) {
+		return errors.New("dense nodes have a different number of ids and coordinates")
+	}
+
+	var id, lat, lon int64
+	for index := range ids {
+		id, lat, lon = id+ids[index], lat+lats[index], lon+lons[index]
+		node(OSMNode{ID: id, Lat: block.coordinate(block.latOffset, lat),
+			Lon: block.coordinate(block.lonOffset, lon)})
+	}
+
+	return nil
+}
+
+// decodeOSMWay decodes a way, whose node ids are each stored as the difference
+// from the one before
+func decodeOSMWay(block osmBlockContext, data []byte, way func(OSMWay)) error {
+
+	var id int64
+	var keys, values []uint32
+	var refs []int64
+	err := forEachProtobufField(data, func(field protobufField) error {
+		var err error
+		switch field.number {
+		case 1:
+			id = int64(field.varint)
+		case 2:
+			keys, err = appendUnsigned(keys, field)
+		case 3:
+			values, err = appendUnsigned(values, field)
+		case 8:
+			refs, err = appendSigned(refs, field)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	tags, err := block.tags(keys, values)
+	if err != nil {
+		return err
+	}
+	nodes := make([]int64, len(refs))
+	var ref int64
+	for index, delta := range refs {
+		ref += delta
+		nodes[index] = ref
+	}
+
+	way(OSMWay{ID: id, Tags: tags, Nodes: nodes})
+	return nil
+}
@@ -0,0 +1,50 @@
+package databaseQueries
+
+import (
+	"bytes"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestReadOSMPBF(t *testing.T) {
+
+	extract, err := os.ReadFile(testWalkingExtract)
+	if err != nil {
+		t.Log("Could not open the walking extract:", err)
+		t.FailNow()
+	}
+
+	nodes := map[int64]OSMNode{}
+	ways := map[int64]OSMWay{}
+	err = ReadOSMPBF(bytes.NewReader(extract), func(node OSMNode) {
+		nodes[node.ID] = node
+	}, func(way OSMWay) {
+		ways[way.ID] = way
+	})
+	if err != nil {
+		t.Log("Could not read the walking extract:", err)
+		t.FailNow()
+	}
+
+	if len(nodes) != 20 || len(ways) != 16 {
+		t.Log("Expected 20 nodes and 16 ways, got", len(nodes), len(ways))
+		t.Fail()
+	}
+	if node := nodes[15]; math.Abs(node.Lat-53.3412) > 1e-7 || math.Abs(node.Lon+6.2604) > 1e-7 {
+		t.Log("Expected node 15 to be at 53.3412, -6.2604, got", node)
+		t.Fail()
+	}
+	grafton := ways[100]
+	if grafton.Tags["name"] != "Grafton Street" || grafton.Tags["highway"] != "pedestrian" ||
+		len(grafton.Nodes) != 6 || grafton.Nodes[3] != 15 || grafton.Nodes[5] != 5 {
+		t.Log("Expected Grafton Street to be read with its tags and nodes, got", grafton)
+		t.Fail()
+	}
+
+	// A data blob cut short must be refused rather than read in part
+	if err = ReadOSMPBF(bytes.NewReader(extract[:len(extract)-10]), func(OSMNode) {}, func(OSMWay) {}); err == nil {
+		t.Log("Expected a truncated extract to be refused")
+		t.Fail()
+	}
+}
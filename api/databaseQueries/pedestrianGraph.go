@@ -0,0 +1,471 @@
+package databaseQueries
+
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"sync"
+
+	"googlemaps.github.io/maps"
+)
+
+// pedestrianCellDegrees is the size of the grid cells that the nodes of the
+// pedestrian graph are kept in, so that only the cells around a point are
+// searched when snapping it to the graph
+const pedestrianCellDegrees = 0.005
+
+// ErrNoWalk is returned when there is no walk between two points, either
+// because one of them is too far from any walkable way or because the ways
+// near each aren't connected
+var ErrNoWalk = errors.New("no walk between the points")
+
+// excludedHighways are the kinds of highway that can't be walked along, even
+// if they are tagged as open to pedestrians
+var excludedHighways = map[string]bool{
+	"motorway": true, "motorway_link": true, "construction": true, "proposed": true, "abandoned": true,
+	"bus_guideway": true, "busway": true, "raceway": true,
+}
+
+// footAllowed and accessDenied are the values of the foot and access tags that
+// open a way to pedestrians and close it to them
+var footAllowed = map[string]bool{"yes": true, "designated": true, "permissive": true}
+var accessDenied = map[string]bool{"no": true, "private": true}
+
+// walkableWay reports whether a way can be walked along and whether it is a
+// flight of steps. Any highway can be walked other than motorways and the like,
+// unless pedestrians are kept off it by the foot or access tags
+func walkableWay(tags map[string]string) (walkable bool, steps bool) {
+
+	highway, ok := tags["highway"]
+	if !ok || excludedHighways[highway] || tags["foot"] == "no" {
+		return false, false
+	}
+	if accessDenied[tags["access"]] && !footAllowed[tags["foot"]] {
+		return false, false
+	}
+
+	return true, highway == "steps"
+}
+
+// pedestrianEdge is a stretch of walkable way between two nodes of the graph
+type pedestrianEdge struct {
+	to     int32
+	metres float64
+	steps  bool
+}
+
+// PedestrianGraph is the network of walkable ways in an OpenStreetMap extract.
+// Points are snapped to the nearest node within the configured distance, with
+// the straight line from the point to that node counted as part of the walk
+type PedestrianGraph struct {
+	nodes         []maps.LatLng
+	edges         [][]pedestrianEdge
+	cells         map[[2]int][]int32
+	speed         float64
+	maxSnapMetres float64
+}
+
+// WalkPath is a walk along the pedestrian graph, with its length in metres, how
+// long it takes in seconds and the points it passes through as a GeoJSON
+// LineString
+type WalkPath struct {
+	DistanceMetres  float64         `json:"distance_metres"`
+	DurationSeconds int64           `json:"duration_seconds"`
+	Geometry        GeoJSONGeometry `json:"geometry"`
+	Path            []maps.LatLng   `json:"-"`
+}
+
+// NewPedestrianGraph returns an empty PedestrianGraph, which has no walks
+func NewPedestrianGraph(walkingConfig WalkingConfig) *PedestrianGraph {
+	return &PedestrianGraph{
+		cells:         map[[2]int][]int32{},
+		speed:         walkingConfig.SpeedMetresPerSecond,
+		maxSnapMetres: walkingConfig.MaxSnapMetres,
+	}
+}
+
+// ReadPedestrianGraph builds the pedestrian graph from the walkable ways in an
+// OpenStreetMap PBF extract. Only the nodes of walkable ways are kept
+func ReadPedestrianGraph(reader io.Reader, walkingConfig WalkingConfig) (*PedestrianGraph, error) {
+
+	graph := NewPedestrianGraph(walkingConfig)
+	osmNodes := map[int64]maps.LatLng{}
+	graphNodes := map[int64]int32{}
+
+	nodeIndex := func(id int64) (int32, bool) {
+		if index, ok := graphNodes[id]; ok {
+			return index, true
+		}
+		point, ok := osmNodes[id]
+		if !ok {
+			return 0, false
+		}
+		index := int32(len(graph.nodes))
+		graph.nodes = append(graph.nodes, point)
+		graph.edges = append(graph.edges, nil)
+		graphNodes[id] = index
+		cell := pedestrianCell(point.Lat, point.Lng)
+		graph.cells[cell] = append(graph.cells[cell], index)
+		return index, true
+	}
+
+	err := ReadOSMPBF(reader, func(node OSMNode) {
+		osmNodes[node.ID] = maps.LatLng{Lat: node.Lat, Lng: node.Lon}
+	}, func(way OSMWay) {
+		walkable, steps := walkableWay(way.Tags)
+		if !walkable {
+			return
+		}
+		// Ways that refer to nodes outside of the extract are cut where they leave it
+		for index := 1; index < len(way.Nodes); index++ {
+			from, fromOk := nodeIndex(way.Nodes[index-1])
+			to, toOk := nodeIndex(way.Nodes[index])
+			if !fromOk || !toOk || from == to {
+				continue
+			}
+			metres := graph.distance(from, to)
+			graph.edges[from] = append(graph.edges[from], pedestrianEdge{to: to, metres: metres, steps: steps})
+			graph.edges[to] = append(graph.edges[to], pedestrianEdge{to: from, metres: metres, steps: steps})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return graph, nil
+}
+
+// LoadPedestrianGraph reads the OpenStreetMap extract named in the configuration
+func LoadPedestrianGraph(walkingConfig WalkingConfig) (*PedestrianGraph, error) {
+
+	file, err := os.Open(walkingConfig.OSMFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadPedestrianGraph(file, walkingConfig)
+}
+
+// loadConfiguredPedestrianGraph loads the extract named in the configuration,
+// logging rather than failing if it can't be read so that walks are measured in
+// a straight line as before
+func loadConfiguredPedestrianGraph(walkingConfig WalkingConfig) *PedestrianGraph {
+
+	if walkingConfig.OSMFile == "" {
+		return NewPedestrianGraph(walkingConfig)
+	}
+
+	graph, err := LoadPedestrianGraph(walkingConfig)
+	if err != nil {
+		defaultLogger.Error("could not load the pedestrian graph", "file", walkingConfig.OSMFile, "error", err)
+		return NewPedestrianGraph(walkingConfig)
+	}
+
+	defaultLogger.Info("loaded pedestrian graph", "file", walkingConfig.OSMFile, "nodes", graph.Len())
+	return graph
+}
+
+var sharedPedestrianGraph *PedestrianGraph
+var sharedPedestrianGraphOnce sync.Once
+
+// pedestrianGraph returns the PedestrianGraph shared by the package, loading it
+// from the configured extract the first time it is called unless
+// SetPedestrianGraph has already been used to provide it
+func pedestrianGraph() *PedestrianGraph {
+	sharedPedestrianGraphOnce.Do(func() {
+		if sharedPedestrianGraph == nil {
+			sharedPedestrianGraph = loadConfiguredPedestrianGraph(currentConfig.Walking)
+		}
+	})
+	return sharedPedestrianGraph
+}
+
+// SetPedestrianGraph replaces the PedestrianGraph shared by the package
+func SetPedestrianGraph(graph *PedestrianGraph) {
+	sharedPedestrianGraphOnce.Do(func() {})
+	sharedPedestrianGraph = graph
+}
+
+// pedestrianCell returns the grid cell holding a point
+func pedestrianCell(lat float64, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / pedestrianCellDegrees)), int(math.Floor(lon / pedestrianCellDegrees))}
+}
+
+// Len returns the number of nodes in the graph
+func (graph *PedestrianGraph) Len() int {
+
+	if graph == nil {
+		return 0
+	}
+
+	return len(graph.nodes)
+}
+
+// distance returns the straight line distance in metres between two nodes
+func (graph *PedestrianGraph) distance(from int32, to int32) float64 {
+	return distanceMetres(graph.nodes[from].Lat, graph.nodes[from].Lng, graph.nodes[to].Lat, graph.nodes[to].Lng)
+}
+
+// snap returns the node nearest the point along with how far away it is,
+// reporting false if there is none within the snapping distance
+func (graph *PedestrianGraph) snap(point maps.LatLng) (int32, float64, bool) {
+
+	if graph.Len() == 0 {
+		return 0, 0, false
+	}
+
+	// Enough cells are searched in each direction to cover the snapping distance
+	latCells := int(math.Ceil(graph.maxSnapMetres / (pedestrianCellDegrees * earthRadiusMetres * math.Pi / 180)))
+	lonCells := int(math.Ceil(float64(latCells) / math.Cos(point.Lat*math.Pi/180)))
+
+	centre := pedestrianCell(point.Lat, point.Lng)
+	nearest, nearestMetres := int32(-1), graph.maxSnapMetres
+	for latCell := centre[0] - latCells; latCell <= centre[0]+latCells; latCell++ {
+		for lonCell := centre[1] - lonCells; lonCell <= centre[1]+lonCells; lonCell++ {
+			for _, node := range graph.cells[[2]int{latCell, lonCell}] {
+				metres := distanceMetres(point.Lat, point.Lng, graph.nodes[node].Lat, graph.nodes[node].Lng)
+				if metres <= nearestMetres {
+					nearest, nearestMetres = node, metres
+				}
+			}
+		}
+	}
+
+	return nearest, nearestMetres, nearest >= 0
+}
+
+// walkQueueItem is a node waiting to be visited by a search, ordered by its
+// distance from the start plus the estimate of the distance left
+type walkQueueItem struct {
+	node     int32
+	priority float64
+}
+
+// walkQueue is a priority queue of nodes for container/heap
+type walkQueue []walkQueueItem
+
+func (queue walkQueue) Len() int            { return len(queue) }
+func (queue walkQueue) Less(i, j int) bool  { return queue[i].priority < queue[j].priority }
+func (queue walkQueue) Swap(i, j int)       { queue[i], queue[j] = queue[j], queue[i] }
+func (queue *walkQueue) Push(x interface{}) { *queue = append(*queue, x.(walkQueueItem)) }
+func (queue *walkQueue) Pop() interface{} {
+	old := *queue
+	item := old[len(old)-1]
+	*queue = old[:len(old)-1]
+	return item
+}
+
+// walkSearch is the result of searching the graph from a node, holding the
+// distance to each node reached and the node it was reached from
+type walkSearch struct {
+	distances map[int32]float64
+	previous  map[int32]int32
+}
+
+// search finds the shortest walks from the start node. With a goal it is an A*
+// search, guided by the straight line distance to the goal, that stops once the
+// goal is reached. Without one, given as -1, it is a Dijkstra search reaching
+// every node within the maximum distance. Steps are left out in wheelchair mode
+func (graph *PedestrianGraph) search(start int32, goal int32, maxMetres float64, options RouteOptions) walkSearch {
+
+	result := walkSearch{distances: map[int32]float64{start: 0}, previous: map[int32]int32{}}
+	estimate := func(node int32) float64 {
+		if goal < 0 {
+			return 0
+		}
+		return graph.distance(node, goal)
+	}
+
+	visited := map[int32]bool{}
+	queue := &walkQueue{{node: start, priority: estimate(start)}}
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(walkQueueItem).node
+		if visited[node] {
+			continue
+		}
+		visited[node] = true
+		if node == goal {
+			break
+		}
+
+		for _, edge := range graph.edges[node] {
+			if edge.steps && options.Wheelchair {
+				continue
+			}
+			distance := result.distances[node] + edge.metres
+			if distance > maxMetres {
+				continue
+			}
+			if known, ok := result.distances[edge.to]; ok && known <= distance {
+				continue
+			}
+			result.distances[edge.to] = distance
+			result.previous[edge.to] = node
+			heap.Push(queue, walkQueueItem{node: edge.to, priority: distance + estimate(edge.to)})
+		}
+	}
+
+	return result
+}
+
+// walkSeconds returns how many seconds it takes to walk the metres
+func (graph *PedestrianGraph) walkSeconds(metres float64) int64 {
+	return int64(math.Round(metres / graph.speed))
+}
+
+// newWalkPath returns the walk through the points, which is metres long
+func (graph *PedestrianGraph) newWalkPath(metres float64, points []maps.LatLng) WalkPath {
+	return WalkPath{
+		DistanceMetres:  math.Round(metres),
+		DurationSeconds: graph.walkSeconds(metres),
+		Geometry:        geoJSONLine(points),
+		Path:            points,
+	}
+}
+
+// Route returns the shortest walk between two points, avoiding steps in
+// wheelchair mode. ErrNoWalk is returned if either point can't be snapped to
+// the graph or there is no walk between them within the longest walk allowed
+func (graph *PedestrianGraph) Route(from maps.LatLng, to maps.LatLng, options RouteOptions) (WalkPath, error) {
+
+	start, startMetres, startOk := graph.snap(from)
+	goal, goalMetres, goalOk := graph.snap(to)
+	if !startOk || !goalOk {
+		return WalkPath{}, ErrNoWalk
+	}
+
+	maxMetres := longestWalkMetres(options)
+	result := graph.search(start, goal, maxMetres-startMetres-goalMetres, options)
+	metres, ok := result.distances[goal]
+	if !ok || startMetres+metres+goalMetres > maxMetres {
+		return WalkPath{}, ErrNoWalk
+	}
+
+	nodes := []int32{goal}
+	for node := goal; node != start; {
+		node = result.previous[node]
+		nodes = append(nodes, node)
+	}
+	points := []maps.LatLng{from}
+	for index := len(nodes) - 1; index >= 0; index-- {
+		points = append(points, graph.nodes[nodes[index]])
+	}
+	points = append(points, to)
+
+	return graph.newWalkPath(startMetres+metres+goalMetres, points), nil
+}
+
+// WalkDistances returns the length in metres of the shortest walk from a point
+// to each of the targets, in the same order, with a single search of the graph.
+// Targets further than the maximum distance or that can't be reached are given
+// as positive infinity. ErrNoWalk is returned if the point can't be snapped to
+// the graph
+func (graph *PedestrianGraph) WalkDistances(from maps.LatLng, targets []maps.LatLng, maxMetres float64,
+	options RouteOptions) ([]float64, error) {
+
+	start, startMetres, ok := graph.snap(from)
+	if !ok {
+		return nil, ErrNoWalk
+	}
+
+	result := graph.search(start, -1, maxMetres-startMetres, options)
+	distances := make([]float64, len(targets))
+	for index, target := range targets {
+		distances[index] = math.Inf(1)
+		node, nodeMetres, snapped := graph.snap(target)
+		if !snapped {
+			continue
+		}
+		if metres, reached := result.distances[node]; reached && startMetres+metres+nodeMetres <= maxMetres {
+			distances[index] = startMetres + metres + nodeMetres
+		}
+	}
+
+	return distances, nil
+}
+
+// AttachWalks takes in the routes matched for a journey and sets the walk from
+// the origin to the first stop and from the last stop to the destination of
+// each, avoiding steps in wheelchair mode. Walks to and from the same stop are
+// only routed once. Routes are left without walks where there is no pedestrian
+// graph or no walk could be found
+func AttachWalks(routes []busRouteJSON, origin maps.LatLng, destination maps.LatLng,
+	options RouteOptions) []busRouteJSON {
+
+	graph := pedestrianGraph()
+	if graph.Len() == 0 {
+		return routes
+	}
+
+	type walkKey struct {
+		from maps.LatLng
+		to   maps.LatLng
+	}
+	walks := map[walkKey]*WalkPath{}
+	walk := func(from maps.LatLng, to maps.LatLng) *WalkPath {
+		key := walkKey{from: from, to: to}
+		if path, ok := walks[key]; ok {
+			return path
+		}
+		var found *WalkPath
+		if path, err := graph.Route(from, to, options); err == nil {
+			found = &path
+		}
+		walks[key] = found
+		return found
+	}
+
+	for index, route := range routes {
+		if len(route.Stops) == 0 {
+			continue
+		}
+		first, last := route.Stops[0], route.Stops[len(route.Stops)-1]
+		routes[index].AccessWalk = walk(origin, maps.LatLng{Lat: first.StopLat, Lng: first.StopLon})
+		routes[index].EgressWalk = walk(maps.LatLng{Lat: last.StopLat, Lng: last.StopLon}, destination)
+	}
+
+	return routes
+}
+
+// longestWalkMetres returns the longest walk to or from a stop, which is
+// shorter in wheelchair mode where the wheelchair limit is lower
+func longestWalkMetres(options RouteOptions) float64 {
+
+	if options.Wheelchair {
+		return math.Min(currentConfig.Walking.MaxWalkMetres, currentConfig.Accessibility.MaxWalkMetres)
+	}
+
+	return currentConfig.Walking.MaxWalkMetres
+}
+
+// walkingSeconds returns how many seconds it takes to walk the metres at the
+// walking speed of the shared pedestrian graph
+func walkingSeconds(metres float64) int64 {
+	return pedestrianGraph().walkSeconds(metres)
+}
+
+// walkingDistances returns the length in metres of the walk from a point to
+// each of the targets, or positive infinity for those beyond the maximum. Walks
+// follow the shared pedestrian graph, falling back to straight lines where
+// there is no graph or the point isn't near it
+func walkingDistances(from maps.LatLng, targets []maps.LatLng, maxMetres float64,
+	options RouteOptions) []float64 {
+
+	distances, err := pedestrianGraph().WalkDistances(from, targets, maxMetres, options)
+	if err == nil {
+		return distances
+	}
+
+	distances = make([]float64, len(targets))
+	for index, target := range targets {
+		distances[index] = distanceMetres(from.Lat, from.Lng, target.Lat, target.Lng)
+		if distances[index] > maxMetres {
+			distances[index] = math.Inf(1)
+		}
+	}
+
+	return distances
+}
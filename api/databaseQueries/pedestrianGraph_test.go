@@ -0,0 +1,211 @@
+package databaseQueries
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"googlemaps.github.io/maps"
+)
+
+// testWalkingExtract is a small OpenStreetMap extract of the streets around
+// Grafton Street, written by testdata/make_walking_extract.py
+const testWalkingExtract = "testdata/dublin-walking.osm.pbf"
+
+// testWalkingNodes are the points of the nodes in the walking extract
+var testWalkingNodes = map[int]maps.LatLng{
+	1: {Lat: 53.34420, Lng: -6.25920}, 3: {Lat: 53.34200, Lng: -6.26020}, 4: {Lat: 53.34020, Lng: -6.26070},
+	5: {Lat: 53.33970, Lng: -6.26080}, 8: {Lat: 53.33960, Lng: -6.25840}, 11: {Lat: 53.33620, Lng: -6.25430},
+	12: {Lat: 53.33700, Lng: -6.26260}, 13: {Lat: 53.33830, Lng: -6.26170}, 14: {Lat: 53.33800, Lng: -6.25850},
+	19: {Lat: 53.35000, Lng: -6.27000},
+}
+
+// samePoint reports whether two points are within a centimetre of each other
+func samePoint(a maps.LatLng, b maps.LatLng) bool {
+	return distanceMetres(a.Lat, a.Lng, b.Lat, b.Lng) < 0.01
+}
+
+// setLongestWheelchairWalk sets the longest walk allowed in wheelchair mode and
+// returns the one it replaces, so that it can be put back once a test is done
+func setLongestWheelchairWalk(metres float64) float64 {
+
+	previous := currentConfig.Accessibility.MaxWalkMetres
+	currentConfig.Accessibility.MaxWalkMetres = metres
+
+	return previous
+}
+
+// loadTestPedestrianGraph reads the walking extract with the default settings
+func loadTestPedestrianGraph(t *testing.T) *PedestrianGraph {
+
+	walkingConfig := DefaultConfig().Walking
+	walkingConfig.OSMFile = testWalkingExtract
+	graph, err := LoadPedestrianGraph(walkingConfig)
+	if err != nil {
+		t.Log("Could not load the walking extract:", err)
+		t.FailNow()
+	}
+
+	return graph
+}
+
+func TestWalkableWay(t *testing.T) {
+
+	for _, test := range []struct {
+		tags     map[string]string
+		walkable bool
+		steps    bool
+	}{
+		{map[string]string{"highway": "footway"}, true, false},
+		{map[string]string{"highway": "steps"}, true, true},
+		{map[string]string{"highway": "motorway"}, false, false},
+		{map[string]string{"highway": "primary", "foot": "no"}, false, false},
+		{map[string]string{"highway": "service", "access": "private"}, false, false},
+		{map[string]string{"highway": "service", "access": "private", "foot": "yes"}, true, false},
+		{map[string]string{"building": "yes"}, false, false},
+	} {
+		if walkable, steps := walkableWay(test.tags); walkable != test.walkable || steps != test.steps {
+			t.Log("Expected", test.tags, "to be walkable", test.walkable, "and steps", test.steps,
+				"got", walkable, steps)
+			t.Fail()
+		}
+	}
+}
+
+func TestPedestrianGraphRoute(t *testing.T) {
+
+	graph := loadTestPedestrianGraph(t)
+
+	// The building and the nodes only it uses are left out
+	if graph.Len() != 20 {
+		t.Log("Expected the 20 nodes of walkable ways, got", graph.Len())
+		t.Fail()
+	}
+
+	// The private road from Chatham Street to Dawson Street can't be used, so the
+	// walk goes around by St Stephen's Green
+	walk, err := graph.Route(testWalkingNodes[4], testWalkingNodes[8], RouteOptions{})
+	if err != nil {
+		t.Log("Could not route from Chatham Street to Dawson Street:", err)
+		t.FailNow()
+	}
+	expected := distanceMetres(53.34020, -6.26070, 53.33970, -6.26080) +
+		distanceMetres(53.33970, -6.26080, 53.33960, -6.25840)
+	if math.Abs(walk.DistanceMetres-math.Round(expected)) > 0 || len(walk.Path) != 5 ||
+		!samePoint(walk.Path[2], testWalkingNodes[5]) {
+		t.Log("Expected a walk of", math.Round(expected), "metres by St Stephen's Green, got", walk)
+		t.Fail()
+	}
+	if walk.DurationSeconds != int64(math.Round(walk.DistanceMetres/1.3)) || walk.Geometry.Type != "LineString" {
+		t.Log("Expected the walk to take", walk.DistanceMetres/1.3, "seconds along a LineString, got", walk)
+		t.Fail()
+	}
+
+	// Steps cut through the park, but are avoided in wheelchair mode. The way
+	// around is further than a wheelchair user may walk by default
+	if _, err = graph.Route(testWalkingNodes[13], testWalkingNodes[14], RouteOptions{Wheelchair: true}); !errors.Is(err, ErrNoWalk) {
+		t.Log("Expected no walk beyond the longest walk in wheelchair mode, got", err)
+		t.Fail()
+	}
+	defer setLongestWheelchairWalk(setLongestWheelchairWalk(1000))
+	walk, _ = graph.Route(testWalkingNodes[13], testWalkingNodes[14], RouteOptions{})
+	stepFree, err := graph.Route(testWalkingNodes[13], testWalkingNodes[14], RouteOptions{Wheelchair: true})
+	if err != nil || len(walk.Path) != 4 || stepFree.DistanceMetres <= walk.DistanceMetres ||
+		!samePoint(stepFree.Path[2], testWalkingNodes[5]) {
+		t.Log("Expected the steps to be avoided in wheelchair mode, got", walk, stepFree, err)
+		t.Fail()
+	}
+
+	// The motorway can't be walked along
+	walk, _ = graph.Route(testWalkingNodes[12], testWalkingNodes[11], RouteOptions{})
+	if walk.DistanceMetres <= distanceMetres(53.33700, -6.26260, 53.33620, -6.25430)+1 {
+		t.Log("Expected the walk to avoid the motorway, got", walk)
+		t.Fail()
+	}
+
+	for _, to := range []maps.LatLng{testWalkingNodes[19], {Lat: 53.36, Lng: -6.30}} {
+		if _, err = graph.Route(testWalkingNodes[1], to, RouteOptions{}); !errors.Is(err, ErrNoWalk) {
+			t.Log("Expected no walk to", to, "got", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestPedestrianGraphWalkDistances(t *testing.T) {
+
+	graph := loadTestPedestrianGraph(t)
+
+	targets := []maps.LatLng{testWalkingNodes[3], testWalkingNodes[8], testWalkingNodes[19], testWalkingNodes[11]}
+	distances, err := graph.WalkDistances(testWalkingNodes[4], targets, 400, RouteOptions{})
+	if err != nil {
+		t.Log("Could not find walking distances:", err)
+		t.FailNow()
+	}
+	for index, target := range targets[:2] {
+		walk, _ := graph.Route(testWalkingNodes[4], target, RouteOptions{})
+		if math.Round(distances[index]) != walk.DistanceMetres {
+			t.Log("Expected the distance to", target, "to match the route of", walk.DistanceMetres, "got",
+				distances[index])
+			t.Fail()
+		}
+	}
+	if !math.IsInf(distances[2], 1) || !math.IsInf(distances[3], 1) {
+		t.Log("Expected the unconnected and distant targets to be out of reach, got", distances)
+		t.Fail()
+	}
+
+	if _, err = NewPedestrianGraph(DefaultConfig().Walking).WalkDistances(testWalkingNodes[4], targets, 400,
+		RouteOptions{}); !errors.Is(err, ErrNoWalk) {
+		t.Log("Expected no walks over an empty graph, got", err)
+		t.Fail()
+	}
+}
+
+func TestAttachWalks(t *testing.T) {
+
+	routes := []busRouteJSON{
+		{RouteNum: "14", Stops: []RouteStop{
+			{StopLat: testWalkingNodes[3].Lat, StopLon: testWalkingNodes[3].Lng},
+			{StopLat: testWalkingNodes[13].Lat, StopLon: testWalkingNodes[13].Lng},
+		}},
+		{RouteNum: "15", Stops: []RouteStop{
+			{StopLat: testWalkingNodes[3].Lat, StopLon: testWalkingNodes[3].Lng},
+			{StopLat: testWalkingNodes[19].Lat, StopLon: testWalkingNodes[19].Lng},
+		}},
+		{RouteNum: "16"},
+	}
+
+	SetPedestrianGraph(NewPedestrianGraph(DefaultConfig().Walking))
+	if walked := AttachWalks(append([]busRouteJSON{}, routes...), testWalkingNodes[1], testWalkingNodes[14],
+		RouteOptions{}); walked[0].AccessWalk != nil {
+		t.Log("Expected no walks without a pedestrian graph, got", walked[0].AccessWalk)
+		t.Fail()
+	}
+
+	SetPedestrianGraph(loadTestPedestrianGraph(t))
+	defer SetPedestrianGraph(NewPedestrianGraph(DefaultConfig().Walking))
+	defer setLongestWheelchairWalk(setLongestWheelchairWalk(1000))
+	walked := AttachWalks(routes, testWalkingNodes[1], testWalkingNodes[14], RouteOptions{Wheelchair: true})
+	if walked[0].AccessWalk == nil || walked[0].AccessWalk != walked[1].AccessWalk {
+		t.Log("Expected the walk to the shared first stop to be routed once, got", walked[0].AccessWalk,
+			walked[1].AccessWalk)
+		t.Fail()
+	}
+	if walked[0].EgressWalk == nil || len(walked[0].EgressWalk.Path) != 5 {
+		t.Log("Expected the walk from the last stop to go around the steps, got", walked[0].EgressWalk)
+		t.Fail()
+	}
+	if walked[1].EgressWalk != nil || walked[2].AccessWalk != nil {
+		t.Log("Expected no walk from a stop that can't be walked from or a route without stops")
+		t.Fail()
+	}
+
+	// The walks are followed when the itinerary is exported
+	itinerary := Itinerary{Route: walked[0], Origin: testWalkingNodes[1], Destination: testWalkingNodes[14]}
+	access, egress, _ := itinerary.WalkLegs()
+	if len(access.Points()) != len(walked[0].AccessWalk.Path) ||
+		egress.DistanceMetres != walked[0].EgressWalk.DistanceMetres {
+		t.Log("Expected the itinerary walks to follow the attached walks, got", access, egress)
+		t.Fail()
+	}
+}
@@ -0,0 +1,190 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// PredictionDeadline is how long a route matching request waits for travel
+// time predictions before the routes still waiting fall back to the static
+// timetable, and PredictionWorkers is the most predictions requested at once
+var (
+	PredictionDeadline = 3 * time.Second
+	PredictionWorkers  = 8
+)
+
+// travelTimePredictor is the signature of GetTravelTimePredictionWithContext,
+// which predictTravelTime is set to outside of tests
+type travelTimePredictor func(ctx context.Context, routeNum string,
+	date string, direction string) (TravelTimePredictionFloat, error)
+
+var predictTravelTime travelTimePredictor = GetTravelTimePredictionWithContext
+
+// PendingPrediction holds a matched route that is waiting on its travel time
+// prediction along with the static timetable arrival times at the origin,
+// destination, first and final stops for the trip that are needed to turn the
+// prediction for the whole route into one for the journey, or to fall back to
+// the static timetable if there is no prediction
+type PendingPrediction struct {
+	Route                  busRouteJSON
+	OriginArrivalTime      string
+	DestinationArrivalTime string
+	FirstStopArrivalTime   string
+	FinalStopArrivalTime   string
+}
+
+// predictionOutcome is the result of a single prediction request, with the
+// index of the route in the slice of pending predictions it was made for
+type predictionOutcome struct {
+	index      int
+	prediction TravelTimePredictionFloat
+	err        error
+}
+
+// PredictTravelTimes takes in the context of the request, the routes matched for
+// a query and the date of the query and returns the routes with their travel times filled in.
+// Predictions are requested concurrently by at most PredictionWorkers workers and
+// any route without a prediction once PredictionDeadline has passed uses the
+// static timetable instead, with the Source of each travel time showing which
+// was used. The routes are returned in the same order they were passed in
+func PredictTravelTimes(requestCtx context.Context, pendingRoutes []PendingPrediction,
+	date string) []busRouteJSON {
+
+	ctx, cancel := context.WithTimeout(requestCtx, PredictionDeadline)
+	defer cancel()
+
+	return predictTravelTimes(ctx, pendingRoutes, date, PredictionWorkers, predictTravelTime)
+}
+
+// predictTravelTimes does the work of PredictTravelTimes with the deadline set
+// on the context and the number of workers and the predictor passed in
+func predictTravelTimes(ctx context.Context, pendingRoutes []PendingPrediction,
+	date string, workers int, predictor travelTimePredictor) []busRouteJSON {
+
+	if len(pendingRoutes) == 0 {
+		return nil
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(pendingRoutes) {
+		workers = len(pendingRoutes)
+	}
+
+	// Both channels are buffered to hold every route so that neither the workers
+	// nor this function ever block on them, even once the deadline has passed
+	jobs := make(chan int, len(pendingRoutes))
+	outcomes := make(chan predictionOutcome, len(pendingRoutes))
+	for index := range pendingRoutes {
+		jobs <- index
+	}
+	close(jobs)
+
+	for worker := 0; worker < workers; worker++ {
+		go func() {
+			for index := range jobs {
+				if ctx.Err() != nil {
+					outcomes <- predictionOutcome{index: index, err: ctx.Err()}
+					continue
+				}
+				pendingRoute := pendingRoutes[index]
+				prediction, err := predictor(ctx, pendingRoute.Route.RouteNum, date,
+					pendingRoute.Route.Direction)
+				outcomes <- predictionOutcome{index: index, prediction: prediction, err: err}
+			}
+		}()
+	}
+
+	// Collect predictions until all have arrived or the deadline passes, after which
+	// the routes still without one are left to fall back to the static timetable
+	logger := LoggerFromContext(ctx)
+	predictions := make([]*TravelTimePredictionFloat, len(pendingRoutes))
+	errs := make([]error, len(pendingRoutes))
+	for received := 0; received < len(pendingRoutes); received++ {
+		select {
+		case outcome := <-outcomes:
+			if outcome.err != nil {
+				logger.Warn("travel time prediction failed",
+					"route", pendingRoutes[outcome.index].Route.RouteNum, "error", outcome.err)
+				errs[outcome.index] = outcome.err
+				continue
+			}
+			prediction := outcome.prediction
+			predictions[outcome.index] = &prediction
+		case <-ctx.Done():
+			logger.Warn("travel time prediction deadline passed",
+				"routes_outstanding", len(pendingRoutes)-received)
+			received = len(pendingRoutes)
+		}
+	}
+
+	routes := make([]busRouteJSON, 0, len(pendingRoutes))
+	for index, pendingRoute := range pendingRoutes {
+		route := pendingRoute.Route
+		route.TravelTime = CreateJourneyTravelTime(pendingRoute, predictions[index])
+		routes = append(routes, route)
+
+		predictionOutcomes.WithLabelValues(outcomeLabel(errs[index], route.TravelTime)).Inc()
+	}
+
+	return routes
+}
+
+// outcomeLabel takes in the error of the prediction for a route, which is
+// nil if there was none or it never arrived, and the travel time given for the
+// route and returns the outcome the prediction is counted as. Only predictions
+// cut short by the deadline count as falling back to the static timetable, any
+// other failure is an error even when the deadline has since passed
+func outcomeLabel(err error, travelTime TravelTimePrediction) string {
+
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return predictionOutcomeError
+	}
+	if travelTime.Source == "static" {
+		return predictionOutcomeStaticFallback
+	}
+
+	return predictionOutcomeSuccess
+}
+
+// CreateJourneyTravelTime takes in a route waiting on its travel time and the
+// prediction for it, which is nil if there is none, and returns the travel time
+// for the journey. If there is no prediction, or the prediction is empty, then
+// the travel time is taken from the static timetable with its Source set to static
+func CreateJourneyTravelTime(pendingRoute PendingPrediction,
+	prediction *TravelTimePredictionFloat) TravelTimePrediction {
+
+	var journeyTravelTime TravelTimePrediction
+	if prediction != nil {
+
+		// Floating point travel time used in conjunction with static timetable time
+		// information to generate more user-friendly travel time information
+		journeyTravelTime = AdjustTravelTime(*prediction, pendingRoute.OriginArrivalTime,
+			pendingRoute.DestinationArrivalTime, pendingRoute.FirstStopArrivalTime,
+			pendingRoute.FinalStopArrivalTime)
+	}
+
+	// If the travel time prediction could not be calculated then static timetable
+	// information is used for the travel time estimation returned to the user
+	if prediction == nil || journeyTravelTime.Source == "static" {
+		staticTravelTime := GetStaticTime(pendingRoute.OriginArrivalTime, pendingRoute.DestinationArrivalTime)
+		estimatedArrival := GetTimeStringAsHoursAndMinutes(pendingRoute.DestinationArrivalTime)
+		journeyTravelTime.Source = "static"
+		journeyTravelTime.TransitTime = staticTravelTime
+		journeyTravelTime.TransitTimeMinusMAE = staticTravelTime
+		journeyTravelTime.TransitTimePlusMAE = staticTravelTime
+		journeyTravelTime.EstimatedArrivalTime = estimatedArrival
+		journeyTravelTime.EstimatedArrivalHighTime = estimatedArrival
+		journeyTravelTime.EstimatedArrivalLowTime = estimatedArrival
+	}
+
+	// Static timetable departure time is used to provide the user of an estimate
+	// for how when a bus will arrive to begin their journey
+	if len(pendingRoute.Route.Stops) > 0 {
+		journeyTravelTime.ScheduledDepartureTime =
+			GetTimeStringAsHoursAndMinutes(pendingRoute.Route.Stops[0].ArrivalTime)
+	}
+
+	return journeyTravelTime
+}
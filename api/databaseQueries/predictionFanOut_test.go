@@ -0,0 +1,142 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// createTestPendingPrediction returns a route waiting on its prediction with a
+// static journey of 22 minutes from 07:00 to 07:22 on a 44 minute route
+func createTestPendingPrediction(routeNum string) PendingPrediction {
+
+	var testRoute busRouteJSON
+	testRoute.RouteNum = routeNum
+	testRoute.Direction = "1"
+	testRoute.Stops = []RouteStop{
+		{StopNumber: "1", StopSequence: "1", ArrivalTime: "07:00:00"},
+		{StopNumber: "2", StopSequence: "2", ArrivalTime: "07:22:00"},
+	}
+
+	return PendingPrediction{
+		Route:                  testRoute,
+		OriginArrivalTime:      "07:00:00",
+		DestinationArrivalTime: "07:22:00",
+		FirstStopArrivalTime:   "07:00:00",
+		FinalStopArrivalTime:   "07:44:00",
+	}
+}
+
+func TestPredictTravelTimes(t *testing.T) {
+
+	testPendingRoutes := []PendingPrediction{
+		createTestPendingPrediction("fast"),
+		createTestPendingPrediction("slow"),
+		createTestPendingPrediction("broken"),
+	}
+
+	testPredictor := func(ctx context.Context, routeNum string,
+		date string, direction string) (TravelTimePredictionFloat, error) {
+		switch routeNum {
+		case "slow":
+			select {
+			case <-time.After(time.Second):
+				return TravelTimePredictionFloat{60, 70, 50}, nil
+			case <-ctx.Done():
+				return TravelTimePredictionFloat{}, ctx.Err()
+			}
+		case "broken":
+			return TravelTimePredictionFloat{}, errors.New("prediction service unavailable")
+		}
+		return TravelTimePredictionFloat{60, 70, 50}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	routes := predictTravelTimes(ctx, testPendingRoutes, "2022-08-12 07:00:00", 3, testPredictor)
+	if time.Since(start) > 500*time.Millisecond {
+		t.Log("Slow prediction should have been abandoned at the deadline")
+		t.Fail()
+	}
+
+	if len(routes) != 3 || routes[0].RouteNum != "fast" || routes[1].RouteNum != "slow" {
+		t.Log("Routes should be returned in the order they were passed in")
+		t.FailNow()
+	}
+
+	// Half of the 44 minute route is travelled, so half of the 60 minute prediction
+	if routes[0].TravelTime.Source != "prediction" || routes[0].TravelTime.TransitTime != 30 {
+		t.Log("Fast route should use the prediction of 30 minutes but has", routes[0].TravelTime)
+		t.Fail()
+	}
+	for _, route := range routes[1:] {
+		if route.TravelTime.Source != "static" || route.TravelTime.TransitTime != 22 ||
+			route.TravelTime.EstimatedArrivalTime != "07:22" {
+			t.Log("Route", route.RouteNum, "should fall back to the static time but has", route.TravelTime)
+			t.Fail()
+		}
+	}
+	if routes[0].TravelTime.ScheduledDepartureTime != "07:00" {
+		t.Log("Scheduled departure should be 07:00 but is", routes[0].TravelTime.ScheduledDepartureTime)
+		t.Fail()
+	}
+}
+
+func TestOutcomeLabel(t *testing.T) {
+
+	static := TravelTimePrediction{Source: "static"}
+	for _, test := range []struct {
+		err        error
+		travelTime TravelTimePrediction
+		outcome    string
+	}{
+		{nil, TravelTimePrediction{Source: "prediction"}, predictionOutcomeSuccess},
+		{nil, static, predictionOutcomeStaticFallback},
+		{context.DeadlineExceeded, static, predictionOutcomeStaticFallback},
+		{errors.New("prediction service unavailable"), static, predictionOutcomeError},
+		{context.Canceled, static, predictionOutcomeError},
+	} {
+		if outcome := outcomeLabel(test.err, test.travelTime); outcome != test.outcome {
+			t.Log("Expected", test.err, "to be counted as", test.outcome, "but was", outcome)
+			t.Fail()
+		}
+	}
+}
+
+func TestPredictTravelTimesWorkerLimit(t *testing.T) {
+
+	var running int32
+	var maxRunning int32
+	testPredictor := func(ctx context.Context, routeNum string,
+		date string, direction string) (TravelTimePredictionFloat, error) {
+		current := atomic.AddInt32(&running, 1)
+		for {
+			previous := atomic.LoadInt32(&maxRunning)
+			if current <= previous || atomic.CompareAndSwapInt32(&maxRunning, previous, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return TravelTimePredictionFloat{60, 70, 50}, nil
+	}
+
+	var testPendingRoutes []PendingPrediction
+	for index := 0; index < 10; index++ {
+		testPendingRoutes = append(testPendingRoutes, createTestPendingPrediction("46A"))
+	}
+
+	routes := predictTravelTimes(context.Background(), testPendingRoutes, "2022-08-12 07:00:00", 2, testPredictor)
+	if len(routes) != 10 {
+		t.Log("All 10 routes should be returned but got", len(routes))
+		t.Fail()
+	}
+	if maxRunning > 2 {
+		t.Log("At most 2 predictions should run at once but", maxRunning, "did")
+		t.Fail()
+	}
+}
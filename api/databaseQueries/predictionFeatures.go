@@ -0,0 +1,132 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// PredictionFeatureVersion is the version of the feature vector assembled for
+// the prediction service. Version 1 held the weekday, hour, month and departure
+// time alone, which are still passed in the path of each request, while version
+// 2 adds the weather and the calendar flags as query parameters. It should be
+// bumped whenever a feature is added, removed or changes meaning
+const PredictionFeatureVersion = 2
+
+// PredictionFeatures is the feature vector passed to the prediction service for
+// an instant. The weekday is 0 for Sunday, the hour and month are those seen in
+// Dublin and the departure time is in seconds from the start of the service
+// day. The weather is left out where it isn't known
+type PredictionFeatures struct {
+	Version       int      `json:"version"`
+	Weekday       int      `json:"weekday"`
+	Hour          int      `json:"hour"`
+	Month         int      `json:"month"`
+	DepartureTime int64    `json:"departure_time"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	Precipitation *float64 `json:"precipitation,omitempty"`
+	WindSpeed     *float64 `json:"wind_speed,omitempty"`
+	SchoolTerm    bool     `json:"school_term"`
+	BankHoliday   bool     `json:"bank_holiday"`
+	SpecialEvent  bool     `json:"special_event"`
+}
+
+// SpecialEvent is an event such as a match or concert that changes how traffic
+// moves while it runs
+type SpecialEvent struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// newPredictionFeatures returns the features of an instant that depend on the
+// time alone, as seen in Dublin. The departure time is measured from the start
+// of the GTFS service day so that it lines up with the timetable on the days
+// that the clocks change
+func newPredictionFeatures(instant time.Time) PredictionFeatures {
+
+	instant = instant.In(dublinLocation)
+	_, secondsIntoServiceDay := ServiceDay(instant)
+
+	return PredictionFeatures{
+		Version:       PredictionFeatureVersion,
+		Weekday:       int(instant.Weekday()),
+		Hour:          instant.Hour(),
+		Month:         int(instant.Month()),
+		DepartureTime: secondsIntoServiceDay % (24 * 3600),
+	}
+}
+
+// AssemblePredictionFeatures takes in an instant along with where the weather,
+// calendar and events are taken from and returns the features for a prediction
+// at that instant. The calendar flags are those of the service day. Weather that
+// can't be found is left out, and any error other than ErrNoWeather is logged
+func AssemblePredictionFeatures(ctx context.Context, instant time.Time, weather WeatherProvider,
+	calendar DayCalendar, events []SpecialEvent) PredictionFeatures {
+
+	features := newPredictionFeatures(instant)
+
+	conditions, err := weather.WeatherAt(ctx, instant)
+	if err == nil {
+		features.Temperature = &conditions.Temperature
+		features.Precipitation = &conditions.Precipitation
+		features.WindSpeed = &conditions.WindSpeed
+	} else if !errors.Is(err, ErrNoWeather) {
+		LoggerFromContext(ctx).Warn("could not find the weather for prediction features", "error", err)
+	}
+
+	serviceDate, _ := ServiceDay(instant)
+	features.BankHoliday = calendar.IsBankHoliday(serviceDate)
+	features.SchoolTerm = calendar.IsSchoolTerm(serviceDate)
+	for _, event := range events {
+		if !instant.Before(event.Start) && instant.Before(event.End) {
+			features.SpecialEvent = true
+		}
+	}
+
+	return features
+}
+
+// PathValues returns the version 1 features, passed in the path of a request to
+// the prediction service, with the hour and month padded to two digits
+func (features PredictionFeatures) PathValues() []string {
+	return []string{
+		strconv.Itoa(features.Weekday),
+		fmt.Sprintf("%02d", features.Hour),
+		fmt.Sprintf("%02d", features.Month),
+		strconv.FormatInt(features.DepartureTime, 10),
+	}
+}
+
+// QueryValues returns the features added since version 1, passed as query
+// parameters of a request to the prediction service along with the version.
+// Flags are given as 0 or 1 and unknown weather is left out
+func (features PredictionFeatures) QueryValues() url.Values {
+
+	flag := func(value bool) string {
+		if value {
+			return "1"
+		}
+		return "0"
+	}
+
+	values := url.Values{}
+	values.Set("feature_version", strconv.Itoa(features.Version))
+	for name, value := range map[string]*float64{
+		"temp":          features.Temperature,
+		"precipitation": features.Precipitation,
+		"wind_speed":    features.WindSpeed,
+	} {
+		if value != nil {
+			values.Set(name, strconv.FormatFloat(*value, 'f', -1, 64))
+		}
+	}
+	values.Set("school_term", flag(features.SchoolTerm))
+	values.Set("bank_holiday", flag(features.BankHoliday))
+	values.Set("special_event", flag(features.SpecialEvent))
+
+	return values
+}
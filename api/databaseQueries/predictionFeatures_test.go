@@ -0,0 +1,76 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testWeatherProvider is a WeatherProvider returning the same conditions, or
+// error, for every instant
+type testWeatherProvider struct {
+	conditions WeatherConditions
+	err        error
+}
+
+func (provider testWeatherProvider) WeatherAt(ctx context.Context, instant time.Time) (WeatherConditions, error) {
+	return provider.conditions, provider.err
+}
+
+// testCalendar returns a calendar with a once-off holiday on Friday 18 March
+// 2022 and the summer term of 2022, which the June bank holiday falls in
+func testCalendar(t *testing.T) *IrishCalendar {
+
+	calendar, err := NewIrishCalendar(CalendarConfig{
+		BankHolidays: []string{"2022-03-18"},
+		SchoolTerms:  []string{"2022-04-25/2022-06-30"},
+	})
+	if err != nil {
+		t.Log("The test calendar should load but got", err)
+		t.FailNow()
+	}
+
+	return calendar
+}
+
+func TestAssemblePredictionFeatures(t *testing.T) {
+
+	// Tuesday 7 June 2022 at 08:15 in Dublin, a school day with a match on
+	instant := time.Date(2022, 6, 7, 8, 15, 0, 0, dublinLocation)
+	weather := testWeatherProvider{conditions: WeatherConditions{Temperature: 14.5, Precipitation: 0.4, WindSpeed: 6}}
+	events := []SpecialEvent{{Name: "Match", Start: instant.Add(-time.Hour), End: instant.Add(time.Hour)}}
+
+	features := AssemblePredictionFeatures(context.Background(), instant, weather, testCalendar(t), events)
+	if features.Version != PredictionFeatureVersion || features.Weekday != 2 || features.Hour != 8 ||
+		features.Month != 6 || features.DepartureTime != 29700 {
+		t.Log("Expected the features of the time to match version 1, got", features)
+		t.Fail()
+	}
+	if features.Temperature == nil || *features.Temperature != 14.5 || *features.WindSpeed != 6 ||
+		!features.SchoolTerm || features.BankHoliday || !features.SpecialEvent {
+		t.Log("Expected the weather, term and event to be flagged, got", features)
+		t.Fail()
+	}
+
+	query := features.QueryValues()
+	if query.Get("feature_version") != "2" || query.Get("temp") != "14.5" || query.Get("precipitation") != "0.4" ||
+		query.Get("school_term") != "1" || query.Get("bank_holiday") != "0" || query.Get("special_event") != "1" {
+		t.Log("Expected the features to be passed as query parameters, got", query.Encode())
+		t.Fail()
+	}
+}
+
+func TestAssemblePredictionFeaturesWithoutWeather(t *testing.T) {
+
+	instant := time.Date(2022, 6, 6, 23, 0, 0, 0, dublinLocation)
+	for _, err := range []error{ErrNoWeather, errors.New("connection refused")} {
+		features := AssemblePredictionFeatures(context.Background(), instant, testWeatherProvider{err: err},
+			testCalendar(t), nil)
+		if features.Temperature != nil || features.QueryValues().Has("temp") || !features.BankHoliday ||
+			features.SchoolTerm || features.SpecialEvent {
+			t.Log("Expected the weather to be left out on the bank holiday, got", features)
+			t.Fail()
+		}
+	}
+}
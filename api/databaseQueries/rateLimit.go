@@ -0,0 +1,176 @@
+package databaseQueries
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket holds the tokens left for one caller and when they were last
+// topped up. Tokens are added continuously at the rate of the bucket, in tokens
+// per second, up to its capacity, and each request takes one
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+	rate       float64
+	capacity   float64
+}
+
+// RateLimitResult describes the state of a caller's bucket after a request, as
+// reported in the rate limit headers. Reset is how long until the bucket is full
+// again and RetryAfter, only set when the request isn't allowed, is how long
+// until the next token is available
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// RateLimiter is a token bucket rate limiter keeping a separate bucket for each
+// key, such as an IP address or api key. Buckets that have been idle long enough
+// to fill back up are dropped as they are no different from a new bucket
+type RateLimiter struct {
+	rate    float64
+	burst   float64
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+	now     func() time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing requestsPerMinute on average
+// for each key, with up to burst requests at once
+func NewRateLimiter(requestsPerMinute float64, burst int) *RateLimiter {
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &RateLimiter{
+		rate:    requestsPerMinute / 60,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key if there is one and returns the
+// RateLimitResult for the request
+func (limiter *RateLimiter) Allow(key string) RateLimitResult {
+	return limiter.AllowWithRate(key, limiter.rate*60, int(limiter.burst))
+}
+
+// AllowWithRate works as Allow but uses the given rate and burst for the bucket
+// rather than those of the RateLimiter, so that one RateLimiter can hold the
+// buckets for api keys that each have their own limits
+func (limiter *RateLimiter) AllowWithRate(key string, requestsPerMinute float64, burst int) RateLimitResult {
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	rate := requestsPerMinute / 60
+	capacity := math.Max(float64(burst), 1)
+	now := limiter.now()
+
+	limiter.calls++
+	if limiter.calls%1000 == 0 {
+		limiter.removeIdleBuckets(now)
+	}
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, lastRefill: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.rate, bucket.capacity = rate, capacity
+
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*rate)
+	bucket.lastRefill = now
+
+	result := RateLimitResult{Limit: int(capacity)}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else if rate > 0 {
+		result.RetryAfter = secondsDuration((1 - bucket.tokens) / rate)
+	}
+
+	result.Remaining = int(math.Floor(bucket.tokens))
+	if rate > 0 {
+		result.Reset = secondsDuration((capacity - bucket.tokens) / rate)
+	}
+
+	return result
+}
+
+// removeIdleBuckets drops every bucket that would be full by now at its own
+// rate and capacity. It must be called with the lock held
+func (limiter *RateLimiter) removeIdleBuckets(now time.Time) {
+
+	for key, bucket := range limiter.buckets {
+		if bucket.rate > 0 && bucket.tokens+now.Sub(bucket.lastRefill).Seconds()*bucket.rate >= bucket.capacity {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+// Len returns the number of buckets currently held
+func (limiter *RateLimiter) Len() int {
+
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	return len(limiter.buckets)
+}
+
+// secondsDuration converts a number of seconds into a duration, rounding up to
+// the next whole second as the rate limit headers are given in seconds
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(math.Ceil(seconds)) * time.Second
+}
+
+// QuotaTracker counts the requests made with each api key during the current
+// Dublin day, starting again from zero each midnight
+type QuotaTracker struct {
+	lock   sync.Mutex
+	day    string
+	counts map[string]int64
+	now    func() time.Time
+}
+
+// NewQuotaTracker returns an empty QuotaTracker
+func NewQuotaTracker() *QuotaTracker {
+	return &QuotaTracker{counts: map[string]int64{}, now: time.Now}
+}
+
+// Use counts a request against the daily quota for key, unless the quota has
+// already been used up, and returns whether the request is allowed, how many
+// requests are left today and how long until the quota resets at midnight. A
+// quota of zero or less means the key has no daily limit
+func (tracker *QuotaTracker) Use(key string, quota int64) (bool, int64, time.Duration) {
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	now := tracker.now().In(dublinLocation)
+	today := now.Format("2006-01-02")
+	if today != tracker.day {
+		tracker.day = today
+		tracker.counts = map[string]int64{}
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, dublinLocation)
+	untilReset := midnight.Sub(now)
+
+	if quota <= 0 {
+		return true, 0, untilReset
+	}
+	if tracker.counts[key] >= quota {
+		return false, 0, untilReset
+	}
+
+	tracker.counts[key]++
+	return true, quota - tracker.counts[key], untilReset
+}
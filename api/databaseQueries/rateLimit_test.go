@@ -0,0 +1,83 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+
+	testNow := time.Date(2022, 8, 12, 10, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(60, 2)
+	limiter.now = func() time.Time { return testNow }
+
+	first := limiter.Allow("1.2.3.4")
+	second := limiter.Allow("1.2.3.4")
+	third := limiter.Allow("1.2.3.4")
+
+	if !first.Allowed || !second.Allowed || third.Allowed {
+		t.Log("A burst of 2 should allow two requests and reject the third")
+		t.Fail()
+	}
+	if third.Remaining != 0 || third.RetryAfter != time.Second || third.Reset != 2*time.Second {
+		t.Log("Unexpected state after the burst was used up:", third)
+		t.Fail()
+	}
+
+	if !limiter.Allow("5.6.7.8").Allowed {
+		t.Log("Each key should have its own bucket")
+		t.Fail()
+	}
+
+	// One token is added each second at 60 requests per minute
+	testNow = testNow.Add(time.Second)
+	if !limiter.Allow("1.2.3.4").Allowed {
+		t.Log("A token should be available again after a second")
+		t.Fail()
+	}
+}
+
+func TestRateLimiterRemovesIdleBuckets(t *testing.T) {
+
+	testNow := time.Date(2022, 8, 12, 10, 0, 0, 0, time.UTC)
+	limiter := NewRateLimiter(60, 5)
+	limiter.now = func() time.Time { return testNow }
+
+	limiter.Allow("idle")
+	limiter.AllowWithRate("slow key", 0.5, 50)
+	testNow = testNow.Add(time.Minute)
+	for index := 0; index < 998; index++ {
+		limiter.Allow("busy")
+	}
+
+	// The bucket of the key with its own slower rate is not full yet so is kept
+	if _, ok := limiter.buckets["slow key"]; !ok || limiter.Len() != 2 {
+		t.Log("Only the idle bucket should have been removed, buckets held:", limiter.Len())
+		t.Fail()
+	}
+}
+
+func TestQuotaTrackerResetsAtDublinMidnight(t *testing.T) {
+
+	// 22:30 UTC on the 12th of August is 23:30 in Dublin
+	testNow := time.Date(2022, 8, 12, 22, 30, 0, 0, time.UTC)
+	tracker := NewQuotaTracker()
+	tracker.now = func() time.Time { return testNow }
+
+	allowed, remaining, untilReset := tracker.Use("key", 2)
+	if !allowed || remaining != 1 || untilReset != 30*time.Minute {
+		t.Log("Unexpected quota state after the first request:", allowed, remaining, untilReset)
+		t.Fail()
+	}
+	tracker.Use("key", 2)
+	if allowed, _, _ = tracker.Use("key", 2); allowed {
+		t.Log("The third request should be over a quota of 2")
+		t.Fail()
+	}
+
+	testNow = testNow.Add(31 * time.Minute)
+	if allowed, _, _ = tracker.Use("key", 2); !allowed {
+		t.Log("The quota should reset at midnight in Dublin")
+		t.Fail()
+	}
+}
@@ -0,0 +1,170 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrReplayFinished is returned by a ReplayFeedSource once every file has been
+// replayed
+var ErrReplayFinished = errors.New("every feed file has been replayed")
+
+// feedResponseLimit is the largest GTFS-R feed read from the NTA, well above
+// the few megabytes of a full trip updates feed
+const feedResponseLimit = 64 << 20
+
+// FeedSource gives the GTFS-R feed each time it is polled
+type FeedSource interface {
+	// Name identifies the source in the poll status and logs
+	Name() string
+	// Fetch returns the current feed
+	Fetch(ctx context.Context) (FeedMessage, error)
+}
+
+// HTTPFeedSource fetches a GTFS-R feed in the NTA JSON format from a url,
+// sending the api key in the x-api-key header
+type HTTPFeedSource struct {
+	url    string
+	apiKey string
+	client *http.Client
+}
+
+// NewHTTPFeedSource returns an HTTPFeedSource fetching the url with the client
+func NewHTTPFeedSource(url string, apiKey string, client *http.Client) *HTTPFeedSource {
+	return &HTTPFeedSource{url: url, apiKey: apiKey, client: client}
+}
+
+// Name returns the url of the feed
+func (source *HTTPFeedSource) Name() string {
+	return source.url
+}
+
+// Fetch requests the feed and decodes it, returning an error for any response
+// other than 200
+func (source *HTTPFeedSource) Fetch(ctx context.Context) (FeedMessage, error) {
+
+	var feed FeedMessage
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, source.url, nil)
+	if err != nil {
+		return feed, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if source.apiKey != "" {
+		request.Header.Set("x-api-key", source.apiKey)
+	}
+
+	resp, err := source.client.Do(request)
+	if err != nil {
+		return feed, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return feed, fmt.Errorf("feed returned %s", resp.Status)
+	}
+
+	err = json.NewDecoder(io.LimitReader(resp.Body, feedResponseLimit)).Decode(&feed)
+	return feed, err
+}
+
+// ReplayFeedSource replays GTFS-R feeds saved as JSON files, one file for each
+// poll in the order of their names, so the poller can be run offline
+type ReplayFeedSource struct {
+	lock  sync.Mutex
+	name  string
+	files []string
+	next  int
+}
+
+// NewReplayFeedSource returns a ReplayFeedSource for the path, which is either a
+// single feed file or a directory whose .json files are replayed in order
+func NewReplayFeedSource(path string) (*ReplayFeedSource, error) {
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return &ReplayFeedSource{name: path, files: []string{path}}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".json") {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .json feed files in %s", path)
+	}
+	sort.Strings(files)
+
+	return &ReplayFeedSource{name: path, files: files}, nil
+}
+
+// Name returns the replayed path
+func (source *ReplayFeedSource) Name() string {
+	return source.name
+}
+
+// Fetch reads the next feed file, returning ErrReplayFinished once there are
+// none left
+func (source *ReplayFeedSource) Fetch(ctx context.Context) (FeedMessage, error) {
+
+	var feed FeedMessage
+
+	source.lock.Lock()
+	if source.next >= len(source.files) {
+		source.lock.Unlock()
+		return feed, ErrReplayFinished
+	}
+	file := source.files[source.next]
+	source.next++
+	source.lock.Unlock()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return feed, err
+	}
+	if err = json.Unmarshal(data, &feed); err != nil {
+		return feed, fmt.Errorf("%s: %w", file, err)
+	}
+
+	return feed, nil
+}
+
+// newFeedSources returns the sources named by the configuration, the replayed
+// files where a replay path is given and the feed urls otherwise
+func newFeedSources(realtimeConfig RealtimeConfig) ([]FeedSource, error) {
+
+	if realtimeConfig.ReplayPath != "" {
+		source, err := NewReplayFeedSource(realtimeConfig.ReplayPath)
+		if err != nil {
+			return nil, err
+		}
+		return []FeedSource{source}, nil
+	}
+
+	client := &http.Client{Timeout: time.Duration(realtimeConfig.Timeout)}
+	var sources []FeedSource
+	for _, url := range realtimeConfig.Feeds {
+		sources = append(sources, NewHTTPFeedSource(url, realtimeConfig.APIKey, client))
+	}
+
+	return sources, nil
+}
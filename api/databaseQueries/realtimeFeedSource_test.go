@@ -0,0 +1,70 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHTTPFeedSourceSendsAPIKey(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(testTripUpdateFeed))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Timeout: time.Second}
+	feed, err := NewHTTPFeedSource(server.URL, "secret", client).Fetch(context.Background())
+	if err != nil || len(feed.Entity) != 2 {
+		t.Log("Expected the feed to be fetched with the api key, got", feed, err)
+		t.Fail()
+	}
+
+	if _, err = NewHTTPFeedSource(server.URL, "wrong", client).Fetch(context.Background()); err == nil {
+		t.Log("Expected an error for a rejected api key")
+		t.Fail()
+	}
+}
+
+func TestReplayFeedSource(t *testing.T) {
+
+	directory := t.TempDir()
+	os.WriteFile(filepath.Join(directory, "2.json"), []byte(testVehicleFeed), 0o600)
+	os.WriteFile(filepath.Join(directory, "1.json"), []byte(testTripUpdateFeed), 0o600)
+	os.WriteFile(filepath.Join(directory, "notes.txt"), []byte("not a feed"), 0o600)
+
+	source, err := NewReplayFeedSource(directory)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	first, err := source.Fetch(context.Background())
+	if err != nil || first.Entity[0].Id != "update-1" {
+		t.Log("Expected 1.json to be replayed first, got", first, err)
+		t.Fail()
+	}
+	second, err := source.Fetch(context.Background())
+	if err != nil || second.Entity[0].Id != "vehicle-1" {
+		t.Log("Expected 2.json to be replayed second, got", second, err)
+		t.Fail()
+	}
+	if _, err = source.Fetch(context.Background()); !errors.Is(err, ErrReplayFinished) {
+		t.Log("Expected the replay to be finished, got", err)
+		t.Fail()
+	}
+
+	if _, err = NewReplayFeedSource(t.TempDir()); err == nil {
+		t.Log("Expected an error for a directory without feed files")
+		t.Fail()
+	}
+}
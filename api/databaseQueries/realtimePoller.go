@@ -0,0 +1,373 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FeedStatus is the health of polling a single feed source. The next poll is
+// pushed back after each failure in a row, and a replayed source is finished
+// once every file has been read
+type FeedStatus struct {
+	Source              string     `json:"source"`
+	LastAttempt         *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Entities            int        `json:"entities"`
+	TripStates          int        `json:"trip_states"`
+	DelayObservations   int        `json:"delay_observations"`
+	FeedTimestamp       *time.Time `json:"feed_timestamp,omitempty"`
+	NextPoll            *time.Time `json:"next_poll,omitempty"`
+	Finished            bool       `json:"finished,omitempty"`
+}
+
+// PollerStatus is the health of the GTFS-R poller as a whole, ok while every
+// source is polled successfully and degraded while any is failing
+type PollerStatus struct {
+	Status  string       `json:"status"`
+	Sources []FeedStatus `json:"sources"`
+}
+
+// RealtimePoller polls each GTFS-R feed source at an interval, keeping the state
+// of each trip in the realtime store, the delays along it in the delay archive,
+// the service alerts in the alert store and the vehicle positions in the
+// tracker. Service days no longer retained are dropped from the archive hourly
+type RealtimePoller struct {
+	sources     []FeedSource
+	store       RealtimeStore
+	archive     DelayArchive
+	alerts      AlertStore
+	vehicles    *VehicleTracker
+	interval    time.Duration
+	maxBackoff  time.Duration
+	stateMaxAge time.Duration
+
+	lock       sync.RWMutex
+	statuses   map[string]*FeedStatus
+	recorders  map[string]*delayRecorder
+	lastPruned time.Time
+}
+
+// NewRealtimePoller returns a RealtimePoller for the sources, taking how often
+// they are polled, how far polls are pushed back after failures and how long
+// trip states are kept without being updated from the configuration
+func NewRealtimePoller(sources []FeedSource, store RealtimeStore, archive DelayArchive, alerts AlertStore,
+	vehicles *VehicleTracker, realtimeConfig RealtimeConfig) *RealtimePoller {
+
+	poller := &RealtimePoller{
+		sources:     sources,
+		store:       store,
+		archive:     archive,
+		alerts:      alerts,
+		vehicles:    vehicles,
+		interval:    time.Duration(realtimeConfig.Interval),
+		maxBackoff:  time.Duration(realtimeConfig.MaxBackoff),
+		stateMaxAge: time.Duration(realtimeConfig.StateMaxAge),
+		statuses:    map[string]*FeedStatus{},
+		recorders:   map[string]*delayRecorder{},
+	}
+	for _, source := range sources {
+		poller.statuses[source.Name()] = &FeedStatus{Source: source.Name()}
+		poller.recorders[source.Name()] = newDelayRecorder()
+	}
+
+	return poller
+}
+
+// Run polls every source until the context is cancelled or, when replaying,
+// every source has finished
+func (poller *RealtimePoller) Run(ctx context.Context) {
+
+	var running sync.WaitGroup
+	for _, source := range poller.sources {
+		running.Add(1)
+		go func(source FeedSource) {
+			defer running.Done()
+			poller.runSource(ctx, source)
+		}(source)
+	}
+	running.Wait()
+}
+
+// runSource polls a single source, waiting the interval between polls or
+// longer after failures, until the context is cancelled or the source finishes
+func (poller *RealtimePoller) runSource(ctx context.Context, source FeedSource) {
+
+	logger := LoggerFromContext(ctx).With("source", source.Name())
+	for {
+		err := poller.PollOnce(ctx, source)
+		if errors.Is(err, ErrReplayFinished) {
+			logger.Info("finished replaying realtime feeds")
+			return
+		}
+		if err != nil {
+			logger.Warn("could not poll realtime feed", "error", err)
+		}
+
+		wait := poller.nextPoll(source.Name(), time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// pollBackoff returns how long to wait before the next poll after the given
+// number of failures in a row, doubling the interval for each up to the most
+// it may be pushed back
+func pollBackoff(interval time.Duration, maxBackoff time.Duration, failures int) time.Duration {
+
+	wait := interval
+	for failure := 0; failure < failures && wait < maxBackoff; failure++ {
+		wait *= 2
+	}
+	if failures > 0 && wait > maxBackoff {
+		wait = maxBackoff
+	}
+
+	return wait
+}
+
+// nextPoll records when a source is next polled and returns how long to wait
+// until then
+func (poller *RealtimePoller) nextPoll(name string, now time.Time) time.Duration {
+
+	poller.lock.Lock()
+	defer poller.lock.Unlock()
+
+	status := poller.statuses[name]
+	wait := pollBackoff(poller.interval, poller.maxBackoff, status.ConsecutiveFailures)
+	next := now.Add(wait)
+	status.NextPoll = &next
+
+	return wait
+}
+
+// PollOnce fetches the feed from the source and stores the trip states, delays,
+// service alerts and vehicle positions in it, recording the outcome in
+// the status of the source. Alerts are only stored from feeds holding any, so
+// that a trip updates feed doesn't clear them, and a failure to place vehicles
+// is logged without failing the poll
+func (poller *RealtimePoller) PollOnce(ctx context.Context, source FeedSource) error {
+
+	fetchedAt := time.Now()
+	feed, err := source.Fetch(ctx)
+	if errors.Is(err, ErrReplayFinished) {
+		poller.updateStatus(source.Name(), func(status *FeedStatus) { status.Finished = true })
+		return err
+	}
+	if err == nil {
+		err = poller.storeFeed(ctx, source.Name(), feed, fetchedAt)
+	}
+
+	if err != nil {
+		realtimePolls.WithLabelValues("error").Inc()
+		poller.updateStatus(source.Name(), func(status *FeedStatus) {
+			status.LastAttempt = &fetchedAt
+			status.LastError = err.Error()
+			status.ConsecutiveFailures++
+		})
+		return err
+	}
+
+	realtimePolls.WithLabelValues("success").Inc()
+	poller.updateStatus(source.Name(), func(status *FeedStatus) {
+		status.LastAttempt = &fetchedAt
+		status.LastSuccess = &fetchedAt
+		status.LastError = ""
+		status.ConsecutiveFailures = 0
+		status.Entities = len(feed.Entity)
+		if feedTime, ok := feed.Header.Timestamp.Time(); ok {
+			status.FeedTimestamp = &feedTime
+		}
+	})
+
+	return nil
+}
+
+// storeFeed stores everything in a feed fetched from the named source
+func (poller *RealtimePoller) storeFeed(ctx context.Context, name string, feed FeedMessage,
+	fetchedAt time.Time) error {
+
+	states := ParseTripStates(feed, fetchedAt)
+	if len(states) > 0 {
+		if err := poller.store.UpsertTripStates(ctx, states, fetchedAt.Add(-poller.stateMaxAge)); err != nil {
+			return err
+		}
+
+		// Trips are archived without their scheduled times if the timetable
+		// can't be read, rather than being left out
+		tripIds := make([]string, len(states))
+		for index, state := range states {
+			tripIds[index] = state.TripId
+		}
+		trips, err := findTripStops(ctx, tripIds)
+		if err != nil {
+			LoggerFromContext(ctx).Warn("could not find scheduled times of realtime trips", "source", name,
+				"error", err)
+		}
+
+		// What was observed is only committed once it has been archived, so that
+		// it is observed again at the next poll if either write fails
+		poller.lock.Lock()
+		tripObservations, delayObservations, recording := poller.recorders[name].Observe(states, trips)
+		poller.lock.Unlock()
+		if err = poller.archive.ArchiveTrips(ctx, tripObservations); err != nil {
+			return err
+		}
+		if err = poller.archive.ArchiveDelays(ctx, delayObservations); err != nil {
+			return err
+		}
+		poller.lock.Lock()
+		poller.recorders[name].Commit(recording)
+		poller.lock.Unlock()
+		poller.pruneDelayArchive(ctx, fetchedAt)
+
+		poller.updateStatus(name, func(status *FeedStatus) {
+			status.TripStates = len(states)
+			status.DelayObservations = len(delayObservations)
+		})
+	}
+
+	hasAlerts, hasVehicles := false, false
+	for _, entity := range feed.Entity {
+		hasAlerts = hasAlerts || entity.Alert != nil
+		hasVehicles = hasVehicles || entity.Vehicle != nil || entity.TripUpdate != nil
+	}
+	if hasAlerts {
+		if _, err := IngestServiceAlerts(ctx, feed, poller.alerts); err != nil {
+			return err
+		}
+	}
+	if hasVehicles {
+		if _, err := IngestVehiclePositions(ctx, feed, poller.vehicles); err != nil {
+			LoggerFromContext(ctx).Warn("could not place vehicles from realtime feed", "source", name, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// pruneDelayArchive drops the service days no longer retained from the delay
+// archive, at most once every delayArchivePruneInterval. A failure is only
+// logged, to be tried again at the next interval
+func (poller *RealtimePoller) pruneDelayArchive(ctx context.Context, now time.Time) {
+
+	poller.lock.Lock()
+	if now.Sub(poller.lastPruned) < delayArchivePruneInterval {
+		poller.lock.Unlock()
+		return
+	}
+	poller.lastPruned = now
+	poller.lock.Unlock()
+
+	dropped, err := poller.archive.PruneDelays(ctx, now)
+	if err != nil {
+		LoggerFromContext(ctx).Warn("could not prune the delay archive", "error", err)
+		return
+	}
+	if dropped > 0 {
+		LoggerFromContext(ctx).Info("pruned the delay archive", "service_days", dropped)
+	}
+}
+
+// updateStatus applies the change to the status of the named source
+func (poller *RealtimePoller) updateStatus(name string, change func(status *FeedStatus)) {
+
+	poller.lock.Lock()
+	defer poller.lock.Unlock()
+
+	change(poller.statuses[name])
+}
+
+// Status returns the health of the poller and each of its sources
+func (poller *RealtimePoller) Status() PollerStatus {
+
+	poller.lock.RLock()
+	defer poller.lock.RUnlock()
+
+	status := PollerStatus{Status: HealthStatusOK, Sources: []FeedStatus{}}
+	for _, source := range poller.sources {
+		sourceStatus := *poller.statuses[source.Name()]
+		if sourceStatus.ConsecutiveFailures > 0 || sourceStatus.LastSuccess == nil && !sourceStatus.Finished {
+			status.Status = HealthStatusDegraded
+		}
+		status.Sources = append(status.Sources, sourceStatus)
+	}
+
+	return status
+}
+
+var sharedRealtimePoller *RealtimePoller
+var sharedRealtimePollerLock sync.RWMutex
+
+// currentRealtimePoller returns the running poller, or nil if none was started
+func currentRealtimePoller() *RealtimePoller {
+
+	sharedRealtimePollerLock.RLock()
+	defer sharedRealtimePollerLock.RUnlock()
+
+	return sharedRealtimePoller
+}
+
+// StartRealtimePoller starts polling the GTFS-R feeds, or replaying the feed
+// files, named by the configuration until the context is cancelled. Nothing is
+// started, and nil returned, when the configuration names neither
+func StartRealtimePoller(ctx context.Context, realtimeConfig RealtimeConfig) (*RealtimePoller, error) {
+
+	if !realtimeConfig.Enabled() {
+		return nil, nil
+	}
+
+	sources, err := newFeedSources(realtimeConfig)
+	if err != nil {
+		return nil, err
+	}
+	poller := NewRealtimePoller(sources, realtimeStore(), delayArchive(), alertStore(), vehicleTracker(),
+		realtimeConfig)
+
+	sharedRealtimePollerLock.Lock()
+	sharedRealtimePoller = poller
+	sharedRealtimePollerLock.Unlock()
+
+	go poller.Run(ctx)
+	return poller, nil
+}
+
+// GetRealtimeStatus returns the PollerStatus of the running poller, or a status
+// of disabled when no feeds are polled
+func GetRealtimeStatus(c *gin.Context) {
+
+	poller := currentRealtimePoller()
+	if poller == nil {
+		c.IndentedJSON(http.StatusOK, PollerStatus{Status: "disabled", Sources: []FeedStatus{}})
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, poller.Status())
+}
+
+// checkRealtimePoller returns the readiness check for the poller, which is
+// degraded rather than down while feeds are failing as journeys can still be
+// planned from the timetable
+func checkRealtimePoller(poller *RealtimePoller) HealthCheck {
+
+	start := time.Now()
+	status := poller.Status()
+	check := HealthCheck{Name: "realtime_poller", Status: status.Status, LatencyMs: elapsedMilliseconds(start)}
+	for _, source := range status.Sources {
+		if source.LastError != "" {
+			check.Detail = source.Source + ": " + source.LastError
+			break
+		}
+	}
+
+	return check
+}
@@ -0,0 +1,204 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testFeedSource gives each of its feeds in turn, or its error once they run out
+type testFeedSource struct {
+	feeds []FeedMessage
+	err   error
+}
+
+func (source *testFeedSource) Name() string {
+	return "test"
+}
+
+func (source *testFeedSource) Fetch(ctx context.Context) (FeedMessage, error) {
+
+	if len(source.feeds) == 0 {
+		return FeedMessage{}, source.err
+	}
+	feed := source.feeds[0]
+	source.feeds = source.feeds[1:]
+
+	return feed, nil
+}
+
+// newTestPoller returns a poller for the source keeping everything in memory
+func newTestPoller(source FeedSource) (*RealtimePoller, *MemoryRealtimeStore, *MemoryDelayArchive,
+	*MemoryAlertStore) {
+
+	store := NewMemoryRealtimeStore()
+	archive := NewMemoryDelayArchive(36500)
+	alerts := NewMemoryAlertStore()
+	poller := NewRealtimePoller([]FeedSource{source}, store, archive, alerts, NewVehicleTracker(time.Hour),
+		DefaultConfig().Realtime)
+
+	return poller, store, archive, alerts
+}
+
+func TestRealtimePollerStoresTripsAndHistory(t *testing.T) {
+
+	resolveFeedReferences = testFeedReferences
+	findTripStops = testFindTripStops
+	defer func() {
+		resolveFeedReferences = FindFeedReferences
+		findTripStops = FindTripStops
+	}()
+
+	feed := parseTestFeed(t, testTripUpdateFeed)
+	source := &testFeedSource{feeds: []FeedMessage{feed, feed}, err: ErrReplayFinished}
+	poller, store, archive, alerts := newTestPoller(source)
+	alerts.ReplaceAlerts(context.Background(), []ServiceAlert{{Id: "alert-1"}})
+
+	for poll := 0; poll < 2; poll++ {
+		if err := poller.PollOnce(context.Background(), source); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+
+	states, _ := store.FindTripStates(context.Background())
+	serviceDate := time.Date(2022, 6, 15, 0, 0, 0, 0, dublinLocation)
+	delays, _ := archive.AggregateDelays(context.Background(), DelayQuery{From: serviceDate, To: serviceDate})
+	if len(states) != 2 || len(delays) != 1 || delays[0].Observations != 2 {
+		t.Log("Expected both trips stored and the delays archived once, got", states, delays)
+		t.Fail()
+	}
+	if stored, _ := alerts.FindAlerts(context.Background()); len(stored) != 1 {
+		t.Log("Expected a feed without alerts to leave them as they are, got", stored)
+		t.Fail()
+	}
+
+	status := poller.Status()
+	if status.Status != HealthStatusOK || status.Sources[0].TripStates != 2 ||
+		status.Sources[0].DelayObservations != 0 || status.Sources[0].LastSuccess == nil {
+		t.Log("Expected the status of two successful polls, got", status)
+		t.Fail()
+	}
+
+	if err := poller.PollOnce(context.Background(), source); !errors.Is(err, ErrReplayFinished) ||
+		!poller.Status().Sources[0].Finished {
+		t.Log("Expected the source to be finished, got", err, poller.Status())
+		t.Fail()
+	}
+}
+
+// failingDelayArchive is a MemoryDelayArchive that fails to archive delays the
+// number of times given before working
+type failingDelayArchive struct {
+	*MemoryDelayArchive
+	failures int
+}
+
+func (archive *failingDelayArchive) ArchiveDelays(ctx context.Context, observations []DelayObservation) error {
+
+	if archive.failures > 0 {
+		archive.failures--
+		return errors.New("archive unavailable")
+	}
+
+	return archive.MemoryDelayArchive.ArchiveDelays(ctx, observations)
+}
+
+func TestRealtimePollerArchivesAfterFailure(t *testing.T) {
+
+	resolveFeedReferences = testFeedReferences
+	findTripStops = testFindTripStops
+	defer func() {
+		resolveFeedReferences = FindFeedReferences
+		findTripStops = FindTripStops
+	}()
+
+	feed := parseTestFeed(t, testTripUpdateFeed)
+	source := &testFeedSource{feeds: []FeedMessage{feed, feed}, err: ErrReplayFinished}
+	archive := &failingDelayArchive{MemoryDelayArchive: NewMemoryDelayArchive(36500), failures: 1}
+	poller := NewRealtimePoller([]FeedSource{source}, NewMemoryRealtimeStore(), archive, NewMemoryAlertStore(),
+		NewVehicleTracker(time.Hour), DefaultConfig().Realtime)
+
+	if err := poller.PollOnce(context.Background(), source); err == nil {
+		t.Log("Expected the first poll to fail with the archive")
+		t.Fail()
+	}
+	if err := poller.PollOnce(context.Background(), source); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// The delays that failed to be archived are archived by the next poll
+	serviceDate := time.Date(2022, 6, 15, 0, 0, 0, 0, dublinLocation)
+	delays, _ := archive.AggregateDelays(context.Background(), DelayQuery{From: serviceDate, To: serviceDate})
+	if len(delays) != 1 || delays[0].Observations != 2 || poller.Status().Sources[0].DelayObservations != 2 {
+		t.Log("Expected the delays to be archived after the failure, got", delays, poller.Status())
+		t.Fail()
+	}
+}
+
+func TestRealtimePollerReportsFailures(t *testing.T) {
+
+	source := &testFeedSource{err: errors.New("feed returned 503 Service Unavailable")}
+	poller, _, _, _ := newTestPoller(source)
+
+	poller.PollOnce(context.Background(), source)
+	poller.PollOnce(context.Background(), source)
+
+	status := poller.Status()
+	if status.Status != HealthStatusDegraded || status.Sources[0].ConsecutiveFailures != 2 ||
+		status.Sources[0].LastError == "" {
+		t.Log("Expected the failures to be reported, got", status)
+		t.Fail()
+	}
+
+	check := checkRealtimePoller(poller)
+	if check.Status != HealthStatusDegraded || check.Critical || check.Detail == "" {
+		t.Log("Expected a degraded readiness check, got", check)
+		t.Fail()
+	}
+
+	if wait := poller.nextPoll(source.Name(), time.Now()); wait != 4*time.Minute {
+		t.Log("Expected the next poll to be pushed back after two failures, got", wait)
+		t.Fail()
+	}
+}
+
+func TestPollBackoff(t *testing.T) {
+
+	for failures, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute,
+		8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		if wait := pollBackoff(time.Minute, 10*time.Minute, failures); wait != expected {
+			t.Log("Expected", expected, "after", failures, "failures, got", wait)
+			t.Fail()
+		}
+	}
+}
+
+func TestRealtimePollerRunsUntilReplayFinishes(t *testing.T) {
+
+	findTripStops = testFindTripStops
+	defer func() { findTripStops = FindTripStops }()
+
+	source := &testFeedSource{feeds: []FeedMessage{parseTestFeed(t, testTripUpdateFeed)}, err: ErrReplayFinished}
+	poller, store, _, _ := newTestPoller(source)
+	poller.interval = time.Millisecond
+
+	finished := make(chan bool)
+	go func() {
+		poller.Run(context.Background())
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Log("Expected the poller to stop once the replay finished")
+		t.FailNow()
+	}
+	if states, _ := store.FindTripStates(context.Background()); len(states) != 2 {
+		t.Log("Expected the replayed trips to be stored, got", states)
+		t.Fail()
+	}
+}
@@ -0,0 +1,501 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Time bands of the service day that reliability is broken down by, with
+// TimeBandUnknown for trips whose scheduled start isn't known
+const (
+	TimeBandEarly     = "early"
+	TimeBandAMPeak    = "am_peak"
+	TimeBandInterPeak = "inter_peak"
+	TimeBandPMPeak    = "pm_peak"
+	TimeBandEvening   = "evening"
+	TimeBandUnknown   = "unknown"
+)
+
+// Schedule relationships of trips in the GTFS-R feed that reliability treats
+// apart from the scheduled ones
+const (
+	scheduleAdded    = "ADDED"
+	scheduleCanceled = "CANCELED"
+)
+
+// secondsInServiceDay is the length of a service day without clock changes
+const secondsInServiceDay = 24 * 60 * 60
+
+// scheduledTripsFinder is the signature of FindScheduledTrips, which
+// findScheduledTrips is set to outside of tests
+type scheduledTripsFinder func(ctx context.Context, serviceDate time.Time, routeNum string) ([]serviceTrip, error)
+
+var findScheduledTrips scheduledTripsFinder = FindScheduledTrips
+
+// timeBands holds the hour each time band starts at, in order
+var timeBands = []struct {
+	name      string
+	startHour int
+}{
+	{TimeBandEarly, 0},
+	{TimeBandAMPeak, 7},
+	{TimeBandInterPeak, 10},
+	{TimeBandPMPeak, 16},
+	{TimeBandEvening, 19},
+}
+
+// OnTimeEarlySeconds and OnTimeLateSeconds are how early and how late a bus can
+// leave a stop and still be counted as on time
+var OnTimeEarlySeconds = 60
+var OnTimeLateSeconds = 300
+
+// MaxHeadwaySeconds is the longest gap between two departures from a stop that
+// is counted as a headway, so that the gaps overnight and those left by trips
+// missing from the feed don't swamp the waiting times
+var MaxHeadwaySeconds int64 = 2 * 60 * 60
+
+// RouteReliability sums up how reliably a route ran in one direction and time
+// band over the service days with archived trips in a range. Trips are those in
+// the timetable for each day, along with any others seen in the GTFS-R feed
+// other than those added to the timetable, and departures are those whose delay
+// was archived. The waiting times are the average waits in seconds of a
+// passenger turning up at random at a stop along the route, as scheduled and as
+// it actually ran, over the trips in the timetable that were seen in the feed,
+// and the excess wait time is how much longer the actual wait was. Rates and
+// waiting times are left out where there's nothing to work them out from
+type RouteReliability struct {
+	RouteNum             string   `json:"route_num"`
+	DirectionId          string   `json:"direction_id"`
+	TimeBand             string   `json:"time_band"`
+	ScheduledTrips       int      `json:"scheduled_trips"`
+	CancelledTrips       int      `json:"cancelled_trips"`
+	CancellationRate     *float64 `json:"cancellation_rate,omitempty"`
+	Departures           int      `json:"departures"`
+	OnTimeRate           *float64 `json:"on_time_rate,omitempty"`
+	EarlyRate            *float64 `json:"early_rate,omitempty"`
+	LateRate             *float64 `json:"late_rate,omitempty"`
+	ScheduledWaitSeconds *float64 `json:"scheduled_wait_seconds,omitempty"`
+	ActualWaitSeconds    *float64 `json:"actual_wait_seconds,omitempty"`
+	ExcessWaitSeconds    *float64 `json:"excess_wait_seconds,omitempty"`
+}
+
+// reliabilityKey identifies a route, direction and time band
+type reliabilityKey struct {
+	routeNum    string
+	directionId string
+	timeBand    string
+}
+
+// reliabilityTotals holds running totals for a route, direction and time band.
+// The headway sums hold the sum of the headways and of their squares, from
+// which the average wait is the sum of squares over twice the sum
+type reliabilityTotals struct {
+	scheduledTrips     int
+	cancelledTrips     int
+	departures         int
+	onTime             int
+	early              int
+	late               int
+	scheduledHeadway   float64
+	scheduledHeadwaySq float64
+	actualHeadway      float64
+	actualHeadwaySq    float64
+}
+
+// headwayKey identifies the departures from one stop along a route in one
+// direction
+type headwayKey struct {
+	routeNum    string
+	directionId string
+	stopId      string
+}
+
+// reliabilityAccumulator adds up the reliability of routes one archived service
+// day at a time, optionally keeping to one direction
+type reliabilityAccumulator struct {
+	directionId string
+	totals      map[reliabilityKey]*reliabilityTotals
+}
+
+// newReliabilityAccumulator returns an empty reliabilityAccumulator keeping to
+// the direction if one is given
+func newReliabilityAccumulator(directionId string) *reliabilityAccumulator {
+	return &reliabilityAccumulator{directionId: directionId, totals: map[reliabilityKey]*reliabilityTotals{}}
+}
+
+// timeBand returns the time band of a time in seconds from the start of the
+// service day, where it is known
+func timeBand(seconds *int64) string {
+
+	if seconds == nil {
+		return TimeBandUnknown
+	}
+
+	hour := int((*seconds%secondsInServiceDay+secondsInServiceDay)%secondsInServiceDay) / 3600
+	band := TimeBandUnknown
+	for _, timeBand := range timeBands {
+		if hour >= timeBand.startHour {
+			band = timeBand.name
+		}
+	}
+
+	return band
+}
+
+// timeBandOrder returns where a time band comes in the service day, with the
+// unknown band last
+func timeBandOrder(band string) int {
+
+	for i, timeBand := range timeBands {
+		if timeBand.name == band {
+			return i
+		}
+	}
+
+	return len(timeBands)
+}
+
+// add returns the totals for the route, direction and time band, creating them
+// the first time they're asked for
+func (accumulator *reliabilityAccumulator) add(routeNum string, directionId string,
+	band string) *reliabilityTotals {
+
+	key := reliabilityKey{routeNum: routeNum, directionId: directionId, timeBand: band}
+	totals, ok := accumulator.totals[key]
+	if !ok {
+		totals = &reliabilityTotals{}
+		accumulator.totals[key] = totals
+	}
+
+	return totals
+}
+
+// AddDay adds up a service day from the trips in the timetable running that day
+// and the trips and delays archived for it. The scheduled trips are taken from
+// the timetable, so that trips missing from the feed are still counted, and the
+// archived observations are joined onto them by trip id. Headways are worked
+// out over the same calls as scheduled and as they ran: those of the trips seen
+// in the feed, with calls that have no delay of their own taking the delay from
+// the call before, as in GTFS-R. Days without any archived trips are skipped,
+// as there's no telling which trips ran
+func (accumulator *reliabilityAccumulator) AddDay(day ArchivedDay, timetable []serviceTrip) {
+
+	if len(day.Trips) == 0 {
+		return
+	}
+
+	relationships := map[string]string{}
+	for _, trip := range day.Trips {
+		relationships[trip.Id] = trip.ScheduleRelationship
+	}
+	observed := map[string][]DelayObservation{}
+	for _, observation := range day.Delays {
+		observed[observation.TripId] = append(observed[observation.TripId], observation)
+	}
+
+	scheduled := map[headwayKey][]int64{}
+	actual := map[headwayKey][]int64{}
+
+	inTimetable := map[string]bool{}
+	for _, trip := range timetable {
+		inTimetable[trip.TripId] = true
+		if !accumulator.keeps(trip.Direction) {
+			continue
+		}
+		relationship, seen := relationships[trip.TripId]
+
+		var start *int64
+		delay := 0
+		for _, stop := range trip.Stops {
+			seconds, ok := parseServiceTime(stop.DepartureTime)
+			if !ok {
+				continue
+			}
+			if start == nil {
+				start = &seconds
+			}
+			if observedDelay, found := stopDelay(observed[trip.TripId], stop); found {
+				delay = observedDelay
+			}
+			if !seen || stop.StopId == "" {
+				continue
+			}
+			key := headwayKey{routeNum: trip.RouteNum, directionId: trip.Direction, stopId: stop.StopId}
+			scheduled[key] = append(scheduled[key], seconds)
+			if relationship != scheduleCanceled {
+				actual[key] = append(actual[key], seconds+int64(delay))
+			}
+		}
+
+		totals := accumulator.add(trip.RouteNum, trip.Direction, timeBand(start))
+		totals.scheduledTrips++
+		if relationship == scheduleCanceled {
+			totals.cancelledTrips++
+		}
+	}
+
+	// Trips seen in the feed but not in the timetable, such as those of an
+	// earlier timetable, are still counted though their departures aren't known
+	for _, trip := range day.Trips {
+		if inTimetable[trip.Id] || trip.ScheduleRelationship == scheduleAdded ||
+			!accumulator.keeps(trip.DirectionId) {
+			continue
+		}
+		totals := accumulator.add(trip.RouteNum, trip.DirectionId, timeBand(trip.ScheduledStart))
+		totals.scheduledTrips++
+		if trip.ScheduleRelationship == scheduleCanceled {
+			totals.cancelledTrips++
+		}
+	}
+
+	for _, observation := range day.Delays {
+		relationship := relationships[observation.TripId]
+		if relationship == scheduleCanceled || !accumulator.keeps(observation.DirectionId) {
+			continue
+		}
+
+		band := timeBand(observation.Scheduled)
+		if observation.Scheduled == nil {
+			hour := int64(observation.Hour) * 3600
+			band = timeBand(&hour)
+		}
+		totals := accumulator.add(observation.RouteNum, observation.DirectionId, band)
+		totals.departures++
+		switch {
+		case observation.Delay < -OnTimeEarlySeconds:
+			totals.early++
+		case observation.Delay > OnTimeLateSeconds:
+			totals.late++
+		default:
+			totals.onTime++
+		}
+	}
+
+	for key, departures := range scheduled {
+		accumulator.addHeadways(key, departures, false)
+	}
+	for key, departures := range actual {
+		accumulator.addHeadways(key, departures, true)
+	}
+}
+
+// stopDelay returns the delay archived for a trip at one of its stops, matched
+// by stop sequence where the observation has one and by stop id otherwise,
+// reporting false if there isn't one
+func stopDelay(observations []DelayObservation, stop BusStop) (int, bool) {
+
+	sequence, sequenceErr := strconv.Atoi(stop.StopSequence)
+	for _, observation := range observations {
+		if observation.StopSequence != nil {
+			if sequenceErr == nil && *observation.StopSequence == sequence {
+				return observation.Delay, true
+			}
+		} else if observation.StopId != "" && observation.StopId == stop.StopId {
+			return observation.Delay, true
+		}
+	}
+
+	return 0, false
+}
+
+// FindScheduledTrips takes in the context of the request, a service date and a
+// route number, which may be empty for every route, and returns the trips in the
+// timetable running on the service date along with their stops
+func FindScheduledTrips(requestCtx context.Context, serviceDate time.Time, routeNum string) ([]serviceTrip, error) {
+
+	collection, ctx, disconnect, err := openTimetable(requestCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	filter := serviceDateFilter(ctx, collection, serviceDate)
+	if routeNum != "" {
+		filter = append(filter, bson.E{Key: "route.route_short_name", Value: strings.ToUpper(routeNum)})
+	}
+	trips, err := findTimetableTrips(ctx, collection, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The filter lets every trip through if the services couldn't be listed
+	running := trips[:0]
+	for _, trip := range trips {
+		if serviceCalendar().RunsOn(trip.ServiceId, serviceDate, dayCalendar()) {
+			running = append(running, trip)
+		}
+	}
+
+	return running, nil
+}
+
+// addHeadways adds the gaps between the departures from a stop, as scheduled or
+// as they actually ran, to the time band of the later departure of each gap
+func (accumulator *reliabilityAccumulator) addHeadways(key headwayKey, departures []int64, actual bool) {
+
+	sort.Slice(departures, func(i, j int) bool { return departures[i] < departures[j] })
+	for i := 1; i < len(departures); i++ {
+		headway := departures[i] - departures[i-1]
+		if headway <= 0 || headway > MaxHeadwaySeconds {
+			continue
+		}
+		totals := accumulator.add(key.routeNum, key.directionId, timeBand(&departures[i]))
+		if actual {
+			totals.actualHeadway += float64(headway)
+			totals.actualHeadwaySq += float64(headway * headway)
+		} else {
+			totals.scheduledHeadway += float64(headway)
+			totals.scheduledHeadwaySq += float64(headway * headway)
+		}
+	}
+}
+
+// keeps reports whether the accumulator adds up the given direction
+func (accumulator *reliabilityAccumulator) keeps(directionId string) bool {
+	return accumulator.directionId == "" || accumulator.directionId == directionId
+}
+
+// rate returns the count over the total, or nil when the total is zero
+func rate(count int, total int) *float64 {
+
+	if total == 0 {
+		return nil
+	}
+	value := float64(count) / float64(total)
+
+	return &value
+}
+
+// averageWait returns the average wait of a passenger turning up at random
+// given the sum of the headways and of their squares, or nil when there are none
+func averageWait(sum float64, sumOfSquares float64) *float64 {
+
+	if sum == 0 {
+		return nil
+	}
+	value := sumOfSquares / (2 * sum)
+
+	return &value
+}
+
+// Results returns the reliability of each route, direction and time band added
+// up, sorted by route number, direction and time band
+func (accumulator *reliabilityAccumulator) Results() []RouteReliability {
+
+	results := []RouteReliability{}
+	for key, totals := range accumulator.totals {
+		result := RouteReliability{
+			RouteNum:             key.routeNum,
+			DirectionId:          key.directionId,
+			TimeBand:             key.timeBand,
+			ScheduledTrips:       totals.scheduledTrips,
+			CancelledTrips:       totals.cancelledTrips,
+			CancellationRate:     rate(totals.cancelledTrips, totals.scheduledTrips),
+			Departures:           totals.departures,
+			OnTimeRate:           rate(totals.onTime, totals.departures),
+			EarlyRate:            rate(totals.early, totals.departures),
+			LateRate:             rate(totals.late, totals.departures),
+			ScheduledWaitSeconds: averageWait(totals.scheduledHeadway, totals.scheduledHeadwaySq),
+			ActualWaitSeconds:    averageWait(totals.actualHeadway, totals.actualHeadwaySq),
+		}
+		if result.ScheduledWaitSeconds != nil && result.ActualWaitSeconds != nil {
+			excess := *result.ActualWaitSeconds - *result.ScheduledWaitSeconds
+			result.ExcessWaitSeconds = &excess
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		first, second := results[i], results[j]
+		if first.RouteNum != second.RouteNum {
+			return routeNumLess(first.RouteNum, second.RouteNum)
+		}
+		if first.DirectionId != second.DirectionId {
+			return first.DirectionId < second.DirectionId
+		}
+		return timeBandOrder(first.TimeBand) < timeBandOrder(second.TimeBand)
+	})
+
+	return results
+}
+
+// reliabilityTable lays out the reliability of routes as a CSV file, leaving
+// the rates and waiting times that couldn't be worked out empty
+func reliabilityTable(results []RouteReliability) csvTable {
+
+	optional := func(value *float64) string {
+		if value == nil {
+			return ""
+		}
+		return formatCSVFloat(*value)
+	}
+
+	table := csvTable{
+		header: []string{"route_num", "direction_id", "time_band", "scheduled_trips", "cancelled_trips",
+			"cancellation_rate", "departures", "on_time_rate", "early_rate", "late_rate",
+			"scheduled_wait_seconds", "actual_wait_seconds", "excess_wait_seconds"},
+		rows: [][]string{},
+	}
+	for _, result := range results {
+		table.rows = append(table.rows, []string{result.RouteNum, result.DirectionId, result.TimeBand,
+			strconv.Itoa(result.ScheduledTrips), strconv.Itoa(result.CancelledTrips),
+			optional(result.CancellationRate), strconv.Itoa(result.Departures), optional(result.OnTimeRate),
+			optional(result.EarlyRate), optional(result.LateRate), optional(result.ScheduledWaitSeconds),
+			optional(result.ActualWaitSeconds), optional(result.ExcessWaitSeconds)})
+	}
+
+	return table
+}
+
+// GetReliabilityAnalytics returns the on time performance, excess wait time and
+// cancellation rate of routes by direction and time band between the from and
+// to service dates, given as YYYY-MM-DD, optionally narrowed down to a route
+// number and direction. They are returned as CSV when the format query
+// parameter or the Accept header asks for it
+func GetReliabilityAnalytics(c *gin.Context) {
+
+	format, err := negotiateAnalyticsFormat(c.Query("format"), c.GetHeader("Accept"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, err.Error())
+		return
+	}
+	from, to, err := parseAnalyticsDates(c, currentConfig.DelayArchive.MaxQueryDays, time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid reliability query: "+err.Error())
+		return
+	}
+	routeNum := strings.TrimSpace(c.Query("route"))
+	directionId := strings.TrimSpace(c.Query("direction"))
+
+	ctx := c.Request.Context()
+	accumulator := newReliabilityAccumulator(directionId)
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		serviceDate := date.Format(feedDateLayout)
+		day, err := delayArchive().FindDay(ctx, serviceDate, routeNum)
+		if err != nil {
+			LoggerFromContext(ctx).Error("could not find archived service day", "service_date", serviceDate,
+				"error", err)
+			c.IndentedJSON(http.StatusInternalServerError, "Reliability could not be worked out")
+			return
+		}
+		timetable, err := findScheduledTrips(ctx, date, routeNum)
+		if err != nil {
+			LoggerFromContext(ctx).Error("could not find the scheduled trips", "service_date", serviceDate,
+				"error", err)
+			c.IndentedJSON(http.StatusInternalServerError, "Reliability could not be worked out")
+			return
+		}
+
+		accumulator.AddDay(day, timetable)
+	}
+
+	results := accumulator.Results()
+	writeAnalytics(c, format, "reliability", results, reliabilityTable(results))
+}
@@ -0,0 +1,203 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testArchivedDay returns a morning on route 46A where the 08:10 is cancelled,
+// the 08:20 leaves nearly seven minutes late and an extra trip is added
+func testArchivedDay() ArchivedDay {
+
+	start := func(seconds int64) *int64 { return &seconds }
+
+	return ArchivedDay{
+		ServiceDate: "20220615",
+		Trips: []TripObservation{
+			{Id: "trip-1", ServiceDate: "20220615", RouteNum: "46A", DirectionId: "0", ScheduledStart: start(8 * 3600),
+				ScheduleRelationship: "SCHEDULED"},
+			{Id: "trip-2", RouteNum: "46A", DirectionId: "0", ScheduledStart: start(8*3600 + 600),
+				ScheduleRelationship: "CANCELED"},
+			{Id: "trip-3", RouteNum: "46A", DirectionId: "0", ScheduledStart: start(8*3600 + 1200),
+				ScheduleRelationship: "SCHEDULED"},
+			{Id: "trip-4", RouteNum: "46A", DirectionId: "0", ScheduleRelationship: "ADDED"},
+		},
+		Delays: []DelayObservation{
+			{Id: "trip-1/1", ServiceDate: "20220615", TripId: "trip-1", RouteNum: "46A", DirectionId: "0", StopId: "stop-1", Delay: 0,
+				Scheduled: start(8 * 3600)},
+			{Id: "trip-3/1", TripId: "trip-3", RouteNum: "46A", DirectionId: "0", StopId: "stop-1", Delay: 400,
+				Scheduled: start(8*3600 + 1200)},
+			{Id: "trip-4/1", TripId: "trip-4", RouteNum: "46A", DirectionId: "0", StopId: "stop-1", Delay: -90,
+				Hour: 8},
+		},
+	}
+}
+
+// testScheduledTrips returns the timetable of the morning of testArchivedDay,
+// with a trip at 08:30 that was never seen in the feed
+func testScheduledTrips() []serviceTrip {
+
+	trip := func(tripId string, departure string) serviceTrip {
+		return serviceTrip{tripStops: tripStops{TripId: tripId, RouteNum: "46A", Direction: "0",
+			Stops: []BusStop{{StopId: "stop-1", DepartureTime: departure}}}, ServiceId: "weekday"}
+	}
+
+	return []serviceTrip{trip("trip-1", "08:00:00"), trip("trip-2", "08:10:00"), trip("trip-3", "08:20:00"),
+		trip("trip-5", "08:30:00")}
+}
+
+func TestTimeBand(t *testing.T) {
+
+	for seconds, expected := range map[int64]string{
+		0:                   TimeBandEarly,
+		7 * 3600:            TimeBandAMPeak,
+		12 * 3600:           TimeBandInterPeak,
+		16*3600 + 1800:      TimeBandPMPeak,
+		23 * 3600:           TimeBandEvening,
+		24*3600 + 30*60:     TimeBandEarly,
+		secondsInServiceDay: TimeBandEarly,
+	} {
+		if band := timeBand(&seconds); band != expected {
+			t.Log("Expected", seconds, "to be in", expected, "got", band)
+			t.Fail()
+		}
+	}
+	if band := timeBand(nil); band != TimeBandUnknown {
+		t.Log("Expected an unknown time to be in the unknown band, got", band)
+		t.Fail()
+	}
+}
+
+func TestReliabilityAccumulator(t *testing.T) {
+
+	accumulator := newReliabilityAccumulator("")
+	accumulator.AddDay(testArchivedDay(), testScheduledTrips())
+
+	results := accumulator.Results()
+	if len(results) != 1 {
+		t.Log("Expected the morning peak of 46A alone, got", results)
+		t.FailNow()
+	}
+	result := results[0]
+	if result.TimeBand != TimeBandAMPeak || result.ScheduledTrips != 4 || result.CancelledTrips != 1 ||
+		*result.CancellationRate != 1.0/4 {
+		t.Log("Expected one of four scheduled trips to be cancelled, got", result)
+		t.Fail()
+	}
+	if result.Departures != 3 || *result.OnTimeRate != 1.0/3 || *result.EarlyRate != 1.0/3 ||
+		*result.LateRate != 1.0/3 {
+		t.Log("Expected one departure each on time, early and late, got", result)
+		t.Fail()
+	}
+
+	// Scheduled headways of ten minutes wait five on average, while the single
+	// gap of 1600 seconds that ran waits 800
+	if *result.ScheduledWaitSeconds != 300 || *result.ActualWaitSeconds != 800 || *result.ExcessWaitSeconds != 500 {
+		t.Log("Expected an excess wait of 500 seconds, got", *result.ScheduledWaitSeconds,
+			*result.ActualWaitSeconds, result.ExcessWaitSeconds)
+		t.Fail()
+	}
+}
+
+func TestReliabilityAccumulatorKeepsToDirection(t *testing.T) {
+
+	accumulator := newReliabilityAccumulator("1")
+	accumulator.AddDay(testArchivedDay(), testScheduledTrips())
+
+	if results := accumulator.Results(); len(results) != 0 {
+		t.Log("Expected nothing in direction 1, got", results)
+		t.Fail()
+	}
+}
+
+func TestReliabilityAccumulatorWithoutTimetable(t *testing.T) {
+
+	// Trips seen in the feed are still counted where the timetable has none of
+	// them, though there are no scheduled departures to work out waits from
+	accumulator := newReliabilityAccumulator("")
+	accumulator.AddDay(testArchivedDay(), nil)
+
+	results := accumulator.Results()
+	if len(results) != 1 || results[0].ScheduledTrips != 3 || results[0].CancelledTrips != 1 ||
+		results[0].ScheduledWaitSeconds != nil || results[0].ActualWaitSeconds != nil {
+		t.Log("Expected the three trips seen without waits, got", results)
+		t.Fail()
+	}
+
+	// Without anything archived the timetable alone says nothing of the day
+	accumulator = newReliabilityAccumulator("")
+	accumulator.AddDay(ArchivedDay{ServiceDate: "20220616"}, testScheduledTrips())
+	if results = accumulator.Results(); len(results) != 0 {
+		t.Log("Expected a day without archived trips to be skipped, got", results)
+		t.Fail()
+	}
+}
+
+func TestReliabilityAccumulatorComparesObservedCalls(t *testing.T) {
+
+	trip := func(tripId string, first string, second string) serviceTrip {
+		return serviceTrip{tripStops: tripStops{TripId: tripId, RouteNum: "46A", Direction: "0",
+			Stops: []BusStop{{StopId: "stop-1", StopSequence: "1", DepartureTime: first},
+				{StopId: "stop-2", StopSequence: "2", DepartureTime: second}}}, ServiceId: "weekday"}
+	}
+	sequence := 1
+	day := ArchivedDay{
+		ServiceDate: "20220615",
+		Trips: []TripObservation{
+			{Id: "trip-1", RouteNum: "46A", DirectionId: "0", ScheduleRelationship: "SCHEDULED"},
+			{Id: "trip-2", RouteNum: "46A", DirectionId: "0", ScheduleRelationship: "SCHEDULED"},
+		},
+		Delays: []DelayObservation{
+			{TripId: "trip-1", RouteNum: "46A", DirectionId: "0", StopSequence: &sequence, Delay: 60, Hour: 8},
+			{TripId: "trip-2", RouteNum: "46A", DirectionId: "0", StopSequence: &sequence, Delay: 60, Hour: 8},
+		},
+	}
+
+	// Only the first stop of each trip was observed, and trip-3 was never seen
+	// at all, so none of them add to the excess wait
+	accumulator := newReliabilityAccumulator("")
+	accumulator.AddDay(day, []serviceTrip{trip("trip-1", "08:00:00", "08:05:00"),
+		trip("trip-2", "08:10:00", "08:15:00"), trip("trip-3", "08:15:00", "08:20:00")})
+
+	results := accumulator.Results()
+	if len(results) != 1 || results[0].ScheduledTrips != 3 || *results[0].ScheduledWaitSeconds != 300 ||
+		*results[0].ExcessWaitSeconds != 0 {
+		t.Log("Expected no excess wait from calls that weren't observed, got", results)
+		t.Fail()
+	}
+}
+
+func TestGetReliabilityAnalyticsAsCSV(t *testing.T) {
+
+	archive := NewMemoryDelayArchive(36500)
+	SetDelayArchive(archive)
+	defer SetDelayArchive(nil)
+	day := testArchivedDay()
+	archive.ArchiveTrips(context.Background(), day.Trips[:1])
+	archive.ArchiveDelays(context.Background(), day.Delays[:1])
+	findScheduledTrips = func(ctx context.Context, serviceDate time.Time, routeNum string) ([]serviceTrip, error) {
+		if serviceDate.Format(feedDateLayout) != "20220615" || routeNum != "46a" {
+			return nil, nil
+		}
+		return testScheduledTrips()[:1], nil
+	}
+	defer func() { findScheduledTrips = FindScheduledTrips }()
+
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest("GET", "/analytics/reliability?from=2022-06-15&to=2022-06-15&route=46a", nil)
+	c.Request.Header.Set("Accept", "text/csv")
+	GetReliabilityAnalytics(c)
+
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if recorder.Code != 200 || len(lines) != 2 || !strings.HasPrefix(lines[0], "route_num,direction_id,time_band") ||
+		!strings.HasPrefix(lines[1], "46A,0,am_peak,1,0,0,1,1,0,0,,,") {
+		t.Log("Expected a CSV file with the morning peak of 46A, got", recorder.Code, lines)
+		t.Fail()
+	}
+}
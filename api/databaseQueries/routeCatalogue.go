@@ -0,0 +1,452 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// routeDirectionDocument is the result of grouping the trips_n_stops collection
+// by route and direction for the route catalogue. The id holds the route number
+// and direction as a RouteId
+type routeDirectionDocument struct {
+	Id            RouteId  `bson:"_id"`
+	RouteLongName string   `bson:"route_long_name"`
+	Trips         int      `bson:"trips"`
+	Headsigns     []string `bson:"headsigns"`
+	FirstStop     string   `bson:"first_stop"`
+	LastStop      string   `bson:"last_stop"`
+}
+
+// routeVariantId identifies a distinct sequence of stops in one direction
+type routeVariantId struct {
+	Direction string   `bson:"direction"`
+	Pattern   []string `bson:"pattern"`
+}
+
+// routeVariantDocument is the result of grouping the trips on one route by
+// direction and sequence of stops, with the stops and shape of one trip that
+// follows the sequence
+type routeVariantDocument struct {
+	Id            routeVariantId `bson:"_id"`
+	RouteLongName string         `bson:"route_long_name"`
+	Trips         int            `bson:"trips"`
+	Headsigns     []string       `bson:"headsigns"`
+	Stops         []BusStop      `bson:"stops"`
+	Shapes        []Shape        `bson:"shapes"`
+}
+
+// openTimetable connects to Mongo and returns the trips_n_stops collection along
+// with a context derived from the request context that bounds every query made
+// with it. The returned function disconnects and must be deferred by the caller
+func openTimetable(requestCtx context.Context) (*mongo.Collection, context.Context, func(), error) {
+	return openCollection(requestCtx, currentConfig.Mongo.Collections.TripsAndStops)
+}
+
+// openCollection works as openTimetable for the named collection
+func openCollection(requestCtx context.Context, name string) (*mongo.Collection, context.Context, func(), error) {
+
+	ctx, cancel := context.WithTimeout(requestCtx, 60*time.Second)
+
+	client, err := ConnectToMongo()
+	if err == nil {
+		err = client.Connect(ctx)
+	}
+	if err != nil {
+		cancel()
+		return nil, nil, nil, err
+	}
+
+	collection := client.Database(currentConfig.Mongo.Database).Collection(name)
+
+	return collection, ctx, func() {
+		client.Disconnect(ctx)
+		cancel()
+	}, nil
+}
+
+// GetRoutes returns the route catalogue, listing every route in the timetable
+// with a summary of each of its directions
+func GetRoutes(c *gin.Context) {
+
+	routes, err := FindRoutes(c.Request.Context())
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not list routes", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Routes could not be listed")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, routes)
+}
+
+// FindRoutes takes in the context of the request and returns a RouteSummary for
+// every route in the trips_n_stops collection, sorted by route number. The
+// catalogue is cached against the timetable generation
+func FindRoutes(requestCtx context.Context) ([]RouteSummary, error) {
+
+	routes := []RouteSummary{}
+	cacheKey := resultCache().TimetableKey("routes")
+	if resultCache().GetJSON(cacheKindRouteCatalogue, cacheKey, &routes) {
+		return routes, nil
+	}
+
+	collection, ctx, disconnect, err := openTimetable(requestCtx)
+	if err != nil {
+		return routes, err
+	}
+	defer disconnect()
+
+	query, err := collection.Aggregate(ctx, bson.A{
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "route_num", Value: "$route.route_short_name"},
+				{Key: "direction", Value: "$direction_id"},
+			}},
+			{Key: "route_long_name", Value: bson.D{{Key: "$first", Value: "$route.route_long_name"}}},
+			{Key: "trips", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "headsigns", Value: bson.D{{Key: "$addToSet", Value: "$trip_headsign"}}},
+			{Key: "first_stop", Value: bson.D{{Key: "$first",
+				Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{"$stops.stop_name", 0}}}}}},
+			{Key: "last_stop", Value: bson.D{{Key: "$first",
+				Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{"$stops.stop_name", -1}}}}}},
+		}}},
+	})
+	if err != nil {
+		return routes, err
+	}
+
+	var directionDocuments []routeDirectionDocument
+	if err = query.All(ctx, &directionDocuments); err != nil {
+		return routes, err
+	}
+
+	routes = BuildRouteSummaries(directionDocuments)
+	resultCache().SetJSON(cacheKindRouteCatalogue, cacheKey, routes, RouteCatalogueCacheTTL)
+	return routes, nil
+}
+
+// BuildRouteSummaries takes in the trips grouped by route and direction and
+// returns a RouteSummary for each route, sorted by route number with the
+// directions of each route in order
+func BuildRouteSummaries(directionDocuments []routeDirectionDocument) []RouteSummary {
+
+	summaries := map[string]*RouteSummary{}
+	for _, document := range directionDocuments {
+		summary, ok := summaries[document.Id.RouteNum]
+		if !ok {
+			summary = &RouteSummary{RouteNum: document.Id.RouteNum}
+			summaries[document.Id.RouteNum] = summary
+		}
+		if summary.RouteLongName == "" {
+			summary.RouteLongName = document.RouteLongName
+		}
+		summary.Directions = append(summary.Directions, RouteDirectionSummary{
+			Direction: document.Id.Direction,
+			Headsign:  mainHeadsign(document.Headsigns, document.LastStop),
+			FirstStop: document.FirstStop,
+			LastStop:  document.LastStop,
+			Trips:     document.Trips,
+		})
+	}
+
+	routes := make([]RouteSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		sort.Slice(summary.Directions, func(i, j int) bool {
+			return summary.Directions[i].Direction < summary.Directions[j].Direction
+		})
+		routes = append(routes, *summary)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routeNumLess(routes[i].RouteNum, routes[j].RouteNum)
+	})
+
+	return routes
+}
+
+// GetRoute returns the stop pattern for each direction of the route number
+// given in the request URL
+func GetRoute(c *gin.Context) {
+
+	route, found, err := FindRouteDetail(c.Request.Context(), c.Param("routeNum"))
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not find route", "route", c.Param("routeNum"), "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Route could not be found")
+		return
+	}
+	if !found {
+		c.IndentedJSON(http.StatusNotFound, "No route with that number")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, route)
+}
+
+// GetRouteStops returns the stop pattern for the route number and direction
+// given in the request URL, with its variants, headsigns and simplified shape
+func GetRouteStops(c *gin.Context) {
+
+	direction := c.Param("direction")
+	if direction != "0" && direction != "1" {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid direction parameter in request, expected 0 or 1")
+		return
+	}
+
+	route, found, err := FindRouteDetail(c.Request.Context(), c.Param("routeNum"))
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not find route", "route", c.Param("routeNum"), "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Route could not be found")
+		return
+	}
+
+	for _, pattern := range route.Directions {
+		if found && pattern.Direction == direction {
+			c.IndentedJSON(http.StatusOK, pattern)
+			return
+		}
+	}
+
+	c.IndentedJSON(http.StatusNotFound, "No route with that number runs in that direction")
+}
+
+// FindRouteDetail takes in the context of the request and a route number and
+// returns the RouteDetail for it, reporting false if the route isn't in the
+// timetable. The detail is cached against the timetable generation
+func FindRouteDetail(requestCtx context.Context, routeNum string) (RouteDetail, bool, error) {
+
+	routeNum = strings.ToUpper(strings.TrimSpace(routeNum))
+	route := RouteDetail{RouteNum: routeNum}
+
+	cacheKey := resultCache().TimetableKey("route", routeNum)
+	if resultCache().GetJSON(cacheKindRouteCatalogue, cacheKey, &route) {
+		return route, len(route.Directions) > 0, nil
+	}
+
+	collection, ctx, disconnect, err := openTimetable(requestCtx)
+	if err != nil {
+		return route, false, err
+	}
+	defer disconnect()
+
+	variants, err := findRouteVariants(ctx, collection, routeNum)
+	if err != nil {
+		return route, false, err
+	}
+
+	route = BuildRouteDetail(routeNum, variants)
+	resultCache().SetJSON(cacheKindRouteCatalogue, cacheKey, route, RouteCatalogueCacheTTL)
+	return route, len(route.Directions) > 0, nil
+}
+
+// findRouteVariants returns the trips of a route grouped by direction and
+// sequence of stops
+func findRouteVariants(ctx context.Context, collection *mongo.Collection,
+	routeNum string) ([]routeVariantDocument, error) {
+
+	var variants []routeVariantDocument
+
+	query, err := collection.Aggregate(ctx, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "route.route_short_name", Value: routeNum}}}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{
+				{Key: "direction", Value: "$direction_id"},
+				{Key: "pattern", Value: "$stops.stop_number"},
+			}},
+			{Key: "route_long_name", Value: bson.D{{Key: "$first", Value: "$route.route_long_name"}}},
+			{Key: "trips", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "headsigns", Value: bson.D{{Key: "$addToSet", Value: "$trip_headsign"}}},
+			{Key: "stops", Value: bson.D{{Key: "$first", Value: "$stops"}}},
+			{Key: "shapes", Value: bson.D{{Key: "$first", Value: "$shapes"}}},
+		}}},
+	})
+	if err != nil {
+		return variants, err
+	}
+
+	err = query.All(ctx, &variants)
+	return variants, err
+}
+
+// BuildRouteDetail takes in a route number and its trips grouped by direction
+// and sequence of stops and returns the RouteDetail with a RoutePattern for
+// each direction
+func BuildRouteDetail(routeNum string, variants []routeVariantDocument) RouteDetail {
+
+	route := RouteDetail{RouteNum: routeNum, Directions: []RoutePattern{}}
+
+	byDirection := map[string][]routeVariantDocument{}
+	for _, variant := range variants {
+		byDirection[variant.Id.Direction] = append(byDirection[variant.Id.Direction], variant)
+		if route.RouteLongName == "" {
+			route.RouteLongName = variant.RouteLongName
+		}
+	}
+
+	for direction, directionVariants := range byDirection {
+		route.Directions = append(route.Directions, BuildRoutePattern(routeNum, direction, directionVariants))
+	}
+	sort.Slice(route.Directions, func(i, j int) bool {
+		return route.Directions[i].Direction < route.Directions[j].Direction
+	})
+
+	return route
+}
+
+// BuildRoutePattern takes in a route number, a direction and the variants of the
+// route in that direction and returns its RoutePattern. The canonical pattern is
+// the variant with the most trips, with ties going to the variant with more stops
+func BuildRoutePattern(routeNum string, direction string, variants []routeVariantDocument) RoutePattern {
+
+	for index := range variants {
+		sortBusStops(variants[index].Stops)
+	}
+	sort.SliceStable(variants, func(i, j int) bool {
+		if variants[i].Trips != variants[j].Trips {
+			return variants[i].Trips > variants[j].Trips
+		}
+		return len(variants[i].Stops) > len(variants[j].Stops)
+	})
+
+	pattern := RoutePattern{
+		RouteNum:  routeNum,
+		Direction: direction,
+		Headsigns: []string{},
+		Stops:     []PatternStop{},
+		Shape:     []ShapeJSON{},
+		Variants:  []RouteVariant{},
+	}
+
+	seenHeadsigns := map[string]bool{}
+	for index, variant := range variants {
+
+		lastStop, firstStop := "", ""
+		stopNumbers := make([]string, 0, len(variant.Stops))
+		for _, stop := range variant.Stops {
+			stopNumbers = append(stopNumbers, stop.StopNumber)
+		}
+		if len(variant.Stops) > 0 {
+			firstStop = variant.Stops[0].StopName
+			lastStop = variant.Stops[len(variant.Stops)-1].StopName
+		}
+
+		headsign := mainHeadsign(variant.Headsigns, lastStop)
+		if !seenHeadsigns[headsign] {
+			seenHeadsigns[headsign] = true
+			pattern.Headsigns = append(pattern.Headsigns, headsign)
+		}
+
+		pattern.Trips += variant.Trips
+		pattern.Variants = append(pattern.Variants, RouteVariant{
+			Variant:     index,
+			Canonical:   index == 0,
+			Headsign:    headsign,
+			Trips:       variant.Trips,
+			FirstStop:   firstStop,
+			LastStop:    lastStop,
+			StopNumbers: stopNumbers,
+		})
+	}
+
+	if len(variants) == 0 {
+		return pattern
+	}
+
+	pattern.Headsign = pattern.Variants[0].Headsign
+	for _, stop := range variants[0].Stops {
+		pattern.Stops = append(pattern.Stops, patternStop(stop))
+	}
+	pattern.Shape = SimplifyShape(ShapesToJSON(variants[0].Shapes), RouteShapeTolerance)
+
+	return pattern
+}
+
+// patternStop converts a stop on a trip into a PatternStop
+func patternStop(stop BusStop) PatternStop {
+
+	lat, _ := strconv.ParseFloat(stop.StopLat, 64)
+	lon, _ := strconv.ParseFloat(stop.StopLon, 64)
+	sequence, _ := strconv.Atoi(stop.StopSequence)
+	distance, _ := strconv.ParseFloat(stop.DistanceTravelled, 64)
+
+	return PatternStop{
+		StopId:            stop.StopId,
+		StopName:          stop.StopName,
+		StopNumber:        stop.StopNumber,
+		StopLat:           lat,
+		StopLon:           lon,
+		StopSequence:      sequence,
+		DistanceTravelled: distance,
+	}
+}
+
+// sortBusStops sorts the stops of a trip by their sequence number
+func sortBusStops(stops []BusStop) {
+	sort.SliceStable(stops, func(i, j int) bool {
+		sequenceI, _ := strconv.Atoi(stops[i].StopSequence)
+		sequenceJ, _ := strconv.Atoi(stops[j].StopSequence)
+		return sequenceI < sequenceJ
+	})
+}
+
+// mainHeadsign returns the first non-empty headsign in alphabetical order, so
+// that the same headsign is always chosen, or the name of the last stop if the
+// timetable has no headsigns
+func mainHeadsign(headsigns []string, lastStop string) string {
+
+	sortedHeadsigns := append([]string{}, headsigns...)
+	sort.Strings(sortedHeadsigns)
+	for _, headsign := range sortedHeadsigns {
+		if strings.TrimSpace(headsign) != "" {
+			return headsign
+		}
+	}
+
+	return lastStop
+}
+
+// routeNumLess orders route numbers as they appear on a timetable, with routes
+// that start with a number first in numeric order (so 7, 7A, 7B, 9, 13, 46A),
+// followed by those starting with letters grouped by their letters (C1, C2,
+// H1, N4, X25)
+func routeNumLess(routeNumA string, routeNumB string) bool {
+
+	prefixA, numberA, suffixA := splitRouteNum(routeNumA)
+	prefixB, numberB, suffixB := splitRouteNum(routeNumB)
+
+	if prefixA != prefixB {
+		return prefixA < prefixB
+	}
+	if numberA != numberB {
+		return numberA < numberB
+	}
+	if suffixA != suffixB {
+		return suffixA < suffixB
+	}
+
+	return routeNumA < routeNumB
+}
+
+// splitRouteNum splits a route number into its leading letters, its number and
+// whatever follows the number
+func splitRouteNum(routeNum string) (string, int, string) {
+
+	digitsStart := strings.IndexFunc(routeNum, unicode.IsDigit)
+	if digitsStart < 0 {
+		return routeNum, 0, ""
+	}
+
+	digitsEnd := digitsStart
+	for digitsEnd < len(routeNum) && unicode.IsDigit(rune(routeNum[digitsEnd])) {
+		digitsEnd++
+	}
+	number, _ := strconv.Atoi(routeNum[digitsStart:digitsEnd])
+
+	return routeNum[:digitsStart], number, routeNum[digitsEnd:]
+}
@@ -0,0 +1,76 @@
+package databaseQueries
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRouteNumLess(t *testing.T) {
+
+	routeNums := []string{"X25", "46A", "C1", "7B", "13", "7", "N4", "9", "7A", "C2", "145"}
+	sort.Slice(routeNums, func(i, j int) bool { return routeNumLess(routeNums[i], routeNums[j]) })
+
+	expected := []string{"7", "7A", "7B", "9", "13", "46A", "145", "C1", "C2", "N4", "X25"}
+	if !reflect.DeepEqual(routeNums, expected) {
+		t.Log("Route numbers sorted as", routeNums, "but expected", expected)
+		t.Fail()
+	}
+}
+
+func TestBuildRoutePatternChoosesCanonicalVariant(t *testing.T) {
+
+	fullStops := []BusStop{
+		{StopNumber: "2", StopName: "Middle", StopSequence: "2", StopLat: "53.2", StopLon: "-6.2"},
+		{StopNumber: "1", StopName: "Start", StopSequence: "1", StopLat: "53.1", StopLon: "-6.1"},
+		{StopNumber: "3", StopName: "End", StopSequence: "3", StopLat: "53.3", StopLon: "-6.3"},
+	}
+	shortStops := []BusStop{
+		{StopNumber: "1", StopName: "Start", StopSequence: "1"},
+		{StopNumber: "2", StopName: "Middle", StopSequence: "2"},
+	}
+
+	pattern := BuildRoutePattern("46A", "1", []routeVariantDocument{
+		{Trips: 3, Headsigns: []string{"Middle"}, Stops: shortStops},
+		{Trips: 40, Headsigns: []string{""}, Stops: fullStops},
+	})
+
+	if pattern.Trips != 43 || len(pattern.Variants) != 2 {
+		t.Log("Expected 43 trips over 2 variants but got", pattern.Trips, len(pattern.Variants))
+		t.FailNow()
+	}
+	if !pattern.Variants[0].Canonical || pattern.Variants[0].Trips != 40 {
+		t.Log("The variant with the most trips should be canonical:", pattern.Variants)
+		t.Fail()
+	}
+	if pattern.Headsign != "End" || !reflect.DeepEqual(pattern.Headsigns, []string{"End", "Middle"}) {
+		t.Log("Missing headsigns should fall back to the last stop, got", pattern.Headsign, pattern.Headsigns)
+		t.Fail()
+	}
+	if len(pattern.Stops) != 3 || pattern.Stops[0].StopNumber != "1" || pattern.Stops[0].StopLat != 53.1 {
+		t.Log("Canonical stops should be sorted by sequence with float coordinates:", pattern.Stops)
+		t.Fail()
+	}
+	if !reflect.DeepEqual(pattern.Variants[1].StopNumbers, []string{"1", "2"}) {
+		t.Log("Unexpected stop numbers for the short variant:", pattern.Variants[1].StopNumbers)
+		t.Fail()
+	}
+}
+
+func TestBuildRouteSummaries(t *testing.T) {
+
+	routes := BuildRouteSummaries([]routeDirectionDocument{
+		{Id: RouteId{RouteNum: "46A", Direction: "1"}, Trips: 10, Headsigns: []string{"Phoenix Park"}},
+		{Id: RouteId{RouteNum: "46A", Direction: "0"}, Trips: 12, LastStop: "Dun Laoghaire"},
+		{Id: RouteId{RouteNum: "7", Direction: "0"}, Trips: 5},
+	})
+
+	if len(routes) != 2 || routes[0].RouteNum != "7" || routes[1].RouteNum != "46A" {
+		t.Log("Routes should be grouped and sorted by route number:", routes)
+		t.FailNow()
+	}
+	if routes[1].Directions[0].Direction != "0" || routes[1].Directions[0].Headsign != "Dun Laoghaire" {
+		t.Log("Directions should be in order with headsigns falling back to the last stop:", routes[1].Directions)
+		t.Fail()
+	}
+}
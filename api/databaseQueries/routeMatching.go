@@ -4,10 +4,11 @@ import (
 	"context"
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo"
 	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -18,8 +19,6 @@ import (
 // so must be done manually from one structure to another in the backend
 
 var stop RouteStop
-var shape ShapeJSON
-var shapes []ShapeJSON
 var originStopArrivalTime string
 var destinationStopArrivalTime string
 var finalStopArrivalTime string
@@ -36,40 +35,88 @@ var destinationDistTravelled float64
 // or the FindMatchingRouteForDeparture function depending on the time type
 // that is passed in and then returns an array of busRouteJSON type containing
 // the routes found that match the query. It may also return a status 400 with
-// the appropriate string message if the time type passed in is invalid
+// the appropriate string message if the time type or the time passed in is
+// invalid. The time is read as Dublin time unless it carries an explicit offset,
+// in which case it is converted into Dublin time before matching. The shape and
+// tolerance query parameters choose the format of each route's shape and how
+// much it is simplified, as described by ParseShapeOptions. The routes can also
+// be exported as GeoJSON, GPX, KML or iCalendar, chosen by the format query parameter or
+// the Accept header as described by NegotiateExportFormat. Service alerts active
+// at each route's departure are attached to the route and its stops, and routes
+// closed by an alert are left out as described by AttachServiceAlerts. With the
+// wheelchair query parameter set to true only stops and trips that can be
+// boarded by wheelchair are used, as described by RouteOptions
 func FindMatchingRoute(c *gin.Context) {
 
 	origin := c.Param("origin")
 	destination := c.Param("destination")
 	timeType := c.Param("timeType")
-	dateAndTime := c.Param("time")
+	dateAndTime, err := NormaliseRequestTime(c.Param("time"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid time parameter in request")
+		return
+	}
+	shapeOptions, err := ParseShapeOptions(c.Query("shape"), c.Query("tolerance"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid shape parameters in request: "+err.Error())
+		return
+	}
+	exportFormat, err := NegotiateExportFormat(c.Query("format"), c.GetHeader("Accept"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid format parameter in request: "+err.Error())
+		return
+	}
+	routeOptions, err := ParseRouteOptions(c.Query("wheelchair"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid wheelchair parameter in request: "+err.Error())
+		return
+	}
+	ctx := ContextWithRouteOptions(c.Request.Context(), routeOptions)
 
+	var busRoutes []busRouteJSON
 	if timeType == "arrival" {
-		busRoutes := FindMatchingRouteForArrival(origin, destination, dateAndTime)
-		c.IndentedJSON(http.StatusOK, busRoutes)
+		busRoutes = FindMatchingRouteForArrival(ctx, origin, destination, dateAndTime)
 	} else if timeType == "departure" {
-		busRoutes := FindMatchingRouteForDeparture(destination, origin, dateAndTime)
-		c.IndentedJSON(http.StatusOK, busRoutes)
+		busRoutes = FindMatchingRouteForDeparture(ctx, destination, origin, dateAndTime)
 	} else {
 		c.IndentedJSON(http.StatusBadRequest, "Invalid time type parameter in request")
+		return
+	}
+	requestTime, _ := ParseRequestTime(dateAndTime)
+	busRoutes = attachActiveServiceAlerts(c.Request.Context(), busRoutes, requestTime)
+	matchedRoutesPerQuery.WithLabelValues(timeType).Observe(float64(len(busRoutes)))
+
+	// Exports always need the shape as points, though it is still simplified
+	// with the tolerance asked for
+	if exportFormat != ExportFormatJSON {
+		busRoutes = FormatRouteShapes(busRoutes,
+			ShapeOptions{Format: ShapeFormatPoints, Tolerance: shapeOptions.Tolerance})
+		WriteItineraryExport(c, exportFormat, NewItineraries(busRoutes, TurnParameterToCoordinates(origin),
+			TurnParameterToCoordinates(destination), requestTime))
+		return
 	}
 
+	c.IndentedJSON(http.StatusOK, FormatRouteShapes(busRoutes, shapeOptions))
 }
 
-// FindMatchingRouteForDeparture takes in the destination coordinates,
-// the origin coordinates and the date for a bus trip and returns a slice
-// of bus routes that match the given parameters. Its three parameters are all
+// FindMatchingRouteForDeparture takes in the context of the request, the destination
+// coordinates, the origin coordinates and the date for a bus trip and returns a slice
+// of bus routes that match the given parameters. Its last three parameters are all
 // taken in as strings and the returned bus routes are of type busRouteJSON. It's
 // internal query for the MongoDB database distinguishes it from the
 // FindMatchingRouteForArrival function by basing its query on the time
-// a bus leaves the origin
-func FindMatchingRouteForDeparture(destination string,
+// a bus leaves the origin. Stops and trips are chosen following the
+// RouteOptions carried by the context
+func FindMatchingRouteForDeparture(requestCtx context.Context,
+	destination string,
 	origin string,
 	date string) []busRouteJSON {
 
 	// resultJSON kept local so that routes from other calls don't persist
 	var resultJSON []busRouteJSON
+	var pendingRoutes []PendingPrediction
 	var route busRouteJSON
+	logger := LoggerFromContext(requestCtx)
 
 	// First step is taking in coordinates, locating the stops near those
 	// coordinates and then returning the 10 closest stops to that initial
@@ -77,11 +124,16 @@ func FindMatchingRouteForDeparture(destination string,
 	originCoordinates := TurnParameterToCoordinates(origin)
 	destinationCoordinates := TurnParameterToCoordinates(destination)
 
-	stopsNearDestination := FindNearbyStopsV2(destinationCoordinates)
-	stopsNearOrigin := FindNearbyStopsV2(originCoordinates)
+	// In wheelchair mode stops that are inaccessible, or too far or steep to
+	// walk to, are left out before the nearest are chosen
+	routeOptions := RouteOptionsFromContext(requestCtx)
+	stopsNearDestination := FilterAccessibleStops(FindNearbyStopsV2(destinationCoordinates),
+		destinationCoordinates, routeOptions)
+	stopsNearOrigin := FilterAccessibleStops(FindNearbyStopsV2(originCoordinates),
+		originCoordinates, routeOptions)
 
-	originStops := CurateNearbyStops(stopsNearOrigin, originCoordinates)
-	destinationStops := CurateNearbyStops(stopsNearDestination, destinationCoordinates)
+	originStops := CurateNearbyStops(stopsNearOrigin, originCoordinates, routeOptions)
+	destinationStops := CurateNearbyStops(stopsNearDestination, destinationCoordinates, routeOptions)
 
 	// Stop numbers for the origin and destination are then extracted from the
 	// 10 nearest stops
@@ -95,88 +147,33 @@ func FindMatchingRouteForDeparture(destination string,
 		destinationStopNums = append(destinationStopNums, destinationStop.StopNumber)
 	}
 
-	log.Println("OriginStopNums:")
-	log.Println(originStopNums)
-	log.Println("")
-	log.Println("DestinationStopNums:")
-	log.Println(destinationStopNums)
-	log.Println("")
+	logger.Debug("nearby stops found", "origin_stops", originStopNums,
+		"destination_stops", destinationStopNums)
 	client, err := ConnectToMongo()
 
-	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(requestCtx, 60*time.Second)
+	defer cancel()
 	err = client.Connect(ctx)
 	if err != nil {
-		log.Print(err)
+		logger.Error("could not connect to Mongo", "error", err)
 	}
 	defer client.Disconnect(ctx) // defer has rest of function complete before disconnect
 
-	// Time of day portion of the date entered extracted here
-	timeString := GetTimeString(date)
+	// The time of day is measured from the start of the service day, so that it
+	// lines up with the timetable on the days that the clocks change
+	requestTime, _ := ParseRequestTime(date)
+	serviceDate, secondsIntoServiceDay := ServiceDay(requestTime)
+	timeString := formatServiceTime(secondsIntoServiceDay)
 
 	// Aggregation pipeline created in Mongo Compass and then transformed to suit
 	// the mongo driver in Go
-	collection := client.Database("BusData").Collection("trips_n_stops")
+	collection := client.Database(currentConfig.Mongo.Database).Collection(currentConfig.Mongo.Collections.TripsAndStops)
 
-	query, err := collection.Aggregate(ctx, bson.A{
-		bson.D{
-			{"$match",
-				bson.D{
-					{"stops",
-						bson.D{
-							{"$elemMatch",
-								bson.D{
-									{"stop_number",
-										bson.D{
-											{"$in",
-												originStopNums,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-					{"stops.stop_number",
-						bson.D{
-							{"$in",
-								destinationStopNums,
-							},
-						},
-					},
-				},
-			},
-		},
-		bson.D{
-			{"$group",
-				bson.D{
-					{"_id",
-						bson.A{
-							"$route.route_short_name",
-							"$direction_id",
-						},
-					},
-					{"stops", bson.D{{"$first", "$stops"}}},
-				},
-			},
-		},
-	})
-	if err != nil {
-		log.Println(err)
-	}
+	// Routes serving both the origin and destination stops are found first, with
+	// the result cached for the time bucket that the query falls in
+	routes := FindRouteCandidates(ctx, collection, originStopNums, destinationStopNums, date)
 
-	// routes object used to decode the results of the query and prepare for
-	// transformation
-	var routes []MatchedRoute
-
-	if err = query.All(ctx, &routes); err != nil {
-		log.Println(err)
-	}
-
-	log.Println("Results from first query:")
-	for _, value := range routes {
-		log.Println(value)
-	}
-	log.Println("")
+	logger.Debug("route candidates found", "candidates", len(routes))
 	var routesWithOAndD []MatchedRouteWithOAndD
 	var routeWithOAndD MatchedRouteWithOAndD
 	for _, matchingRoute := range routes {
@@ -192,49 +189,14 @@ func FindMatchingRouteForDeparture(destination string,
 	var fullRoutes = []busRoute{}
 	var allRoutes = []busRoute{}
 	for _, routeDocument := range routesWithOAndD {
-		log.Println("Route document id field 0 = " + routeDocument.Id[0])
-		log.Println("Route document id field 01 = " + routeDocument.Id[1])
-		query, err = collection.Aggregate(ctx, bson.A{
-			bson.D{{
-				"$match", bson.D{
-					{"route.route_short_name", routeDocument.Id[0]},
-					{"direction_id", routeDocument.Id[1]},
-					{"stops", bson.D{
-						{"$elemMatch", bson.D{
-							{"stop_number", routeDocument.OriginStopNumber},
-							{"departure_time", bson.D{
-								{"$gt", timeString},
-							},
-							}}},
-					}}},
-			}},
-			bson.D{{"$sort", bson.D{{"stops.departure_time", 1}}}},
-			bson.D{
-				{"$group", bson.D{
-					{"_id", "$route.route_short_name"},
-					{"direction", bson.D{{"$first", "$direction_id"}}},
-					{"stops", bson.D{{"$first", "$stops"}}},
-					{"shapes", bson.D{{"$first", "$shapes"}}},
-				}},
-			},
-		})
-		if err != nil {
-			log.Println("Error from Mongo query")
-			log.Println(err)
-		}
-
-		if err = query.All(ctx, &fullRoutes); err != nil {
-			log.Println("Error reading query result into fullRoutes array")
-			log.Println(err)
-		}
-		log.Println("Number of routes found:", len(fullRoutes))
+		fullRoutes = FindFirstTripForDeparture(ctx, collection, routeDocument, serviceDate, timeString)
+		logger.Debug("trips found for route candidate", "route", routeDocument.Id[0],
+			"direction", routeDocument.Id[1], "trips", len(fullRoutes))
 		for index, _ := range fullRoutes {
 			fullRoutes[index].Direction = routeDocument.Id[1]
 		}
 
 		allRoutes = append(allRoutes, fullRoutes...)
-		log.Println("Full Routes array after reading in query result:")
-		log.Println(fullRoutes)
 	}
 
 	//log.Println("All routes in busRoute format:")
@@ -244,8 +206,6 @@ func FindMatchingRouteForDeparture(destination string,
 	// objects while also generating travel time predictions and fare calculations
 	for _, currentRoute := range allRoutes {
 
-		log.Println(string(currentRoute.Id))
-		log.Println(currentRoute.Direction)
 		// Intermediary object to hold route information with fields for
 		// origin and destination stop numbers
 		var routeWithOAndD busRouteV2
@@ -253,11 +213,9 @@ func FindMatchingRouteForDeparture(destination string,
 		routeWithOAndD.Direction = currentRoute.Direction
 		routeWithOAndD.Stops = currentRoute.Stops
 		routeWithOAndD.Shapes = currentRoute.Shapes
-		log.Println(currentRoute.Direction, routeWithOAndD.Direction)
-		//log.Println("Route with Origin and Destination:")
-		//log.Println(routeWithOAndD)
-		log.Println("")
 		route.RouteNum = string(currentRoute.Id)
+		route.WheelchairAccessible = tripWheelchairAccessible(currentRoute.TripId,
+			currentRoute.WheelchairAccessible)
 
 		// Two flags used within main loop when checking for matching origin and destination
 		originAndDestinationFound := false
@@ -297,9 +255,9 @@ func FindMatchingRouteForDeparture(destination string,
 			}
 		}
 
-		log.Println("Origin and Destination after loop:")
-		log.Println(routeWithOAndD.OriginStopNumber, routeWithOAndD.DestinationStopNumber)
-		log.Println("")
+		logger.Debug("origin and destination stops matched", "route", routeWithOAndD.Id,
+			"origin_stop", routeWithOAndD.OriginStopNumber,
+			"destination_stop", routeWithOAndD.DestinationStopNumber)
 		// At the end of the iteration over all stops, if a matching origin
 		// and destination were never found, skip remaining steps and move on
 		// to next route document in result slice
@@ -312,7 +270,8 @@ func FindMatchingRouteForDeparture(destination string,
 			routeWithOAndD.DestinationStopNumber, currentRoute, stop)
 
 		// Shapes slice created
-		route.Shapes = CreateShapesSlice(currentRoute)
+		route.Shapes = CreateShapesSlice(currentRoute, routeWithOAndD.OriginStopNumber,
+			routeWithOAndD.DestinationStopNumber)
 		//if route.Shapes[0].ShapePtSequence != "1" {
 		//	shapeDistance, _ := strconv.ParseFloat(route.Shapes[0].ShapeDistTravel, 64)
 		//	log.Println()
@@ -325,7 +284,8 @@ func FindMatchingRouteForDeparture(destination string,
 			for shapeIndex, currentShape := range route.Shapes {
 				currentShapeDist, _ := strconv.ParseFloat(currentShape.ShapeDistTravel, 64)
 				if currentShapeDist == stopShapeCheck.DistanceTravelled {
-					log.Println("Found match for shape", shapeIndex, "with stop", stopShapeIndex)
+					logger.Debug("found match for shape with stop", "shape_index", shapeIndex,
+						"stop_index", stopShapeIndex)
 					break
 				}
 			}
@@ -351,32 +311,6 @@ func FindMatchingRouteForDeparture(destination string,
 			route.Direction = "1"
 		}
 
-		// Get travel time prediction as floating point numbers based on call to external api
-		// connecting to flask application
-		initialTravelTime, err := GetTravelTimePrediction(route.RouteNum, date, route.Direction)
-		if err != nil {
-			log.Println(err)
-		}
-
-		// Floating point travel time used in conjunction with static timetable time
-		// information to generate more user-friendly travel time information
-		journeyTravelTime := AdjustTravelTime(initialTravelTime, originStopArrivalTime,
-			destinationStopArrivalTime, firstStopArrivalTime, finalStopArrivalTime)
-
-		// If the travel time prediction could not be calculated then source will have
-		// been set to static, where now static timetable information is used for the
-		// travel time estimation returned to the user
-		if journeyTravelTime.Source == "static" {
-			staticTravelTime := GetStaticTime(originStopArrivalTime, destinationStopArrivalTime)
-			journeyTravelTime.TransitTime = staticTravelTime
-			journeyTravelTime.TransitTimeMinusMAE = staticTravelTime
-			journeyTravelTime.TransitTimePlusMAE = staticTravelTime
-			journeyTravelTime.EstimatedArrivalTime = GetTimeStringAsHoursAndMinutes(destinationStopArrivalTime)
-			journeyTravelTime.EstimatedArrivalHighTime = GetTimeStringAsHoursAndMinutes(destinationStopArrivalTime)
-			journeyTravelTime.EstimatedArrivalLowTime = GetTimeStringAsHoursAndMinutes(destinationStopArrivalTime)
-		}
-		route.TravelTime = journeyTravelTime
-
 		// The stops slice is finally adjusted so that it only contains stops along the route being
 		// travelled
 		originStopIndex, destinationStopIndex := CurateStopsSlice(routeWithOAndD.OriginStopNumber,
@@ -386,47 +320,65 @@ func FindMatchingRouteForDeparture(destination string,
 		if route.Shapes[0].ShapePtSequence != "1" {
 			shapeDistance, _ := strconv.ParseFloat(route.Shapes[0].ShapeDistTravel, 64)
 			if math.Sqrt(math.Pow(shapeDistance-route.Stops[0].DistanceTravelled, 2)) > 100 {
-				log.Println("Mismatch between the route shape and the actual route - route removed")
+				logger.Warn("mismatch between the route shape and the actual route, route removed",
+					"route", route.RouteNum)
 				continue
 			}
 		}
 
-		// Static timetable departure time is used to provide the user of an estimate
-		// for how when a bus will arrive to begin their journey
-		route.TravelTime.ScheduledDepartureTime = GetTimeStringAsHoursAndMinutes(route.Stops[0].ArrivalTime)
-
-		resultJSON = append(resultJSON, route)
+		// Travel time predictions are requested for all routes at once after this loop,
+		// so the static timetable times needed for them are kept alongside the route
+		pendingRoutes = append(pendingRoutes, PendingPrediction{
+			Route:                  route,
+			OriginArrivalTime:      originStopArrivalTime,
+			DestinationArrivalTime: destinationStopArrivalTime,
+			FirstStopArrivalTime:   firstStopArrivalTime,
+			FinalStopArrivalTime:   finalStopArrivalTime,
+		})
 	}
 
+	// Travel time predictions for every matched route are fetched concurrently, with
+	// any route whose prediction misses the deadline falling back to the static timetable
+	resultJSON = PredictTravelTimes(requestCtx, pendingRoutes, date)
 	resultJSON = CurateReturnedDepartureRoutes(date, resultJSON)
+	resultJSON = AttachWalks(resultJSON, originCoordinates, destinationCoordinates, routeOptions)
 	return resultJSON
 }
 
-// FindMatchingRouteForArrival takes in the destination coordinates,
-// the origin coordinates and the date for a bus trip and returns a slice
-// of bus routes that match the given parameters. Its three parameters are all
+// FindMatchingRouteForArrival takes in the context of the request, the destination
+// coordinates, the origin coordinates and the date for a bus trip and returns a slice
+// of bus routes that match the given parameters. Its last three parameters are all
 // taken in as strings and the returned bus routes are of type busRouteJSON. It
 // is distinct from the FindMatchingRouteForDeparture function as it bases
 // its MongoDb query on the arrival time at the destination stop rather
-// than the time to leave the origin stop
-func FindMatchingRouteForArrival(origin string,
+// than the time to leave the origin stop. Stops and trips are chosen following
+// the RouteOptions carried by the context
+func FindMatchingRouteForArrival(requestCtx context.Context,
+	origin string,
 	destination string,
 	date string) []busRouteJSON {
 
 	// resultJSON kept local so that routes from other calls don't persist
 	var resultJSON []busRouteJSON
+	var pendingRoutes []PendingPrediction
 	var route busRouteJSON
+	logger := LoggerFromContext(requestCtx)
 	// First step is taking in coordinates, locating the stops near those
 	// coordinates and then returning the 10 closest stops to that initial
 	// coordinate pair
 	originCoordinates := TurnParameterToCoordinates(origin)
 	destinationCoordinates := TurnParameterToCoordinates(destination)
 
-	stopsNearDestination := FindNearbyStopsV2(destinationCoordinates)
-	stopsNearOrigin := FindNearbyStopsV2(originCoordinates)
+	// In wheelchair mode stops that are inaccessible, or too far or steep to
+	// walk to, are left out before the nearest are chosen
+	routeOptions := RouteOptionsFromContext(requestCtx)
+	stopsNearDestination := FilterAccessibleStops(FindNearbyStopsV2(destinationCoordinates),
+		destinationCoordinates, routeOptions)
+	stopsNearOrigin := FilterAccessibleStops(FindNearbyStopsV2(originCoordinates),
+		originCoordinates, routeOptions)
 
-	originStops := CurateNearbyStops(stopsNearOrigin, originCoordinates)
-	destinationStops := CurateNearbyStops(stopsNearDestination, destinationCoordinates)
+	originStops := CurateNearbyStops(stopsNearOrigin, originCoordinates, routeOptions)
+	destinationStops := CurateNearbyStops(stopsNearDestination, destinationCoordinates, routeOptions)
 
 	// Stop numbers for the origin and destination are then extracted from the
 	// 10 nearest stops
@@ -440,88 +392,33 @@ func FindMatchingRouteForArrival(origin string,
 		destinationStopNums = append(destinationStopNums, destinationStop.StopNumber)
 	}
 
-	log.Println("OriginStopNums:")
-	log.Println(originStopNums)
-	log.Println("")
-	log.Println("DestinationStopNums:")
-	log.Println(destinationStopNums)
-	log.Println("")
+	logger.Debug("nearby stops found", "origin_stops", originStopNums,
+		"destination_stops", destinationStopNums)
 	client, err := ConnectToMongo()
 
-	ctx, _ := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(requestCtx, 60*time.Second)
+	defer cancel()
 	err = client.Connect(ctx)
 	if err != nil {
-		log.Print(err)
+		logger.Error("could not connect to Mongo", "error", err)
 	}
 	defer client.Disconnect(ctx) // defer has rest of function complete before disconnect
 
-	// Time of day portion of the date entered extracted here
-	timeString := GetTimeString(date)
+	// The time of day is measured from the start of the service day, so that it
+	// lines up with the timetable on the days that the clocks change
+	requestTime, _ := ParseRequestTime(date)
+	serviceDate, secondsIntoServiceDay := ServiceDay(requestTime)
+	timeString := formatServiceTime(secondsIntoServiceDay)
 
 	// Aggregation pipeline created in Mongo Compass and then transformed to suit
 	// the mongo driver in Go
-	collection := client.Database("BusData").Collection("trips_n_stops")
-
-	query, err := collection.Aggregate(ctx, bson.A{
-		bson.D{
-			{"$match",
-				bson.D{
-					{"stops",
-						bson.D{
-							{"$elemMatch",
-								bson.D{
-									{"stop_number",
-										bson.D{
-											{"$in",
-												originStopNums,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-					{"stops.stop_number",
-						bson.D{
-							{"$in",
-								destinationStopNums,
-							},
-						},
-					},
-				},
-			},
-		},
-		bson.D{
-			{"$group",
-				bson.D{
-					{"_id",
-						bson.A{
-							"$route.route_short_name",
-							"$direction_id",
-						},
-					},
-					{"stops", bson.D{{"$first", "$stops"}}},
-				},
-			},
-		},
-	})
-	if err != nil {
-		log.Println(err)
-	}
-
-	// routes object used to decode the results of the query and prepare for
-	// transformation
-	var routes []MatchedRoute
+	collection := client.Database(currentConfig.Mongo.Database).Collection(currentConfig.Mongo.Collections.TripsAndStops)
 
-	if err = query.All(ctx, &routes); err != nil {
-		log.Println(err)
-	}
+	// Routes serving both the origin and destination stops are found first, with
+	// the result cached for the time bucket that the query falls in
+	routes := FindRouteCandidates(ctx, collection, originStopNums, destinationStopNums, date)
 
-	log.Println("Results from first query:")
-	for _, value := range routes {
-		log.Println(value)
-	}
-	log.Println("")
+	logger.Debug("route candidates found", "candidates", len(routes))
 	var routesWithOAndD []MatchedRouteWithOAndD
 	var routeWithOAndD MatchedRouteWithOAndD
 	for _, matchingRoute := range routes {
@@ -537,40 +434,9 @@ func FindMatchingRouteForArrival(origin string,
 	var fullRoutes []busRoute
 	var allRoutes []busRoute
 	for _, routeDocument := range routesWithOAndD {
-		query, err = collection.Aggregate(ctx, bson.A{
-			bson.D{{
-				"$match", bson.D{
-					{"route.route_short_name", routeDocument.Id[0]},
-					{"direction_id", routeDocument.Id[1]},
-					{"stops", bson.D{
-						{"$elemMatch", bson.D{
-							{"stop_number", routeDocument.DestinationStopNumber},
-							{"arrival_time", bson.D{
-								{"$lte", timeString},
-							},
-							}}},
-					}}},
-			}},
-			bson.D{{"$sort", bson.D{{"stops.arrival_time", -1}}}},
-			bson.D{
-				{"$group", bson.D{
-					{"_id", "$route.route_short_name"},
-					{"stops", bson.D{{"$first", "$stops"}}},
-					{"shapes", bson.D{{"$first", "$shapes"}}},
-					{"direction", bson.D{{"$first", "$direction_id"}}},
-				}},
-			},
-		})
-		if err != nil {
-			log.Println("Error from Mongo query")
-			log.Println(err)
-		}
-
-		if err = query.All(ctx, &fullRoutes); err != nil {
-			log.Println("Error reading query result into fullRoutes array")
-			log.Println(err)
-		}
-		log.Println("Number of routes found:", len(fullRoutes))
+		fullRoutes = FindLastTripForArrival(ctx, collection, routeDocument, serviceDate, timeString)
+		logger.Debug("trips found for route candidate", "route", routeDocument.Id[0],
+			"direction", routeDocument.Id[1], "trips", len(fullRoutes))
 		for index, _ := range fullRoutes {
 			fullRoutes[index].Direction = routeDocument.Id[1]
 		}
@@ -579,14 +445,11 @@ func FindMatchingRouteForArrival(origin string,
 
 	}
 
-	log.Println("All routes in busRoute format:")
-	log.Println(allRoutes)
-	log.Println("")
+	logger.Debug("trips found for all route candidates", "trips", len(allRoutes))
 	// Iterate over the result objects to transform them into suitable return
 	// objects while also generating travel time predictions and fare calculations
 	for _, currentRoute := range allRoutes {
 
-		log.Println(string(currentRoute.Id))
 		// Intermediary object to hold route information with fields for
 		// origin and destination stop numbers
 		var routeWithOAndD busRouteV2
@@ -594,11 +457,9 @@ func FindMatchingRouteForArrival(origin string,
 		routeWithOAndD.Stops = currentRoute.Stops
 		routeWithOAndD.Shapes = currentRoute.Shapes
 		routeWithOAndD.Direction = currentRoute.Direction
-		log.Println(currentRoute.Direction, routeWithOAndD.Direction)
-		log.Println("Route with Origin and Destination:")
-		log.Println(routeWithOAndD)
-		log.Println("")
 		route.RouteNum = string(currentRoute.Id)
+		route.WheelchairAccessible = tripWheelchairAccessible(currentRoute.TripId,
+			currentRoute.WheelchairAccessible)
 
 		// Two flags used within main loop when checking for matching origin and destination
 		originAndDestinationFound := false
@@ -638,9 +499,9 @@ func FindMatchingRouteForArrival(origin string,
 			}
 		}
 
-		log.Println("Route with O and D after loop to check for origin and destination:")
-		log.Println(routeWithOAndD)
-		log.Println("")
+		logger.Debug("origin and destination stops matched", "route", routeWithOAndD.Id,
+			"origin_stop", routeWithOAndD.OriginStopNumber,
+			"destination_stop", routeWithOAndD.DestinationStopNumber)
 		// At the end of the iteration over all stops, if a matching origin
 		// and destination were never found, skip remaining steps and move on
 		// to next route document in result slice
@@ -653,7 +514,8 @@ func FindMatchingRouteForArrival(origin string,
 			routeWithOAndD.DestinationStopNumber, currentRoute, stop)
 
 		// Shapes slice created
-		route.Shapes = CreateShapesSlice(currentRoute)
+		route.Shapes = CreateShapesSlice(currentRoute, routeWithOAndD.OriginStopNumber,
+			routeWithOAndD.DestinationStopNumber)
 		//if route.Shapes[0].ShapePtSequence != "1" {
 		//	shapeDistance, _ := strconv.ParseFloat(route.Shapes[0].ShapeDistTravel, 64)
 		//	if math.Sqrt(math.Pow(shapeDistance-route.Stops[0].DistanceTravelled, 2)) > 100 {
@@ -665,7 +527,8 @@ func FindMatchingRouteForArrival(origin string,
 			for shapeIndex, currentShape := range route.Shapes {
 				currentShapeDist, _ := strconv.ParseFloat(currentShape.ShapeDistTravel, 64)
 				if currentShapeDist == stopShapeCheck.DistanceTravelled {
-					log.Println("Found match for shape", shapeIndex, "with stop", stopShapeIndex)
+					logger.Debug("found match for shape with stop", "shape_index", shapeIndex,
+						"stop_index", stopShapeIndex)
 					break
 				}
 			}
@@ -691,32 +554,6 @@ func FindMatchingRouteForArrival(origin string,
 			route.Direction = "1"
 		}
 
-		// Get travel time prediction as floating point numbers based on call to external api
-		// connecting to flask application
-		initialTravelTime, err := GetTravelTimePrediction(route.RouteNum, date, route.Direction)
-		if err != nil {
-			log.Println(err)
-		}
-
-		// Floating point travel time used in conjunction with static timetable time
-		// information to generate more user-friendly travel time information
-		journeyTravelTime := AdjustTravelTime(initialTravelTime, originStopArrivalTime,
-			destinationStopArrivalTime, firstStopArrivalTime, finalStopArrivalTime)
-
-		// If the travel time prediction could not be calculated then source will have
-		// been set to static, where now static timetable information is used for the
-		// travel time estimation returned to the user
-		if journeyTravelTime.Source == "static" {
-			staticTravelTime := GetStaticTime(originStopArrivalTime, destinationStopArrivalTime)
-			journeyTravelTime.TransitTime = staticTravelTime
-			journeyTravelTime.TransitTimeMinusMAE = staticTravelTime
-			journeyTravelTime.TransitTimePlusMAE = staticTravelTime
-			journeyTravelTime.EstimatedArrivalTime = GetTimeStringAsHoursAndMinutes(destinationStopArrivalTime)
-			journeyTravelTime.EstimatedArrivalHighTime = GetTimeStringAsHoursAndMinutes(destinationStopArrivalTime)
-			journeyTravelTime.EstimatedArrivalLowTime = GetTimeStringAsHoursAndMinutes(destinationStopArrivalTime)
-		}
-		route.TravelTime = journeyTravelTime
-
 		// The stops slice is finally adjusted so that it only contains stops along the route being
 		// travelled
 		originStopIndex, destinationStopIndex := CurateStopsSlice(routeWithOAndD.OriginStopNumber,
@@ -726,17 +563,233 @@ func FindMatchingRouteForArrival(origin string,
 		if route.Shapes[0].ShapePtSequence != "1" {
 			shapeDistance, _ := strconv.ParseFloat(route.Shapes[0].ShapeDistTravel, 64)
 			if math.Sqrt(math.Pow(shapeDistance-route.Stops[0].DistanceTravelled, 2)) > 100 {
-				log.Println("Mismatch between the route shape and the actual route - route removed")
+				logger.Warn("mismatch between the route shape and the actual route, route removed",
+					"route", route.RouteNum)
 				continue
 			}
 		}
-		// Static timetable departure time is used to provide the user of an estimate
-		// for how when a bus will arrive to begin their journey
-		route.TravelTime.ScheduledDepartureTime = GetTimeStringAsHoursAndMinutes(route.Stops[0].ArrivalTime)
 
-		resultJSON = append(resultJSON, route)
+		// Travel time predictions are requested for all routes at once after this loop,
+		// so the static timetable times needed for them are kept alongside the route
+		pendingRoutes = append(pendingRoutes, PendingPrediction{
+			Route:                  route,
+			OriginArrivalTime:      originStopArrivalTime,
+			DestinationArrivalTime: destinationStopArrivalTime,
+			FirstStopArrivalTime:   firstStopArrivalTime,
+			FinalStopArrivalTime:   finalStopArrivalTime,
+		})
 	}
 
+	// Travel time predictions for every matched route are fetched concurrently, with
+	// any route whose prediction misses the deadline falling back to the static timetable
+	resultJSON = PredictTravelTimes(requestCtx, pendingRoutes, date)
 	resultJSON = CurateReturnedArrivalRoutes(date, resultJSON)
+	resultJSON = AttachWalks(resultJSON, originCoordinates, destinationCoordinates, routeOptions)
 	return resultJSON
 }
+
+// FindRouteCandidates takes in the context and trips_n_stops collection for a
+// route matching query, the stop numbers near the origin and destination and the
+// date of the query and returns the routes (grouped by route number and direction)
+// with trips serving both an origin stop and a destination stop. Results are
+// cached against the timetable generation for the time bucket that the date
+// falls in, as the same pair of locations is often queried repeatedly
+func FindRouteCandidates(ctx context.Context, collection *mongo.Collection,
+	originStopNums []string, destinationStopNums []string, date string) []MatchedRoute {
+
+	// routes object used to decode the results of the query and prepare for
+	// transformation
+	var routes []MatchedRoute
+
+	cacheKey := resultCache().TimetableKey(strings.Join(originStopNums, ","),
+		strings.Join(destinationStopNums, ","), timeBucket(date, RouteCandidatesBucket))
+	if resultCache().GetJSON(cacheKindRouteCandidates, cacheKey, &routes) {
+		return routes
+	}
+
+	// Aggregation pipeline created in Mongo Compass and then transformed to suit
+	// the mongo driver in Go
+	query, err := collection.Aggregate(ctx, bson.A{
+		bson.D{
+			{"$match",
+				bson.D{
+					{"stops",
+						bson.D{
+							{"$elemMatch",
+								bson.D{
+									{"stop_number",
+										bson.D{
+											{"$in",
+												originStopNums,
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+					{"stops.stop_number",
+						bson.D{
+							{"$in",
+								destinationStopNums,
+							},
+						},
+					},
+				},
+			},
+		},
+		bson.D{
+			{"$group",
+				bson.D{
+					{"_id",
+						bson.A{
+							"$route.route_short_name",
+							"$direction_id",
+						},
+					},
+					{"stops", bson.D{{"$first", "$stops"}}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		LoggerFromContext(ctx).Error("route candidate query failed", "error", err)
+		return routes
+	}
+
+	if err = query.All(ctx, &routes); err != nil {
+		LoggerFromContext(ctx).Error("could not decode route candidates", "error", err)
+		return routes
+	}
+
+	resultCache().SetJSON(cacheKindRouteCandidates, cacheKey, routes, RouteCandidatesCacheTTL)
+	return routes
+}
+
+// FindFirstTripForDeparture takes in the context and trips_n_stops collection for
+// a route matching query, a route candidate with its origin and destination stops,
+// the service date and the time of day of the query on that service day and
+// returns the first trip on that route running that day that departs the origin
+// stop after that time. In wheelchair mode, taken from the RouteOptions of the
+// context, the first trip that can be boarded by wheelchair is returned instead.
+// Results are cached against the timetable generation, the service date and the
+// wheelchair mode
+func FindFirstTripForDeparture(ctx context.Context, collection *mongo.Collection,
+	routeDocument MatchedRouteWithOAndD, serviceDate time.Time, timeString string) []busRoute {
+
+	var fullRoutes []busRoute
+	options := RouteOptionsFromContext(ctx)
+
+	cacheKey := resultCache().TimetableKey("departure", routeDocument.Id[0], routeDocument.Id[1],
+		routeDocument.OriginStopNumber, serviceDate.Format(serviceDateLayout), timeString,
+		strconv.FormatBool(options.Wheelchair))
+	if resultCache().GetJSON(cacheKindRouteTrips, cacheKey, &fullRoutes) {
+		return fullRoutes
+	}
+
+	// Only trips running on the service date are matched and, in wheelchair mode,
+	// trips marked as inaccessible are left out
+	match := append(bson.D{
+		{"route.route_short_name", routeDocument.Id[0]},
+		{"direction_id", routeDocument.Id[1]},
+		{"stops", bson.D{
+			{"$elemMatch", bson.D{
+				{"stop_number", routeDocument.OriginStopNumber},
+				{"departure_time", bson.D{
+					{"$gt", timeString},
+				},
+				}}},
+		}}}, tripAccessibilityFilter(options)...)
+	match = append(match, serviceDateFilter(ctx, collection, serviceDate)...)
+
+	query, err := collection.Aggregate(ctx, bson.A{
+		bson.D{{"$match", match}},
+		bson.D{{"$sort", bson.D{{"stops.departure_time", 1}}}},
+		bson.D{
+			{"$group", bson.D{
+				{"_id", "$route.route_short_name"},
+				{"direction", bson.D{{"$first", "$direction_id"}}},
+				{"trip_id", bson.D{{"$first", "$trip_id"}}},
+				{"wheelchair_accessible", bson.D{{"$first", "$wheelchair_accessible"}}},
+				{"stops", bson.D{{"$first", "$stops"}}},
+				{"shapes", bson.D{{"$first", "$shapes"}}},
+			}},
+		},
+	})
+	if err != nil {
+		LoggerFromContext(ctx).Error("trip query failed", "route", routeDocument.Id[0], "error", err)
+		return fullRoutes
+	}
+
+	if err = query.All(ctx, &fullRoutes); err != nil {
+		LoggerFromContext(ctx).Error("could not decode trips", "route", routeDocument.Id[0], "error", err)
+		return fullRoutes
+	}
+
+	resultCache().SetJSON(cacheKindRouteTrips, cacheKey, fullRoutes, RouteTripsCacheTTL)
+	return fullRoutes
+}
+
+// FindLastTripForArrival takes in the context and trips_n_stops collection for
+// a route matching query, a route candidate with its origin and destination stops,
+// the service date and the time of day of the query on that service day and
+// returns the last trip on that route running that day that arrives at the
+// destination stop by that time. In wheelchair mode, taken from the RouteOptions
+// of the context, the last trip that can be boarded by wheelchair is returned
+// instead. Results are cached against the timetable generation, the service date
+// and the wheelchair mode
+func FindLastTripForArrival(ctx context.Context, collection *mongo.Collection,
+	routeDocument MatchedRouteWithOAndD, serviceDate time.Time, timeString string) []busRoute {
+
+	var fullRoutes []busRoute
+	options := RouteOptionsFromContext(ctx)
+
+	cacheKey := resultCache().TimetableKey("arrival", routeDocument.Id[0], routeDocument.Id[1],
+		routeDocument.DestinationStopNumber, serviceDate.Format(serviceDateLayout), timeString,
+		strconv.FormatBool(options.Wheelchair))
+	if resultCache().GetJSON(cacheKindRouteTrips, cacheKey, &fullRoutes) {
+		return fullRoutes
+	}
+
+	// Only trips running on the service date are matched and, in wheelchair mode,
+	// trips marked as inaccessible are left out
+	match := append(bson.D{
+		{"route.route_short_name", routeDocument.Id[0]},
+		{"direction_id", routeDocument.Id[1]},
+		{"stops", bson.D{
+			{"$elemMatch", bson.D{
+				{"stop_number", routeDocument.DestinationStopNumber},
+				{"arrival_time", bson.D{
+					{"$lte", timeString},
+				},
+				}}},
+		}}}, tripAccessibilityFilter(options)...)
+	match = append(match, serviceDateFilter(ctx, collection, serviceDate)...)
+
+	query, err := collection.Aggregate(ctx, bson.A{
+		bson.D{{"$match", match}},
+		bson.D{{"$sort", bson.D{{"stops.arrival_time", -1}}}},
+		bson.D{
+			{"$group", bson.D{
+				{"_id", "$route.route_short_name"},
+				{"stops", bson.D{{"$first", "$stops"}}},
+				{"shapes", bson.D{{"$first", "$shapes"}}},
+				{"direction", bson.D{{"$first", "$direction_id"}}},
+				{"trip_id", bson.D{{"$first", "$trip_id"}}},
+				{"wheelchair_accessible", bson.D{{"$first", "$wheelchair_accessible"}}},
+			}},
+		},
+	})
+	if err != nil {
+		LoggerFromContext(ctx).Error("trip query failed", "route", routeDocument.Id[0], "error", err)
+		return fullRoutes
+	}
+
+	if err = query.All(ctx, &fullRoutes); err != nil {
+		LoggerFromContext(ctx).Error("could not decode trips", "route", routeDocument.Id[0], "error", err)
+		return fullRoutes
+	}
+
+	resultCache().SetJSON(cacheKindRouteTrips, cacheKey, fullRoutes, RouteTripsCacheTTL)
+	return fullRoutes
+}
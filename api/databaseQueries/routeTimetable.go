@@ -0,0 +1,282 @@
+package databaseQueries
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// serviceDateLayout is the format of the date parameter of the timetable endpoints
+const serviceDateLayout = "2006-01-02"
+
+// timetableStopTime is a single call at a stop by a trip, as read from the
+// trips_n_stops collection for the route timetable and stop details
+type timetableStopTime struct {
+	RouteNum      string  `bson:"route_num" json:"route_num"`
+	Direction     string  `bson:"direction" json:"direction"`
+	TripId        string  `bson:"trip_id" json:"trip_id"`
+	Headsign      string  `bson:"trip_headsign" json:"trip_headsign"`
+	ServiceId     string  `bson:"service_id" json:"service_id"`
+	Stop          BusStop `bson:"stop" json:"stop"`
+	FinalStopName string  `bson:"final_stop_name" json:"final_stop_name"`
+}
+
+// runsOn reports whether the trip making a call at a stop runs on the service
+// date, so that the route timetable and stop departures of a day only show the
+// trips running that day rather than those of every service
+func (stopTime timetableStopTime) runsOn(serviceDate time.Time) bool {
+	return serviceCalendar().RunsOn(stopTime.ServiceId, serviceDate, dayCalendar())
+}
+
+// RouteTimetable holds every scheduled departure of a route in one direction
+// from a stop on a service day, grouped by hour. The holiday is named where the
+// service day is a public holiday, when the Sunday timetable runs
+type RouteTimetable struct {
+	RouteNum    string          `bson:"route_num" json:"route_num"`
+	Direction   string          `bson:"direction" json:"direction"`
+	StopNumber  string          `bson:"stop_number" json:"stop_number"`
+	StopName    string          `bson:"stop_name" json:"stop_name"`
+	ServiceDate string          `bson:"service_date" json:"service_date"`
+	Holiday     string          `bson:"holiday,omitempty" json:"holiday,omitempty"`
+	Departures  int             `bson:"departures" json:"departures"`
+	Hours       []TimetableHour `bson:"hours" json:"hours"`
+}
+
+// TimetableHour holds the departures in one hour of the service day. Hours past
+// midnight at the end of the service day are given as 24, 25 and so on, as in
+// the timetable itself, so that they sort after the rest of the day
+type TimetableHour struct {
+	Hour       int                  `bson:"hour" json:"hour"`
+	Departures []TimetableDeparture `bson:"departures" json:"departures"`
+}
+
+// TimetableDeparture is a single scheduled departure. Time is the time of day
+// as shown on a printed timetable, ScheduledTime is the time as given in the
+// timetable (which may be past 24:00:00) and DepartureAt is the exact instant
+type TimetableDeparture struct {
+	Time          string `bson:"time" json:"time"`
+	ScheduledTime string `bson:"scheduled_time" json:"scheduled_time"`
+	DepartureAt   string `bson:"departure_at" json:"departure_at"`
+	Headsign      string `bson:"headsign" json:"headsign"`
+	TripId        string `bson:"trip_id" json:"trip_id"`
+	ServiceId     string `bson:"service_id,omitempty" json:"service_id,omitempty"`
+}
+
+// GetRouteTimetable returns the scheduled departures of the route in the
+// direction given in the request URL from the stop given in the stop query
+// parameter, for the service day given in the date query parameter as
+// "yyyy-mm-dd" or today's service day in Dublin if no date is given
+func GetRouteTimetable(c *gin.Context) {
+
+	direction := c.Param("direction")
+	if direction != "0" && direction != "1" {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid direction parameter in request, expected 0 or 1")
+		return
+	}
+
+	stopNumber := strings.TrimSpace(c.Query("stop"))
+	if stopNumber == "" {
+		c.IndentedJSON(http.StatusBadRequest, "The stop query parameter is required")
+		return
+	}
+
+	serviceDate, err := parseServiceDate(c.Query("date"), time.Now())
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid date parameter in request, expected yyyy-mm-dd")
+		return
+	}
+
+	timetable, found, err := FindRouteTimetable(c.Request.Context(), c.Param("routeNum"), direction,
+		stopNumber, serviceDate)
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not find timetable", "route", c.Param("routeNum"),
+			"stop", stopNumber, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Timetable could not be found")
+		return
+	}
+	if !found {
+		c.IndentedJSON(http.StatusNotFound, "The route doesn't serve that stop in that direction")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, timetable)
+}
+
+// parseServiceDate takes in the date parameter of a request and returns the
+// service date it refers to, defaulting to the service day that now falls on
+func parseServiceDate(date string, now time.Time) (time.Time, error) {
+
+	if strings.TrimSpace(date) == "" {
+		serviceDate, _ := ServiceDay(now)
+		return serviceDate, nil
+	}
+
+	return time.ParseInLocation(serviceDateLayout, strings.TrimSpace(date), dublinLocation)
+}
+
+// FindRouteTimetable takes in the context of the request, a route number,
+// direction, stop number and service date and returns the RouteTimetable for
+// them, reporting false if the route doesn't call at the stop in that direction.
+// The calls at the stop are cached against the timetable generation
+func FindRouteTimetable(requestCtx context.Context, routeNum string, direction string,
+	stopNumber string, serviceDate time.Time) (RouteTimetable, bool, error) {
+
+	routeNum = strings.ToUpper(strings.TrimSpace(routeNum))
+
+	var stopTimes []timetableStopTime
+	cacheKey := resultCache().TimetableKey("timetable", routeNum, direction, stopNumber)
+	if !resultCache().GetJSON(cacheKindRouteCatalogue, cacheKey, &stopTimes) {
+
+		collection, ctx, disconnect, err := openTimetable(requestCtx)
+		if err != nil {
+			return RouteTimetable{}, false, err
+		}
+		defer disconnect()
+
+		stopTimes, err = findStopTimes(ctx, collection, stopNumber, bson.D{
+			{Key: "route.route_short_name", Value: routeNum},
+			{Key: "direction_id", Value: direction},
+		})
+		if err != nil {
+			return RouteTimetable{}, false, err
+		}
+		resultCache().SetJSON(cacheKindRouteCatalogue, cacheKey, stopTimes, RouteCatalogueCacheTTL)
+	}
+
+	if len(stopTimes) == 0 {
+		return RouteTimetable{}, false, nil
+	}
+
+	return BuildRouteTimetable(routeNum, direction, stopNumber, serviceDate, stopTimes), true, nil
+}
+
+// findStopTimes returns every call at the stop by trips matching the filter,
+// along with the name of the final stop of each trip to use where the timetable
+// has no headsign
+func findStopTimes(ctx context.Context, collection *mongo.Collection, stopNumber string,
+	filter bson.D) ([]timetableStopTime, error) {
+
+	stopTimes := []timetableStopTime{}
+
+	filter = append(filter, bson.E{Key: "stops.stop_number", Value: stopNumber})
+	query, err := collection.Aggregate(ctx, bson.A{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "route_num", Value: "$route.route_short_name"},
+			{Key: "direction", Value: "$direction_id"},
+			{Key: "trip_id", Value: 1},
+			{Key: "trip_headsign", Value: 1},
+			{Key: "service_id", Value: 1},
+			{Key: "final_stop_name", Value: bson.D{{Key: "$arrayElemAt", Value: bson.A{"$stops.stop_name", -1}}}},
+			{Key: "stop", Value: "$stops"},
+		}}},
+		bson.D{{Key: "$unwind", Value: "$stop"}},
+		bson.D{{Key: "$match", Value: bson.D{{Key: "stop.stop_number", Value: stopNumber}}}},
+	})
+	if err != nil {
+		return stopTimes, err
+	}
+
+	err = query.All(ctx, &stopTimes)
+	return stopTimes, err
+}
+
+// BuildRouteTimetable takes in the route number, direction, stop number and
+// service date along with every call at the stop and returns the RouteTimetable,
+// with the departures sorted by time and grouped by the hour of the service day.
+// Calls with a time that can't be read, or by trips whose service doesn't run on
+// the service date, are left out. Where no service calendar is loaded the days
+// a service runs on are read from its id, such as "y1002-Saturday"
+func BuildRouteTimetable(routeNum string, direction string, stopNumber string,
+	serviceDate time.Time, stopTimes []timetableStopTime) RouteTimetable {
+
+	timetable := RouteTimetable{
+		RouteNum:    routeNum,
+		Direction:   direction,
+		StopNumber:  stopNumber,
+		ServiceDate: serviceDate.Format(serviceDateLayout),
+		Hours:       []TimetableHour{},
+	}
+	if holiday, found := dayCalendar().Holiday(serviceDate); found {
+		timetable.Holiday = holiday.Name
+	}
+
+	type timedStopTime struct {
+		seconds  int64
+		stopTime timetableStopTime
+	}
+	var timedStopTimes []timedStopTime
+	for _, stopTime := range stopTimes {
+		seconds, ok := parseServiceTime(stopTime.Stop.DepartureTime)
+		if !ok || !stopTime.runsOn(serviceDate) {
+			continue
+		}
+		timedStopTimes = append(timedStopTimes, timedStopTime{seconds, stopTime})
+		if timetable.StopName == "" {
+			timetable.StopName = stopTime.Stop.StopName
+		}
+	}
+	sort.SliceStable(timedStopTimes, func(i, j int) bool {
+		return timedStopTimes[i].seconds < timedStopTimes[j].seconds
+	})
+
+	for _, timed := range timedStopTimes {
+
+		hour := int(timed.seconds / 3600)
+		if len(timetable.Hours) == 0 || timetable.Hours[len(timetable.Hours)-1].Hour != hour {
+			timetable.Hours = append(timetable.Hours, TimetableHour{Hour: hour})
+		}
+
+		departureAt := ServiceDayStart(serviceDate).Add(time.Duration(timed.seconds) * time.Second)
+		current := &timetable.Hours[len(timetable.Hours)-1]
+		current.Departures = append(current.Departures, TimetableDeparture{
+			Time:          departureAt.In(dublinLocation).Format("15:04"),
+			ScheduledTime: timed.stopTime.Stop.DepartureTime,
+			DepartureAt:   departureAt.In(dublinLocation).Format(time.RFC3339),
+			Headsign:      stopTimeHeadsign(timed.stopTime),
+			TripId:        timed.stopTime.TripId,
+			ServiceId:     timed.stopTime.ServiceId,
+		})
+		timetable.Departures++
+	}
+
+	return timetable
+}
+
+// parseServiceTime takes in a timetable time in the format "hh:mm:ss", where
+// the hours may exceed 23, and returns the number of seconds since the start
+// of the service day, reporting false if the time can't be read
+func parseServiceTime(serviceTime string) (int64, bool) {
+
+	parts := strings.Split(strings.TrimSpace(serviceTime), ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	var values [3]int64
+	for index, part := range parts {
+		value, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || value < 0 || (index > 0 && value > 59) {
+			return 0, false
+		}
+		values[index] = value
+	}
+
+	return values[0]*3600 + values[1]*60 + values[2], true
+}
+
+// formatServiceTime returns the number of seconds since the start of the
+// service day as a timetable time in the format "hh:mm:ss", with hours past 23
+// for times after midnight, so that it compares as a string with timetable times
+func formatServiceTime(seconds int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
@@ -0,0 +1,110 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseServiceTime(t *testing.T) {
+
+	cases := map[string]int64{"07:05:00": 25500, "7:05:00": 25500, "24:30:15": 88215}
+	for serviceTime, expected := range cases {
+		seconds, ok := parseServiceTime(serviceTime)
+		if !ok || seconds != expected {
+			t.Log("Parsed", serviceTime, "as", seconds, ok, "but expected", expected)
+			t.Fail()
+		}
+	}
+
+	for _, serviceTime := range []string{"", "07:05", "07:65:00", "aa:00:00"} {
+		if _, ok := parseServiceTime(serviceTime); ok {
+			t.Log("Expected", serviceTime, "not to parse")
+			t.Fail()
+		}
+	}
+}
+
+func TestBuildRouteTimetableGroupsByHour(t *testing.T) {
+
+	stopTime := func(tripId string, departure string, headsign string) timetableStopTime {
+		return timetableStopTime{
+			TripId:        tripId,
+			Headsign:      headsign,
+			FinalStopName: "Terminus",
+			Stop:          BusStop{StopNumber: "1234", StopName: "Main Street", DepartureTime: departure},
+		}
+	}
+
+	serviceDate := time.Date(2022, time.June, 15, 0, 0, 0, 0, dublinLocation)
+	timetable := BuildRouteTimetable("46A", "1", "1234", serviceDate, []timetableStopTime{
+		stopTime("c", "24:10:00", "Late"),
+		stopTime("b", "07:45:00", ""),
+		stopTime("a", "7:05:00", "Early"),
+		stopTime("d", "bad", "Broken"),
+		stopTime("e", "08:00:00", "Early"),
+	})
+
+	if timetable.Departures != 4 || timetable.StopName != "Main Street" || timetable.ServiceDate != "2022-06-15" {
+		t.Log("Unexpected timetable", timetable)
+		t.FailNow()
+	}
+
+	if len(timetable.Hours) != 3 || timetable.Hours[0].Hour != 7 || timetable.Hours[1].Hour != 8 ||
+		timetable.Hours[2].Hour != 24 {
+		t.Log("Unexpected hours", timetable.Hours)
+		t.FailNow()
+	}
+
+	early := timetable.Hours[0].Departures
+	if len(early) != 2 || early[0].TripId != "a" || early[1].TripId != "b" || early[0].Time != "07:05" {
+		t.Log("Unexpected departures in the first hour", early)
+		t.Fail()
+	}
+	if early[1].Headsign != "Terminus" {
+		t.Log("Expected the final stop to be used as the headsign but got", early[1].Headsign)
+		t.Fail()
+	}
+
+	late := timetable.Hours[2].Departures[0]
+	if late.Time != "00:10" || late.DepartureAt != "2022-06-16T00:10:00+01:00" {
+		t.Log("Unexpected departure after midnight", late)
+		t.Fail()
+	}
+}
+
+func TestBuildRouteTimetableByServiceDay(t *testing.T) {
+
+	stopTimes := []timetableStopTime{
+		{TripId: "weekday", ServiceId: "y1002-Weekday", Stop: BusStop{DepartureTime: "07:00:00"}},
+		{TripId: "saturday", ServiceId: "y1002-Saturday", Stop: BusStop{DepartureTime: "08:00:00"}},
+		{TripId: "sunday", ServiceId: "y1002-Sunday", Stop: BusStop{DepartureTime: "09:00:00"}},
+	}
+
+	// Without calendar files the day a service runs on is read from its id
+	for date, tripId := range map[time.Time]string{
+		time.Date(2022, time.June, 15, 0, 0, 0, 0, dublinLocation): "weekday",
+		time.Date(2022, time.June, 18, 0, 0, 0, 0, dublinLocation): "saturday",
+		time.Date(2022, time.June, 6, 0, 0, 0, 0, dublinLocation):  "sunday",
+	} {
+		timetable := BuildRouteTimetable("46A", "1", "1234", date, stopTimes)
+		if timetable.Departures != 1 || timetable.Hours[0].Departures[0].TripId != tripId {
+			t.Log("Expected only the", tripId, "trip on", date.Format(serviceDateLayout), "got", timetable.Hours)
+			t.Fail()
+		}
+	}
+}
+
+func TestParseServiceDate(t *testing.T) {
+
+	now := time.Date(2022, time.June, 16, 1, 30, 0, 0, dublinLocation)
+	serviceDate, err := parseServiceDate("", now)
+	if err != nil || serviceDate.Format(serviceDateLayout) != "2022-06-16" {
+		t.Log("Expected today's service day but got", serviceDate, err)
+		t.Fail()
+	}
+
+	if _, err := parseServiceDate("16/06/2022", now); err == nil {
+		t.Log("Expected an invalid date to be rejected")
+		t.Fail()
+	}
+}
@@ -0,0 +1,351 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commuteTimeLayout is the layout of the target arrival time of a commute
+const commuteTimeLayout = "15:04"
+
+// maxSavedNameLength is the longest name allowed for a place or commute
+const maxSavedNameLength = 64
+
+// commuteWeekdays maps the names accepted for the days of a commute, in full or
+// shortened to three letters, to the day they stand for
+var commuteWeekdays = map[string]time.Weekday{
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+	"sunday": time.Sunday, "sun": time.Sunday,
+}
+
+// ErrJourneyProfileConflict is returned by a JourneyStore when a profile was
+// changed by another request while it was being updated
+var ErrJourneyProfileConflict = errors.New("saved journeys were changed by another request")
+
+// SavedPlace is a named place such as home or work that commutes run between
+type SavedPlace struct {
+	Name    string  `bson:"name" json:"name"`
+	Lat     float64 `bson:"lat" json:"lat"`
+	Lon     float64 `bson:"lon" json:"lon"`
+	Address string  `bson:"address,omitempty" json:"address,omitempty"`
+}
+
+// Commute is a recurring journey between two saved places on the given days of
+// the week, arriving by the target time given as "15:04" in Dublin time
+type Commute struct {
+	Name     string   `bson:"name" json:"name"`
+	From     string   `bson:"from" json:"from"`
+	To       string   `bson:"to" json:"to"`
+	Weekdays []string `bson:"weekdays" json:"weekdays"`
+	ArriveBy string   `bson:"arrive_by" json:"arrive_by"`
+}
+
+// JourneyProfile holds the saved places and commutes of one owner. The version
+// is increased each time the profile is saved so that concurrent updates can be
+// detected
+type JourneyProfile struct {
+	Owner     string       `bson:"_id" json:"owner"`
+	Places    []SavedPlace `bson:"places" json:"places"`
+	Commutes  []Commute    `bson:"commutes" json:"commutes"`
+	Version   int64        `bson:"version" json:"version"`
+	UpdatedAt time.Time    `bson:"updated_at" json:"updated_at"`
+}
+
+// JourneyStore is the interface that a store for saved journeys must satisfy.
+// GetProfile returns an empty profile for an owner that has saved nothing,
+// SaveProfile stores a profile as long as its version still matches the stored
+// one, returning ErrJourneyProfileConflict if not, and DeleteProfile removes
+// everything saved by an owner
+type JourneyStore interface {
+	GetProfile(ctx context.Context, owner string) (JourneyProfile, error)
+	SaveProfile(ctx context.Context, profile JourneyProfile) error
+	DeleteProfile(ctx context.Context, owner string) error
+}
+
+// Place returns the saved place with the given name
+func (profile JourneyProfile) Place(name string) (SavedPlace, bool) {
+
+	for _, place := range profile.Places {
+		if place.Name == name {
+			return place, true
+		}
+	}
+
+	return SavedPlace{}, false
+}
+
+// Commute returns the commute with the given name
+func (profile JourneyProfile) Commute(name string) (Commute, bool) {
+
+	for _, commute := range profile.Commutes {
+		if commute.Name == name {
+			return commute, true
+		}
+	}
+
+	return Commute{}, false
+}
+
+// PutPlace adds the place to the profile, replacing any place with the same
+// name, as long as no more than maxPlaces would be saved
+func (profile *JourneyProfile) PutPlace(place SavedPlace, maxPlaces int) error {
+
+	if err := place.Validate(); err != nil {
+		return err
+	}
+
+	for index := range profile.Places {
+		if profile.Places[index].Name == place.Name {
+			profile.Places[index] = place
+			return nil
+		}
+	}
+	if len(profile.Places) >= maxPlaces {
+		return fmt.Errorf("no more than %d places can be saved", maxPlaces)
+	}
+
+	profile.Places = append(profile.Places, place)
+	return nil
+}
+
+// RemovePlace removes the named place from the profile, reporting false if it
+// wasn't saved. A place used by a commute can't be removed
+func (profile *JourneyProfile) RemovePlace(name string) (bool, error) {
+
+	for _, commute := range profile.Commutes {
+		if commute.From == name || commute.To == name {
+			return false, fmt.Errorf("place '%s' is used by commute '%s'", name, commute.Name)
+		}
+	}
+
+	for index, place := range profile.Places {
+		if place.Name == name {
+			profile.Places = append(profile.Places[:index], profile.Places[index+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// PutCommute adds the commute to the profile, replacing any commute with the
+// same name, as long as both of its places are saved and no more than
+// maxCommutes would be saved. The weekdays are stored in their full form
+func (profile *JourneyProfile) PutCommute(commute Commute, maxCommutes int) error {
+
+	weekdays, err := commute.Validate()
+	if err != nil {
+		return err
+	}
+	for _, placeName := range []string{commute.From, commute.To} {
+		if _, ok := profile.Place(placeName); !ok {
+			return fmt.Errorf("place '%s' isn't saved", placeName)
+		}
+	}
+
+	commute.Weekdays = nil
+	for _, weekday := range weekdays {
+		commute.Weekdays = append(commute.Weekdays, strings.ToLower(weekday.String()))
+	}
+
+	for index := range profile.Commutes {
+		if profile.Commutes[index].Name == commute.Name {
+			profile.Commutes[index] = commute
+			return nil
+		}
+	}
+	if len(profile.Commutes) >= maxCommutes {
+		return fmt.Errorf("no more than %d commutes can be saved", maxCommutes)
+	}
+
+	profile.Commutes = append(profile.Commutes, commute)
+	return nil
+}
+
+// RemoveCommute removes the named commute from the profile, reporting false if
+// it wasn't saved
+func (profile *JourneyProfile) RemoveCommute(name string) bool {
+
+	for index, commute := range profile.Commutes {
+		if commute.Name == name {
+			profile.Commutes = append(profile.Commutes[:index], profile.Commutes[index+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks that the place has a name and coordinates that are on the map
+func (place SavedPlace) Validate() error {
+
+	if err := validateSavedName(place.Name); err != nil {
+		return err
+	}
+	if place.Lat < -90 || place.Lat > 90 || place.Lon < -180 || place.Lon > 180 {
+		return errors.New("place coordinates are out of range")
+	}
+
+	return nil
+}
+
+// Validate checks the commute and returns the days of the week it runs on in
+// order from Sunday, without duplicates
+func (commute Commute) Validate() ([]time.Weekday, error) {
+
+	if err := validateSavedName(commute.Name); err != nil {
+		return nil, err
+	}
+	if commute.From == "" || commute.To == "" {
+		return nil, errors.New("a commute needs both a from and a to place")
+	}
+	if commute.From == commute.To {
+		return nil, errors.New("a commute must be between two different places")
+	}
+	if _, err := time.Parse(commuteTimeLayout, commute.ArriveBy); err != nil {
+		return nil, fmt.Errorf("invalid arrive_by time '%s', expected hh:mm", commute.ArriveBy)
+	}
+	if len(commute.Weekdays) == 0 {
+		return nil, errors.New("a commute needs at least one weekday")
+	}
+
+	days := [7]bool{}
+	for _, name := range commute.Weekdays {
+		weekday, ok := commuteWeekdays[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday '%s'", name)
+		}
+		days[weekday] = true
+	}
+
+	var weekdays []time.Weekday
+	for weekday, runs := range days {
+		if runs {
+			weekdays = append(weekdays, time.Weekday(weekday))
+		}
+	}
+
+	return weekdays, nil
+}
+
+// RunsOn reports whether the commute runs on the given day of the week
+func (commute Commute) RunsOn(weekday time.Weekday) bool {
+
+	for _, name := range commute.Weekdays {
+		if day, ok := commuteWeekdays[strings.ToLower(name)]; ok && day == weekday {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateSavedName checks the name of a place or commute
+func validateSavedName(name string) error {
+
+	if strings.TrimSpace(name) == "" {
+		return errors.New("a name is required")
+	}
+	if len(name) > maxSavedNameLength {
+		return fmt.Errorf("names can be at most %d characters", maxSavedNameLength)
+	}
+
+	return nil
+}
+
+// MemoryJourneyStore is a JourneyStore keeping profiles in memory, used within
+// tests and when the api runs without Mongo. Profiles are lost on restart
+type MemoryJourneyStore struct {
+	lock     sync.Mutex
+	profiles map[string]JourneyProfile
+}
+
+// NewMemoryJourneyStore returns an empty MemoryJourneyStore
+func NewMemoryJourneyStore() *MemoryJourneyStore {
+	return &MemoryJourneyStore{profiles: map[string]JourneyProfile{}}
+}
+
+// GetProfile returns the profile of the owner
+func (store *MemoryJourneyStore) GetProfile(ctx context.Context, owner string) (JourneyProfile, error) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	profile, ok := store.profiles[owner]
+	if !ok {
+		return JourneyProfile{Owner: owner, Places: []SavedPlace{}, Commutes: []Commute{}}, nil
+	}
+
+	// The slices are copied so that changes by the caller aren't seen by others
+	profile.Places = append([]SavedPlace{}, profile.Places...)
+	profile.Commutes = append([]Commute{}, profile.Commutes...)
+	return profile, nil
+}
+
+// SaveProfile stores the profile if its version matches the stored one
+func (store *MemoryJourneyStore) SaveProfile(ctx context.Context, profile JourneyProfile) error {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.profiles[profile.Owner].Version != profile.Version {
+		return ErrJourneyProfileConflict
+	}
+
+	profile.Version++
+	profile.UpdatedAt = time.Now().UTC()
+	store.profiles[profile.Owner] = profile
+	return nil
+}
+
+// DeleteProfile removes the profile of the owner
+func (store *MemoryJourneyStore) DeleteProfile(ctx context.Context, owner string) error {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.profiles, owner)
+	return nil
+}
+
+var sharedJourneyStore JourneyStore
+var sharedJourneyStoreOnce sync.Once
+
+// journeyStore returns the JourneyStore shared by the whole package, creating
+// it from the journeys configuration the first time it is called unless
+// SetJourneyStore has already been used to provide one
+func journeyStore() JourneyStore {
+	sharedJourneyStoreOnce.Do(func() {
+		if sharedJourneyStore == nil {
+			sharedJourneyStore = newJourneyStore(currentConfig.Journeys)
+		}
+	})
+	return sharedJourneyStore
+}
+
+// SetJourneyStore replaces the JourneyStore shared by the package, which allows
+// the store to be chosen at startup or swapped out within tests
+func SetJourneyStore(store JourneyStore) {
+	sharedJourneyStoreOnce.Do(func() {})
+	sharedJourneyStore = store
+}
+
+// newJourneyStore creates the store described by the journeys configuration,
+// which may be "mongo" (the default) or "memory"
+func newJourneyStore(journeysConfig JourneysConfig) JourneyStore {
+
+	if strings.ToLower(journeysConfig.Store) == "memory" {
+		return NewMemoryJourneyStore()
+	}
+
+	return NewMongoJourneyStore(currentConfig.Mongo.Collections.SavedJourneys)
+}
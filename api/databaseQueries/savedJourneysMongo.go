@@ -0,0 +1,76 @@
+package databaseQueries
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoJourneyStore is a JourneyStore keeping one document per owner in a Mongo
+// collection, keyed by the owner
+type MongoJourneyStore struct {
+	collection string
+}
+
+// NewMongoJourneyStore returns a MongoJourneyStore using the named collection
+func NewMongoJourneyStore(collection string) *MongoJourneyStore {
+	return &MongoJourneyStore{collection: collection}
+}
+
+// GetProfile returns the profile of the owner
+func (store *MongoJourneyStore) GetProfile(requestCtx context.Context, owner string) (JourneyProfile, error) {
+
+	profile := JourneyProfile{Owner: owner, Places: []SavedPlace{}, Commutes: []Commute{}}
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, store.collection)
+	if err != nil {
+		return profile, err
+	}
+	defer disconnect()
+
+	err = collection.FindOne(ctx, bson.D{{Key: "_id", Value: owner}}).Decode(&profile)
+	if err == mongo.ErrNoDocuments {
+		return profile, nil
+	}
+
+	return profile, err
+}
+
+// SaveProfile stores the profile if its version matches the stored one. The
+// version is part of the filter, so a profile changed in the meantime doesn't
+// match and the upsert then fails on the owner already being taken
+func (store *MongoJourneyStore) SaveProfile(requestCtx context.Context, profile JourneyProfile) error {
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, store.collection)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	filter := bson.D{{Key: "_id", Value: profile.Owner}, {Key: "version", Value: profile.Version}}
+	profile.Version++
+	profile.UpdatedAt = time.Now().UTC()
+
+	_, err = collection.ReplaceOne(ctx, filter, profile, options.Replace().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrJourneyProfileConflict
+	}
+
+	return err
+}
+
+// DeleteProfile removes the profile of the owner
+func (store *MongoJourneyStore) DeleteProfile(requestCtx context.Context, owner string) error {
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, store.collection)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	_, err = collection.DeleteOne(ctx, bson.D{{Key: "_id", Value: owner}})
+	return err
+}
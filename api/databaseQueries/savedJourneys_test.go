@@ -0,0 +1,142 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testJourneyProfile() JourneyProfile {
+
+	profile := JourneyProfile{Owner: "web/alice"}
+	profile.PutPlace(SavedPlace{Name: "home", Lat: 53.288, Lon: -6.199}, 5)
+	profile.PutPlace(SavedPlace{Name: "work", Lat: 53.321, Lon: -6.231}, 5)
+
+	return profile
+}
+
+func TestPutPlace(t *testing.T) {
+
+	profile := testJourneyProfile()
+
+	if err := profile.PutPlace(SavedPlace{Name: "home", Lat: 53.3, Lon: -6.2}, 2); err != nil {
+		t.Log("Replacing a saved place shouldn't count against the limit, got", err)
+		t.Fail()
+	}
+	if place, _ := profile.Place("home"); place.Lat != 53.3 || len(profile.Places) != 2 {
+		t.Log("Expected home to be replaced, got", profile.Places)
+		t.Fail()
+	}
+	if err := profile.PutPlace(SavedPlace{Name: "gym", Lat: 53.3, Lon: -6.2}, 2); err == nil {
+		t.Log("Expected a place past the limit to be rejected")
+		t.Fail()
+	}
+	if err := profile.PutPlace(SavedPlace{Name: "moon", Lat: 120, Lon: 0}, 5); err == nil {
+		t.Log("Expected a place with coordinates out of range to be rejected")
+		t.Fail()
+	}
+	if err := profile.PutPlace(SavedPlace{Name: " ", Lat: 53.3, Lon: -6.2}, 5); err == nil {
+		t.Log("Expected a place without a name to be rejected")
+		t.Fail()
+	}
+}
+
+func TestPutCommute(t *testing.T) {
+
+	profile := testJourneyProfile()
+
+	commute := Commute{Name: "to work", From: "home", To: "work",
+		Weekdays: []string{"Fri", "monday", "mon"}, ArriveBy: "08:45"}
+	if err := profile.PutCommute(commute, 5); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	saved, _ := profile.Commute("to work")
+	if len(saved.Weekdays) != 2 || saved.Weekdays[0] != "monday" || saved.Weekdays[1] != "friday" {
+		t.Log("Expected the weekdays to be stored in full, in order and without duplicates, got", saved.Weekdays)
+		t.Fail()
+	}
+	if !saved.RunsOn(time.Friday) || saved.RunsOn(time.Tuesday) {
+		t.Log("Expected the commute to run on Mondays and Fridays only")
+		t.Fail()
+	}
+
+	invalid := []Commute{
+		{Name: "a", From: "home", To: "gym", Weekdays: []string{"mon"}, ArriveBy: "08:45"},
+		{Name: "b", From: "home", To: "home", Weekdays: []string{"mon"}, ArriveBy: "08:45"},
+		{Name: "c", From: "home", To: "work", Weekdays: []string{"someday"}, ArriveBy: "08:45"},
+		{Name: "d", From: "home", To: "work", Weekdays: []string{}, ArriveBy: "08:45"},
+		{Name: "e", From: "home", To: "work", Weekdays: []string{"mon"}, ArriveBy: "25:00"},
+	}
+	for _, commute := range invalid {
+		if err := profile.PutCommute(commute, 5); err == nil {
+			t.Log("Expected commute", commute.Name, "to be rejected")
+			t.Fail()
+		}
+	}
+}
+
+func TestRemovePlaceInUse(t *testing.T) {
+
+	profile := testJourneyProfile()
+	profile.PutCommute(Commute{Name: "to work", From: "home", To: "work",
+		Weekdays: []string{"mon"}, ArriveBy: "08:45"}, 5)
+
+	if _, err := profile.RemovePlace("home"); err == nil {
+		t.Log("Expected a place used by a commute to be kept")
+		t.Fail()
+	}
+
+	profile.RemoveCommute("to work")
+	removed, err := profile.RemovePlace("home")
+	if err != nil || !removed {
+		t.Log("Expected the place to be removed once no commute uses it, got", removed, err)
+		t.Fail()
+	}
+	if removed, _ = profile.RemovePlace("home"); removed {
+		t.Log("Expected removing a place that isn't saved to report false")
+		t.Fail()
+	}
+}
+
+func TestMemoryJourneyStore(t *testing.T) {
+
+	store := NewMemoryJourneyStore()
+	ctx := context.Background()
+
+	profile, err := store.GetProfile(ctx, "web/alice")
+	if err != nil || profile.Owner != "web/alice" || len(profile.Places) != 0 {
+		t.Log("Expected an empty profile for a new owner, got", profile, err)
+		t.FailNow()
+	}
+
+	profile.PutPlace(SavedPlace{Name: "home", Lat: 53.288, Lon: -6.199}, 5)
+	if err = store.SaveProfile(ctx, profile); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// Saving the same version again means another request saved in between
+	if err = store.SaveProfile(ctx, profile); !errors.Is(err, ErrJourneyProfileConflict) {
+		t.Log("Expected a conflict when saving a stale profile, got", err)
+		t.Fail()
+	}
+
+	saved, _ := store.GetProfile(ctx, "web/alice")
+	if saved.Version != 1 || len(saved.Places) != 1 {
+		t.Log("Expected the saved profile to be returned at version 1, got", saved)
+		t.Fail()
+	}
+	if other, _ := store.GetProfile(ctx, "web/bob"); len(other.Places) != 0 {
+		t.Log("Expected profiles to be kept apart by owner, got", other)
+		t.Fail()
+	}
+
+	store.DeleteProfile(ctx, "web/alice")
+	if deleted, _ := store.GetProfile(ctx, "web/alice"); len(deleted.Places) != 0 || deleted.Version != 0 {
+		t.Log("Expected the profile to be deleted, got", deleted)
+		t.Fail()
+	}
+}
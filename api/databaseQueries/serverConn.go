@@ -0,0 +1,35 @@
+package databaseQueries
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// connContextKey is the key under which the connection a request arrived on is
+// stored in its context
+type connContextKey struct{}
+
+// ConnContext stores the connection in the context of each request arriving on
+// it, so that handlers streaming their response can extend its write deadline.
+// It is set as the ConnContext of the http.Server
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// extendWriteDeadline gives the response to the request with the context the
+// given time from now to be written, in place of the server's write timeout
+// from the start of the request, so that a stream kept busy isn't cut off part
+// way through. It does nothing if the connection isn't in the context or the
+// timeout isn't positive
+func extendWriteDeadline(ctx context.Context, timeout time.Duration) {
+
+	conn, ok := ctx.Value(connContextKey{}).(net.Conn)
+	if !ok || timeout <= 0 {
+		return
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		LoggerFromContext(ctx).Warn("could not extend the write deadline", "error", err)
+	}
+}
@@ -0,0 +1,31 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestExtendWriteDeadline(t *testing.T) {
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// Without the connection in the context nothing is changed
+	extendWriteDeadline(context.Background(), time.Millisecond)
+
+	ctx := ConnContext(context.Background(), server)
+	extendWriteDeadline(ctx, 20*time.Millisecond)
+
+	// Nothing reads from the client, so the write waits until the deadline
+	start := time.Now()
+	if _, err := server.Write([]byte("data")); !errors.Is(err, os.ErrDeadlineExceeded) ||
+		time.Since(start) > time.Second {
+		t.Log("Expected the write to reach the extended deadline, got", err, "after", time.Since(start))
+		t.Fail()
+	}
+}
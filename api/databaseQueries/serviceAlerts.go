@@ -0,0 +1,400 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AlertEffectNoService is the GTFS-R effect of an alert closing the routes or
+// stops it informs about
+const AlertEffectNoService = "NO_SERVICE"
+
+// feedIncrementalityDifferential is the incrementality of a GTFS-R feed that
+// only holds the entities changed since the last one
+const feedIncrementalityDifferential = "DIFFERENTIAL"
+
+// ServiceAlert is a GTFS-R service alert as stored by the api, with its texts
+// in English and the route ids, trip ids and stop ids it informs about
+// resolved to route and stop numbers where the timetable knows them
+type ServiceAlert struct {
+	Id               string        `bson:"_id" json:"id"`
+	Cause            string        `bson:"cause,omitempty" json:"cause,omitempty"`
+	Effect           string        `bson:"effect,omitempty" json:"effect,omitempty"`
+	Header           string        `bson:"header" json:"header"`
+	Description      string        `bson:"description,omitempty" json:"description,omitempty"`
+	URL              string        `bson:"url,omitempty" json:"url,omitempty"`
+	ActivePeriods    []AlertPeriod `bson:"active_periods" json:"active_periods"`
+	InformedEntities []AlertEntity `bson:"informed_entities" json:"informed_entities"`
+	FeedTimestamp    time.Time     `bson:"feed_timestamp" json:"feed_timestamp"`
+}
+
+// AlertPeriod is a period an alert is active for, where a missing start or end
+// leaves the period open at that end
+type AlertPeriod struct {
+	Start *time.Time `bson:"start,omitempty" json:"start,omitempty"`
+	End   *time.Time `bson:"end,omitempty" json:"end,omitempty"`
+}
+
+// AlertEntity is an agency, route, trip or stop that an alert informs about.
+// Every field given must match for the alert to apply
+type AlertEntity struct {
+	AgencyId    string `bson:"agency_id,omitempty" json:"agency_id,omitempty"`
+	RouteId     string `bson:"route_id,omitempty" json:"route_id,omitempty"`
+	RouteNum    string `bson:"route_num,omitempty" json:"route_num,omitempty"`
+	DirectionId string `bson:"direction_id,omitempty" json:"direction_id,omitempty"`
+	TripId      string `bson:"trip_id,omitempty" json:"trip_id,omitempty"`
+	StopId      string `bson:"stop_id,omitempty" json:"stop_id,omitempty"`
+	StopNumber  string `bson:"stop_number,omitempty" json:"stop_number,omitempty"`
+}
+
+// AlertNotice is the part of an alert attached to the routes and stops it
+// applies to in route matching responses
+type AlertNotice struct {
+	Id            string        `bson:"id" json:"id"`
+	Cause         string        `bson:"cause,omitempty" json:"cause,omitempty"`
+	Effect        string        `bson:"effect,omitempty" json:"effect,omitempty"`
+	Header        string        `bson:"header" json:"header"`
+	Description   string        `bson:"description,omitempty" json:"description,omitempty"`
+	URL           string        `bson:"url,omitempty" json:"url,omitempty"`
+	ActivePeriods []AlertPeriod `bson:"active_periods" json:"active_periods"`
+}
+
+// AlertStore is the interface that a store for service alerts must satisfy.
+// ReplaceAlerts swaps every stored alert for the ones given and FindAlerts
+// returns every stored alert, active or not
+type AlertStore interface {
+	ReplaceAlerts(ctx context.Context, alerts []ServiceAlert) error
+	FindAlerts(ctx context.Context) ([]ServiceAlert, error)
+}
+
+// ActiveAt reports whether the alert is active at the instant. An alert without
+// any active periods is always active
+func (alert ServiceAlert) ActiveAt(instant time.Time) bool {
+
+	if len(alert.ActivePeriods) == 0 {
+		return true
+	}
+
+	for _, period := range alert.ActivePeriods {
+		if (period.Start == nil || !instant.Before(*period.Start)) &&
+			(period.End == nil || instant.Before(*period.End)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Notice returns the alert as attached to routes and stops
+func (alert ServiceAlert) Notice() AlertNotice {
+	return AlertNotice{
+		Id:            alert.Id,
+		Cause:         alert.Cause,
+		Effect:        alert.Effect,
+		Header:        alert.Header,
+		Description:   alert.Description,
+		URL:           alert.URL,
+		ActivePeriods: alert.ActivePeriods,
+	}
+}
+
+// ParseServiceAlerts takes in a GTFS-R feed and returns the alerts in it, along
+// with the ids of any alert entities marked as deleted
+func ParseServiceAlerts(feed FeedMessage) ([]ServiceAlert, []string) {
+
+	feedTimestamp, _ := feed.Header.Timestamp.Time()
+
+	alerts := []ServiceAlert{}
+	var deleted []string
+	for _, entity := range feed.Entity {
+		if entity.IsDeleted {
+			deleted = append(deleted, entity.Id)
+			continue
+		}
+		if entity.Alert == nil || entity.Id == "" {
+			continue
+		}
+
+		alert := ServiceAlert{
+			Id:               entity.Id,
+			Cause:            entity.Alert.Cause,
+			Effect:           entity.Alert.Effect,
+			Header:           entity.Alert.HeaderText.Text(),
+			Description:      entity.Alert.DescriptionText.Text(),
+			URL:              entity.Alert.Url.Text(),
+			ActivePeriods:    []AlertPeriod{},
+			InformedEntities: []AlertEntity{},
+			FeedTimestamp:    feedTimestamp,
+		}
+
+		for _, feedPeriod := range entity.Alert.ActivePeriod {
+			period := AlertPeriod{}
+			if start, ok := feedPeriod.Start.Time(); ok {
+				period.Start = &start
+			}
+			if end, ok := feedPeriod.End.Time(); ok {
+				period.End = &end
+			}
+			alert.ActivePeriods = append(alert.ActivePeriods, period)
+		}
+
+		for _, selector := range entity.Alert.InformedEntity {
+			informed := AlertEntity{AgencyId: selector.AgencyId, RouteId: selector.RouteId, StopId: selector.StopId}
+			if selector.Trip != nil {
+				informed.TripId = selector.Trip.TripId
+				if informed.RouteId == "" {
+					informed.RouteId = selector.Trip.RouteId
+				}
+				if selector.Trip.DirectionId != nil {
+					informed.DirectionId = strconv.Itoa(*selector.Trip.DirectionId)
+				}
+			}
+			alert.InformedEntities = append(alert.InformedEntities, informed)
+		}
+
+		alerts = append(alerts, alert)
+	}
+
+	return alerts, deleted
+}
+
+// ResolveAlertEntities fills in the route and stop numbers of the entities each
+// alert informs about from the references. Route ids the timetable doesn't know
+// fall back to the route number within Dublin Bus route ids such as
+// "60-46A-b12-1"
+func ResolveAlertEntities(alerts []ServiceAlert, references feedReferences) []ServiceAlert {
+
+	for alertIndex := range alerts {
+		for entityIndex := range alerts[alertIndex].InformedEntities {
+			entity := &alerts[alertIndex].InformedEntities[entityIndex]
+			if entity.RouteId != "" {
+				if routeNum, ok := references.RouteNums[entity.RouteId]; ok {
+					entity.RouteNum = routeNum
+				} else {
+					entity.RouteNum = routeNumFromRouteId(entity.RouteId)
+				}
+			}
+			if entity.RouteNum == "" && entity.TripId != "" {
+				entity.RouteNum = references.TripRouteNums[entity.TripId]
+			}
+			if entity.StopId != "" {
+				entity.StopNumber = references.StopNumbers[entity.StopId]
+			}
+		}
+	}
+
+	return alerts
+}
+
+// IngestServiceAlerts takes in the context of the request, a GTFS-R feed and the
+// store to keep alerts in and stores the alerts in the feed, returning the
+// number of alerts stored. A full feed replaces every stored alert, while a
+// differential feed only adds, replaces or deletes the alerts it holds. Route
+// and stop numbers are resolved where possible, with alerts still stored if
+// they can't be
+func IngestServiceAlerts(ctx context.Context, feed FeedMessage, store AlertStore) (int, error) {
+
+	alerts, deleted := ParseServiceAlerts(feed)
+
+	var routeIds, tripIds, stopIds []string
+	for _, alert := range alerts {
+		for _, entity := range alert.InformedEntities {
+			if entity.RouteId != "" {
+				routeIds = append(routeIds, entity.RouteId)
+			}
+			if entity.TripId != "" {
+				tripIds = append(tripIds, entity.TripId)
+			}
+			if entity.StopId != "" {
+				stopIds = append(stopIds, entity.StopId)
+			}
+		}
+	}
+	references, err := resolveFeedReferences(ctx, routeIds, tripIds, stopIds)
+	if err != nil {
+		LoggerFromContext(ctx).Warn("could not resolve alert routes and stops", "error", err)
+	}
+	alerts = ResolveAlertEntities(alerts, references)
+
+	if strings.EqualFold(feed.Header.Incrementality, feedIncrementalityDifferential) {
+		stored, err := store.FindAlerts(ctx)
+		if err != nil {
+			return 0, err
+		}
+		alerts = mergeServiceAlerts(stored, alerts, deleted)
+	}
+
+	if err = store.ReplaceAlerts(ctx, alerts); err != nil {
+		return 0, err
+	}
+
+	return len(alerts), nil
+}
+
+// mergeServiceAlerts returns the stored alerts with the updated alerts added or
+// replacing those with the same id and the deleted alerts removed
+func mergeServiceAlerts(stored []ServiceAlert, updated []ServiceAlert, deleted []string) []ServiceAlert {
+
+	byId := map[string]ServiceAlert{}
+	for _, alert := range stored {
+		byId[alert.Id] = alert
+	}
+	for _, alert := range updated {
+		byId[alert.Id] = alert
+	}
+	for _, id := range deleted {
+		delete(byId, id)
+	}
+
+	merged := make([]ServiceAlert, 0, len(byId))
+	for _, alert := range byId {
+		merged = append(merged, alert)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Id < merged[j].Id })
+
+	return merged
+}
+
+// FilterServiceAlerts returns the alerts informing about the route number and
+// stop, given as either its number or id, that are active at the instant. An
+// empty route or stop matches every alert and a zero instant matches alerts
+// whether they are active or not
+func FilterServiceAlerts(alerts []ServiceAlert, routeNum string, stop string, instant time.Time) []ServiceAlert {
+
+	filtered := []ServiceAlert{}
+	for _, alert := range alerts {
+		if !instant.IsZero() && !alert.ActiveAt(instant) {
+			continue
+		}
+		for _, entity := range alert.InformedEntities {
+			if (routeNum == "" || entity.RouteNum == routeNum) &&
+				(stop == "" || entity.StopNumber == stop || entity.StopId == stop) {
+				filtered = append(filtered, alert)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+// GetAlerts returns the service alerts active now, which can be narrowed down
+// to a route number with the route query parameter and to a stop number or id
+// with the stop query parameter. Alerts that aren't active are included when
+// the active query parameter is false
+func GetAlerts(c *gin.Context) {
+
+	instant := time.Now()
+	if active := c.Query("active"); active != "" {
+		activeOnly, err := strconv.ParseBool(active)
+		if err != nil {
+			c.IndentedJSON(http.StatusBadRequest, "Invalid active parameter in request, expected true or false")
+			return
+		}
+		if !activeOnly {
+			instant = time.Time{}
+		}
+	}
+
+	alerts, err := alertStore().FindAlerts(c.Request.Context())
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not find service alerts", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Service alerts could not be found")
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, FilterServiceAlerts(alerts, strings.TrimSpace(c.Query("route")),
+		strings.TrimSpace(c.Query("stop")), instant))
+}
+
+// PostAlerts stores the service alerts in the GTFS-R feed given as JSON in the
+// request body, as described by IngestServiceAlerts
+func PostAlerts(c *gin.Context) {
+
+	var feed FeedMessage
+	if err := c.ShouldBindJSON(&feed); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid GTFS-R feed in request: "+err.Error())
+		return
+	}
+
+	stored, err := IngestServiceAlerts(c.Request.Context(), feed, alertStore())
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not store service alerts", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Service alerts could not be stored")
+		return
+	}
+
+	LoggerFromContext(c.Request.Context()).Info("service alerts ingested", "alerts", stored)
+	c.IndentedJSON(http.StatusOK, gin.H{"alerts": stored})
+}
+
+// MemoryAlertStore is an AlertStore keeping alerts in memory, used within tests
+// and when the api runs without Mongo
+type MemoryAlertStore struct {
+	lock   sync.RWMutex
+	alerts []ServiceAlert
+}
+
+// NewMemoryAlertStore returns an empty MemoryAlertStore
+func NewMemoryAlertStore() *MemoryAlertStore {
+	return &MemoryAlertStore{alerts: []ServiceAlert{}}
+}
+
+// ReplaceAlerts swaps every stored alert for the ones given
+func (store *MemoryAlertStore) ReplaceAlerts(ctx context.Context, alerts []ServiceAlert) error {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.alerts = append([]ServiceAlert{}, alerts...)
+	return nil
+}
+
+// FindAlerts returns every stored alert
+func (store *MemoryAlertStore) FindAlerts(ctx context.Context) ([]ServiceAlert, error) {
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return append([]ServiceAlert{}, store.alerts...), nil
+}
+
+var sharedAlertStore AlertStore
+var sharedAlertStoreOnce sync.Once
+
+// alertStore returns the AlertStore shared by the whole package, creating it
+// from the alerts configuration the first time it is called unless
+// SetAlertStore has already been used to provide one
+func alertStore() AlertStore {
+	sharedAlertStoreOnce.Do(func() {
+		if sharedAlertStore == nil {
+			sharedAlertStore = newAlertStore(currentConfig.Alerts)
+		}
+	})
+	return sharedAlertStore
+}
+
+// SetAlertStore replaces the AlertStore shared by the package, which allows the
+// store to be chosen at startup or swapped out within tests
+func SetAlertStore(store AlertStore) {
+	sharedAlertStoreOnce.Do(func() {})
+	sharedAlertStore = store
+}
+
+// newAlertStore creates the store described by the alerts configuration, which
+// may be "mongo" (the default) or "memory"
+func newAlertStore(alertsConfig AlertsConfig) AlertStore {
+
+	if strings.ToLower(alertsConfig.Store) == "memory" {
+		return NewMemoryAlertStore()
+	}
+
+	return NewMongoAlertStore(currentConfig.Mongo.Collections.ServiceAlerts)
+}
@@ -0,0 +1,70 @@
+package databaseQueries
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoAlertStore is an AlertStore keeping one document per alert in a Mongo
+// collection, keyed by the id of the alert in the feed
+type MongoAlertStore struct {
+	collection string
+}
+
+// NewMongoAlertStore returns a MongoAlertStore using the named collection
+func NewMongoAlertStore(collection string) *MongoAlertStore {
+	return &MongoAlertStore{collection: collection}
+}
+
+// ReplaceAlerts swaps every stored alert for the ones given. Each alert is
+// upserted before the alerts no longer in the feed are deleted, so the
+// collection is never left empty while it is being updated
+func (store *MongoAlertStore) ReplaceAlerts(requestCtx context.Context, alerts []ServiceAlert) error {
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, store.collection)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	ids := bson.A{}
+	var writes []mongo.WriteModel
+	for _, alert := range alerts {
+		ids = append(ids, alert.Id)
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: alert.Id}}).
+			SetReplacement(alert).
+			SetUpsert(true))
+	}
+	if len(writes) > 0 {
+		if _, err = collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+
+	_, err = collection.DeleteMany(ctx, bson.D{{Key: "_id", Value: bson.D{{Key: "$nin", Value: ids}}}})
+	return err
+}
+
+// FindAlerts returns every stored alert
+func (store *MongoAlertStore) FindAlerts(requestCtx context.Context) ([]ServiceAlert, error) {
+
+	alerts := []ServiceAlert{}
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, store.collection)
+	if err != nil {
+		return alerts, err
+	}
+	defer disconnect()
+
+	cursor, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return alerts, err
+	}
+	err = cursor.All(ctx, &alerts)
+
+	return alerts, err
+}
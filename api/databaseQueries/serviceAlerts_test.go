@@ -0,0 +1,130 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testFeedReferences resolves the route and stop of testAlertFeed
+func testFeedReferences(ctx context.Context, routeIds []string, tripIds []string,
+	stopIds []string) (feedReferences, error) {
+
+	return feedReferences{
+		RouteNums:     map[string]string{},
+		TripRouteNums: map[string]string{"trip-39": "39A"},
+		StopNumbers:   map[string]string{"8250DB002039": "2039"},
+	}, nil
+}
+
+func TestParseServiceAlerts(t *testing.T) {
+
+	var feed FeedMessage
+	json.Unmarshal([]byte(testAlertFeed), &feed)
+
+	alerts, deleted := ParseServiceAlerts(feed)
+	if len(alerts) != 1 || len(deleted) != 1 || deleted[0] != "alert-2" {
+		t.Log("Expected one alert and one deleted alert, got", alerts, deleted)
+		t.FailNow()
+	}
+
+	alert := alerts[0]
+	if alert.Id != "alert-1" || alert.Effect != "DETOUR" || alert.Header != "Diversion" ||
+		len(alert.InformedEntities) != 2 || len(alert.ActivePeriods) != 1 {
+		t.Log("Expected the alert to be read from the feed, got", alert)
+		t.Fail()
+	}
+	if !alert.ActiveAt(time.Unix(1655300000, 0)) || alert.ActiveAt(time.Unix(1655362800, 0)) {
+		t.Log("Expected the alert to be active from its start until its end")
+		t.Fail()
+	}
+}
+
+func TestResolveAlertEntities(t *testing.T) {
+
+	alerts := []ServiceAlert{{Id: "a", InformedEntities: []AlertEntity{
+		{RouteId: "60-46A-b12-1"},
+		{RouteId: "3249_46681"},
+		{TripId: "trip-39"},
+		{StopId: "8250DB002039"},
+	}}}
+	references, _ := testFeedReferences(context.Background(), nil, nil, nil)
+	references.RouteNums["3249_46681"] = "145"
+
+	entities := ResolveAlertEntities(alerts, references)[0].InformedEntities
+	if entities[0].RouteNum != "46A" || entities[1].RouteNum != "145" || entities[2].RouteNum != "39A" ||
+		entities[3].StopNumber != "2039" {
+		t.Log("Expected route and stop numbers to be resolved, got", entities)
+		t.Fail()
+	}
+}
+
+func TestIngestServiceAlerts(t *testing.T) {
+
+	resolveFeedReferences = testFeedReferences
+	defer func() { resolveFeedReferences = FindFeedReferences }()
+
+	store := NewMemoryAlertStore()
+	store.ReplaceAlerts(context.Background(), []ServiceAlert{{Id: "alert-2"}, {Id: "alert-3"}})
+
+	var feed FeedMessage
+	json.Unmarshal([]byte(testAlertFeed), &feed)
+	feed.Header.Incrementality = "DIFFERENTIAL"
+
+	stored, err := IngestServiceAlerts(context.Background(), feed, store)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	alerts, _ := store.FindAlerts(context.Background())
+	if stored != 2 || len(alerts) != 2 || alerts[0].Id != "alert-1" || alerts[1].Id != "alert-3" {
+		t.Log("Expected a differential feed to add alert-1 and delete alert-2, got", alerts)
+		t.Fail()
+	}
+	if alerts[0].InformedEntities[1].StopNumber != "2039" {
+		t.Log("Expected the stop number to be resolved, got", alerts[0].InformedEntities)
+		t.Fail()
+	}
+
+	feed.Header.Incrementality = "FULL_DATASET"
+	IngestServiceAlerts(context.Background(), feed, store)
+	alerts, _ = store.FindAlerts(context.Background())
+	if len(alerts) != 1 || alerts[0].Id != "alert-1" {
+		t.Log("Expected a full feed to replace every alert, got", alerts)
+		t.Fail()
+	}
+}
+
+func TestFilterServiceAlerts(t *testing.T) {
+
+	end := time.Date(2022, time.June, 15, 12, 0, 0, 0, time.UTC)
+	alerts := []ServiceAlert{
+		{Id: "route", InformedEntities: []AlertEntity{{RouteId: "r", RouteNum: "46A"}}},
+		{Id: "stop", InformedEntities: []AlertEntity{{StopId: "8250DB002039", StopNumber: "2039"}}},
+		{Id: "ended", ActivePeriods: []AlertPeriod{{End: &end}},
+			InformedEntities: []AlertEntity{{RouteId: "r", RouteNum: "46A"}}},
+	}
+	now := time.Date(2022, time.June, 16, 8, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		route    string
+		stop     string
+		instant  time.Time
+		expected int
+	}{
+		{"", "", now, 2},
+		{"", "", time.Time{}, 3},
+		{"46A", "", now, 1},
+		{"", "2039", now, 1},
+		{"", "8250DB002039", now, 1},
+		{"145", "", now, 0},
+	}
+
+	for _, testCase := range cases {
+		if filtered := FilterServiceAlerts(alerts, testCase.route, testCase.stop, testCase.instant); len(filtered) != testCase.expected {
+			t.Log("Expected", testCase.expected, "alerts for", testCase.route, testCase.stop, "got", filtered)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// cacheKindServiceIds is the kind of cached result holding the distinct service
+// ids of the timetable
+const cacheKindServiceIds = "service_ids"
+
+// gtfsCalendarDays are the columns of GTFS calendar.txt for each day of the
+// week, indexed by time.Weekday
+var gtfsCalendarDays = [7]string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+
+// mondayToFriday are the days of the week that weekday services run on
+var mondayToFriday = []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}
+
+// serviceIdWords are the words of a service id that give the days it runs on,
+// used when the calendar files don't know the service. Words are split on
+// anything other than a letter or digit, so "Sat" and "mon-fri" are both read
+var serviceIdWords = map[string][]time.Weekday{
+	"weekday":   mondayToFriday,
+	"weekdays":  mondayToFriday,
+	"wkdy":      mondayToFriday,
+	"mf":        mondayToFriday,
+	"daily":     append([]time.Weekday{time.Sunday, time.Saturday}, mondayToFriday...),
+	"mon":       {time.Monday},
+	"monday":    {time.Monday},
+	"tue":       {time.Tuesday},
+	"tues":      {time.Tuesday},
+	"tuesday":   {time.Tuesday},
+	"wed":       {time.Wednesday},
+	"wednesday": {time.Wednesday},
+	"thu":       {time.Thursday},
+	"thur":      {time.Thursday},
+	"thurs":     {time.Thursday},
+	"thursday":  {time.Thursday},
+	"fri":       {time.Friday},
+	"friday":    {time.Friday},
+	"sat":       {time.Saturday},
+	"saturday":  {time.Saturday},
+	"sun":       {time.Sunday},
+	"sunday":    {time.Sunday},
+}
+
+// serviceIdDays returns the days of the week a service runs on as given by the
+// words of its id, such as "weekday" or "sat". A range of days written as
+// "mon-fri" covers the days between. It reports false when no word of the id
+// names a day
+func serviceIdDays(serviceId string) ([7]bool, bool) {
+
+	var days [7]bool
+	serviceId = strings.ToLower(serviceId)
+	words := strings.FieldsFunc(serviceId, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	found := false
+	for index, word := range words {
+		weekdays, ok := serviceIdWords[word]
+		if !ok {
+			continue
+		}
+		found = true
+		for _, weekday := range weekdays {
+			days[weekday] = true
+		}
+		// A single day followed by a dash and another is a range
+		if index+1 < len(words) && len(weekdays) == 1 && strings.Contains(serviceId, word+"-"+words[index+1]) {
+			if last, ok := serviceIdWords[words[index+1]]; ok && len(last) == 1 {
+				for weekday := weekdays[0]; weekday != last[0]; weekday = (weekday + 1) % 7 {
+					days[weekday] = true
+				}
+			}
+		}
+	}
+
+	return days, found
+}
+
+// gtfsService is a service in GTFS calendar.txt, running on the days of the
+// week flagged between its start and end dates, formatted as YYYYMMDD
+type gtfsService struct {
+	days  [7]bool
+	start string
+	end   string
+}
+
+// ServiceCalendar knows which GTFS services run on each service date, from the
+// services in calendar.txt and their exceptions in calendar_dates.txt. Services
+// listed as school term services only run while schools are open
+type ServiceCalendar struct {
+	services           map[string]gtfsService
+	exceptions         map[string]map[string]bool
+	schoolTermServices map[string]bool
+}
+
+// NewServiceCalendar returns an empty ServiceCalendar, which lets every service
+// run on every date
+func NewServiceCalendar() *ServiceCalendar {
+	return &ServiceCalendar{
+		services:           map[string]gtfsService{},
+		exceptions:         map[string]map[string]bool{},
+		schoolTermServices: map[string]bool{},
+	}
+}
+
+// Len returns the number of services known from either file
+func (calendar *ServiceCalendar) Len() int {
+
+	if calendar == nil {
+		return 0
+	}
+
+	known := len(calendar.services)
+	for serviceId := range calendar.exceptions {
+		if _, ok := calendar.services[serviceId]; !ok {
+			known++
+		}
+	}
+
+	return known
+}
+
+// RunsOn reports whether the service runs on the service date. An exception in
+// calendar_dates.txt always wins. Otherwise the service must cover the date and
+// run on the weekday whose timetable the day calendar says runs that date, so
+// that public holidays run the Sunday services. School term services don't run
+// outside of term. Services the calendar knows nothing about, which is every
+// service when no calendar files are loaded, run on the days named in their id
+// as read by serviceIdDays, again mapping holidays to Sunday. Only those whose
+// id names no day are taken to run every day
+func (calendar *ServiceCalendar) RunsOn(serviceId string, serviceDate time.Time, days DayCalendar) bool {
+
+	if calendar != nil {
+		if calendar.schoolTermServices[serviceId] && !days.IsSchoolTerm(serviceDate) {
+			return false
+		}
+
+		date := serviceDate.Format(feedDateLayout)
+		if added, ok := calendar.exceptions[serviceId][date]; ok {
+			return added
+		}
+
+		if service, ok := calendar.services[serviceId]; ok {
+			return date >= service.start && date <= service.end && service.days[days.ServiceWeekday(serviceDate)]
+		}
+		if _, hasExceptions := calendar.exceptions[serviceId]; hasExceptions {
+			return false
+		}
+	}
+
+	if weekdays, ok := serviceIdDays(serviceId); ok {
+		return weekdays[days.ServiceWeekday(serviceDate)]
+	}
+
+	return true
+}
+
+// readGTFSTable reads a GTFS file, calling row with a function returning the
+// value of a column in each row. The header must hold every required column
+func readGTFSTable(reader io.Reader, required []string, row func(field func(string) string)) error {
+
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for index, name := range header {
+		// GTFS files are often saved with a byte order mark before the first column
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = index
+	}
+	for _, name := range required {
+		if _, ok := columns[name]; !ok {
+			return errors.New("missing the " + name + " column")
+		}
+	}
+
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		row(func(name string) string {
+			index, ok := columns[name]
+			if !ok || index >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[index])
+		})
+	}
+}
+
+// ReadServiceCalendar reads a GTFS calendar.txt file and, if it isn't nil, a
+// calendar_dates.txt file, marking the given services as school term services
+func ReadServiceCalendar(services io.Reader, serviceDates io.Reader,
+	schoolTermServices []string) (*ServiceCalendar, error) {
+
+	calendar := NewServiceCalendar()
+	for _, serviceId := range schoolTermServices {
+		calendar.schoolTermServices[serviceId] = true
+	}
+
+	if services != nil {
+		required := append([]string{"service_id", "start_date", "end_date"}, gtfsCalendarDays[:]...)
+		err := readGTFSTable(services, required, func(field func(string) string) {
+			service := gtfsService{start: field("start_date"), end: field("end_date")}
+			for weekday, name := range gtfsCalendarDays {
+				service.days[weekday] = field(name) == "1"
+			}
+			calendar.services[field("service_id")] = service
+		})
+		if err != nil {
+			return nil, errors.New("invalid calendar.txt: " + err.Error())
+		}
+	}
+
+	if serviceDates != nil {
+		err := readGTFSTable(serviceDates, []string{"service_id", "date", "exception_type"},
+			func(field func(string) string) {
+				serviceId := field("service_id")
+				if calendar.exceptions[serviceId] == nil {
+					calendar.exceptions[serviceId] = map[string]bool{}
+				}
+				// Exception type 1 adds the service on the date and 2 removes it
+				calendar.exceptions[serviceId][field("date")] = field("exception_type") == "1"
+			})
+		if err != nil {
+			return nil, errors.New("invalid calendar_dates.txt: " + err.Error())
+		}
+	}
+
+	return calendar, nil
+}
+
+// LoadServiceCalendar reads the calendar.txt and calendar_dates.txt files named
+// in the configuration, either of which may be left out
+func LoadServiceCalendar(calendarConfig CalendarConfig) (*ServiceCalendar, error) {
+
+	var readers []io.Reader
+	for _, path := range []string{calendarConfig.ServicesFile, calendarConfig.ServiceDatesFile} {
+		if path == "" {
+			readers = append(readers, nil)
+			continue
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	return ReadServiceCalendar(readers[0], readers[1], calendarConfig.SchoolTermServices)
+}
+
+// loadConfiguredServiceCalendar loads the service calendar named in the
+// configuration, logging rather than failing if it can't be read so that every
+// service runs every day as before
+func loadConfiguredServiceCalendar(calendarConfig CalendarConfig) *ServiceCalendar {
+
+	calendar, err := LoadServiceCalendar(calendarConfig)
+	if err != nil {
+		defaultLogger.Error("could not load the service calendar", "file", calendarConfig.ServicesFile,
+			"dates_file", calendarConfig.ServiceDatesFile, "error", err)
+		return NewServiceCalendar()
+	}
+
+	if calendar.Len() > 0 {
+		defaultLogger.Info("loaded service calendar", "file", calendarConfig.ServicesFile, "services",
+			calendar.Len())
+	}
+	return calendar
+}
+
+var sharedServiceCalendar *ServiceCalendar
+var sharedServiceCalendarOnce sync.Once
+
+// serviceCalendar returns the ServiceCalendar shared by the package, loading it
+// from the configured files the first time it is called unless
+// SetServiceCalendar has already been used to provide it
+func serviceCalendar() *ServiceCalendar {
+	sharedServiceCalendarOnce.Do(func() {
+		if sharedServiceCalendar == nil {
+			sharedServiceCalendar = loadConfiguredServiceCalendar(currentConfig.Calendar)
+		}
+	})
+	return sharedServiceCalendar
+}
+
+// SetServiceCalendar replaces the ServiceCalendar shared by the package
+func SetServiceCalendar(calendar *ServiceCalendar) {
+	sharedServiceCalendarOnce.Do(func() {})
+	sharedServiceCalendar = calendar
+}
+
+// timetableServiceIdsFinder is the signature of TimetableServiceIds, which
+// findTimetableServiceIds is set to outside of tests
+type timetableServiceIdsFinder func(ctx context.Context, collection *mongo.Collection) ([]string, error)
+
+var findTimetableServiceIds timetableServiceIdsFinder = TimetableServiceIds
+
+// TimetableServiceIds takes in the context of the request and the trips_n_stops
+// collection and returns the distinct service ids of the timetable, with any
+// stored as numbers given as strings. They are cached against the timetable
+// generation
+func TimetableServiceIds(ctx context.Context, collection *mongo.Collection) ([]string, error) {
+
+	serviceIds := []string{}
+	cacheKey := resultCache().TimetableKey("services")
+	if !resultCache().GetJSON(cacheKindServiceIds, cacheKey, &serviceIds) {
+		values, err := collection.Distinct(ctx, "service_id", bson.D{})
+		if err != nil {
+			return nil, err
+		}
+		serviceIds = serviceIdStrings(values)
+		resultCache().SetJSON(cacheKindServiceIds, cacheKey, serviceIds, RouteCatalogueCacheTTL)
+	}
+
+	return serviceIds, nil
+}
+
+// serviceIdStrings returns the distinct service_id values of the timetable as
+// strings, leaving out only those that are missing
+func serviceIdStrings(values []interface{}) []string {
+
+	serviceIds := []string{}
+	for _, value := range values {
+		switch serviceId := value.(type) {
+		case nil:
+		case string:
+			serviceIds = append(serviceIds, serviceId)
+		default:
+			serviceIds = append(serviceIds, fmt.Sprint(serviceId))
+		}
+	}
+
+	return serviceIds
+}
+
+// RunningServiceIds takes in the context of the request, the trips_n_stops
+// collection and a service date and returns the ids of the services in the
+// timetable that run on that date according to the shared service and day
+// calendars
+func RunningServiceIds(ctx context.Context, collection *mongo.Collection, serviceDate time.Time) ([]string, error) {
+
+	serviceIds, err := findTimetableServiceIds(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+
+	return runningServices(serviceIds, serviceDate), nil
+}
+
+// runningServices returns those of the service ids that run on the service date
+func runningServices(serviceIds []string, serviceDate time.Time) []string {
+
+	running := []string{}
+	for _, serviceId := range serviceIds {
+		if serviceCalendar().RunsOn(serviceId, serviceDate, dayCalendar()) {
+			running = append(running, serviceId)
+		}
+	}
+
+	return running
+}
+
+// serviceDateFilter returns the match on trips whose service runs on any of the
+// service dates, to be added to a trips_n_stops query. Service ids stored as
+// numbers are matched by value as well. Should the services not be found, or
+// the timetable have none, nothing is filtered, as before calendars
+func serviceDateFilter(ctx context.Context, collection *mongo.Collection, serviceDates ...time.Time) bson.D {
+
+	serviceIds, err := findTimetableServiceIds(ctx, collection)
+	if err != nil {
+		LoggerFromContext(ctx).Error("could not find the services of the timetable", "error", err)
+		return bson.D{}
+	}
+	if len(serviceIds) == 0 {
+		return bson.D{}
+	}
+
+	running := bson.A{}
+	for _, serviceDate := range serviceDates {
+		for _, serviceId := range runningServices(serviceIds, serviceDate) {
+			running = append(running, serviceId)
+			if number, err := strconv.ParseInt(serviceId, 10, 64); err == nil {
+				running = append(running, number)
+			}
+		}
+	}
+
+	return bson.D{{Key: "service_id", Value: bson.D{{Key: "$in", Value: running}}}}
+}
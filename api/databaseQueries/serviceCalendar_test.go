@@ -0,0 +1,176 @@
+package databaseQueries
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const testServices = "\ufeffservice_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\n" +
+	"weekday,1,1,1,1,1,0,0,20220101,20221231\n" +
+	"sunday,0,0,0,0,0,0,1,20220101,20221231\n" +
+	"school,1,1,1,1,1,0,0,20220101,20221231\n"
+
+const testServiceDates = "service_id,date,exception_type\n" +
+	"weekday,20220606,1\n" +
+	"sunday,20220606,2\n" +
+	"extra,20220611,1\n"
+
+func TestServiceCalendarRunsOn(t *testing.T) {
+
+	calendar, err := ReadServiceCalendar(strings.NewReader(testServices), strings.NewReader(testServiceDates),
+		[]string{"school"})
+	if err != nil {
+		t.Log("Expected the service calendar to be read but got", err)
+		t.FailNow()
+	}
+	if calendar.Len() != 4 {
+		t.Log("Expected 4 services, got", calendar.Len())
+		t.Fail()
+	}
+
+	days := testCalendar(t)
+	for _, test := range []struct {
+		service  string
+		date     string
+		expected bool
+	}{
+		// St Patrick's Day on a Thursday runs the Sunday timetable
+		{"weekday", "2022-03-17", false},
+		{"sunday", "2022-03-17", true},
+		{"weekday", "2022-03-16", true},
+		// School term services don't run in July
+		{"school", "2022-06-07", true},
+		{"school", "2022-07-05", false},
+		// Exceptions win over the holiday
+		{"weekday", "2022-06-06", true},
+		{"sunday", "2022-06-06", false},
+		{"extra", "2022-06-11", true},
+		{"extra", "2022-06-12", false},
+		{"weekday", "2023-01-03", false},
+		{"unknown", "2022-03-17", true},
+	} {
+		date, _ := time.ParseInLocation(analyticsDateLayout, test.date, dublinLocation)
+		if calendar.RunsOn(test.service, date, days) != test.expected {
+			t.Log("Expected service", test.service, "running on", test.date, "to be", test.expected)
+			t.Fail()
+		}
+	}
+
+	// Without calendar files the days are read from the service ids, with St
+	// Patrick's Day still running the Sunday services
+	for _, calendar := range []*ServiceCalendar{nil, NewServiceCalendar()} {
+		for _, test := range []struct {
+			service  string
+			date     string
+			expected bool
+		}{
+			{"Weekday", "2022-03-16", true},
+			{"Weekday", "2022-03-17", false},
+			{"y1001-Sun", "2022-03-17", true},
+			{"sat", "2022-03-19", true},
+			{"sat", "2022-03-18", false},
+			{"mon-wed", "2022-03-15", true},
+			{"mon-wed", "2022-03-18", false},
+			{"1023", "2022-03-17", true},
+		} {
+			date, _ := time.ParseInLocation(analyticsDateLayout, test.date, dublinLocation)
+			if calendar.RunsOn(test.service, date, days) != test.expected {
+				t.Log("Expected service", test.service, "running on", test.date, "without a calendar to be",
+					test.expected)
+				t.Fail()
+			}
+		}
+	}
+}
+
+func TestServiceIdDays(t *testing.T) {
+
+	for _, test := range []struct {
+		serviceId string
+		weekdays  []time.Weekday
+	}{
+		{"y1001-Sun", []time.Weekday{time.Sunday}},
+		{"sunday", []time.Weekday{time.Sunday}},
+		{"mon", []time.Weekday{time.Monday}},
+		{"Monday", []time.Weekday{time.Monday}},
+		{"tue", []time.Weekday{time.Tuesday}},
+		{"tues", []time.Weekday{time.Tuesday}},
+		{"tuesday", []time.Weekday{time.Tuesday}},
+		{"wed", []time.Weekday{time.Wednesday}},
+		{"wednesday", []time.Weekday{time.Wednesday}},
+		{"thu", []time.Weekday{time.Thursday}},
+		{"thur", []time.Weekday{time.Thursday}},
+		{"thurs", []time.Weekday{time.Thursday}},
+		{"thursday", []time.Weekday{time.Thursday}},
+		{"fri", []time.Weekday{time.Friday}},
+		{"friday", []time.Weekday{time.Friday}},
+		{"sat", []time.Weekday{time.Saturday}},
+		{"y1002-Saturday", []time.Weekday{time.Saturday}},
+		{"weekday", mondayToFriday},
+		{"weekdays", mondayToFriday},
+		{"wkdy", mondayToFriday},
+		{"MF", mondayToFriday},
+		{"tues-thurs", []time.Weekday{time.Tuesday, time.Wednesday, time.Thursday}},
+	} {
+		days, ok := serviceIdDays(test.serviceId)
+		var expected [7]bool
+		for _, weekday := range test.weekdays {
+			expected[weekday] = true
+		}
+		if !ok || days != expected {
+			t.Log("Expected service", test.serviceId, "to run on", test.weekdays, "got", days, ok)
+			t.Fail()
+		}
+	}
+
+	if _, ok := serviceIdDays("1023"); ok {
+		t.Log("Expected a service id without a day in it to give no days")
+		t.Fail()
+	}
+}
+
+func TestServiceDateFilter(t *testing.T) {
+
+	serviceIds := serviceIdStrings([]interface{}{"sat", int32(1023), nil, "sun"})
+	if strings.Join(serviceIds, ",") != "sat,1023,sun" {
+		t.Log("Expected service ids stored as numbers to be read as strings, got", serviceIds)
+		t.Fail()
+	}
+
+	findTimetableServiceIds = func(ctx context.Context, collection *mongo.Collection) ([]string, error) {
+		return serviceIds, nil
+	}
+	defer func() {
+		findTimetableServiceIds = TimetableServiceIds
+	}()
+
+	saturday := time.Date(2022, 6, 18, 0, 0, 0, 0, dublinLocation)
+	filter := serviceDateFilter(context.Background(), nil, saturday)
+	expected := bson.D{{Key: "service_id", Value: bson.D{{Key: "$in", Value: bson.A{"sat", "1023", int64(1023)}}}}}
+	if !reflect.DeepEqual(filter, expected) {
+		t.Log("Expected the services running on Saturday to be matched, got", filter)
+		t.Fail()
+	}
+
+	// A timetable without service ids is left unfiltered rather than emptied
+	serviceIds = []string{}
+	if filter = serviceDateFilter(context.Background(), nil, saturday); len(filter) != 0 {
+		t.Log("Expected nothing to be filtered without service ids, got", filter)
+		t.Fail()
+	}
+}
+
+func TestReadServiceCalendarRefusesMissingColumns(t *testing.T) {
+
+	_, err := ReadServiceCalendar(strings.NewReader("service_id,monday\nweekday,1\n"), nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "calendar.txt") {
+		t.Log("Expected calendar.txt to be refused, got", err)
+		t.Fail()
+	}
+}
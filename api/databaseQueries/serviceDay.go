@@ -0,0 +1,149 @@
+package databaseQueries
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	// Embedded zone database so that Europe/Dublin can be loaded even when the
+	// container image does not ship with tzdata installed
+	_ "time/tzdata"
+)
+
+// RequestTimeLayout is the layout of the date strings passed in through the
+// api and passed on to the prediction service, i.e. "yyyy-MM-dd hh:mm:ss"
+const RequestTimeLayout = "2006-01-02 15:04:05"
+
+// dublinLocation is the time zone that all request times, timetable times and
+// prediction features are interpreted in regardless of the zone of the host
+var dublinLocation = loadDublinLocation()
+
+// requestTimeLayoutsWithOffset are the layouts accepted by ParseRequestTime
+// that carry an explicit UTC offset and so are converted into Dublin time
+var requestTimeLayoutsWithOffset = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02 15:04Z07:00",
+}
+
+// requestTimeLayoutsNaive are the layouts accepted by ParseRequestTime that
+// have no offset and are read as wall clock time in Dublin
+var requestTimeLayoutsNaive = []string{
+	RequestTimeLayout,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04",
+}
+
+// loadDublinLocation loads the Europe/Dublin time zone and is only used to
+// initialise dublinLocation. Given the embedded zone database this should never
+// fail, but if it does the error is logged and UTC is used instead
+func loadDublinLocation() *time.Location {
+
+	location, err := time.LoadLocation("Europe/Dublin")
+	if err != nil {
+		defaultLogger.Error("could not load Europe/Dublin time zone, falling back to UTC", "error", err)
+		return time.UTC
+	}
+
+	return location
+}
+
+// DublinLocation returns the Europe/Dublin time zone used throughout the
+// backend for interpreting request times and timetable times
+func DublinLocation() *time.Location {
+	return dublinLocation
+}
+
+// ParseRequestTime takes in the date string passed into an api request and
+// returns it as a time.Time in Dublin time. Strings in the format
+// "yyyy-MM-dd hh:mm:ss" (or without seconds, or with a 'T' separator) that
+// carry no offset are read as wall clock time in Dublin, while strings with an
+// explicit offset such as "2022-10-30T00:30:00Z" are converted into Dublin time
+// so that the weekday and hour of the request are those seen in Dublin
+func ParseRequestTime(date string) (time.Time, error) {
+
+	date = strings.TrimSpace(date)
+
+	for _, layout := range requestTimeLayoutsWithOffset {
+		parsedTime, err := time.Parse(layout, date)
+		if err == nil {
+			return parsedTime.In(dublinLocation), nil
+		}
+	}
+
+	for _, layout := range requestTimeLayoutsNaive {
+		parsedTime, err := time.ParseInLocation(layout, date, dublinLocation)
+		if err == nil {
+			return parsedTime, nil
+		}
+	}
+
+	return time.Time{}, errors.New("invalid time '" + date + "', expected format yyyy-MM-dd hh:mm:ss")
+}
+
+// FormatRequestTime takes in a time and returns it in the "yyyy-MM-dd hh:mm:ss"
+// format as Dublin wall clock time. This is the format that the rest of the
+// route matching functions and the prediction service expect
+func FormatRequestTime(requestTime time.Time) string {
+	return requestTime.In(dublinLocation).Format(RequestTimeLayout)
+}
+
+// NormaliseRequestTime parses a date string from an api request using
+// ParseRequestTime and returns it reformatted in Dublin time using
+// FormatRequestTime, or an error if the date could not be parsed
+func NormaliseRequestTime(date string) (string, error) {
+
+	requestTime, err := ParseRequestTime(date)
+	if err != nil {
+		return "", err
+	}
+
+	return FormatRequestTime(requestTime), nil
+}
+
+// ServiceDayStart takes in a service date and returns the instant that GTFS
+// timetable times on that date are measured from. As per the GTFS reference,
+// this is "noon minus 12h" in Dublin rather than midnight, which means that it is
+// an hour before or after midnight on the days that the clocks change, while
+// timetable times still read as wall clock time for the rest of the day
+func ServiceDayStart(serviceDate time.Time) time.Time {
+
+	serviceDate = serviceDate.In(dublinLocation)
+	noon := time.Date(serviceDate.Year(), serviceDate.Month(), serviceDate.Day(),
+		12, 0, 0, 0, dublinLocation)
+
+	return noon.Add(-12 * time.Hour)
+}
+
+// ServiceDay takes in an instant and returns the service date it falls on (at
+// midnight in Dublin) along with the number of seconds since the start of that
+// service day, as would appear in the timetable. Normally this is the calendar
+// date in Dublin, but in the hour between midnight and the clocks going back in
+// October the instant is before that day's start and so belongs to the
+// previous service day instead, with a time past 24:00:00
+func ServiceDay(instant time.Time) (time.Time, int64) {
+
+	instant = instant.In(dublinLocation)
+	serviceDate := time.Date(instant.Year(), instant.Month(), instant.Day(),
+		0, 0, 0, 0, dublinLocation)
+
+	secondsSinceStart := int64(instant.Sub(ServiceDayStart(serviceDate)) / time.Second)
+	if secondsSinceStart < 0 {
+		serviceDate = serviceDate.AddDate(0, 0, -1)
+		secondsSinceStart = int64(instant.Sub(ServiceDayStart(serviceDate)) / time.Second)
+	}
+
+	return serviceDate, secondsSinceStart
+}
+
+// ServiceTimeToInstant takes in a service date and a timetable time in the format
+// "hh:mm:ss", which may exceed 24:00:00 for trips running past midnight, and
+// returns the instant that time refers to
+func ServiceTimeToInstant(serviceDate time.Time, serviceTime string) time.Time {
+
+	seconds := convertStringTimeToTotalSeconds(serviceTime)
+
+	return ServiceDayStart(serviceDate).Add(time.Duration(seconds) * time.Second)
+}
@@ -0,0 +1,129 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRequestTime(t *testing.T) {
+
+	naiveTime, err := ParseRequestTime("2022-08-12 07:30:00")
+	if err != nil {
+		t.Log("Naive request time should parse but returned error", err)
+		t.FailNow()
+	}
+	if naiveTime.Location() != DublinLocation() || naiveTime.Hour() != 7 {
+		t.Log("Naive request time should be read as 07:30 in Dublin but was", naiveTime)
+		t.Fail()
+	}
+
+	// 23:30 UTC in summer is 00:30 the following day in Dublin
+	offsetTime, err := ParseRequestTime("2022-08-12T23:30:00Z")
+	if err != nil {
+		t.Log("Request time with offset should parse but returned error", err)
+		t.FailNow()
+	}
+	if offsetTime.Day() != 13 || offsetTime.Hour() != 0 || offsetTime.Minute() != 30 {
+		t.Log("Request time with offset should be 2022-08-13 00:30 in Dublin but was", offsetTime)
+		t.Fail()
+	}
+
+	_, err = ParseRequestTime("12/08/2022")
+	if err == nil {
+		t.Log("Invalid request time should return an error")
+		t.Fail()
+	}
+}
+
+func TestNormaliseRequestTime(t *testing.T) {
+
+	normalisedTime, err := NormaliseRequestTime("2022-12-31T23:59:00+01:00")
+	if err != nil || normalisedTime != "2022-12-31 22:59:00" {
+		t.Log("Normalised time should be '2022-12-31 22:59:00' but is", normalisedTime, err)
+		t.Fail()
+	}
+}
+
+func TestServiceDayStart(t *testing.T) {
+
+	// Clocks go forward at 01:00 on 27 March 2022, so noon minus 12h is 23:00 the day before
+	marchStart := ServiceDayStart(time.Date(2022, 3, 27, 0, 0, 0, 0, DublinLocation()))
+	expectedMarchStart := time.Date(2022, 3, 26, 23, 0, 0, 0, time.UTC)
+	if !marchStart.Equal(expectedMarchStart) {
+		t.Log("March service day start should be", expectedMarchStart, "but is", marchStart.UTC())
+		t.Fail()
+	}
+
+	// Clocks go back at 02:00 on 30 October 2022, so noon minus 12h is 01:00 IST
+	octoberStart := ServiceDayStart(time.Date(2022, 10, 30, 0, 0, 0, 0, DublinLocation()))
+	expectedOctoberStart := time.Date(2022, 10, 30, 0, 0, 0, 0, time.UTC)
+	if !octoberStart.Equal(expectedOctoberStart) {
+		t.Log("October service day start should be", expectedOctoberStart, "but is", octoberStart.UTC())
+		t.Fail()
+	}
+}
+
+func TestServiceDay(t *testing.T) {
+
+	// A departure at 08:00 on the day the clocks go forward reads as 08:00:00
+	// in the timetable even though only seven hours have passed since midnight
+	marchDate, marchSeconds := ServiceDay(time.Date(2022, 3, 27, 8, 0, 0, 0, DublinLocation()))
+	if marchDate.Day() != 27 || marchSeconds != 8*3600 {
+		t.Log("March service day should be the 27th at 28800 seconds but was", marchDate, marchSeconds)
+		t.Fail()
+	}
+
+	octoberDate, octoberSeconds := ServiceDay(time.Date(2022, 10, 30, 8, 0, 0, 0, DublinLocation()))
+	if octoberDate.Day() != 30 || octoberSeconds != 8*3600 {
+		t.Log("October service day should be the 30th at 28800 seconds but was", octoberDate, octoberSeconds)
+		t.Fail()
+	}
+
+	// 00:30 IST on the day the clocks go back is before that day's start and so
+	// belongs to the previous service day at 24:30:00
+	lateDate, lateSeconds := ServiceDay(time.Date(2022, 10, 29, 23, 30, 0, 0, time.UTC))
+	if lateDate.Day() != 29 || lateSeconds != 24*3600+30*60 {
+		t.Log("Late night service day should be the 29th at 88200 seconds but was", lateDate, lateSeconds)
+		t.Fail()
+	}
+
+	instant := ServiceTimeToInstant(lateDate, "24:30:00")
+	if !instant.Equal(time.Date(2022, 10, 29, 23, 30, 0, 0, time.UTC)) {
+		t.Log("Service time 24:30:00 on the 29th should be 23:30 UTC but was", instant.UTC())
+		t.Fail()
+	}
+}
+
+func TestFeatureExtraction(t *testing.T) {
+
+	// Sunday 30 October 2022 00:30 in Dublin expressed in UTC
+	features := FeatureExtraction("2022-10-29T23:30:00Z")
+	if len(features) != 4 {
+		t.Log("Four features should have been extracted but got", features)
+		t.FailNow()
+	}
+	if features[0] != "0" || features[1] != "00" || features[2] != "10" || features[3] != "1800" {
+		t.Log("Features should be [0 00 10 1800] but were", features)
+		t.Fail()
+	}
+
+	features = FeatureExtraction("2022-03-27 08:15:00")
+	if features[0] != "0" || features[1] != "08" || features[2] != "03" || features[3] != "29700" {
+		t.Log("Features should be [0 08 03 29700] but were", features)
+		t.Fail()
+	}
+
+	if len(FeatureExtraction("not a date")) != 0 {
+		t.Log("No features should be extracted from an invalid date")
+		t.Fail()
+	}
+}
+
+func TestDayOfTheWeek(t *testing.T) {
+
+	dayNum := DayOfTheWeek([]string{"2022", "08", "12"}, []string{"23", "30", "00"})
+	if dayNum != "5" {
+		t.Log("12 August 2022 is a Friday so day should be '5' but is", dayNum)
+		t.Fail()
+	}
+}
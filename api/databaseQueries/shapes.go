@@ -0,0 +1,390 @@
+package databaseQueries
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"googlemaps.github.io/maps"
+)
+
+// Formats that the shape of a matched route can be returned in. Points is the
+// original list of ShapeJSON points, polyline is a Google encoded polyline and
+// geojson is a GeoJSON LineString
+const (
+	ShapeFormatPoints   = "points"
+	ShapeFormatPolyline = "polyline"
+	ShapeFormatGeoJSON  = "geojson"
+)
+
+// MaxShapeTolerance is the largest simplification tolerance in metres that can
+// be asked for, beyond which the line no longer follows the roads at all
+const MaxShapeTolerance = 1000.0
+
+// earthRadiusMetres is the mean radius of the earth used for distances
+const earthRadiusMetres = 6371000
+
+// RouteShapeTolerance is the tolerance in metres used when simplifying the shape
+// of a route for the route catalogue. Points closer than this to the simplified
+// line are dropped, which removes most of the points without visibly changing
+// the line at the zoom levels used to show a whole route
+var RouteShapeTolerance = 10.0
+
+// distanceMetres returns the great circle distance in metres between two points
+// using the haversine formula
+func distanceMetres(latA float64, lonA float64, latB float64, lonB float64) float64 {
+
+	radiansLatA := latA * math.Pi / 180
+	radiansLatB := latB * math.Pi / 180
+	deltaLat := (latB - latA) * math.Pi / 180
+	deltaLon := (lonB - lonA) * math.Pi / 180
+
+	haversine := math.Sin(deltaLat/2)*math.Sin(deltaLat/2) +
+		math.Cos(radiansLatA)*math.Cos(radiansLatB)*math.Sin(deltaLon/2)*math.Sin(deltaLon/2)
+
+	return 2 * earthRadiusMetres * math.Atan2(math.Sqrt(haversine), math.Sqrt(1-haversine))
+}
+
+// ShapesToJSON takes in the shape points of a trip as read from Mongo, with
+// their coordinates as strings, and returns them as ShapeJSON points sorted by
+// their sequence number
+func ShapesToJSON(shapePoints []Shape) []ShapeJSON {
+
+	points := make([]ShapeJSON, 0, len(shapePoints))
+	for _, shapePoint := range shapePoints {
+		lat, _ := strconv.ParseFloat(shapePoint.ShapePtLat, 64)
+		lon, _ := strconv.ParseFloat(shapePoint.ShapePtLon, 64)
+		points = append(points, ShapeJSON{
+			ShapePtLat:      lat,
+			ShapePtLon:      lon,
+			ShapePtSequence: shapePoint.ShapePtSequence,
+			ShapeDistTravel: shapePoint.ShapeDistTravel,
+		})
+	}
+
+	sort.SliceStable(points, func(i, j int) bool {
+		sequenceI, _ := strconv.Atoi(points[i].ShapePtSequence)
+		sequenceJ, _ := strconv.Atoi(points[j].ShapePtSequence)
+		return sequenceI < sequenceJ
+	})
+
+	return points
+}
+
+// SimplifyShape takes in the points of a shape and a tolerance in metres and
+// returns the points kept by the Douglas-Peucker algorithm, which always keeps
+// the first and last points and then recursively keeps the point furthest from
+// the line between the points kept so far while it is further than the tolerance
+func SimplifyShape(points []ShapeJSON, toleranceMetres float64) []ShapeJSON {
+
+	if len(points) < 3 || toleranceMetres <= 0 {
+		return points
+	}
+
+	// Points are projected onto a flat plane in metres around the first point,
+	// which is accurate enough over the size of Dublin
+	originLat := points[0].ShapePtLat * math.Pi / 180
+	projected := make([][2]float64, len(points))
+	for index, point := range points {
+		projected[index] = [2]float64{
+			(point.ShapePtLon - points[0].ShapePtLon) * math.Pi / 180 * math.Cos(originLat) * earthRadiusMetres,
+			(point.ShapePtLat - points[0].ShapePtLat) * math.Pi / 180 * earthRadiusMetres,
+		}
+	}
+
+	keep := make([]bool, len(points))
+	keep[0], keep[len(points)-1] = true, true
+
+	// An explicit stack is used rather than recursion as shapes can have
+	// thousands of points
+	stack := [][2]int{{0, len(points) - 1}}
+	for len(stack) > 0 {
+		segment := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		furthestIndex, furthestDistance := -1, toleranceMetres
+		for index := segment[0] + 1; index < segment[1]; index++ {
+			distance := distanceToSegment(projected[index], projected[segment[0]], projected[segment[1]])
+			if distance > furthestDistance {
+				furthestIndex, furthestDistance = index, distance
+			}
+		}
+
+		if furthestIndex >= 0 {
+			keep[furthestIndex] = true
+			stack = append(stack, [2]int{segment[0], furthestIndex}, [2]int{furthestIndex, segment[1]})
+		}
+	}
+
+	simplified := []ShapeJSON{}
+	for index, point := range points {
+		if keep[index] {
+			simplified = append(simplified, point)
+		}
+	}
+
+	return simplified
+}
+
+// distanceToSegment returns the distance from a point to the line segment
+// between start and end, all given as x and y coordinates in metres
+func distanceToSegment(point [2]float64, start [2]float64, end [2]float64) float64 {
+
+	deltaX, deltaY := end[0]-start[0], end[1]-start[1]
+	lengthSquared := deltaX*deltaX + deltaY*deltaY
+	if lengthSquared == 0 {
+		return math.Hypot(point[0]-start[0], point[1]-start[1])
+	}
+
+	position := ((point[0]-start[0])*deltaX + (point[1]-start[1])*deltaY) / lengthSquared
+	position = math.Max(0, math.Min(1, position))
+
+	return math.Hypot(point[0]-(start[0]+position*deltaX), point[1]-(start[1]+position*deltaY))
+}
+
+// GeoJSONGeometry is a GeoJSON geometry. Coordinates are given as longitude
+// then latitude, as GeoJSON requires
+type GeoJSONGeometry struct {
+	Type        string      `bson:"type" json:"type"`
+	Coordinates interface{} `bson:"coordinates" json:"coordinates"`
+}
+
+// NewGeoJSONLineString takes in the points of a shape and returns them as a
+// GeoJSON LineString
+func NewGeoJSONLineString(points []ShapeJSON) GeoJSONGeometry {
+
+	coordinates := make([][2]float64, 0, len(points))
+	for _, point := range points {
+		coordinates = append(coordinates, [2]float64{point.ShapePtLon, point.ShapePtLat})
+	}
+
+	return GeoJSONGeometry{Type: "LineString", Coordinates: coordinates}
+}
+
+// EncodePolyline takes in the points of a shape and returns them as a Google
+// encoded polyline
+func EncodePolyline(points []ShapeJSON) string {
+
+	path := make([]maps.LatLng, 0, len(points))
+	for _, point := range points {
+		path = append(path, maps.LatLng{Lat: point.ShapePtLat, Lng: point.ShapePtLon})
+	}
+
+	return maps.Encode(path)
+}
+
+// ShapeOptions holds the format that route shapes are returned in and the
+// tolerance in metres they are simplified with, where zero leaves them as is
+type ShapeOptions struct {
+	Format    string
+	Tolerance float64
+}
+
+// ParseShapeOptions takes in the shape and tolerance query parameters of a
+// request and returns the ShapeOptions they describe. An empty format means
+// points and an empty tolerance means no simplification
+func ParseShapeOptions(format string, tolerance string) (ShapeOptions, error) {
+
+	options := ShapeOptions{Format: strings.ToLower(strings.TrimSpace(format))}
+
+	switch options.Format {
+	case "":
+		options.Format = ShapeFormatPoints
+	case ShapeFormatPoints, ShapeFormatPolyline, ShapeFormatGeoJSON:
+	default:
+		return options, errors.New("unknown shape format '" + format + "'")
+	}
+
+	if strings.TrimSpace(tolerance) != "" {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(tolerance), 64)
+		if err != nil || math.IsNaN(parsed) || parsed < 0 || parsed > MaxShapeTolerance {
+			return options, errors.New("tolerance must be between 0 and " +
+				strconv.FormatFloat(MaxShapeTolerance, 'f', -1, 64) + " metres")
+		}
+		options.Tolerance = parsed
+	}
+
+	return options, nil
+}
+
+// FormatRouteShapes takes in matched routes and the ShapeOptions of the request
+// and returns the routes with their shapes simplified and in the format asked
+// for. Only the field for that format is filled in
+func FormatRouteShapes(routes []busRouteJSON, options ShapeOptions) []busRouteJSON {
+
+	for index := range routes {
+		points := SimplifyShape(routes[index].Shapes, options.Tolerance)
+
+		switch options.Format {
+		case ShapeFormatPolyline:
+			routes[index].Shapes = nil
+			routes[index].Polyline = EncodePolyline(points)
+		case ShapeFormatGeoJSON:
+			lineString := NewGeoJSONLineString(points)
+			routes[index].Shapes = nil
+			routes[index].ShapeGeoJSON = &lineString
+		default:
+			routes[index].Shapes = points
+		}
+	}
+
+	return routes
+}
+
+// shapeProjection is where a stop falls on a shape, given as the index of the
+// segment of the shape nearest to it and how far along that segment it is from
+// zero to one, along with the point itself
+type shapeProjection struct {
+	segment  int
+	position float64
+	point    ShapeJSON
+}
+
+// CutShapeAtStops takes in the points of a shape and the origin and destination
+// stops and returns the part of the shape between them, starting and ending
+// exactly where each stop projects onto the shape. So that routes that loop back
+// on themselves are cut at the right place, each stop is only projected onto the
+// segments around its distance travelled where the stop and shape have them, and
+// the destination is only looked for after the origin
+func CutShapeAtStops(points []ShapeJSON, originStop BusStop, destinationStop BusStop) []ShapeJSON {
+
+	if len(points) < 2 {
+		return points
+	}
+
+	originLat, _ := strconv.ParseFloat(originStop.StopLat, 64)
+	originLon, _ := strconv.ParseFloat(originStop.StopLon, 64)
+	destinationLat, _ := strconv.ParseFloat(destinationStop.StopLat, 64)
+	destinationLon, _ := strconv.ParseFloat(destinationStop.StopLon, 64)
+
+	originFirst, originLast := shapeSegmentsAround(points, originStop.DistanceTravelled)
+	origin := projectOntoShape(points, originLat, originLon, originFirst, 0, originLast)
+
+	destinationFirst, destinationLast := shapeSegmentsAround(points, destinationStop.DistanceTravelled)
+	fromSegment, fromPosition := origin.segment, origin.position
+	if destinationFirst > fromSegment {
+		fromSegment, fromPosition = destinationFirst, 0
+	}
+	if destinationLast < fromSegment {
+		destinationLast = fromSegment
+	}
+	destination := projectOntoShape(points, destinationLat, destinationLon, fromSegment, fromPosition,
+		destinationLast)
+
+	cut := []ShapeJSON{origin.point}
+	appendPoint := func(point ShapeJSON) {
+		last := cut[len(cut)-1]
+		if last.ShapePtLat != point.ShapePtLat || last.ShapePtLon != point.ShapePtLon {
+			cut = append(cut, point)
+		}
+	}
+	for index := origin.segment + 1; index <= destination.segment; index++ {
+		appendPoint(points[index])
+	}
+	appendPoint(destination.point)
+
+	return cut
+}
+
+// shapeSegmentsAround takes in the points of a shape and the distance travelled
+// of a stop and returns the first and last segments the stop may fall on, those
+// whose distances travelled span that of the stop. The whole shape is returned
+// where the stop or the shape points have no distance travelled, or none of the
+// segments span it
+func shapeSegmentsAround(points []ShapeJSON, distTravelled string) (int, int) {
+
+	lastSegment := len(points) - 2
+	distance, err := strconv.ParseFloat(distTravelled, 64)
+	if err != nil {
+		return 0, lastSegment
+	}
+
+	first, last := -1, -1
+	for segment := 0; segment <= lastSegment; segment++ {
+		start, startErr := strconv.ParseFloat(points[segment].ShapeDistTravel, 64)
+		end, endErr := strconv.ParseFloat(points[segment+1].ShapeDistTravel, 64)
+		if startErr != nil || endErr != nil {
+			return 0, lastSegment
+		}
+		if start <= distance && distance <= end {
+			if first < 0 {
+				first = segment
+			}
+			last = segment
+		}
+	}
+	if first < 0 {
+		return 0, lastSegment
+	}
+
+	return first, last
+}
+
+// projectOntoShape returns the projection of a point onto the nearest segment
+// of the shape from the given segment and position up to the last segment given
+func projectOntoShape(points []ShapeJSON, lat float64, lon float64,
+	fromSegment int, fromPosition float64, lastSegment int) shapeProjection {
+
+	// Points are projected onto a flat plane in metres around the stop
+	scale := math.Cos(lat * math.Pi / 180)
+	project := func(point ShapeJSON) [2]float64 {
+		return [2]float64{
+			(point.ShapePtLon - lon) * math.Pi / 180 * scale * earthRadiusMetres,
+			(point.ShapePtLat - lat) * math.Pi / 180 * earthRadiusMetres,
+		}
+	}
+
+	best := shapeProjection{segment: fromSegment, position: fromPosition}
+	bestDistance := math.Inf(1)
+	for segment := fromSegment; segment <= lastSegment && segment < len(points)-1; segment++ {
+		start, end := project(points[segment]), project(points[segment+1])
+		deltaX, deltaY := end[0]-start[0], end[1]-start[1]
+
+		position := 0.0
+		if lengthSquared := deltaX*deltaX + deltaY*deltaY; lengthSquared > 0 {
+			position = -(start[0]*deltaX + start[1]*deltaY) / lengthSquared
+		}
+		position = math.Max(0, math.Min(1, position))
+		if segment == fromSegment {
+			position = math.Max(position, fromPosition)
+		}
+
+		distance := math.Hypot(start[0]+position*deltaX, start[1]+position*deltaY)
+		if distance < bestDistance {
+			best, bestDistance = shapeProjection{segment: segment, position: position}, distance
+		}
+	}
+
+	best.point = interpolateShapePoint(points[best.segment], points[best.segment+1], best.position)
+	return best
+}
+
+// interpolateShapePoint returns the point the given fraction of the way from
+// start to end. The point takes the sequence number of start, and its distance
+// travelled is interpolated where both points have one
+func interpolateShapePoint(start ShapeJSON, end ShapeJSON, position float64) ShapeJSON {
+
+	switch position {
+	case 0:
+		return start
+	case 1:
+		return end
+	}
+
+	point := ShapeJSON{
+		ShapePtLat:      start.ShapePtLat + (end.ShapePtLat-start.ShapePtLat)*position,
+		ShapePtLon:      start.ShapePtLon + (end.ShapePtLon-start.ShapePtLon)*position,
+		ShapePtSequence: start.ShapePtSequence,
+	}
+
+	startDistance, startErr := strconv.ParseFloat(start.ShapeDistTravel, 64)
+	endDistance, endErr := strconv.ParseFloat(end.ShapeDistTravel, 64)
+	if startErr == nil && endErr == nil {
+		distance := math.Round((startDistance+(endDistance-startDistance)*position)*100) / 100
+		point.ShapeDistTravel = strconv.FormatFloat(distance, 'f', -1, 64)
+	}
+
+	return point
+}
@@ -0,0 +1,171 @@
+package databaseQueries
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestDistanceMetres(t *testing.T) {
+
+	// O'Connell Bridge to St Stephen's Green is roughly 1km
+	distance := distanceMetres(53.34722, -6.25917, 53.33821, -6.25911)
+	if math.Abs(distance-1002) > 10 {
+		t.Log("Expected about 1002 metres but got", distance)
+		t.Fail()
+	}
+}
+
+func TestSimplifyShapeDropsPointsOnStraightLine(t *testing.T) {
+
+	// Points every ~11 metres north along a straight line, with one point
+	// pushed ~70 metres east. The spike and the points either side of it,
+	// which are far from the lines to the tip of the spike, must be kept
+	var points []ShapeJSON
+	for index := 0; index <= 20; index++ {
+		points = append(points, ShapeJSON{ShapePtLat: 53.34 + float64(index)*0.0001, ShapePtLon: -6.26})
+	}
+	points[10].ShapePtLon = -6.259
+
+	simplified := SimplifyShape(points, 10)
+
+	if len(simplified) != 5 {
+		t.Log("Expected the two ends and the spike but got", len(simplified), "points")
+		t.FailNow()
+	}
+	if simplified[0] != points[0] || simplified[1] != points[9] || simplified[2] != points[10] ||
+		simplified[3] != points[11] || simplified[4] != points[20] {
+		t.Log("Unexpected points kept:", simplified)
+		t.Fail()
+	}
+}
+
+func TestShapesToJSONSortsBySequence(t *testing.T) {
+
+	shapePoints := []Shape{
+		{ShapePtLat: "53.2", ShapePtLon: "-6.2", ShapePtSequence: "10"},
+		{ShapePtLat: "53.1", ShapePtLon: "-6.1", ShapePtSequence: "2"},
+	}
+
+	points := ShapesToJSON(shapePoints)
+	if points[0].ShapePtSequence != "2" || points[0].ShapePtLat != 53.1 {
+		t.Log("Shape points should be sorted numerically by sequence:", points)
+		t.Fail()
+	}
+}
+
+func TestCutShapeAtStops(t *testing.T) {
+
+	// A shape running north along a line with a point every ~111 metres, and
+	// stops part way along the first and third segments
+	var points []ShapeJSON
+	for index := 0; index <= 4; index++ {
+		points = append(points, ShapeJSON{
+			ShapePtLat:      53.34 + float64(index)*0.001,
+			ShapePtLon:      -6.26,
+			ShapePtSequence: strconv.Itoa(index + 1),
+			ShapeDistTravel: strconv.Itoa(index * 100),
+		})
+	}
+
+	cut := CutShapeAtStops(points, BusStop{StopLat: "53.3405", StopLon: "-6.2601"},
+		BusStop{StopLat: "53.3425", StopLon: "-6.2599"})
+	if len(cut) != 4 {
+		t.Log("Expected the cut shape to have 4 points but got", cut)
+		t.FailNow()
+	}
+	if math.Abs(cut[0].ShapePtLat-53.3405) > 1e-9 || cut[0].ShapePtLon != -6.26 || cut[0].ShapeDistTravel != "50" ||
+		cut[0].ShapePtSequence != "1" {
+		t.Log("Expected the shape to start at the origin projection but got", cut[0])
+		t.Fail()
+	}
+	if cut[1] != points[1] || cut[2] != points[2] {
+		t.Log("Expected the points between the stops to be kept but got", cut[1:3])
+		t.Fail()
+	}
+	if math.Abs(cut[3].ShapePtLat-53.3425) > 1e-9 || cut[3].ShapeDistTravel != "250" {
+		t.Log("Expected the shape to end at the destination projection but got", cut[3])
+		t.Fail()
+	}
+}
+
+func TestCutShapeAtStopsOnLoop(t *testing.T) {
+
+	// A shape going north and coming back south along the same line, with the
+	// destination just behind the origin. The destination must be found on the way back
+	points := []ShapeJSON{
+		{ShapePtLat: 53.340, ShapePtLon: -6.26, ShapePtSequence: "1"},
+		{ShapePtLat: 53.345, ShapePtLon: -6.26, ShapePtSequence: "2"},
+		{ShapePtLat: 53.340, ShapePtLon: -6.2601},
+	}
+
+	cut := CutShapeAtStops(points, BusStop{StopLat: "53.342", StopLon: "-6.26"},
+		BusStop{StopLat: "53.341", StopLon: "-6.26"})
+	if len(cut) != 3 || cut[1] != points[1] {
+		t.Log("Expected the cut shape to go round the loop but got", cut)
+		t.Fail()
+	}
+
+	// With distances travelled, an origin on the way back that is nearer to the
+	// way out is still placed on the way back
+	points = append(points, ShapeJSON{ShapePtLat: 53.335, ShapePtLon: -6.2601})
+	for index, distance := range []string{"0", "556", "1112", "1668"} {
+		points[index].ShapeDistTravel = distance
+	}
+	cut = CutShapeAtStops(points, BusStop{StopLat: "53.342", StopLon: "-6.26", DistanceTravelled: "890"},
+		BusStop{StopLat: "53.337", StopLon: "-6.2601", DistanceTravelled: "1446"})
+	if len(cut) != 3 || cut[0].ShapePtSequence != points[1].ShapePtSequence || cut[0].ShapePtLon > -6.26 ||
+		cut[1] != points[2] || cut[2].ShapePtLat > 53.3371 {
+		t.Log("Expected the cut shape to start on the way back but got", cut)
+		t.Fail()
+	}
+}
+
+func TestParseShapeOptions(t *testing.T) {
+
+	options, err := ParseShapeOptions("", "")
+	if err != nil || options.Format != ShapeFormatPoints || options.Tolerance != 0 {
+		t.Log("Unexpected default shape options", options, err)
+		t.Fail()
+	}
+
+	options, err = ParseShapeOptions("GeoJSON", "25")
+	if err != nil || options.Format != ShapeFormatGeoJSON || options.Tolerance != 25 {
+		t.Log("Unexpected shape options", options, err)
+		t.Fail()
+	}
+
+	for _, invalid := range [][2]string{{"kml", ""}, {"", "-1"}, {"", "abc"}, {"polyline", "5000"}} {
+		if _, err = ParseShapeOptions(invalid[0], invalid[1]); err == nil {
+			t.Log("Expected shape options", invalid, "to be rejected")
+			t.Fail()
+		}
+	}
+}
+
+func TestFormatRouteShapes(t *testing.T) {
+
+	// The example from the Google encoded polyline documentation
+	points := []ShapeJSON{
+		{ShapePtLat: 38.5, ShapePtLon: -120.2},
+		{ShapePtLat: 40.7, ShapePtLon: -120.95},
+		{ShapePtLat: 43.252, ShapePtLon: -126.453},
+	}
+
+	routes := FormatRouteShapes([]busRouteJSON{{Shapes: points}}, ShapeOptions{Format: ShapeFormatPolyline})
+	if routes[0].Polyline != "_p~iF~ps|U_ulLnnqC_mqNvxq`@" || routes[0].Shapes != nil {
+		t.Log("Unexpected polyline", routes[0].Polyline)
+		t.Fail()
+	}
+
+	routes = FormatRouteShapes([]busRouteJSON{{Shapes: points}}, ShapeOptions{Format: ShapeFormatGeoJSON})
+	if routes[0].ShapeGeoJSON == nil || routes[0].ShapeGeoJSON.Type != "LineString" {
+		t.Log("Expected a GeoJSON LineString but got", routes[0].ShapeGeoJSON)
+		t.FailNow()
+	}
+	coordinates := routes[0].ShapeGeoJSON.Coordinates.([][2]float64)
+	if len(coordinates) != 3 || coordinates[0] != [2]float64{-120.2, 38.5} {
+		t.Log("Expected longitude then latitude coordinates but got", coordinates)
+		t.Fail()
+	}
+}
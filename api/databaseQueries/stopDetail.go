@@ -0,0 +1,342 @@
+package databaseQueries
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"googlemaps.github.io/maps"
+)
+
+// MaxStopDepartures is the most departures that can be asked for in the stop
+// details
+const MaxStopDepartures = 50
+
+// StopDetail holds a stop along with every route and direction serving it, its
+// next scheduled departures, the stops within walking distance for transfers
+// and its amenities where the stops file lists them
+type StopDetail struct {
+	StopId         string          `bson:"stop_id" json:"stop_id"`
+	StopName       string          `bson:"stop_name" json:"stop_name"`
+	StopNumber     string          `bson:"stop_number" json:"stop_number"`
+	StopLat        float64         `bson:"stop_lat" json:"stop_lat"`
+	StopLon        float64         `bson:"stop_lon" json:"stop_lon"`
+	Amenities      *StopAmenities  `bson:"amenities,omitempty" json:"amenities,omitempty"`
+	Routes         []StopRoute     `bson:"routes" json:"routes"`
+	NextDepartures []StopDeparture `bson:"next_departures" json:"next_departures"`
+	NearbyStops    []NearbyStop    `bson:"nearby_stops" json:"nearby_stops"`
+}
+
+// StopRoute is a route and direction serving a stop, with the headsigns shown
+// at the stop and the number of trips calling there
+type StopRoute struct {
+	RouteNum  string   `bson:"route_num" json:"route_num"`
+	Direction string   `bson:"direction" json:"direction"`
+	Headsigns []string `bson:"headsigns" json:"headsigns"`
+	Trips     int      `bson:"trips" json:"trips"`
+}
+
+// StopDeparture is a scheduled departure from a stop, with the number of whole
+// minutes until it leaves
+type StopDeparture struct {
+	RouteNum      string `bson:"route_num" json:"route_num"`
+	Direction     string `bson:"direction" json:"direction"`
+	Headsign      string `bson:"headsign" json:"headsign"`
+	TripId        string `bson:"trip_id" json:"trip_id"`
+	ScheduledTime string `bson:"scheduled_time" json:"scheduled_time"`
+	DepartureAt   string `bson:"departure_at" json:"departure_at"`
+	MinutesAway   int    `bson:"minutes_away" json:"minutes_away"`
+}
+
+// NearbyStop is a stop close enough to walk to for a transfer, with the
+// straight line distance to it in metres
+type NearbyStop struct {
+	StopId         string  `bson:"stop_id" json:"stop_id"`
+	StopName       string  `bson:"stop_name" json:"stop_name"`
+	StopNumber     string  `bson:"stop_number" json:"stop_number"`
+	StopLat        float64 `bson:"stop_lat" json:"stop_lat"`
+	StopLon        float64 `bson:"stop_lon" json:"stop_lon"`
+	DistanceMetres float64 `bson:"distance_metres" json:"distance_metres"`
+	WalkingMetres  float64 `bson:"walking_metres,omitempty" json:"walking_metres,omitempty"`
+	WalkingSeconds int64   `bson:"walking_seconds,omitempty" json:"walking_seconds,omitempty"`
+}
+
+// GetStopDetail returns the StopDetail for the stop number given in the request
+// URL. The number of departures listed can be set with the departures query
+// parameter, up to MaxStopDepartures
+func GetStopDetail(c *gin.Context) {
+
+	stopNumber := strings.TrimSpace(c.Param("stopNumber"))
+	logger := LoggerFromContext(c.Request.Context())
+
+	departures := currentConfig.Stops.Departures
+	if requested := c.Query("departures"); requested != "" {
+		parsed, err := strconv.Atoi(requested)
+		if err != nil || parsed < 0 || parsed > MaxStopDepartures {
+			c.IndentedJSON(http.StatusBadRequest, "Invalid departures parameter in request, expected 0 to "+
+				strconv.Itoa(MaxStopDepartures))
+			return
+		}
+		departures = parsed
+	}
+
+	stop, found, err := FindStop(c.Request.Context(), stopNumber)
+	if err != nil {
+		logger.Error("could not find stop", "stop", stopNumber, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Stop could not be found")
+		return
+	}
+	if !found {
+		c.IndentedJSON(http.StatusNotFound, "No stop with that number")
+		return
+	}
+
+	stopTimes, err := FindStopTimesAtStop(c.Request.Context(), stopNumber)
+	if err != nil {
+		logger.Error("could not find stop times", "stop", stopNumber, "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Stop could not be found")
+		return
+	}
+
+	detail := StopDetail{
+		StopId:         stop.StopID,
+		StopName:       stop.StopName,
+		StopNumber:     stop.StopNumber,
+		StopLat:        stop.StopLat,
+		StopLon:        stop.StopLon,
+		Routes:         BuildStopRoutes(stopTimes),
+		NextDepartures: NextStopDepartures(stopTimes, time.Now(), departures),
+		NearbyStops: FindTransferStops(stop,
+			FindNearbyStopsV2(maps.LatLng{Lat: stop.StopLat, Lng: stop.StopLon}),
+			currentConfig.Stops.TransferRadiusMetres),
+	}
+	if amenities, ok := stopMetadata().Lookup(stop.StopID, stop.StopNumber); ok {
+		detail.Amenities = &amenities
+	}
+
+	c.IndentedJSON(http.StatusOK, detail)
+}
+
+// FindStop takes in the context of the request and a stop number and returns
+// the stop from the stops collection, reporting false if there is no such stop
+func FindStop(requestCtx context.Context, stopNumber string) (StopWithCoordinates, bool, error) {
+
+	var stop GeolocatedStop
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, currentConfig.Mongo.Collections.Stops)
+	if err != nil {
+		return StopWithCoordinates{}, false, err
+	}
+	defer disconnect()
+
+	err = collection.FindOne(ctx, bson.D{{Key: "stop_number", Value: stopNumber}}).Decode(&stop)
+	if err == mongo.ErrNoDocuments {
+		return StopWithCoordinates{}, false, nil
+	}
+	if err != nil {
+		return StopWithCoordinates{}, false, err
+	}
+
+	stopLat, _ := strconv.ParseFloat(stop.StopLat, 64)
+	stopLon, _ := strconv.ParseFloat(stop.StopLon, 64)
+
+	return StopWithCoordinates{
+		StopID:     stop.StopId,
+		StopName:   stop.StopName,
+		StopNumber: stop.StopNumber,
+		StopLat:    stopLat,
+		StopLon:    stopLon,
+	}, true, nil
+}
+
+// FindStopTimesAtStop takes in the context of the request and a stop number and
+// returns every call at the stop by any trip in the timetable, whichever days
+// it runs on, so that one cached list serves every service day. The calls are
+// cached against the timetable generation and NextStopDepartures leaves out the
+// trips whose service doesn't run on the service day
+func FindStopTimesAtStop(requestCtx context.Context, stopNumber string) ([]timetableStopTime, error) {
+
+	var stopTimes []timetableStopTime
+	cacheKey := resultCache().TimetableKey("stop_times", stopNumber)
+	if resultCache().GetJSON(cacheKindRouteCatalogue, cacheKey, &stopTimes) {
+		return stopTimes, nil
+	}
+
+	collection, ctx, disconnect, err := openTimetable(requestCtx)
+	if err != nil {
+		return stopTimes, err
+	}
+	defer disconnect()
+
+	stopTimes, err = findStopTimes(ctx, collection, stopNumber, bson.D{})
+	if err != nil {
+		return stopTimes, err
+	}
+
+	resultCache().SetJSON(cacheKindRouteCatalogue, cacheKey, stopTimes, RouteCatalogueCacheTTL)
+	return stopTimes, nil
+}
+
+// BuildStopRoutes takes in the calls at a stop and returns a StopRoute for each
+// route and direction among them, sorted by route number and then direction
+func BuildStopRoutes(stopTimes []timetableStopTime) []StopRoute {
+
+	routes := []StopRoute{}
+	routeIndexes := map[RouteId]int{}
+
+	for _, stopTime := range stopTimes {
+		id := RouteId{RouteNum: stopTime.RouteNum, Direction: stopTime.Direction}
+		index, ok := routeIndexes[id]
+		if !ok {
+			index = len(routes)
+			routeIndexes[id] = index
+			routes = append(routes, StopRoute{RouteNum: id.RouteNum, Direction: id.Direction, Headsigns: []string{}})
+		}
+
+		routes[index].Trips++
+		headsign := stopTimeHeadsign(stopTime)
+		if headsign != "" && !containsString(routes[index].Headsigns, headsign) {
+			routes[index].Headsigns = append(routes[index].Headsigns, headsign)
+		}
+	}
+
+	for index := range routes {
+		sort.Strings(routes[index].Headsigns)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].RouteNum != routes[j].RouteNum {
+			return routeNumLess(routes[i].RouteNum, routes[j].RouteNum)
+		}
+		return routes[i].Direction < routes[j].Direction
+	})
+
+	return routes
+}
+
+// NextStopDepartures takes in the calls at a stop, the current time and the
+// number of departures wanted and returns the next departures from the stop.
+// Trips from the previous service day are included as they may still be
+// running after midnight with times past 24:00:00, and trips whose service
+// doesn't run on a service day are left out of it
+func NextStopDepartures(stopTimes []timetableStopTime, now time.Time, limit int) []StopDeparture {
+
+	type timedDeparture struct {
+		instant  time.Time
+		stopTime timetableStopTime
+	}
+
+	today, _ := ServiceDay(now)
+	var upcoming []timedDeparture
+	for _, serviceDate := range []time.Time{today.AddDate(0, 0, -1), today} {
+		dayStart := ServiceDayStart(serviceDate)
+		for _, stopTime := range stopTimes {
+			seconds, ok := parseServiceTime(stopTime.Stop.DepartureTime)
+			if !ok || !stopTime.runsOn(serviceDate) {
+				continue
+			}
+			instant := dayStart.Add(time.Duration(seconds) * time.Second)
+			if !instant.Before(now) {
+				upcoming = append(upcoming, timedDeparture{instant, stopTime})
+			}
+		}
+	}
+
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		return upcoming[i].instant.Before(upcoming[j].instant)
+	})
+	if len(upcoming) > limit {
+		upcoming = upcoming[:limit]
+	}
+
+	departures := []StopDeparture{}
+	for _, departure := range upcoming {
+		departures = append(departures, StopDeparture{
+			RouteNum:      departure.stopTime.RouteNum,
+			Direction:     departure.stopTime.Direction,
+			Headsign:      stopTimeHeadsign(departure.stopTime),
+			TripId:        departure.stopTime.TripId,
+			ScheduledTime: departure.stopTime.Stop.DepartureTime,
+			DepartureAt:   departure.instant.In(dublinLocation).Format(time.RFC3339),
+			MinutesAway:   int(departure.instant.Sub(now) / time.Minute),
+		})
+	}
+
+	return departures
+}
+
+// FindTransferStops takes in a stop, the stops near it and a radius in metres
+// and returns the nearby stops within the radius, other than the stop itself,
+// sorted by distance. When a pedestrian graph is loaded the walk to each stop is
+// given too, and the stops that can be walked to come first, sorted by the
+// length of the walk
+func FindTransferStops(stop StopWithCoordinates, nearbyStops []StopWithCoordinates,
+	radiusMetres float64) []NearbyStop {
+
+	transferStops := []NearbyStop{}
+	targets := []maps.LatLng{}
+	for _, nearbyStop := range nearbyStops {
+		if nearbyStop.StopNumber == stop.StopNumber {
+			continue
+		}
+
+		distance := distanceMetres(stop.StopLat, stop.StopLon, nearbyStop.StopLat, nearbyStop.StopLon)
+		if distance > radiusMetres {
+			continue
+		}
+
+		transferStops = append(transferStops, NearbyStop{
+			StopId:         nearbyStop.StopID,
+			StopName:       nearbyStop.StopName,
+			StopNumber:     nearbyStop.StopNumber,
+			StopLat:        nearbyStop.StopLat,
+			StopLon:        nearbyStop.StopLon,
+			DistanceMetres: math.Round(distance),
+		})
+		targets = append(targets, maps.LatLng{Lat: nearbyStop.StopLat, Lng: nearbyStop.StopLon})
+	}
+
+	graph := pedestrianGraph()
+	walks, err := graph.WalkDistances(maps.LatLng{Lat: stop.StopLat, Lng: stop.StopLon}, targets,
+		currentConfig.Walking.MaxWalkMetres, RouteOptions{})
+	if err == nil {
+		for index, metres := range walks {
+			if !math.IsInf(metres, 1) {
+				// A stop at the same spot is still counted as a walk of a metre, so
+				// that it isn't taken for one that can't be walked to
+				transferStops[index].WalkingMetres = math.Max(math.Round(metres), 1)
+				transferStops[index].WalkingSeconds = graph.walkSeconds(metres)
+			}
+		}
+	}
+
+	sort.SliceStable(transferStops, func(i, j int) bool {
+		walkableI, walkableJ := transferStops[i].WalkingMetres > 0, transferStops[j].WalkingMetres > 0
+		if walkableI != walkableJ {
+			return walkableI
+		}
+		if walkableI {
+			return transferStops[i].WalkingMetres < transferStops[j].WalkingMetres
+		}
+		return transferStops[i].DistanceMetres < transferStops[j].DistanceMetres
+	})
+
+	return transferStops
+}
+
+// stopTimeHeadsign returns the headsign of the trip making a call, falling back
+// to the name of its final stop where the timetable has no headsign
+func stopTimeHeadsign(stopTime timetableStopTime) string {
+
+	if strings.TrimSpace(stopTime.Headsign) != "" {
+		return stopTime.Headsign
+	}
+
+	return stopTime.FinalStopName
+}
@@ -0,0 +1,130 @@
+package databaseQueries
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildStopRoutes(t *testing.T) {
+
+	routes := BuildStopRoutes([]timetableStopTime{
+		{RouteNum: "46A", Direction: "1", Headsign: "Phoenix Park"},
+		{RouteNum: "7", Direction: "0", FinalStopName: "Bride's Glen"},
+		{RouteNum: "46A", Direction: "1", Headsign: "Phoenix Park"},
+		{RouteNum: "46A", Direction: "0", Headsign: "Dun Laoghaire"},
+	})
+
+	if len(routes) != 3 || routes[0].RouteNum != "7" || routes[1].Direction != "0" || routes[2].Trips != 2 {
+		t.Log("Unexpected routes", routes)
+		t.FailNow()
+	}
+	if len(routes[0].Headsigns) != 1 || routes[0].Headsigns[0] != "Bride's Glen" {
+		t.Log("Expected the final stop to be used as the headsign but got", routes[0].Headsigns)
+		t.Fail()
+	}
+}
+
+func TestNextStopDeparturesIncludesTripsPastMidnight(t *testing.T) {
+
+	stopTime := func(tripId string, departure string) timetableStopTime {
+		return timetableStopTime{RouteNum: "15", Direction: "0", TripId: tripId,
+			Stop: BusStop{DepartureTime: departure}}
+	}
+	stopTimes := []timetableStopTime{
+		stopTime("early", "06:00:00"),
+		stopTime("late", "24:40:00"),
+		stopTime("gone", "00:10:00"),
+		stopTime("soon", "00:45:00"),
+	}
+
+	now := time.Date(2022, time.June, 16, 0, 30, 0, 0, dublinLocation)
+	departures := NextStopDepartures(stopTimes, now, 3)
+
+	if len(departures) != 3 {
+		t.Log("Expected 3 departures but got", departures)
+		t.FailNow()
+	}
+	if departures[0].TripId != "late" || departures[0].MinutesAway != 10 ||
+		departures[0].DepartureAt != "2022-06-16T00:40:00+01:00" {
+		t.Log("Expected the trip from the previous service day first but got", departures[0])
+		t.Fail()
+	}
+	if departures[1].TripId != "soon" || departures[2].TripId != "early" {
+		t.Log("Unexpected order of departures", departures)
+		t.Fail()
+	}
+}
+
+func TestNextStopDeparturesByServiceDay(t *testing.T) {
+
+	stopTimes := []timetableStopTime{
+		{TripId: "friday-late", ServiceId: "y1002-Weekday", Stop: BusStop{DepartureTime: "23:55:00"}},
+		{TripId: "friday-night", ServiceId: "y1002-Weekday", Stop: BusStop{DepartureTime: "24:40:00"}},
+		{TripId: "weekday-morning", ServiceId: "y1002-Weekday", Stop: BusStop{DepartureTime: "07:30:00"}},
+		{TripId: "saturday-morning", ServiceId: "y1002-Saturday", Stop: BusStop{DepartureTime: "07:00:00"}},
+		{TripId: "sunday-morning", ServiceId: "y1002-Sunday", Stop: BusStop{DepartureTime: "08:00:00"}},
+	}
+
+	// Just after midnight on a Saturday a Friday trip is still to come, and
+	// after it only the Saturday trips run
+	now := time.Date(2022, time.June, 18, 0, 20, 0, 0, dublinLocation)
+	departures := NextStopDepartures(stopTimes, now, 10)
+	tripIds := []string{}
+	for _, departure := range departures {
+		tripIds = append(tripIds, departure.TripId)
+	}
+	if strings.Join(tripIds, ",") != "friday-night,saturday-morning" {
+		t.Log("Expected only the trips running on each service day, got", tripIds)
+		t.Fail()
+	}
+}
+
+func TestFindTransferStops(t *testing.T) {
+
+	stop := StopWithCoordinates{StopNumber: "1", StopLat: 53.3498, StopLon: -6.2603}
+	nearby := []StopWithCoordinates{
+		stop,
+		{StopNumber: "2", StopLat: 53.3520, StopLon: -6.2603},
+		{StopNumber: "3", StopLat: 53.3505, StopLon: -6.2603},
+		{StopNumber: "4", StopLat: 53.3600, StopLon: -6.2603},
+	}
+
+	transferStops := FindTransferStops(stop, nearby, 400)
+	if len(transferStops) != 2 || transferStops[0].StopNumber != "3" || transferStops[1].StopNumber != "2" {
+		t.Log("Unexpected transfer stops", transferStops)
+		t.FailNow()
+	}
+	if transferStops[0].DistanceMetres < 70 || transferStops[0].DistanceMetres > 90 {
+		t.Log("Expected the nearest stop to be about 78m away but got", transferStops[0].DistanceMetres)
+		t.Fail()
+	}
+}
+
+func TestFindTransferStopsWalking(t *testing.T) {
+
+	SetPedestrianGraph(loadTestPedestrianGraph(t))
+	defer SetPedestrianGraph(NewPedestrianGraph(DefaultConfig().Walking))
+
+	// Dawson Street is nearer in a straight line, but the private road to it
+	// can't be walked so Wicklow Street is the shorter walk
+	stop := StopWithCoordinates{StopNumber: "chatham", StopLat: testWalkingNodes[4].Lat,
+		StopLon: testWalkingNodes[4].Lng}
+	nearby := []StopWithCoordinates{
+		{StopNumber: "dawson", StopLat: testWalkingNodes[8].Lat, StopLon: testWalkingNodes[8].Lng},
+		{StopNumber: "wicklow", StopLat: testWalkingNodes[3].Lat, StopLon: testWalkingNodes[3].Lng},
+	}
+
+	transferStops := FindTransferStops(stop, nearby, 400)
+	if len(transferStops) != 2 || transferStops[0].StopNumber != "wicklow" || transferStops[1].StopNumber != "dawson" {
+		t.Log("Expected the transfer stops in order of walking distance, got", transferStops)
+		t.FailNow()
+	}
+	dawson := transferStops[1]
+	if dawson.WalkingMetres <= dawson.DistanceMetres ||
+		math.Abs(float64(dawson.WalkingSeconds)-dawson.WalkingMetres/1.3) > 1 {
+		t.Log("Expected the walk to Dawson Street to be longer than the straight line, got", dawson)
+		t.Fail()
+	}
+}
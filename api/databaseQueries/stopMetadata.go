@@ -0,0 +1,237 @@
+package databaseQueries
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Values of the wheelchair boarding field of StopAmenities, following the
+// wheelchair_boarding field of GTFS stops.txt. The same values are used for
+// whether a trip is wheelchair accessible
+const (
+	WheelchairBoardingUnknown       = "unknown"
+	WheelchairBoardingAccessible    = "accessible"
+	WheelchairBoardingNotAccessible = "not_accessible"
+)
+
+// stopMetadataColumns lists the columns of stops.txt read for each amenity.
+// Shelters and real time displays aren't part of GTFS itself, so the names used
+// by the extensions seen in Irish feeds are all accepted
+var stopMetadataColumns = map[string][]string{
+	"shelter":     {"shelter", "has_shelter", "bus_shelter"},
+	"rtpi":        {"rtpi_display", "rtpi", "has_rtpi", "real_time_display"},
+	"wheelchair":  {"wheelchair_boarding"},
+	"stop_id":     {"stop_id"},
+	"stop_number": {"stop_code", "stop_number"},
+}
+
+// StopAmenities holds the optional metadata for a stop. Shelter and RTPIDisplay
+// are left out where the feed doesn't say, rather than being reported as false
+type StopAmenities struct {
+	Shelter            *bool  `bson:"shelter,omitempty" json:"shelter,omitempty"`
+	RTPIDisplay        *bool  `bson:"rtpi_display,omitempty" json:"rtpi_display,omitempty"`
+	WheelchairBoarding string `bson:"wheelchair_boarding,omitempty" json:"wheelchair_boarding,omitempty"`
+}
+
+// StopMetadata holds the StopAmenities of each stop in a stops.txt file, found
+// by stop number or, for feeds without stop codes, by stop id
+type StopMetadata struct {
+	byNumber map[string]StopAmenities
+	byId     map[string]StopAmenities
+}
+
+// NewStopMetadata returns an empty StopMetadata
+func NewStopMetadata() *StopMetadata {
+	return &StopMetadata{byNumber: map[string]StopAmenities{}, byId: map[string]StopAmenities{}}
+}
+
+// Lookup returns the StopAmenities for the stop with the given id or number,
+// reporting false if the stop isn't in the metadata
+func (metadata *StopMetadata) Lookup(stopId string, stopNumber string) (StopAmenities, bool) {
+
+	if metadata == nil {
+		return StopAmenities{}, false
+	}
+	if amenities, ok := metadata.byNumber[stopNumber]; ok && stopNumber != "" {
+		return amenities, true
+	}
+	amenities, ok := metadata.byId[stopId]
+	return amenities, ok && stopId != ""
+}
+
+// Len returns the number of stops held
+func (metadata *StopMetadata) Len() int {
+
+	if metadata == nil {
+		return 0
+	}
+
+	return len(metadata.byId) + len(metadata.byNumber)
+}
+
+// ReadStopMetadata reads a GTFS stops.txt file and returns the StopAmenities of
+// every stop in it that has any. Rows without any of the amenity columns set
+// are skipped so that they are reported as having no metadata
+func ReadStopMetadata(reader io.Reader) (*StopMetadata, error) {
+
+	csvReader := csv.NewReader(reader)
+	csvReader.FieldsPerRecord = -1
+
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string]int{}
+	for index, name := range header {
+		// stops.txt is often saved with a byte order mark before the first column
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for field, names := range stopMetadataColumns {
+			if _, found := columns[field]; !found && containsString(names, name) {
+				columns[field] = index
+			}
+		}
+	}
+	if _, hasId := columns["stop_id"]; !hasId {
+		if _, hasNumber := columns["stop_number"]; !hasNumber {
+			return nil, errors.New("stops file has neither a stop_id nor a stop_code column")
+		}
+	}
+
+	field := func(record []string, name string) string {
+		index, ok := columns[name]
+		if !ok || index >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[index])
+	}
+
+	metadata := NewStopMetadata()
+	for {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		amenities := StopAmenities{
+			Shelter:            parseAmenityFlag(field(record, "shelter")),
+			RTPIDisplay:        parseAmenityFlag(field(record, "rtpi")),
+			WheelchairBoarding: parseWheelchairAccess(field(record, "wheelchair")),
+		}
+		if amenities == (StopAmenities{}) {
+			continue
+		}
+
+		if stopNumber := field(record, "stop_number"); stopNumber != "" {
+			metadata.byNumber[stopNumber] = amenities
+		} else if stopId := field(record, "stop_id"); stopId != "" {
+			metadata.byId[stopId] = amenities
+		}
+	}
+
+	return metadata, nil
+}
+
+// parseAmenityFlag reads a yes or no value from stops.txt, returning nil when
+// it is empty or can't be read
+func parseAmenityFlag(value string) *bool {
+
+	var flag bool
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "y":
+		flag = true
+	case "0", "false", "no", "n":
+		flag = false
+	default:
+		return nil
+	}
+
+	return &flag
+}
+
+// parseWheelchairAccess reads the GTFS wheelchair_boarding value of a stop or
+// wheelchair_accessible value of a trip, where 1 means the stop or trip can be
+// boarded by wheelchair, at least on some vehicles, and 2 means it can't. An
+// empty value is left empty so that the field is omitted
+func parseWheelchairAccess(value string) string {
+
+	switch value {
+	case "":
+		return ""
+	case "1":
+		return WheelchairBoardingAccessible
+	case "2":
+		return WheelchairBoardingNotAccessible
+	default:
+		return WheelchairBoardingUnknown
+	}
+}
+
+// LoadStopMetadata reads the stops.txt file at path
+func LoadStopMetadata(path string) (*StopMetadata, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ReadStopMetadata(file)
+}
+
+// loadConfiguredStopMetadata loads the stops file named in the configuration,
+// logging rather than failing if it can't be read as the metadata is optional
+func loadConfiguredStopMetadata(stopsConfig StopsConfig) *StopMetadata {
+
+	if stopsConfig.MetadataFile == "" {
+		return NewStopMetadata()
+	}
+
+	metadata, err := LoadStopMetadata(stopsConfig.MetadataFile)
+	if err != nil {
+		defaultLogger.Error("could not load stop metadata", "file", stopsConfig.MetadataFile, "error", err)
+		return NewStopMetadata()
+	}
+
+	defaultLogger.Info("loaded stop metadata", "file", stopsConfig.MetadataFile, "stops", metadata.Len())
+	return metadata
+}
+
+var sharedStopMetadata *StopMetadata
+var sharedStopMetadataLock sync.RWMutex
+var sharedStopMetadataOnce sync.Once
+
+// stopMetadata returns the StopMetadata shared by the package, loading it from
+// the configured file the first time it is called unless SetStopMetadata has
+// already been used to provide it
+func stopMetadata() *StopMetadata {
+
+	sharedStopMetadataOnce.Do(func() {
+		sharedStopMetadataLock.Lock()
+		defer sharedStopMetadataLock.Unlock()
+		if sharedStopMetadata == nil {
+			sharedStopMetadata = loadConfiguredStopMetadata(currentConfig.Stops)
+		}
+	})
+
+	sharedStopMetadataLock.RLock()
+	defer sharedStopMetadataLock.RUnlock()
+	return sharedStopMetadata
+}
+
+// SetStopMetadata replaces the StopMetadata shared by the package
+func SetStopMetadata(metadata *StopMetadata) {
+
+	sharedStopMetadataOnce.Do(func() {})
+
+	sharedStopMetadataLock.Lock()
+	defer sharedStopMetadataLock.Unlock()
+	sharedStopMetadata = metadata
+}
@@ -0,0 +1,52 @@
+package databaseQueries
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadStopMetadata(t *testing.T) {
+
+	stopsFile := "\ufeffstop_id,stop_code,stop_name,stop_lat,stop_lon,wheelchair_boarding,has_shelter,rtpi_display\n" +
+		"8220DB000002,2,Parnell Square,53.35,-6.26,1,1,0\n" +
+		"8220DB000003,3,Parnell Square,53.35,-6.26,2,,\n" +
+		"8220DB000004,,Parnell Street,53.35,-6.26,,yes,\n" +
+		"8220DB000005,5,Parnell Street,53.35,-6.26,,,\n"
+
+	metadata, err := ReadStopMetadata(strings.NewReader(stopsFile))
+	if err != nil {
+		t.Log("Could not read stops file:", err)
+		t.FailNow()
+	}
+
+	amenities, ok := metadata.Lookup("8220DB000002", "2")
+	if !ok || amenities.Shelter == nil || !*amenities.Shelter || amenities.RTPIDisplay == nil ||
+		*amenities.RTPIDisplay || amenities.WheelchairBoarding != WheelchairBoardingAccessible {
+		t.Log("Unexpected amenities for stop 2", amenities, ok)
+		t.Fail()
+	}
+
+	amenities, ok = metadata.Lookup("8220DB000003", "3")
+	if !ok || amenities.Shelter != nil || amenities.WheelchairBoarding != WheelchairBoardingNotAccessible {
+		t.Log("Unexpected amenities for stop 3", amenities, ok)
+		t.Fail()
+	}
+
+	if amenities, ok = metadata.Lookup("8220DB000004", "4"); !ok || amenities.Shelter == nil {
+		t.Log("Expected a stop without a code to be found by its id", amenities, ok)
+		t.Fail()
+	}
+
+	if _, ok = metadata.Lookup("8220DB000005", "5"); ok {
+		t.Log("Expected a stop without amenities to have no metadata")
+		t.Fail()
+	}
+}
+
+func TestReadStopMetadataNeedsStopColumn(t *testing.T) {
+
+	if _, err := ReadStopMetadata(strings.NewReader("stop_name,has_shelter\nParnell Square,1\n")); err == nil {
+		t.Log("Expected a stops file without stop ids or codes to be rejected")
+		t.Fail()
+	}
+}
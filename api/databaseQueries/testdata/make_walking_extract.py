@@ -0,0 +1,148 @@
+"""Writes dublin-walking.osm.pbf, the small OSM PBF extract used by the walking
+tests. It holds a handful of streets around Grafton Street and St Stephen's
+Green with made up ids, along with ways that mustn't be walked on: steps, a
+motorway, a private service road, a building outline and a footway that isn't
+connected to anything else. Run it from this directory with python3
+"""
+
+import struct
+import zlib
+
+GRANULARITY = 100
+
+
+def varint(value):
+    out = bytearray()
+    while True:
+        byte = value & 0x7F
+        value >>= 7
+        if value:
+            out.append(byte | 0x80)
+        else:
+            out.append(byte)
+            return bytes(out)
+
+
+def zigzag(value):
+    return (value << 1) ^ (value >> 63)
+
+
+def key(field, wire_type):
+    return varint((field << 3) | wire_type)
+
+
+def field_varint(field, value):
+    return key(field, 0) + varint(value)
+
+
+def field_bytes(field, value):
+    return key(field, 2) + varint(len(value)) + value
+
+
+def packed(field, values, signed=False):
+    body = b"".join(varint(zigzag(v) if signed else v) for v in values)
+    return field_bytes(field, body)
+
+
+def deltas(values):
+    previous = 0
+    out = []
+    for value in values:
+        out.append(value - previous)
+        previous = value
+    return out
+
+
+NODES = [
+    (1, 53.34420, -6.25920),  # College Green
+    (2, 53.34330, -6.25980),  # Grafton Street at Suffolk Street
+    (3, 53.34200, -6.26020),  # Grafton Street at Wicklow Street
+    (4, 53.34020, -6.26070),  # Grafton Street at Chatham Street
+    (5, 53.33970, -6.26080),  # St Stephen's Green at Grafton Street
+    (6, 53.34270, -6.25760),  # Dawson Street at Nassau Street
+    (7, 53.34120, -6.25800),  # Dawson Street at Duke Street
+    (8, 53.33960, -6.25840),  # Dawson Street at St Stephen's Green
+    (9, 53.33940, -6.25580),  # Kildare Street at St Stephen's Green
+    (10, 53.33890, -6.25330),  # St Stephen's Green at Merrion Row
+    (11, 53.33620, -6.25430),  # St Stephen's Green south east
+    (12, 53.33700, -6.26260),  # St Stephen's Green south west
+    (13, 53.33830, -6.26170),  # St Stephen's Green west
+    (14, 53.33800, -6.25850),  # St Stephen's Green bandstand
+    (15, 53.34120, -6.26040),  # Grafton Street at Duke Street
+    (16, 53.34230, -6.26250),  # Wicklow Street at South William Street
+    (17, 53.34360, -6.26120),  # Suffolk Street at Church Lane
+    (18, 53.34250, -6.25450),  # Nassau Street at Kildare Street
+    (19, 53.35000, -6.27000),  # Unconnected footway
+    (20, 53.35050, -6.27000),  # Unconnected footway
+]
+
+WAYS = [
+    (100, [1, 2, 3, 15, 4, 5], {"highway": "pedestrian", "name": "Grafton Street"}),
+    (101, [6, 7, 8], {"highway": "secondary", "name": "Dawson Street"}),
+    (102, [5, 8, 9, 10], {"highway": "primary", "name": "St Stephen's Green North"}),
+    (103, [10, 11], {"highway": "primary", "name": "St Stephen's Green East"}),
+    (104, [5, 13, 12], {"highway": "primary", "name": "St Stephen's Green West"}),
+    (105, [15, 7], {"highway": "residential", "name": "Duke Street"}),
+    (106, [1, 6, 18], {"highway": "primary", "name": "Nassau Street"}),
+    (107, [18, 9], {"highway": "tertiary", "name": "Kildare Street"}),
+    (108, [5, 14, 11], {"highway": "footway", "name": "St Stephen's Green"}),
+    (109, [13, 14], {"highway": "steps"}),
+    (110, [12, 11], {"highway": "motorway"}),
+    (111, [4, 8], {"highway": "service", "access": "private"}),
+    (112, [3, 16], {"highway": "pedestrian", "name": "Wicklow Street"}),
+    (113, [2, 17], {"highway": "primary", "name": "Suffolk Street"}),
+    (114, [19, 20], {"highway": "footway"}),
+    (115, [7, 9, 8, 7], {"building": "yes"}),
+]
+
+
+def string_table(strings):
+    return b"".join(field_bytes(1, s.encode()) for s in strings)
+
+
+def data_block():
+    strings = [""]
+    index = {}
+
+    def intern(value):
+        if value not in index:
+            index[value] = len(strings)
+            strings.append(value)
+        return index[value]
+
+    dense = packed(1, deltas([n[0] for n in NODES]), signed=True)
+    dense += packed(8, deltas([round(n[1] * 1e9 / GRANULARITY) for n in NODES]), signed=True)
+    dense += packed(9, deltas([round(n[2] * 1e9 / GRANULARITY) for n in NODES]), signed=True)
+    node_group = field_bytes(2, dense)
+
+    way_group = b""
+    for way_id, refs, tags in WAYS:
+        way = field_varint(1, way_id)
+        way += packed(2, [intern(k) for k in tags])
+        way += packed(3, [intern(v) for v in tags.values()])
+        way += packed(8, deltas(refs), signed=True)
+        way_group += field_bytes(3, way)
+
+    block = field_bytes(1, string_table(strings))
+    block += field_bytes(2, node_group)
+    block += field_bytes(2, way_group)
+    block += field_varint(17, GRANULARITY)
+    return block
+
+
+def header_block():
+    bbox = (field_varint(1, zigzag(round(-6.28 * 1e9))) + field_varint(2, zigzag(round(-6.25 * 1e9)))
+            + field_varint(3, zigzag(round(53.36 * 1e9))) + field_varint(4, zigzag(round(53.33 * 1e9))))
+    return (field_bytes(1, bbox) + field_bytes(4, b"OsmSchema-V0.6") + field_bytes(4, b"DenseNodes")
+            + field_bytes(16, b"make_walking_extract.py"))
+
+
+def blob(kind, payload):
+    body = field_varint(2, len(payload)) + field_bytes(3, zlib.compress(payload))
+    header = field_bytes(1, kind.encode()) + field_varint(3, len(body))
+    return struct.pack(">I", len(header)) + header + body
+
+
+with open("dublin-walking.osm.pbf", "wb") as extract:
+    extract.write(blob("OSMHeader", header_block()))
+    extract.write(blob("OSMData", data_block()))
@@ -0,0 +1,600 @@
+package databaseQueries
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"googlemaps.github.io/maps"
+)
+
+// transitNetworksKept is how many service days of transit network are kept in
+// memory at once, which is enough for today and tomorrow
+const transitNetworksKept = 2
+
+// transitNetworkBuildTimeout is how long the trips of a service day are looked
+// for when building its transit network
+const transitNetworkBuildTimeout = 2 * time.Minute
+
+// transitStopCellDegrees is the size of the grid cells that the stops of a
+// transit network are kept in, so that only the stops in the cells around a
+// point are searched for those within a walk of it
+const transitStopCellDegrees = 0.005
+
+// serviceTrip is a trip in the timetable with its stops, the service it runs
+// under and whether it can be boarded by wheelchair
+type serviceTrip struct {
+	tripStops            `bson:",inline"`
+	ServiceId            string `bson:"service_id" json:"service_id"`
+	WheelchairAccessible string `bson:"wheelchair_accessible,omitempty" json:"wheelchair_accessible,omitempty"`
+}
+
+// serviceTripsFinder is the signature of FindServiceTrips, which
+// findServiceTrips is set to outside of tests
+type serviceTripsFinder func(ctx context.Context, serviceDates ...time.Time) ([]serviceTrip, error)
+
+var findServiceTrips serviceTripsFinder = FindServiceTrips
+
+// TransitStop is a stop of the transit network
+type TransitStop struct {
+	StopId             string  `json:"stop_id,omitempty"`
+	StopName           string  `json:"stop_name"`
+	StopNumber         string  `json:"stop_number"`
+	StopLat            float64 `json:"stop_lat"`
+	StopLon            float64 `json:"stop_lon"`
+	WheelchairBoarding string  `json:"wheelchair_boarding,omitempty"`
+}
+
+// transitTrip is a trip of the transit network
+type transitTrip struct {
+	tripId               string
+	routeNum             string
+	direction            string
+	wheelchairAccessible string
+}
+
+// transitConnection is a bus leaving one stop and arriving at the next on a
+// trip, with the times in seconds from the start of the service day and the
+// distance travelled along the trip at each stop, which the fare is worked out
+// from
+type transitConnection struct {
+	trip       int32
+	from       int32
+	to         int32
+	departure  int64
+	arrival    int64
+	fromMetres float64
+	toMetres   float64
+}
+
+// transitFootpath is a walk from one stop to another, taking the seconds given
+// or, in wheelchair mode, the step free seconds where there is a step free walk
+type transitFootpath struct {
+	to               int32
+	seconds          int64
+	stepFreeSeconds  int64
+	stepFreeWalkable bool
+}
+
+// TransitNetwork is the timetable of a service day, held as the connections
+// between consecutive stops of every trip running that day sorted by departure,
+// so that it can be searched with the connection scan algorithm. Trips of the
+// day before that run past midnight are included with their times moved onto
+// the service day. Footpaths join stops within the transfer radius
+type TransitNetwork struct {
+	serviceDate time.Time
+	stops       []TransitStop
+	stopIndex   map[string]int32
+	stopCells   map[[2]int][]int32
+	trips       []transitTrip
+	connections []transitConnection
+	footpaths   [][]transitFootpath
+}
+
+// FindServiceTrips takes in the context of the request and service dates and
+// returns the trips in the timetable running on any of the dates along with
+// their stops and service
+func FindServiceTrips(requestCtx context.Context, serviceDates ...time.Time) ([]serviceTrip, error) {
+
+	collection, ctx, disconnect, err := openTimetable(requestCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+
+	return findTimetableTrips(ctx, collection, serviceDateFilter(ctx, collection, serviceDates...))
+}
+
+// findTimetableTrips returns the trips in the trips_n_stops collection matching
+// the filter along with their stops
+func findTimetableTrips(ctx context.Context, collection *mongo.Collection, filter bson.D) ([]serviceTrip, error) {
+
+	cursor, err := collection.Aggregate(ctx, bson.A{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "trip_id", Value: 1},
+			{Key: "route_num", Value: "$route.route_short_name"},
+			{Key: "direction", Value: "$direction_id"},
+			{Key: "service_id", Value: 1},
+			{Key: "wheelchair_accessible", Value: 1},
+			{Key: "stops", Value: 1},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	trips := []serviceTrip{}
+	err = cursor.All(ctx, &trips)
+	return trips, err
+}
+
+// BuildTransitNetwork takes in a service date and the trips in the timetable
+// running that day or the day before and returns the TransitNetwork of the trips
+// running that day. Calls with times that can't be read are left out, as are
+// stops without coordinates
+func BuildTransitNetwork(serviceDate time.Time, trips []serviceTrip) *TransitNetwork {
+
+	network := &TransitNetwork{serviceDate: serviceDate, stopIndex: map[string]int32{},
+		stopCells: map[[2]int][]int32{}}
+
+	previousDate := serviceDate.AddDate(0, 0, -1)
+	previousOffset := int64(ServiceDayStart(serviceDate).Sub(ServiceDayStart(previousDate)) / time.Second)
+	for _, trip := range trips {
+		if serviceCalendar().RunsOn(trip.ServiceId, serviceDate, dayCalendar()) {
+			network.addTrip(trip, 0)
+		}
+		// Only the calls after midnight of the day before's trips can still be
+		// caught on the service day, but the whole trip is added as it is simpler
+		// and the calls before the service day starts are never scanned
+		if runsPastMidnight(trip) && serviceCalendar().RunsOn(trip.ServiceId, previousDate, dayCalendar()) {
+			network.addTrip(trip, previousOffset)
+		}
+	}
+
+	sort.SliceStable(network.connections, func(i, j int) bool {
+		return network.connections[i].departure < network.connections[j].departure
+	})
+	network.addFootpaths(currentConfig.Stops.TransferRadiusMetres)
+
+	return network
+}
+
+// runsPastMidnight reports whether the trip's last call is after midnight
+func runsPastMidnight(trip serviceTrip) bool {
+
+	if len(trip.Stops) == 0 {
+		return false
+	}
+	seconds, ok := parseServiceTime(trip.Stops[len(trip.Stops)-1].ArrivalTime)
+
+	return ok && seconds >= 24*3600
+}
+
+// addStop returns the index of the stop in the network, adding it if needed
+func (network *TransitNetwork) addStop(stop BusStop) (int32, bool) {
+
+	if index, ok := network.stopIndex[stop.StopNumber]; ok {
+		return index, true
+	}
+	lat, latErr := strconv.ParseFloat(stop.StopLat, 64)
+	lon, lonErr := strconv.ParseFloat(stop.StopLon, 64)
+	if latErr != nil || lonErr != nil {
+		return 0, false
+	}
+
+	index := int32(len(network.stops))
+	network.stops = append(network.stops, TransitStop{
+		StopId:             stop.StopId,
+		StopName:           stop.StopName,
+		StopNumber:         stop.StopNumber,
+		StopLat:            lat,
+		StopLon:            lon,
+		WheelchairBoarding: stopWheelchairBoarding(stop.StopId, stop.StopNumber, stop.WheelchairBoarding),
+	})
+	network.stopIndex[stop.StopNumber] = index
+	cell := transitStopCell(lat, lon)
+	network.stopCells[cell] = append(network.stopCells[cell], index)
+
+	return index, true
+}
+
+// transitStopCell returns the grid cell that a point falls in
+func transitStopCell(lat float64, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat / transitStopCellDegrees)), int(math.Floor(lon / transitStopCellDegrees))}
+}
+
+// addTrip adds the connections of a trip, with its times moved back by the
+// offset in seconds
+func (network *TransitNetwork) addTrip(trip serviceTrip, offset int64) {
+
+	tripIndex := int32(len(network.trips))
+	network.trips = append(network.trips, transitTrip{
+		tripId:               trip.TripId,
+		routeNum:             trip.RouteNum,
+		direction:            trip.Direction,
+		wheelchairAccessible: tripWheelchairAccessible(trip.TripId, trip.WheelchairAccessible),
+	})
+
+	previous, previousDeparture, previousMetres := int32(-1), int64(0), 0.0
+	for _, stop := range trip.Stops {
+		index, ok := network.addStop(stop)
+		arrival, arrivalOk := parseServiceTime(stop.ArrivalTime)
+		departure, departureOk := parseServiceTime(stop.DepartureTime)
+		if !ok || !arrivalOk || !departureOk {
+			continue
+		}
+		// Stops without a distance travelled are taken as the start of the trip,
+		// as they are by CalculateFare
+		metres, _ := strconv.ParseFloat(stop.DistanceTravelled, 64)
+		if previous >= 0 && arrival >= previousDeparture {
+			network.connections = append(network.connections, transitConnection{
+				trip:       tripIndex,
+				from:       previous,
+				to:         index,
+				departure:  previousDeparture - offset,
+				arrival:    arrival - offset,
+				fromMetres: previousMetres,
+				toMetres:   metres,
+			})
+		}
+		previous, previousDeparture, previousMetres = index, departure, metres
+	}
+}
+
+// addFootpaths joins each stop to the others within the radius, walked along the
+// pedestrian graph where there is one and in a straight line otherwise
+func (network *TransitNetwork) addFootpaths(radiusMetres float64) {
+
+	network.footpaths = make([][]transitFootpath, len(network.stops))
+	for index, stop := range network.stops {
+		from := maps.LatLng{Lat: stop.StopLat, Lng: stop.StopLon}
+		nearby := network.stopsWithin(from, radiusMetres)
+		targets := make([]maps.LatLng, len(nearby))
+		for target, other := range nearby {
+			targets[target] = maps.LatLng{Lat: network.stops[other].StopLat, Lng: network.stops[other].StopLon}
+		}
+
+		walks := walkingDistances(from, targets, radiusMetres, RouteOptions{})
+		stepFree := walkingDistances(from, targets, radiusMetres, RouteOptions{Wheelchair: true})
+		for target, other := range nearby {
+			if other == int32(index) || math.IsInf(walks[target], 1) {
+				continue
+			}
+			footpath := transitFootpath{to: other, seconds: walkingSeconds(walks[target])}
+			if !math.IsInf(stepFree[target], 1) {
+				footpath.stepFreeSeconds, footpath.stepFreeWalkable = walkingSeconds(stepFree[target]), true
+			}
+			network.footpaths[index] = append(network.footpaths[index], footpath)
+		}
+	}
+}
+
+// stopsWithin returns the indexes of the stops within the straight line
+// distance of a point, in the order they were added to the network. Only the
+// stops in the grid cells the distance reaches into are measured
+func (network *TransitNetwork) stopsWithin(point maps.LatLng, radiusMetres float64) []int32 {
+
+	metresPerDegree := earthRadiusMetres * math.Pi / 180
+	latDegrees := radiusMetres / metresPerDegree
+	lonDegrees := radiusMetres / (metresPerDegree * math.Cos(point.Lat*math.Pi/180))
+	lowest := transitStopCell(point.Lat-latDegrees, point.Lng-lonDegrees)
+	highest := transitStopCell(point.Lat+latDegrees, point.Lng+lonDegrees)
+
+	within := []int32{}
+	for latCell := lowest[0]; latCell <= highest[0]; latCell++ {
+		for lonCell := lowest[1]; lonCell <= highest[1]; lonCell++ {
+			for _, index := range network.stopCells[[2]int{latCell, lonCell}] {
+				stop := network.stops[index]
+				if distanceMetres(point.Lat, point.Lng, stop.StopLat, stop.StopLon) <= radiusMetres {
+					within = append(within, index)
+				}
+			}
+		}
+	}
+	sort.Slice(within, func(i, j int) bool { return within[i] < within[j] })
+
+	return within
+}
+
+// ServiceDate returns the service date the network is the timetable of
+func (network *TransitNetwork) ServiceDate() time.Time {
+	return network.serviceDate
+}
+
+// Len returns the number of connections in the network
+func (network *TransitNetwork) Len() int {
+	return len(network.connections)
+}
+
+// transitLabel is how a stop is reached by a search: when, after how many
+// boardings and, for rebuilding the journey, by which trip boarded at which
+// stop and ridden how far or by walking from which stop, with -1 for the origin
+type transitLabel struct {
+	reached    bool
+	arrival    int64
+	boardings  int
+	trip       int32
+	boardedAt  int32
+	walkFrom   int32
+	rideMetres float64
+}
+
+// TransitReach is the result of searching a network from an origin, holding how
+// each stop is reached
+type TransitReach struct {
+	network   *TransitNetwork
+	departure int64
+	labels    []transitLabel
+}
+
+// Reach searches the network from the origin, leaving at the departure, and
+// returns how each stop can be reached by the limit. The origin is walked from
+// to the stops within the longest walk. In wheelchair mode trips and stops that
+// can't be boarded by wheelchair aren't used and walks avoid steps. Each trip is
+// boarded at the first stop it can be, so the number of boardings is that of
+// the earliest arriving journey found rather than the fewest possible
+func (network *TransitNetwork) Reach(origin maps.LatLng, departure time.Time, limit time.Time,
+	options RouteOptions) TransitReach {
+
+	start := ServiceDayStart(network.serviceDate)
+	reach := TransitReach{
+		network:   network,
+		departure: int64(departure.Sub(start) / time.Second),
+		labels:    make([]transitLabel, len(network.stops)),
+	}
+	end := int64(limit.Sub(start) / time.Second)
+
+	maxWalkMetres := longestWalkMetres(options)
+	nearby := network.stopsWithin(origin, maxWalkMetres)
+	targets := make([]maps.LatLng, len(nearby))
+	for index, stop := range nearby {
+		targets[index] = maps.LatLng{Lat: network.stops[stop].StopLat, Lng: network.stops[stop].StopLon}
+	}
+	for index, metres := range walkingDistances(origin, targets, maxWalkMetres, options) {
+		arrival := reach.departure + walkingSeconds(metres)
+		if !math.IsInf(metres, 1) && arrival <= end {
+			reach.improve(nearby[index], transitLabel{arrival: arrival, trip: -1, boardedAt: -1, walkFrom: -1})
+		}
+	}
+
+	boarded := make([]bool, len(network.trips))
+	boardedAt := make([]int32, len(network.trips))
+	boardedMetres := make([]float64, len(network.trips))
+	first := sort.Search(len(network.connections), func(i int) bool {
+		return network.connections[i].departure >= reach.departure
+	})
+	for _, connection := range network.connections[first:] {
+		if connection.departure > end {
+			break
+		}
+		trip := network.trips[connection.trip]
+		if options.Wheelchair && trip.wheelchairAccessible == WheelchairBoardingNotAccessible {
+			continue
+		}
+
+		if !boarded[connection.trip] {
+			from := reach.labels[connection.from]
+			if !from.reached || from.arrival > connection.departure || (options.Wheelchair &&
+				network.stops[connection.from].WheelchairBoarding == WheelchairBoardingNotAccessible) {
+				continue
+			}
+			boarded[connection.trip], boardedAt[connection.trip] = true, connection.from
+			boardedMetres[connection.trip] = connection.fromMetres
+		}
+
+		if connection.arrival > end || (options.Wheelchair &&
+			network.stops[connection.to].WheelchairBoarding == WheelchairBoardingNotAccessible) {
+			continue
+		}
+		label := transitLabel{arrival: connection.arrival, trip: connection.trip,
+			boardedAt: boardedAt[connection.trip], walkFrom: -1,
+			boardings:  reach.labels[boardedAt[connection.trip]].boardings + 1,
+			rideMetres: connection.toMetres - boardedMetres[connection.trip]}
+		if !reach.improve(connection.to, label) {
+			continue
+		}
+
+		for _, footpath := range network.footpaths[connection.to] {
+			seconds := footpath.seconds
+			if options.Wheelchair {
+				if !footpath.stepFreeWalkable {
+					continue
+				}
+				seconds = footpath.stepFreeSeconds
+			}
+			if label.arrival+seconds <= end {
+				reach.improve(footpath.to, transitLabel{arrival: label.arrival + seconds, boardings: label.boardings,
+					trip: -1, boardedAt: -1, walkFrom: connection.to})
+			}
+		}
+	}
+
+	return reach
+}
+
+// improve sets the label of a stop if it arrives earlier than the one it has,
+// reporting whether it did
+func (reach TransitReach) improve(stop int32, label transitLabel) bool {
+
+	current := reach.labels[stop]
+	if current.reached && current.arrival <= label.arrival {
+		return false
+	}
+	label.reached = true
+	reach.labels[stop] = label
+
+	return true
+}
+
+// ReachedStop is a stop reached by a search, with when it is reached and the
+// number of transfers made on the way
+type ReachedStop struct {
+	TransitStop
+	ArrivalAt     string `json:"arrival_at"`
+	TravelMinutes int    `json:"travel_minutes"`
+	Transfers     int    `json:"transfers"`
+}
+
+// reachedStop returns the ReachedStop for the stop at the index in the network
+func (reach TransitReach) reachedStop(index int32) ReachedStop {
+
+	label := reach.labels[index]
+	arrival := ServiceDayStart(reach.network.serviceDate).Add(time.Duration(label.arrival) * time.Second)
+
+	return ReachedStop{
+		TransitStop:   reach.network.stops[index],
+		ArrivalAt:     arrival.In(dublinLocation).Format(time.RFC3339),
+		TravelMinutes: int((label.arrival - reach.departure) / 60),
+		Transfers:     reach.transfers(index),
+	}
+}
+
+// transfers returns the number of times the bus is changed on the way to the
+// stop at the index in the network
+func (reach TransitReach) transfers(index int32) int {
+
+	if transfers := reach.labels[index].boardings - 1; transfers > 0 {
+		return transfers
+	}
+
+	return 0
+}
+
+// fare returns the fare of the journey to the stop at the index in the network,
+// as the sum of the fares of each bus taken on the way. The journey is followed
+// back through the labels, going no further than one step per stop in case a
+// later label has replaced one on the way
+func (reach TransitReach) fare(index int32) busFares {
+
+	fare := busFares{}
+	for steps := 0; index >= 0 && steps < len(reach.labels); steps++ {
+		label := reach.labels[index]
+		if label.trip < 0 {
+			index = label.walkFrom
+			continue
+		}
+		fare = addFares(fare, fareForDistance(reach.network.trips[label.trip].routeNum, label.rideMetres))
+		index = label.boardedAt
+	}
+
+	return fare
+}
+
+// Stops returns the stops reached, sorted by arrival and then stop number
+func (reach TransitReach) Stops() []ReachedStop {
+
+	reached := []int32{}
+	for index, label := range reach.labels {
+		if label.reached {
+			reached = append(reached, int32(index))
+		}
+	}
+	sort.SliceStable(reached, func(i, j int) bool {
+		a, b := reach.labels[reached[i]], reach.labels[reached[j]]
+		if a.arrival != b.arrival {
+			return a.arrival < b.arrival
+		}
+		return reach.network.stops[reached[i]].StopNumber < reach.network.stops[reached[j]].StopNumber
+	})
+
+	stops := make([]ReachedStop, len(reached))
+	for index, stop := range reached {
+		stops[index] = reach.reachedStop(stop)
+	}
+
+	return stops
+}
+
+// transitNetworkStore keeps the most recently used transit networks, keyed by
+// service date and timetable generation, along with the networks being built.
+// Concurrent requests for the same day wait for a single build, while requests
+// for other days go ahead
+type transitNetworkStore struct {
+	lock     sync.Mutex
+	networks map[string]*TransitNetwork
+	order    []string
+	building map[string]*transitNetworkBuild
+}
+
+// transitNetworkBuild is a network being built, with done closed once the
+// network or the error is set
+type transitNetworkBuild struct {
+	done    chan struct{}
+	network *TransitNetwork
+	err     error
+}
+
+// newTransitNetworkStore returns a transitNetworkStore without any networks
+func newTransitNetworkStore() *transitNetworkStore {
+	return &transitNetworkStore{networks: map[string]*TransitNetwork{}, building: map[string]*transitNetworkBuild{}}
+}
+
+var sharedTransitNetworks = newTransitNetworkStore()
+
+// transitNetworkFor returns the TransitNetwork of the service date, building it
+// from the trips in the timetable running that day or the day before if it
+// isn't already held. The network is built in the background for every request
+// waiting on it, so a request giving up only stops its own wait
+func transitNetworkFor(ctx context.Context, serviceDate time.Time) (*TransitNetwork, error) {
+
+	store := sharedTransitNetworks
+	key := resultCache().TimetableKey("network", serviceDate.Format(serviceDateLayout))
+
+	store.lock.Lock()
+	if network, ok := store.networks[key]; ok {
+		store.lock.Unlock()
+		return network, nil
+	}
+	build, ok := store.building[key]
+	if !ok {
+		build = &transitNetworkBuild{done: make(chan struct{})}
+		store.building[key] = build
+		go store.build(LoggerFromContext(ctx), key, serviceDate, build)
+	}
+	store.lock.Unlock()
+
+	select {
+	case <-build.done:
+		return build.network, build.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// build builds the TransitNetwork of the service date held under the key,
+// keeping it in the store if it could be built. It runs under its own timeout
+// rather than that of the request that started it, logging to the same logger
+func (store *transitNetworkStore) build(logger *Logger, key string, serviceDate time.Time,
+	build *transitNetworkBuild) {
+
+	ctx, cancel := context.WithTimeout(ContextWithLogger(context.Background(), logger), transitNetworkBuildTimeout)
+	defer cancel()
+
+	trips, err := findServiceTrips(ctx, serviceDate, serviceDate.AddDate(0, 0, -1))
+	if err == nil {
+		build.network = BuildTransitNetwork(serviceDate, trips)
+		logger.Info("built transit network", "service_date", serviceDate.Format(serviceDateLayout),
+			"stops", len(build.network.stops), "connections", build.network.Len())
+	}
+	build.err = err
+
+	store.lock.Lock()
+	delete(store.building, key)
+	if err == nil {
+		store.networks[key] = build.network
+		store.order = append(store.order, key)
+		if len(store.order) > transitNetworksKept {
+			delete(store.networks, store.order[0])
+			store.order = store.order[1:]
+		}
+	}
+	store.lock.Unlock()
+	close(build.done)
+}
@@ -0,0 +1,252 @@
+package databaseQueries
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"googlemaps.github.io/maps"
+)
+
+// testTransitStops are the stops of the test network. A, B and C are along a
+// line too far apart to walk between, C2 is a short walk from C and D is far to
+// the north of them
+var testTransitStops = map[string]BusStop{
+	"A":  {StopId: "a", StopName: "A", StopNumber: "1", StopLat: "53.3400", StopLon: "-6.2600"},
+	"B":  {StopId: "b", StopName: "B", StopNumber: "2", StopLat: "53.3400", StopLon: "-6.2400"},
+	"C":  {StopId: "c", StopName: "C", StopNumber: "3", StopLat: "53.3400", StopLon: "-6.2200"},
+	"C2": {StopId: "c2", StopName: "C2", StopNumber: "4", StopLat: "53.3420", StopLon: "-6.2200"},
+	"D":  {StopId: "d", StopName: "D", StopNumber: "5", StopLat: "53.3600", StopLon: "-6.2200"},
+}
+
+// testServiceTrip returns a trip calling at the stops at the times given, as
+// pairs of stop name and time
+func testServiceTrip(tripId string, routeNum string, wheelchairAccessible string, calls ...string) serviceTrip {
+
+	trip := serviceTrip{
+		tripStops:            tripStops{TripId: tripId, RouteNum: routeNum, Direction: "0"},
+		ServiceId:            "weekday",
+		WheelchairAccessible: wheelchairAccessible,
+	}
+	for index := 0; index+1 < len(calls); index += 2 {
+		stop := testTransitStops[calls[index]]
+		stop.ArrivalTime, stop.DepartureTime = calls[index+1], calls[index+1]
+		trip.Stops = append(trip.Stops, stop)
+	}
+
+	return trip
+}
+
+// testServiceTrips are the trips of the test network. Route 3 is the quickest
+// way from A to D but can't be boarded by wheelchair, while routes 1 and 2 get
+// there with a walk between C and C2. Route 4 runs past midnight
+var testServiceTrips = []serviceTrip{
+	testServiceTrip("t1", "1", "1", "A", "08:00:00", "B", "08:10:00", "C", "08:20:00"),
+	testServiceTrip("t2", "2", "1", "C2", "08:30:00", "D", "08:45:00"),
+	testServiceTrip("t3", "3", "2", "A", "08:05:00", "D", "08:25:00"),
+	testServiceTrip("t4", "4", "", "D", "24:30:00", "A", "24:50:00"),
+}
+
+// testServiceDate is the service date the test network is built for
+var testServiceDate = time.Date(2022, 11, 2, 0, 0, 0, 0, dublinLocation)
+
+// reachedStops returns the stops reached by stop name
+func reachedStops(reach TransitReach) map[string]ReachedStop {
+
+	reached := map[string]ReachedStop{}
+	for _, stop := range reach.Stops() {
+		reached[stop.StopName] = stop
+	}
+
+	return reached
+}
+
+func TestTransitNetworkReach(t *testing.T) {
+
+	network := BuildTransitNetwork(testServiceDate, testServiceTrips)
+	if len(network.stops) != 5 || network.Len() != 6 {
+		t.Log("Expected 5 stops and 6 connections, with route 4 added for both days, got", len(network.stops),
+			network.Len())
+		t.Fail()
+	}
+
+	origin := maps.LatLng{Lat: 53.3400, Lng: -6.2600}
+	departure := time.Date(2022, 11, 2, 7, 55, 0, 0, dublinLocation)
+	reach := network.Reach(origin, departure, departure.Add(time.Hour), RouteOptions{})
+	reached := reachedStops(reach)
+	if stops := reach.Stops(); len(stops) != 5 || stops[0].StopName != "A" || stops[0].TravelMinutes != 0 {
+		t.Log("Expected every stop to be reached, starting at the origin, got", stops)
+		t.Fail()
+	}
+	if d := reached["D"]; d.ArrivalAt != "2022-11-02T08:25:00Z" || d.TravelMinutes != 30 || d.Transfers != 0 {
+		t.Log("Expected D to be reached directly on route 3 at 08:25, got", d)
+		t.Fail()
+	}
+	if c2 := reached["C2"]; c2.TravelMinutes != 27 || c2.Transfers != 0 {
+		t.Log("Expected C2 to be walked to from C, got", c2)
+		t.Fail()
+	}
+
+	// Route 3 can't be boarded by wheelchair, so D is reached by changing at C
+	reach = network.Reach(origin, departure, departure.Add(time.Hour), RouteOptions{Wheelchair: true})
+	if d := reachedStops(reach)["D"]; d.ArrivalAt != "2022-11-02T08:45:00Z" || d.Transfers != 1 {
+		t.Log("Expected D to be reached in wheelchair mode at 08:45 with a transfer, got", d)
+		t.Fail()
+	}
+
+	reach = network.Reach(origin, departure, departure.Add(20*time.Minute), RouteOptions{})
+	if reached = reachedStops(reach); len(reached) != 2 || reached["B"].StopNumber != "2" {
+		t.Log("Expected only A and B to be reached within 20 minutes, got", reached)
+		t.Fail()
+	}
+
+	// Just after midnight, route 4 from the day before can still be caught
+	departure = time.Date(2022, 11, 2, 0, 20, 0, 0, dublinLocation)
+	reach = network.Reach(maps.LatLng{Lat: 53.3600, Lng: -6.2200}, departure, departure.Add(time.Hour),
+		RouteOptions{})
+	if a := reachedStops(reach)["A"]; a.ArrivalAt != "2022-11-02T00:50:00Z" {
+		t.Log("Expected A to be reached at 00:50 on the trip of the day before, got", a)
+		t.Fail()
+	}
+}
+
+func TestTransitNetworkFor(t *testing.T) {
+
+	builds := 0
+	var dates []time.Time
+	findServiceTrips = func(ctx context.Context, serviceDates ...time.Time) ([]serviceTrip, error) {
+		builds++
+		dates = serviceDates
+		return testServiceTrips, nil
+	}
+	sharedTransitNetworks = newTransitNetworkStore()
+	defer func() {
+		findServiceTrips = FindServiceTrips
+		sharedTransitNetworks = newTransitNetworkStore()
+	}()
+
+	first, err := transitNetworkFor(context.Background(), testServiceDate)
+	if err != nil {
+		t.Log("Could not build the transit network:", err)
+		t.FailNow()
+	}
+	if again, _ := transitNetworkFor(context.Background(), testServiceDate); again != first || builds != 1 {
+		t.Log("Expected the network of the day to be built once, got", builds, "builds")
+		t.Fail()
+	}
+	if len(dates) != 2 || !dates[0].Equal(testServiceDate) || !dates[1].Equal(testServiceDate.AddDate(0, 0, -1)) {
+		t.Log("Expected only the trips of the day and the day before to be found, got", dates)
+		t.Fail()
+	}
+
+	// Only the two most recently built days are kept
+	transitNetworkFor(context.Background(), testServiceDate.AddDate(0, 0, 1))
+	transitNetworkFor(context.Background(), testServiceDate.AddDate(0, 0, 2))
+	transitNetworkFor(context.Background(), testServiceDate)
+	if builds != 4 || len(sharedTransitNetworks.networks) != 2 {
+		t.Log("Expected the first day to be built again after being dropped, got", builds, "builds")
+		t.Fail()
+	}
+}
+
+func TestTransitNetworkForCancelledRequest(t *testing.T) {
+
+	started, release := make(chan struct{}), make(chan struct{})
+	findServiceTrips = func(ctx context.Context, serviceDates ...time.Time) ([]serviceTrip, error) {
+		close(started)
+		<-release
+		return testServiceTrips, ctx.Err()
+	}
+	sharedTransitNetworks = newTransitNetworkStore()
+	defer func() {
+		findServiceTrips = FindServiceTrips
+		sharedTransitNetworks = newTransitNetworkStore()
+	}()
+
+	// The request that starts the build gives up on it, while another waits
+	requestCtx, cancel := context.WithCancel(context.Background())
+	cancelled := make(chan error, 1)
+	go func() {
+		_, err := transitNetworkFor(requestCtx, testServiceDate)
+		cancelled <- err
+	}()
+	<-started
+	waited := make(chan *TransitNetwork, 1)
+	go func() {
+		network, _ := transitNetworkFor(context.Background(), testServiceDate)
+		waited <- network
+	}()
+
+	cancel()
+	if err := <-cancelled; err != context.Canceled {
+		t.Log("Expected the cancelled request to give up, got", err)
+		t.Fail()
+	}
+	close(release)
+	if network := <-waited; network == nil || network.Len() == 0 {
+		t.Log("Expected the waiting request to get the network built for both")
+		t.Fail()
+	}
+}
+
+func TestTransitNetworkForConcurrentDays(t *testing.T) {
+
+	slowDate := testServiceDate.AddDate(0, 0, 7)
+	started, release := make(chan struct{}), make(chan struct{})
+	var builds int32
+	findServiceTrips = func(ctx context.Context, serviceDates ...time.Time) ([]serviceTrip, error) {
+		atomic.AddInt32(&builds, 1)
+		if serviceDates[0].Equal(slowDate) {
+			close(started)
+			<-release
+		}
+		return testServiceTrips, nil
+	}
+	sharedTransitNetworks = newTransitNetworkStore()
+	defer func() {
+		findServiceTrips = FindServiceTrips
+		sharedTransitNetworks = newTransitNetworkStore()
+	}()
+
+	networks := make(chan *TransitNetwork, 2)
+	for request := 0; request < 2; request++ {
+		go func() {
+			network, _ := transitNetworkFor(context.Background(), slowDate)
+			networks <- network
+		}()
+	}
+
+	// Another day is built while the slow day is still being built
+	<-started
+	if network, err := transitNetworkFor(context.Background(), testServiceDate); err != nil || network == nil {
+		t.Log("Expected another day to be built alongside the slow day, got", err)
+		t.Fail()
+	}
+	close(release)
+
+	if first, second := <-networks, <-networks; first == nil || first != second || atomic.LoadInt32(&builds) != 2 {
+		t.Log("Expected the requests for the slow day to share a single build, got", atomic.LoadInt32(&builds),
+			"builds")
+		t.Fail()
+	}
+}
+
+func TestTransitNetworkStopsWithin(t *testing.T) {
+
+	network := BuildTransitNetwork(testServiceDate, testServiceTrips)
+	origin := maps.LatLng{Lat: 53.3405, Lng: -6.2210}
+
+	// Only C and C2 are near enough, and the other stops aren't in the grid
+	// cells searched
+	within := network.stopsWithin(origin, 500)
+	names := []string{}
+	for _, index := range within {
+		names = append(names, network.stops[index].StopName)
+	}
+	if strings.Join(names, ",") != "C,C2" {
+		t.Log("Expected C and C2 to be within 500 metres, got", names)
+		t.Fail()
+	}
+}
@@ -1,9 +1,9 @@
 package databaseQueries
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
-	"log"
 	"math"
 	"net/http"
 	"net/url"
@@ -12,98 +12,169 @@ import (
 	"time"
 )
 
+// predictionClient is the http client used for requests to the prediction
+// service. Its timeout is only a backstop as the deadline for predictions is
+// normally set through the context of each request
+var predictionClient = &http.Client{Timeout: 30 * time.Second}
+
+// PredictionServiceURL is the base url of the prediction service, with the
+// route, direction, features and date added to its path for each prediction
+var PredictionServiceURL = "https://dublinbus-diy.site/ml/prediction/"
+
 // GetTravelTimePrediction takes in the route number as a string, the
 // date for prediction as a string in the format 'yyyy-MM-dd hh:mm:ss'
 // (including the whitespace) and the direction of travel as a string and
 // then returns the travel time prediction with two other values adjusted
 // for the mean absolute error within the TravelTimePredictionFloat model
-// as well as an error to be checked when generating travel time predictions
+// as well as an error to be checked when generating travel time predictions.
+// The date is read as Dublin time unless it carries an explicit offset and
+// successful predictions are cached per route, direction, hour and version of
+// the features
 func GetTravelTimePrediction(routeNum string,
 	date string,
 	direction string) (TravelTimePredictionFloat, error) {
 
-	// Features for prediction separated out from date here into an
-	// array of strings
-	features := FeatureExtraction(date)
+	return GetTravelTimePredictionWithContext(context.Background(), routeNum, date, direction)
+}
+
+// GetTravelTimePredictionWithContext works exactly as GetTravelTimePrediction but
+// takes in a context as its first parameter, so that the request to the prediction
+// service is abandoned as soon as the context is cancelled or its deadline passes
+func GetTravelTimePredictionWithContext(ctx context.Context,
+	routeNum string,
+	date string,
+	direction string) (TravelTimePredictionFloat, error) {
+
+	requestTime, err := ParseRequestTime(date)
+	if err != nil {
+		return TravelTimePredictionFloat{0, 0, 0}, err
+	}
+
+	// Predictions are cached per route, direction and hour as the features
+	// passed to the model barely change within the hour
+	var travelTime TravelTimePredictionFloat
+	cacheKey := strings.ToUpper(routeNum) + ":" + direction + ":" + requestTime.Format("2006-01-02 15") +
+		":v" + strconv.Itoa(PredictionFeatureVersion)
+	if resultCache().GetJSON(cacheKindPredictions, cacheKey, &travelTime) {
+		return travelTime, nil
+	}
+
+	logger := LoggerFromContext(ctx)
+
+	// Features for prediction assembled from the date, the weather and the
+	// calendar, with the original features in the path and the rest in the query
+	features := AssemblePredictionFeatures(ctx, requestTime, weatherProvider(), dayCalendar(),
+		currentConfig.Calendar.Events)
+	pathValues := features.PathValues()
 
 	// URL is encoded here to prevent there being an issue with
 	// whitespace in the path with some error checks also present
-	baseUrl, err := url.Parse("https://dublinbus-diy.site/ml/prediction/")
+	baseUrl, err := url.Parse(PredictionServiceURL)
+	if err != nil {
+		logger.Error("invalid prediction service url", "error", err)
+	}
+	baseUrl.Path += strings.ToUpper(routeNum) + "/" + direction + "/" + pathValues[0] + "/" +
+		pathValues[1] + "/" + pathValues[2] + "/" + pathValues[3] + "/" + FormatRequestTime(requestTime)
+	baseUrl.RawQuery = features.QueryValues().Encode()
+	logger.Debug("requesting travel time prediction", "url", baseUrl.String())
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseUrl.String(), nil)
 	if err != nil {
-		log.Println("Url Issue: ")
-		log.Println(err.Error())
+		return TravelTimePredictionFloat{0, 0, 0}, err
 	}
-	baseUrl.Path += strings.ToUpper(routeNum) + "/" + direction + "/" + features[0] + "/" +
-		features[1] + "/" + features[2] + "/" + features[3] + "/" + date
-	log.Println(baseUrl.String())
-	resp, err := http.
-		Get(baseUrl.String())
+	resp, err := predictionClient.Do(request)
 	if err != nil {
-		log.Println("Error in the GET request")
-		log.Print(err)
+		logger.Warn("prediction request failed", "route", routeNum, "error", err)
 		return TravelTimePredictionFloat{0, 0, 0}, err
 	}
+	defer resp.Body.Close()
+
+	// Error pages from the prediction service are never taken as predictions
+	if resp.StatusCode != http.StatusOK {
+		logger.Warn("prediction service returned an error", "route", routeNum, "status", resp.StatusCode)
+		return TravelTimePredictionFloat{0, 0, 0}, errors.New("travel time prediction could not be generated")
+	}
 
 	// Response is read in and stored in an object here before transformation
 	// into a string
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Println("Error in the read all call on the response body")
-		log.Print(err)
+		logger.Warn("could not read prediction response", "route", routeNum, "error", err)
 		return TravelTimePredictionFloat{0, 0, 0}, err
 	}
 
-	bodyString := string(body)
+	travelTime, err = parseTravelTimePrediction(string(body))
+	if err != nil {
+		logger.Warn("could not parse prediction response", "route", routeNum, "error", err)
+		return TravelTimePredictionFloat{0, 0, 0}, err
+	}
+
+	resultCache().SetJSON(cacheKindPredictions, cacheKey, travelTime, PredictionCacheTTL)
+	return travelTime, nil
+}
+
+// parseTravelTimePrediction takes in the body returned by the prediction
+// service, a list of the travel time and the travel time plus and minus the
+// mean absolute error, and returns it as a TravelTimePredictionFloat. An error
+// is returned unless the body holds exactly three numbers
+func parseTravelTimePrediction(body string) (TravelTimePredictionFloat, error) {
 
 	// String manipulation used here to have prediction values in correct format
 	// to turn into floating point numbers
-	bodyStringAdjusted := strings.Replace(bodyString, "[", "", 1)
-	bodyStringAdjusted = strings.Replace(bodyStringAdjusted, "]\n", "", 1)
+	bodyStringAdjusted := strings.TrimSpace(body)
+	bodyStringAdjusted = strings.TrimPrefix(bodyStringAdjusted, "[")
+	bodyStringAdjusted = strings.TrimSuffix(bodyStringAdjusted, "]")
 	bodyStrings := strings.Split(bodyStringAdjusted, ",")
-
-	// Final check that travel time object was created correctly
-	if len(bodyStrings) <= 1 {
-		return TravelTimePredictionFloat{0, 0, 0}, errors.
-			New("travel time prediction could not be generated")
+	if len(bodyStrings) != 3 {
+		return TravelTimePredictionFloat{0, 0, 0}, errors.New("travel time prediction could not be generated")
 	}
 
-	// Travel time values turned into floats and then returned with nil error
-	var travelTime TravelTimePredictionFloat
-
-	travelTime.TransitTime, _ = strconv.ParseFloat(bodyStrings[0], 64)
-	travelTime.TransitTimePlusMAE, _ = strconv.ParseFloat(bodyStrings[1], 64)
-	travelTime.TransitTimeMinusMAE, _ = strconv.ParseFloat(bodyStrings[2], 64)
+	values := make([]float64, len(bodyStrings))
+	for index, bodyString := range bodyStrings {
+		value, err := strconv.ParseFloat(strings.TrimSpace(bodyString), 64)
+		if err != nil {
+			return TravelTimePredictionFloat{0, 0, 0}, errors.New("travel time prediction could not be generated")
+		}
+		values[index] = value
+	}
 
-	return travelTime, nil
+	return TravelTimePredictionFloat{
+		TransitTime:         values[0],
+		TransitTimePlusMAE:  values[1],
+		TransitTimeMinusMAE: values[2],
+	}, nil
 }
 
-// FeatureExtraction is a function that uses string manipulation to take
-// in the date parameter for the travel time query and then extracts
-// the necessary predictive features for the predictive models and returns
-// them all in an array of strings
+// FeatureExtraction is a function that takes in the date parameter for the
+// travel time query, parses it into Dublin time using ParseRequestTime and then
+// extracts the necessary predictive features for the predictive models and returns
+// them all in an array of strings. If the date can't be parsed then the error is
+// logged and an empty slice is returned
 func FeatureExtraction(date string) []string {
 
-	dateTimeSplit := strings.Split(date, " ")
-	dateSplit := strings.Split(dateTimeSplit[0], "-")
-	timeSplit := strings.Split(dateTimeSplit[1], ":")
+	requestTime, err := ParseRequestTime(date)
+	if err != nil {
+		defaultLogger.Warn("could not extract features from date", "error", err)
+		return []string{}
+	}
 
-	dayOfWeek := DayOfTheWeek(dateSplit, timeSplit)
-	hour := timeSplit[0]
-	month := dateSplit[1]
-	seconds := SecondsExtraction(timeSplit)
+	return FeatureExtractionFromTime(requestTime)
+}
 
-	featureSlice := []string{dayOfWeek, hour, month, seconds}
-	return featureSlice
+// FeatureExtractionFromTime takes in the time for the travel time query and
+// returns the day of the week (0 being Sunday), the hour, the month and the
+// number of seconds into the service day as strings, all as seen in Dublin. These
+// are the version 1 features, see AssemblePredictionFeatures for the full vector
+func FeatureExtractionFromTime(requestTime time.Time) []string {
+	return newPredictionFeatures(requestTime).PathValues()
 }
 
 // DayOfTheWeek is a function that takes in the slice of strings
 // separating the date and the slice of strings separating the time
-// that was created within the FeatureExtraction function and then
-// uses the built-in time package to determine the day of the week
-// of a given date and return a number from 0-6 inclusive (0 being
-// Sunday). This number is returned as a string to make it suitable
-// for return from FeatureExtraction and for use in the url path for
-// creating travel time predictions
+// in the format used for requests and then uses the built-in time package
+// to determine the day of the week of a given date in Dublin and return a
+// number from 0-6 inclusive (0 being Sunday). This number is returned as a
+// string to make it suitable for use in the url path for creating travel
+// time predictions
 func DayOfTheWeek(dateSlice []string, timeSlice []string) string {
 
 	// Individual fields from each portion of the date and time
@@ -122,28 +193,9 @@ func DayOfTheWeek(dateSlice []string, timeSlice []string) string {
 		time.Month(month),
 		int(day),
 		int(hour),
-		int(minute), int(second), 0, time.Local).Weekday().String()
-
-	// Switch statement used to match return value to given day of the week
-	var dayNum string
-	switch dayOfWeek {
-	case "Sunday":
-		dayNum = "0"
-	case "Monday":
-		dayNum = "1"
-	case "Tuesday":
-		dayNum = "2"
-	case "Wednesday":
-		dayNum = "3"
-	case "Thursday":
-		dayNum = "4"
-	case "Friday":
-		dayNum = "5"
-	case "Saturday":
-		dayNum = "6"
-	}
+		int(minute), int(second), 0, dublinLocation).Weekday()
 
-	return dayNum
+	return strconv.Itoa(int(dayOfWeek))
 }
 
 // SecondsExtraction takes in an array of strings representing the time
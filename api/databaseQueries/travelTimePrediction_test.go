@@ -0,0 +1,52 @@
+package databaseQueries
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTravelTimePrediction(t *testing.T) {
+
+	prediction, err := parseTravelTimePrediction("[1200.5, 1300.5, 1100.5]\n")
+	if err != nil || prediction != (TravelTimePredictionFloat{1200.5, 1300.5, 1100.5}) {
+		t.Log("Expected the three travel times to be read, got", prediction, err)
+		t.Fail()
+	}
+
+	for _, invalid := range []string{"", "[1200.5, 1300.5]\n", "[1200.5, 1300.5, 1100.5, 1]\n",
+		"[1200.5, 1300.5, slow]\n", "<html>Internal Server Error</html>"} {
+		if prediction, err = parseTravelTimePrediction(invalid); err == nil {
+			t.Log("Expected", invalid, "to be refused, got", prediction)
+			t.Fail()
+		}
+	}
+}
+
+func TestGetTravelTimePredictionRefusesErrors(t *testing.T) {
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		calls++
+		if calls == 1 {
+			writer.WriteHeader(http.StatusInternalServerError)
+		}
+		writer.Write([]byte("[1200.5, 1300.5, 1100.5]\n"))
+	}))
+	defer server.Close()
+	previousURL := PredictionServiceURL
+	PredictionServiceURL = server.URL + "/"
+	defer func() { PredictionServiceURL = previousURL }()
+
+	// The error isn't cached, so the prediction is asked for again
+	if _, err := GetTravelTimePredictionWithContext(context.Background(), "46z", "2022-06-15T08:00", "1"); err == nil {
+		t.Log("Expected an error status to be refused")
+		t.Fail()
+	}
+	prediction, err := GetTravelTimePredictionWithContext(context.Background(), "46z", "2022-06-15T08:00", "1")
+	if err != nil || prediction.TransitTime != 1200.5 || calls != 2 {
+		t.Log("Expected the prediction to be asked for again after the error, got", prediction, err, calls)
+		t.Fail()
+	}
+}
@@ -0,0 +1,278 @@
+package databaseQueries
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TripState is the current state of a trip in the GTFS-R trip updates, keyed by
+// the trip id. It is replaced each time the trip is seen in a feed, and the
+// delay is that of the last stop the feed gives one for
+type TripState struct {
+	TripId               string      `bson:"_id" json:"trip_id"`
+	RouteId              string      `bson:"route_id" json:"route_id"`
+	RouteNum             string      `bson:"route_num" json:"route_num"`
+	DirectionId          string      `bson:"direction_id,omitempty" json:"direction_id,omitempty"`
+	StartDate            string      `bson:"start_date,omitempty" json:"start_date,omitempty"`
+	StartTime            string      `bson:"start_time,omitempty" json:"start_time,omitempty"`
+	ScheduleRelationship string      `bson:"schedule_relationship" json:"schedule_relationship"`
+	VehicleId            string      `bson:"vehicle_id,omitempty" json:"vehicle_id,omitempty"`
+	Delay                *int        `bson:"delay,omitempty" json:"delay,omitempty"`
+	StopDelays           []StopDelay `bson:"stop_delays" json:"stop_delays"`
+	FeedTimestamp        time.Time   `bson:"feed_timestamp" json:"feed_timestamp"`
+	UpdatedAt            time.Time   `bson:"updated_at" json:"updated_at"`
+}
+
+// StopDelay is the delay in seconds of the arrival at and departure from a stop
+// of a trip, where the feed gives them, along with whether the stop is skipped
+type StopDelay struct {
+	StopSequence   *int   `bson:"stop_sequence,omitempty" json:"stop_sequence,omitempty"`
+	StopId         string `bson:"stop_id,omitempty" json:"stop_id,omitempty"`
+	ArrivalDelay   *int   `bson:"arrival_delay,omitempty" json:"arrival_delay,omitempty"`
+	DepartureDelay *int   `bson:"departure_delay,omitempty" json:"departure_delay,omitempty"`
+	Skipped        bool   `bson:"skipped,omitempty" json:"skipped,omitempty"`
+}
+
+// RealtimeStore keeps the current state of each trip
+type RealtimeStore interface {
+	// UpsertTripStates adds or replaces the state of each trip given and removes
+	// the states last updated before staleBefore
+	UpsertTripStates(ctx context.Context, states []TripState, staleBefore time.Time) error
+	// FindTripStates returns the state of every trip
+	FindTripStates(ctx context.Context) ([]TripState, error)
+}
+
+// key returns what a stop delay is told apart from the other stops of its trip
+// by, its sequence where the feed gives one and its stop id otherwise
+func (stopDelay StopDelay) key() string {
+
+	if stopDelay.StopSequence != nil {
+		return strconv.Itoa(*stopDelay.StopSequence)
+	}
+
+	return "stop:" + stopDelay.StopId
+}
+
+// ParseTripStates takes in a GTFS-R feed and the time it was fetched and returns
+// the state of each trip it updates, sorted by trip id. The time of the feed is
+// taken from its header, falling back to the time it was fetched
+func ParseTripStates(feed FeedMessage, fetchedAt time.Time) []TripState {
+
+	feedTimestamp, ok := feed.Header.Timestamp.Time()
+	if !ok {
+		feedTimestamp = fetchedAt
+	}
+
+	states := []TripState{}
+	for _, entity := range feed.Entity {
+		update := entity.TripUpdate
+		if entity.IsDeleted || update == nil || update.Trip.TripId == "" {
+			continue
+		}
+
+		state := TripState{
+			TripId:               update.Trip.TripId,
+			RouteId:              update.Trip.RouteId,
+			RouteNum:             routeNumFromRouteId(update.Trip.RouteId),
+			StartDate:            update.Trip.StartDate,
+			StartTime:            update.Trip.StartTime,
+			ScheduleRelationship: update.Trip.ScheduleRelationship,
+			StopDelays:           []StopDelay{},
+			FeedTimestamp:        feedTimestamp.UTC(),
+			UpdatedAt:            fetchedAt.UTC(),
+		}
+		if state.ScheduleRelationship == "" {
+			state.ScheduleRelationship = "SCHEDULED"
+		}
+		if update.Trip.DirectionId != nil {
+			state.DirectionId = strconv.Itoa(*update.Trip.DirectionId)
+		}
+		if update.Vehicle != nil {
+			state.VehicleId = update.Vehicle.Id
+		}
+
+		for _, stopUpdate := range update.StopTimeUpdate {
+			stopDelay := StopDelay{
+				StopSequence: stopUpdate.StopSequence,
+				StopId:       stopUpdate.StopId,
+				Skipped:      stopUpdate.ScheduleRelationship == "SKIPPED",
+			}
+			if delay, found := stopEventDelay(stopUpdate.Arrival, 0); found {
+				stopDelay.ArrivalDelay = &delay
+				state.Delay = stopDelay.ArrivalDelay
+			}
+			if delay, found := stopEventDelay(stopUpdate.Departure, 0); found {
+				stopDelay.DepartureDelay = &delay
+				state.Delay = stopDelay.DepartureDelay
+			}
+			state.StopDelays = append(state.StopDelays, stopDelay)
+		}
+
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].TripId < states[j].TripId })
+
+	return states
+}
+
+// delayRecorder remembers the last delays recorded for each stop of each trip,
+// and how each trip was last scheduled to run, so that only what changed is
+// written to the delay archive
+type delayRecorder struct {
+	recorded      map[string]map[string]StopDelay
+	relationships map[string]string
+}
+
+// delayRecording is the delays and schedule relationships seen by a delayRecorder
+// in one set of trip states, which it treats as recorded once committed
+type delayRecording struct {
+	recorded      map[string]map[string]StopDelay
+	relationships map[string]string
+}
+
+// newDelayRecorder returns a delayRecorder that has recorded nothing
+func newDelayRecorder() *delayRecorder {
+	return &delayRecorder{recorded: map[string]map[string]StopDelay{}, relationships: map[string]string{}}
+}
+
+// Observe takes in the current trip states along with the stops of the trips
+// in the timetable and returns an observation for each trip that is new or
+// whose schedule relationship changed and for each stop whose delays changed
+// since the last commit. It also returns the recording to be committed once the
+// observations have been archived, so that they are observed again if that
+// fails. Trips that are no longer in the states are forgotten, so a full feed
+// is expected each time. A restart forgets everything, but the archive keeps a
+// single record for each trip and each stop of each trip so observing them
+// again adds nothing to it
+func (recorder *delayRecorder) Observe(states []TripState,
+	trips map[string]tripStops) ([]TripObservation, []DelayObservation, delayRecording) {
+
+	tripObservations := []TripObservation{}
+	delayObservations := []DelayObservation{}
+	current := map[string]map[string]StopDelay{}
+	relationships := map[string]string{}
+	for _, state := range states {
+		trip := trips[state.TripId]
+		if relationship, ok := recorder.relationships[state.TripId]; !ok || relationship != state.ScheduleRelationship {
+			tripObservations = append(tripObservations, newTripObservation(state, trip))
+		}
+		relationships[state.TripId] = state.ScheduleRelationship
+
+		previous := recorder.recorded[state.TripId]
+		stops := map[string]StopDelay{}
+		for _, stopDelay := range state.StopDelays {
+			stops[stopDelay.key()] = stopDelay
+			if last, ok := previous[stopDelay.key()]; ok &&
+				equalDelay(last.ArrivalDelay, stopDelay.ArrivalDelay) &&
+				equalDelay(last.DepartureDelay, stopDelay.DepartureDelay) {
+				continue
+			}
+			if stopDelay.ArrivalDelay == nil && stopDelay.DepartureDelay == nil {
+				continue
+			}
+			delayObservations = append(delayObservations, newDelayObservation(state, stopDelay, trip))
+		}
+		current[state.TripId] = stops
+	}
+
+	return tripObservations, delayObservations, delayRecording{recorded: current, relationships: relationships}
+}
+
+// Commit takes in a recording returned by Observe, whose observations have been
+// archived, and remembers it as what was last recorded
+func (recorder *delayRecorder) Commit(recording delayRecording) {
+	recorder.recorded = recording.recorded
+	recorder.relationships = recording.relationships
+}
+
+// equalDelay reports whether two optional delays are the same
+func equalDelay(first *int, second *int) bool {
+
+	if first == nil || second == nil {
+		return first == second
+	}
+
+	return *first == *second
+}
+
+// MemoryRealtimeStore is a RealtimeStore keeping trip states in memory, used
+// within tests and when the api runs without Mongo
+type MemoryRealtimeStore struct {
+	lock   sync.RWMutex
+	states map[string]TripState
+}
+
+// NewMemoryRealtimeStore returns an empty MemoryRealtimeStore
+func NewMemoryRealtimeStore() *MemoryRealtimeStore {
+	return &MemoryRealtimeStore{states: map[string]TripState{}}
+}
+
+// UpsertTripStates adds or replaces the state of each trip given and removes
+// the states last updated before staleBefore
+func (store *MemoryRealtimeStore) UpsertTripStates(ctx context.Context, states []TripState,
+	staleBefore time.Time) error {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for _, state := range states {
+		store.states[state.TripId] = state
+	}
+	for tripId, state := range store.states {
+		if state.UpdatedAt.Before(staleBefore) {
+			delete(store.states, tripId)
+		}
+	}
+
+	return nil
+}
+
+// FindTripStates returns the state of every trip, sorted by trip id
+func (store *MemoryRealtimeStore) FindTripStates(ctx context.Context) ([]TripState, error) {
+
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	states := make([]TripState, 0, len(store.states))
+	for _, state := range store.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].TripId < states[j].TripId })
+
+	return states, nil
+}
+
+var sharedRealtimeStore RealtimeStore
+var sharedRealtimeStoreOnce sync.Once
+
+// realtimeStore returns the RealtimeStore shared by the whole package, creating
+// it from the realtime configuration the first time it is called unless
+// SetRealtimeStore has already been used to provide one
+func realtimeStore() RealtimeStore {
+	sharedRealtimeStoreOnce.Do(func() {
+		if sharedRealtimeStore == nil {
+			sharedRealtimeStore = newRealtimeStore(currentConfig.Realtime)
+		}
+	})
+	return sharedRealtimeStore
+}
+
+// SetRealtimeStore replaces the RealtimeStore shared by the package
+func SetRealtimeStore(store RealtimeStore) {
+	sharedRealtimeStoreOnce.Do(func() {})
+	sharedRealtimeStore = store
+}
+
+// newRealtimeStore returns the RealtimeStore named by the configuration
+func newRealtimeStore(realtimeConfig RealtimeConfig) RealtimeStore {
+
+	if strings.ToLower(realtimeConfig.Store) == "memory" {
+		return NewMemoryRealtimeStore()
+	}
+
+	return NewMongoRealtimeStore(currentConfig.Mongo.Collections.RealtimeData)
+}
@@ -0,0 +1,71 @@
+package databaseQueries
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoRealtimeStore is a RealtimeStore keeping one document per trip in a Mongo
+// collection, keyed by trip id
+type MongoRealtimeStore struct {
+	collection string
+}
+
+// NewMongoRealtimeStore returns a MongoRealtimeStore using the named collection
+func NewMongoRealtimeStore(collection string) *MongoRealtimeStore {
+	return &MongoRealtimeStore{collection: collection}
+}
+
+// UpsertTripStates replaces the document of each trip given, inserting those
+// not yet stored, and then deletes the documents last updated before
+// staleBefore. Unlike the collection being dropped and filled again, readers
+// always find the trips that are still running
+func (store *MongoRealtimeStore) UpsertTripStates(requestCtx context.Context, states []TripState,
+	staleBefore time.Time) error {
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, store.collection)
+	if err != nil {
+		return err
+	}
+	defer disconnect()
+
+	var writes []mongo.WriteModel
+	for _, state := range states {
+		writes = append(writes, mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: state.TripId}}).
+			SetReplacement(state).
+			SetUpsert(true))
+	}
+	if len(writes) > 0 {
+		if _, err = collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+
+	_, err = collection.DeleteMany(ctx, bson.D{{Key: "updated_at", Value: bson.D{{Key: "$lt", Value: staleBefore}}}})
+	return err
+}
+
+// FindTripStates returns the state of every trip, sorted by trip id
+func (store *MongoRealtimeStore) FindTripStates(requestCtx context.Context) ([]TripState, error) {
+
+	states := []TripState{}
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, store.collection)
+	if err != nil {
+		return states, err
+	}
+	defer disconnect()
+
+	cursor, err := collection.Find(ctx, bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return states, err
+	}
+	err = cursor.All(ctx, &states)
+
+	return states, err
+}
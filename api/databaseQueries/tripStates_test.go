@@ -0,0 +1,119 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// testTripUpdateFeed holds an update for a trip that is running late and one
+// for a cancelled trip, in the NTA GTFS-R JSON format
+const testTripUpdateFeed = `{
+	"Header": {"GtfsRealtimeVersion": "2.0", "Incrementality": "FULL_DATASET", "Timestamp": "1655283900"},
+	"Entity": [
+		{
+			"Id": "update-1",
+			"TripUpdate": {
+				"Trip": {"TripId": "trip-46", "RouteId": "60-46A-b12-1", "StartDate": "20220615",
+					"StartTime": "10:00:00", "ScheduleRelationship": "SCHEDULED", "DirectionId": 1},
+				"StopTimeUpdate": [
+					{"StopSequence": 1, "StopId": "stop-1", "Departure": {"Delay": 60}},
+					{"StopSequence": 2, "StopId": "stop-2", "Arrival": {"Delay": 120}, "Departure": {"Delay": 180}}
+				]
+			}
+		},
+		{
+			"Id": "update-2",
+			"TripUpdate": {"Trip": {"TripId": "trip-145", "RouteId": "60-145-b12-1", "ScheduleRelationship": "CANCELED"}}
+		}
+	]
+}`
+
+// parseTestFeed decodes a feed held in a test constant
+func parseTestFeed(t *testing.T, data string) FeedMessage {
+
+	var feed FeedMessage
+	if err := json.Unmarshal([]byte(data), &feed); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	return feed
+}
+
+func TestParseTripStates(t *testing.T) {
+
+	fetchedAt := time.Unix(1655283930, 0)
+	states := ParseTripStates(parseTestFeed(t, testTripUpdateFeed), fetchedAt)
+	if len(states) != 2 {
+		t.Log("Expected a state for each trip, got", states)
+		t.FailNow()
+	}
+
+	state := states[1]
+	if state.TripId != "trip-46" || state.RouteNum != "46A" || state.DirectionId != "1" ||
+		state.Delay == nil || *state.Delay != 180 || len(state.StopDelays) != 2 ||
+		!state.FeedTimestamp.Equal(time.Unix(1655283900, 0)) || !state.UpdatedAt.Equal(fetchedAt) {
+		t.Log("Expected the state of trip-46 to be read from the feed, got", state)
+		t.Fail()
+	}
+	if states[0].TripId != "trip-145" || states[0].ScheduleRelationship != "CANCELED" || states[0].Delay != nil {
+		t.Log("Expected trip-145 to be cancelled, got", states[0])
+		t.Fail()
+	}
+}
+
+func TestDelayRecorderOnlyRecordsChanges(t *testing.T) {
+
+	recorder := newDelayRecorder()
+	states := ParseTripStates(parseTestFeed(t, testTripUpdateFeed), time.Now())
+
+	trips, observations, recording := recorder.Observe(states, nil)
+	if len(trips) != 2 || len(observations) != 2 {
+		t.Log("Expected both trips and both delays of trip-46 to be recorded the first time, got", trips,
+			observations)
+		t.Fail()
+	}
+
+	// Until the recording is committed the same trips and delays are observed
+	if trips, observations, _ = recorder.Observe(states, nil); len(trips) != 2 || len(observations) != 2 {
+		t.Log("Expected everything to be observed again before the commit, got", trips, observations)
+		t.Fail()
+	}
+	recorder.Commit(recording)
+	if trips, observations, _ = recorder.Observe(states, nil); len(trips) != 0 || len(observations) != 0 {
+		t.Log("Expected nothing to be recorded for unchanged trips and delays, got", trips, observations)
+		t.Fail()
+	}
+
+	later := 240
+	states[1].StopDelays[1].DepartureDelay = &later
+	states[1].ScheduleRelationship = "CANCELED"
+	trips, observations, _ = recorder.Observe(states, nil)
+	if len(observations) != 1 || *observations[0].StopSequence != 2 || *observations[0].DepartureDelay != later {
+		t.Log("Expected only the changed delay to be recorded, got", observations)
+		t.Fail()
+	}
+	if len(trips) != 1 || trips[0].Id != "trip-46" || trips[0].ScheduleRelationship != "CANCELED" {
+		t.Log("Expected only the cancelled trip to be recorded, got", trips)
+		t.Fail()
+	}
+}
+
+func TestMemoryRealtimeStoreRemovesStaleTrips(t *testing.T) {
+
+	now := time.Now()
+	store := NewMemoryRealtimeStore()
+	store.UpsertTripStates(context.Background(), []TripState{
+		{TripId: "old", UpdatedAt: now.Add(-3 * time.Hour)},
+		{TripId: "new", UpdatedAt: now.Add(-3 * time.Hour)},
+	}, now.Add(-4*time.Hour))
+	store.UpsertTripStates(context.Background(), []TripState{{TripId: "new", UpdatedAt: now}}, now.Add(-2*time.Hour))
+
+	states, _ := store.FindTripStates(context.Background())
+	if len(states) != 1 || states[0].TripId != "new" {
+		t.Log("Expected only the trip updated recently to be kept, got", states)
+		t.Fail()
+	}
+}
@@ -0,0 +1,69 @@
+package databaseQueries
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// minUserTokenSecretLength is the shortest user token secret allowed for an api
+// key, so that the signatures can't be guessed
+const minUserTokenSecretLength = 32
+
+// ErrInvalidUserToken is returned when a user token is malformed, wasn't signed
+// with the secret of the api key or has expired
+var ErrInvalidUserToken = errors.New("invalid user token")
+
+// SignUserToken takes in the user token secret and name of an api key, the id
+// of a user of the app behind the key and when the token expires and returns a
+// token identifying that user. The app signs a token for each of its users once
+// they have signed in, and they send it as a bearer token in the Authorization
+// header so that their saved journeys are kept apart from those of other users
+func SignUserToken(secret string, keyName string, userID string, expires time.Time) string {
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(userID)) + "." + strconv.FormatInt(expires.Unix(), 10)
+
+	return payload + "." + userTokenSignature(secret, keyName, payload)
+}
+
+// VerifyUserToken takes in the user token secret and name of an api key, a user
+// token sent with that key and the current time and returns the id of the user
+// the token was signed for, or ErrInvalidUserToken if it can't be trusted
+func VerifyUserToken(secret string, keyName string, token string, now time.Time) (string, error) {
+
+	parts := strings.Split(token, ".")
+	if secret == "" || len(parts) != 3 {
+		return "", ErrInvalidUserToken
+	}
+
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(userTokenSignature(secret, keyName, payload))) {
+		return "", ErrInvalidUserToken
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || !now.Before(time.Unix(expires, 0)) {
+		return "", ErrInvalidUserToken
+	}
+	userID, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || strings.TrimSpace(string(userID)) == "" {
+		return "", ErrInvalidUserToken
+	}
+
+	return string(userID), nil
+}
+
+// userTokenSignature returns the signature of the payload of a user token for
+// the named api key. The key name is signed along with the payload so that a
+// token can't be used with another key sharing the same secret
+func userTokenSignature(secret string, keyName string, payload string) string {
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(keyName + "." + payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,35 @@
+package databaseQueries
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserTokens(t *testing.T) {
+
+	secret := strings.Repeat("s", minUserTokenSecretLength)
+	now := time.Date(2022, 6, 15, 8, 0, 0, 0, time.UTC)
+	token := SignUserToken(secret, "web", "alice.smith@example.com", now.Add(time.Hour))
+
+	if userID, err := VerifyUserToken(secret, "web", token, now); err != nil || userID != "alice.smith@example.com" {
+		t.Log("Expected the token to identify alice, got", userID, err)
+		t.Fail()
+	}
+
+	parts := strings.Split(token, ".")
+	forged := SignUserToken("another secret", "web", "bob", now.Add(time.Hour))
+	for name, invalid := range map[string]string{
+		"expired":      SignUserToken(secret, "web", "alice", now),
+		"other key":    SignUserToken(secret, "partner", "alice", now.Add(time.Hour)),
+		"other secret": forged,
+		"changed user": "Ym9i." + parts[1] + "." + parts[2],
+		"empty user":   SignUserToken(secret, "web", "", now.Add(time.Hour)),
+		"malformed":    "alice",
+	} {
+		if userID, err := VerifyUserToken(secret, "web", invalid, now); err != ErrInvalidUserToken {
+			t.Log("Expected the", name, "token to be refused, got", userID, err)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package databaseQueries
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// cacheKindTripStops is the kind of cached result holding the stops of a trip
+const cacheKindTripStops = "trip_stops"
+
+// feedDateLayout is the layout of the start date of a trip in a GTFS-R feed
+const feedDateLayout = "20060102"
+
+// tripStops holds the route, direction and stops of a trip in the timetable
+type tripStops struct {
+	TripId    string    `bson:"trip_id" json:"trip_id"`
+	RouteNum  string    `bson:"route_num" json:"route_num"`
+	Direction string    `bson:"direction" json:"direction"`
+	Stops     []BusStop `bson:"stops" json:"stops"`
+}
+
+// tripStopsFinder is the signature of FindTripStops, which findTripStops is set
+// to outside of tests
+type tripStopsFinder func(ctx context.Context, tripIds []string) (map[string]tripStops, error)
+
+var findTripStops tripStopsFinder = FindTripStops
+
+// timedStop is a stop of a trip with the instants a vehicle is expected to
+// arrive at and depart from it once delays are taken into account
+type timedStop struct {
+	stop      BusStop
+	lat       float64
+	lon       float64
+	arrival   time.Time
+	departure time.Time
+	delay     int
+}
+
+// FindTripStops takes in the context of the request and trip ids and returns
+// the stops of each trip found in the timetable, keyed by trip id. The stops of
+// each trip are cached against the timetable generation
+func FindTripStops(requestCtx context.Context, tripIds []string) (map[string]tripStops, error) {
+
+	trips := map[string]tripStops{}
+	var missing []string
+	for _, tripId := range tripIds {
+		var trip tripStops
+		if resultCache().GetJSON(cacheKindTripStops, resultCache().TimetableKey("trip", tripId), &trip) {
+			trips[tripId] = trip
+		} else {
+			missing = append(missing, tripId)
+		}
+	}
+	if len(missing) == 0 {
+		return trips, nil
+	}
+
+	collection, ctx, disconnect, err := openTimetable(requestCtx)
+	if err != nil {
+		return trips, err
+	}
+	defer disconnect()
+
+	cursor, err := collection.Aggregate(ctx, bson.A{
+		bson.D{{Key: "$match", Value: bson.D{{Key: "trip_id", Value: bson.D{{Key: "$in", Value: missing}}}}}},
+		bson.D{{Key: "$project", Value: bson.D{
+			{Key: "_id", Value: 0},
+			{Key: "trip_id", Value: 1},
+			{Key: "route_num", Value: "$route.route_short_name"},
+			{Key: "direction", Value: "$direction_id"},
+			{Key: "stops", Value: 1},
+		}}},
+	})
+	if err != nil {
+		return trips, err
+	}
+
+	var found []tripStops
+	if err = cursor.All(ctx, &found); err != nil {
+		return trips, err
+	}
+	for _, trip := range found {
+		trips[trip.TripId] = trip
+		resultCache().SetJSON(cacheKindTripStops, resultCache().TimetableKey("trip", trip.TripId), trip,
+			RouteCatalogueCacheTTL)
+	}
+
+	return trips, nil
+}
+
+// InferTripPosition takes in a trip update, the stops of the trip and an instant
+// and returns where the vehicle making the trip is expected to be at that
+// instant. The delays in the update are applied to the timetable, with each
+// carrying on to the following stops until another is given, and a vehicle
+// between two stops is placed along the straight line between them in
+// proportion to the time travelled. False is returned for a trip that hasn't
+// started or has already finished at the instant
+func InferTripPosition(update FeedTripUpdate, trip tripStops, instant time.Time) (VehiclePosition, bool) {
+
+	stops := timeTripStops(update, trip, instant)
+	if len(stops) == 0 || instant.Before(stops[0].departure) || instant.After(stops[len(stops)-1].arrival) {
+		return VehiclePosition{}, false
+	}
+
+	position := VehiclePosition{
+		TripId:      trip.TripId,
+		RouteId:     update.Trip.RouteId,
+		RouteNum:    trip.RouteNum,
+		DirectionId: trip.Direction,
+		Source:      VehicleSourceTripUpdate,
+		Timestamp:   instant.UTC(),
+	}
+	if update.Vehicle != nil {
+		position.VehicleId = update.Vehicle.Id
+		position.Label = update.Vehicle.Label
+	}
+
+	for index, stop := range stops {
+		delay := stop.delay
+		if !instant.Before(stop.arrival) && !instant.After(stop.departure) {
+			position.Lat, position.Lon = stop.lat, stop.lon
+			position.StopId = stop.stop.StopId
+			position.CurrentStatus = "STOPPED_AT"
+			position.Delay = &delay
+			if index+1 < len(stops) {
+				position.Bearing = bearingDegrees(stop.lat, stop.lon, stops[index+1].lat, stops[index+1].lon)
+			}
+			return position, true
+		}
+
+		if index+1 < len(stops) && instant.After(stop.departure) && instant.Before(stops[index+1].arrival) {
+			next := stops[index+1]
+			fraction := float64(instant.Sub(stop.departure)) / float64(next.arrival.Sub(stop.departure))
+			position.Lat = stop.lat + (next.lat-stop.lat)*fraction
+			position.Lon = stop.lon + (next.lon-stop.lon)*fraction
+			position.StopId = next.stop.StopId
+			position.CurrentStatus = "IN_TRANSIT_TO"
+			position.Delay = &delay
+			position.Bearing = bearingDegrees(stop.lat, stop.lon, next.lat, next.lon)
+			return position, true
+		}
+	}
+
+	return VehiclePosition{}, false
+}
+
+// timeTripStops returns the stops of a trip in order with the instants the
+// vehicle is expected at each, on the service date the trip started on or,
+// where the update doesn't say, the service day of the instant. Stops whose
+// times or coordinates can't be read are left out
+func timeTripStops(update FeedTripUpdate, trip tripStops, instant time.Time) []timedStop {
+
+	serviceDate, _ := ServiceDay(instant)
+	if startDate, err := time.ParseInLocation(feedDateLayout, update.Trip.StartDate, dublinLocation); err == nil {
+		serviceDate = startDate
+	}
+	dayStart := ServiceDayStart(serviceDate)
+
+	stops := append([]BusStop{}, trip.Stops...)
+	sort.SliceStable(stops, func(i, j int) bool {
+		first, _ := strconv.Atoi(stops[i].StopSequence)
+		second, _ := strconv.Atoi(stops[j].StopSequence)
+		return first < second
+	})
+
+	// Stops before the first update are given its delay, and the departure
+	// delay at each updated stop then carries on to the following stops
+	delay := 0
+	if len(update.StopTimeUpdate) > 0 {
+		delay, _ = stopEventDelay(update.StopTimeUpdate[0].Departure, 0)
+		delay, _ = stopEventDelay(update.StopTimeUpdate[0].Arrival, delay)
+	}
+
+	var timed []timedStop
+	for _, stop := range stops {
+		arrivalSeconds, arrivalOk := parseServiceTime(stop.ArrivalTime)
+		departureSeconds, departureOk := parseServiceTime(stop.DepartureTime)
+		lat, latErr := strconv.ParseFloat(stop.StopLat, 64)
+		lon, lonErr := strconv.ParseFloat(stop.StopLon, 64)
+		if !arrivalOk || !departureOk || latErr != nil || lonErr != nil {
+			continue
+		}
+		scheduledArrival := dayStart.Add(time.Duration(arrivalSeconds) * time.Second)
+		scheduledDeparture := dayStart.Add(time.Duration(departureSeconds) * time.Second)
+
+		arrivalDelay, departureDelay := delay, delay
+		if stopUpdate, ok := findStopTimeUpdate(update.StopTimeUpdate, stop); ok {
+			arrivalDelay = stopEventDelayAt(stopUpdate.Arrival, scheduledArrival, delay)
+			departureDelay = stopEventDelayAt(stopUpdate.Departure, scheduledDeparture, arrivalDelay)
+			if stopUpdate.Arrival == nil {
+				arrivalDelay = departureDelay
+			}
+			delay = departureDelay
+		}
+
+		arrival := scheduledArrival.Add(time.Duration(arrivalDelay) * time.Second)
+		departure := scheduledDeparture.Add(time.Duration(departureDelay) * time.Second)
+		if departure.Before(arrival) {
+			departure = arrival
+		}
+		timed = append(timed, timedStop{stop: stop, lat: lat, lon: lon,
+			arrival: arrival, departure: departure, delay: departureDelay})
+	}
+
+	return timed
+}
+
+// findStopTimeUpdate returns the update for a stop, matched on its sequence
+// in the trip or failing that its stop id
+func findStopTimeUpdate(updates []FeedStopTimeUpdate, stop BusStop) (FeedStopTimeUpdate, bool) {
+
+	for _, update := range updates {
+		if update.StopSequence != nil && strconv.Itoa(*update.StopSequence) == stop.StopSequence {
+			return update, true
+		}
+	}
+	for _, update := range updates {
+		if update.StopSequence == nil && update.StopId != "" && update.StopId == stop.StopId {
+			return update, true
+		}
+	}
+
+	return FeedStopTimeUpdate{}, false
+}
+
+// stopEventDelay returns the delay in seconds of an arrival or departure,
+// reporting false and returning the fallback if it has none
+func stopEventDelay(event *FeedStopEvent, fallback int) (int, bool) {
+
+	if event == nil || event.Delay == nil {
+		return fallback, false
+	}
+
+	return *event.Delay, true
+}
+
+// stopEventDelayAt returns the delay in seconds of an arrival or departure
+// scheduled for the instant given, working it out from the time of the event
+// where no delay is given and returning the fallback where neither is
+func stopEventDelayAt(event *FeedStopEvent, scheduled time.Time, fallback int) int {
+
+	if delay, ok := stopEventDelay(event, fallback); ok {
+		return delay
+	}
+	if event != nil {
+		if eventTime, ok := event.Time.Time(); ok {
+			return int(eventTime.Sub(scheduled) / time.Second)
+		}
+	}
+
+	return fallback
+}
+
+// bearingDegrees returns the initial bearing in degrees clockwise from north
+// from one point to another, or nil if the points are the same
+func bearingDegrees(latA float64, lonA float64, latB float64, lonB float64) *float64 {
+
+	if latA == latB && lonA == lonB {
+		return nil
+	}
+
+	radiansLatA := latA * math.Pi / 180
+	radiansLatB := latB * math.Pi / 180
+	deltaLon := (lonB - lonA) * math.Pi / 180
+
+	y := math.Sin(deltaLon) * math.Cos(radiansLatB)
+	x := math.Cos(radiansLatA)*math.Sin(radiansLatB) - math.Sin(radiansLatA)*math.Cos(radiansLatB)*math.Cos(deltaLon)
+	bearing := math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+	bearing = math.Round(bearing*10) / 10
+
+	return &bearing
+}
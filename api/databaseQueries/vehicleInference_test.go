@@ -0,0 +1,98 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+// testTrip is a trip of three stops heading east, ten minutes apart
+var testTrip = tripStops{
+	TripId:    "trip-46",
+	RouteNum:  "46A",
+	Direction: "1",
+	Stops: []BusStop{
+		{StopId: "stop-1", StopSequence: "1", StopLat: "53.3", StopLon: "-6.30",
+			ArrivalTime: "10:00:00", DepartureTime: "10:00:00"},
+		{StopId: "stop-2", StopSequence: "2", StopLat: "53.3", StopLon: "-6.28",
+			ArrivalTime: "10:10:00", DepartureTime: "10:11:00"},
+		{StopId: "stop-3", StopSequence: "3", StopLat: "53.3", StopLon: "-6.26",
+			ArrivalTime: "10:21:00", DepartureTime: "10:21:00"},
+	},
+}
+
+// testTripTime returns the instant of the time on the day of testTrip
+func testTripTime(hour int, minute int) time.Time {
+	return time.Date(2022, 6, 15, hour, minute, 0, 0, dublinLocation)
+}
+
+func TestInferTripPositionBetweenStops(t *testing.T) {
+
+	update := FeedTripUpdate{Trip: FeedTripDescriptor{TripId: "trip-46", StartDate: "20220615"}}
+
+	position, ok := InferTripPosition(update, testTrip, testTripTime(10, 5))
+	if !ok {
+		t.Log("Expected a position halfway between the first two stops")
+		t.FailNow()
+	}
+	if position.Lon < -6.2901 || position.Lon > -6.2899 || position.StopId != "stop-2" ||
+		position.CurrentStatus != "IN_TRANSIT_TO" || position.Source != VehicleSourceTripUpdate {
+		t.Log("Expected a position halfway to stop-2, got", position)
+		t.Fail()
+	}
+	if position.Bearing == nil || *position.Bearing < 89 || *position.Bearing > 91 {
+		t.Log("Expected the vehicle to be heading east, got", position.Bearing)
+		t.Fail()
+	}
+}
+
+func TestInferTripPositionAtStop(t *testing.T) {
+
+	update := FeedTripUpdate{Trip: FeedTripDescriptor{TripId: "trip-46", StartDate: "20220615"}}
+
+	position, ok := InferTripPosition(update, testTrip, testTripTime(10, 10).Add(30*time.Second))
+	if !ok || position.StopId != "stop-2" || position.CurrentStatus != "STOPPED_AT" || position.Lon != -6.28 {
+		t.Log("Expected the vehicle to be stopped at stop-2, got", position, ok)
+		t.Fail()
+	}
+}
+
+func TestInferTripPositionOutsideTrip(t *testing.T) {
+
+	update := FeedTripUpdate{Trip: FeedTripDescriptor{TripId: "trip-46", StartDate: "20220615"}}
+
+	if _, ok := InferTripPosition(update, testTrip, testTripTime(9, 59)); ok {
+		t.Log("Expected no position before the trip starts")
+		t.Fail()
+	}
+	if _, ok := InferTripPosition(update, testTrip, testTripTime(10, 22)); ok {
+		t.Log("Expected no position after the trip finishes")
+		t.Fail()
+	}
+}
+
+func TestInferTripPositionAppliesDelays(t *testing.T) {
+
+	delay := 300
+	sequence := 2
+	update := FeedTripUpdate{
+		Trip: FeedTripDescriptor{TripId: "trip-46", StartDate: "20220615"},
+		StopTimeUpdate: []FeedStopTimeUpdate{
+			{StopSequence: &sequence, Departure: &FeedStopEvent{Delay: &delay}},
+		},
+	}
+
+	// The delay at stop-2 also applies to stop-1 before it, so the vehicle is
+	// only leaving stop-1 at 10:05
+	position, ok := InferTripPosition(update, testTrip, testTripTime(10, 5))
+	if !ok || position.StopId != "stop-1" || position.Delay == nil || *position.Delay != delay {
+		t.Log("Expected the vehicle to be at stop-1 five minutes late, got", position, ok)
+		t.Fail()
+	}
+
+	// Carried on to stop-3, the trip only finishes at 10:26
+	position, ok = InferTripPosition(update, testTrip, testTripTime(10, 25))
+	if !ok || position.StopId != "stop-3" || position.CurrentStatus != "IN_TRANSIT_TO" {
+		t.Log("Expected the vehicle to still be heading to stop-3, got", position, ok)
+		t.Fail()
+	}
+}
@@ -0,0 +1,555 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sources of a vehicle position, either given by the vehicle itself in a
+// GTFS-R VehiclePositions feed or inferred from a GTFS-R TripUpdates feed
+const (
+	VehicleSourceVehiclePosition = "vehicle_position"
+	VehicleSourceTripUpdate      = "trip_update"
+)
+
+// vehicleStreamBuffer is how many updates are held for a stream that is slow to
+// read them before it is closed, leaving the client to reconnect
+const vehicleStreamBuffer = 16
+
+// vehicleStreamRetry is how long a client is told to wait before reconnecting
+// to the vehicle stream
+const vehicleStreamRetry = 5 * time.Second
+
+// VehiclePosition is the latest position of a vehicle, or of the trip it is
+// making where the vehicle isn't known. The id is the vehicle id or, failing
+// that, the trip id prefixed with "trip:". Positions inferred from trip updates
+// also carry the delay in seconds they were inferred from
+type VehiclePosition struct {
+	Id            string    `json:"id"`
+	VehicleId     string    `json:"vehicle_id,omitempty"`
+	Label         string    `json:"label,omitempty"`
+	TripId        string    `json:"trip_id,omitempty"`
+	RouteId       string    `json:"route_id,omitempty"`
+	RouteNum      string    `json:"route_num,omitempty"`
+	DirectionId   string    `json:"direction_id,omitempty"`
+	Lat           float64   `json:"lat"`
+	Lon           float64   `json:"lon"`
+	Bearing       *float64  `json:"bearing,omitempty"`
+	Speed         *float64  `json:"speed,omitempty"`
+	StopId        string    `json:"stop_id,omitempty"`
+	CurrentStatus string    `json:"current_status,omitempty"`
+	Delay         *int      `json:"delay,omitempty"`
+	Source        string    `json:"source"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// VehicleUpdate is a change to the tracked vehicles, holding the positions that
+// were added or moved and the ids of those that were removed
+type VehicleUpdate struct {
+	Positions []VehiclePosition `json:"positions"`
+	Removed   []string          `json:"removed"`
+}
+
+// BoundingBox is an area of the map between two longitudes and two latitudes
+type BoundingBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// VehicleFilter narrows vehicle positions down to a route number and to those
+// within a bounding box, either of which may be left out
+type VehicleFilter struct {
+	RouteNum    string
+	BoundingBox *BoundingBox
+}
+
+// VehicleTracker keeps the latest position of each vehicle and passes each
+// change on to its subscribers. Positions older than the maximum age are
+// dropped, as are positions inferred for a trip once the vehicle making it
+// reports its own
+type VehicleTracker struct {
+	lock        sync.RWMutex
+	maxAge      time.Duration
+	positions   map[string]VehiclePosition
+	subscribers map[chan VehicleUpdate]bool
+	closed      bool
+}
+
+// NewVehicleTracker returns an empty VehicleTracker dropping positions older
+// than maxAge
+func NewVehicleTracker(maxAge time.Duration) *VehicleTracker {
+	return &VehicleTracker{
+		maxAge:      maxAge,
+		positions:   map[string]VehiclePosition{},
+		subscribers: map[chan VehicleUpdate]bool{},
+	}
+}
+
+// ParseBoundingBox reads a bounding box given as minLon,minLat,maxLon,maxLat
+func ParseBoundingBox(bbox string) (BoundingBox, error) {
+
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return BoundingBox{}, errors.New("expected minLon,minLat,maxLon,maxLat")
+	}
+
+	var values [4]float64
+	for index, part := range parts {
+		value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BoundingBox{}, fmt.Errorf("invalid coordinate '%s'", part)
+		}
+		values[index] = value
+	}
+
+	box := BoundingBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+	if box.MinLon > box.MaxLon || box.MinLat > box.MaxLat {
+		return BoundingBox{}, errors.New("minimum coordinates must not be greater than the maximum")
+	}
+
+	return box, nil
+}
+
+// Contains reports whether the point is within the bounding box
+func (box BoundingBox) Contains(lat float64, lon float64) bool {
+	return lat >= box.MinLat && lat <= box.MaxLat && lon >= box.MinLon && lon <= box.MaxLon
+}
+
+// ParseVehicleFilter reads a VehicleFilter from the route and bbox query
+// parameters, where the bounding box is read by ParseBoundingBox
+func ParseVehicleFilter(route string, bbox string) (VehicleFilter, error) {
+
+	filter := VehicleFilter{RouteNum: strings.TrimSpace(route)}
+	if strings.TrimSpace(bbox) != "" {
+		box, err := ParseBoundingBox(bbox)
+		if err != nil {
+			return VehicleFilter{}, err
+		}
+		filter.BoundingBox = &box
+	}
+
+	return filter, nil
+}
+
+// Matches reports whether the position is let through by the filter
+func (filter VehicleFilter) Matches(position VehiclePosition) bool {
+
+	if filter.RouteNum != "" && !strings.EqualFold(position.RouteNum, filter.RouteNum) {
+		return false
+	}
+
+	return filter.BoundingBox == nil || filter.BoundingBox.Contains(position.Lat, position.Lon)
+}
+
+// vehiclePositionId returns the id a position is tracked under
+func vehiclePositionId(position VehiclePosition) string {
+
+	if position.VehicleId != "" {
+		return position.VehicleId
+	}
+
+	return "trip:" + position.TripId
+}
+
+// Update adds the positions to the tracker, replacing older positions with the
+// same id, drops any positions that are too old at now and passes the changes
+// on to the subscribers
+func (tracker *VehicleTracker) Update(positions []VehiclePosition, now time.Time) {
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	// Trips whose vehicles report their own positions aren't inferred
+	reportedTrips := map[string]bool{}
+	for _, position := range positions {
+		if position.Source == VehicleSourceVehiclePosition && position.TripId != "" {
+			reportedTrips[position.TripId] = true
+		}
+	}
+	for _, position := range tracker.positions {
+		if position.Source == VehicleSourceVehiclePosition && position.TripId != "" &&
+			now.Sub(position.Timestamp) <= tracker.maxAge {
+			reportedTrips[position.TripId] = true
+		}
+	}
+
+	update := VehicleUpdate{Positions: []VehiclePosition{}, Removed: []string{}}
+	for _, position := range positions {
+		if position.Source == VehicleSourceTripUpdate && reportedTrips[position.TripId] {
+			continue
+		}
+		position.Id = vehiclePositionId(position)
+		if existing, ok := tracker.positions[position.Id]; ok && existing.Timestamp.After(position.Timestamp) {
+			continue
+		}
+		tracker.positions[position.Id] = position
+		update.Positions = append(update.Positions, position)
+	}
+
+	for id, position := range tracker.positions {
+		inferredForReportedTrip := position.Source == VehicleSourceTripUpdate && reportedTrips[position.TripId]
+		if now.Sub(position.Timestamp) > tracker.maxAge || inferredForReportedTrip {
+			delete(tracker.positions, id)
+			update.Removed = append(update.Removed, id)
+		}
+	}
+
+	if len(update.Positions) == 0 && len(update.Removed) == 0 {
+		return
+	}
+	for subscriber := range tracker.subscribers {
+		select {
+		case subscriber <- update:
+		default:
+			// The subscriber has fallen too far behind, so its stream is ended
+			// and the client reconnects to start again from a snapshot
+			delete(tracker.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Positions returns the positions let through by the filter that aren't too
+// old at now, sorted by id
+func (tracker *VehicleTracker) Positions(filter VehicleFilter, now time.Time) []VehiclePosition {
+
+	tracker.lock.RLock()
+	defer tracker.lock.RUnlock()
+
+	positions := []VehiclePosition{}
+	for _, position := range tracker.positions {
+		if now.Sub(position.Timestamp) <= tracker.maxAge && filter.Matches(position) {
+			positions = append(positions, position)
+		}
+	}
+	sort.Slice(positions, func(i, j int) bool { return positions[i].Id < positions[j].Id })
+
+	return positions
+}
+
+// Subscribe returns a channel receiving each change to the tracked positions
+// along with a function to stop receiving them. The channel is closed if the
+// subscriber falls too far behind or the tracker is closed
+func (tracker *VehicleTracker) Subscribe() (<-chan VehicleUpdate, func()) {
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	subscriber := make(chan VehicleUpdate, vehicleStreamBuffer)
+	if tracker.closed {
+		close(subscriber)
+		return subscriber, func() {}
+	}
+	tracker.subscribers[subscriber] = true
+
+	return subscriber, func() {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+		if tracker.subscribers[subscriber] {
+			delete(tracker.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Close closes the channel of every subscriber, ending their streams, and has
+// any later subscriber's channel closed straight away. Positions are still kept
+// up to date for GetVehicles
+func (tracker *VehicleTracker) Close() {
+
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	tracker.closed = true
+	for subscriber := range tracker.subscribers {
+		delete(tracker.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// CloseVehicleStreams ends every vehicle stream, so that the server can shut
+// down without waiting on streams that would otherwise never finish. It is
+// registered with the http.Server to be called on shutdown
+func CloseVehicleStreams() {
+	vehicleTracker().Close()
+}
+
+// Filter returns the part of the update let through by the filter. Removed ids
+// are always kept as the position removed may have matched
+func (update VehicleUpdate) Filter(filter VehicleFilter) VehicleUpdate {
+
+	filtered := VehicleUpdate{Positions: []VehiclePosition{}, Removed: update.Removed}
+	for _, position := range update.Positions {
+		if filter.Matches(position) {
+			filtered.Positions = append(filtered.Positions, position)
+		}
+	}
+
+	return filtered
+}
+
+var sharedVehicleTracker *VehicleTracker
+var sharedVehicleTrackerOnce sync.Once
+
+// vehicleTracker returns the VehicleTracker shared by the whole package,
+// creating it from the vehicles configuration the first time it is called
+// unless SetVehicleTracker has already been used to provide one
+func vehicleTracker() *VehicleTracker {
+	sharedVehicleTrackerOnce.Do(func() {
+		if sharedVehicleTracker == nil {
+			sharedVehicleTracker = NewVehicleTracker(time.Duration(currentConfig.Vehicles.MaxAge))
+		}
+	})
+	return sharedVehicleTracker
+}
+
+// SetVehicleTracker replaces the VehicleTracker shared by the package
+func SetVehicleTracker(tracker *VehicleTracker) {
+	sharedVehicleTrackerOnce.Do(func() {})
+	sharedVehicleTracker = tracker
+}
+
+// ParseVehiclePositions takes in a GTFS-R feed and returns the positions given
+// by its vehicle entities, with their route numbers resolved from the
+// references. Entities without a position or without a vehicle or trip to
+// track it by are left out, and those without a timestamp take the feed's
+func ParseVehiclePositions(feed FeedMessage, references feedReferences) []VehiclePosition {
+
+	feedTimestamp, _ := feed.Header.Timestamp.Time()
+
+	positions := []VehiclePosition{}
+	for _, entity := range feed.Entity {
+		vehicle := entity.Vehicle
+		if entity.IsDeleted || vehicle == nil || vehicle.Position == nil {
+			continue
+		}
+
+		position := VehiclePosition{
+			Lat:           vehicle.Position.Latitude,
+			Lon:           vehicle.Position.Longitude,
+			Bearing:       vehicle.Position.Bearing,
+			Speed:         vehicle.Position.Speed,
+			StopId:        vehicle.StopId,
+			CurrentStatus: vehicle.CurrentStatus,
+			Source:        VehicleSourceVehiclePosition,
+			Timestamp:     feedTimestamp,
+		}
+		if timestamp, ok := vehicle.Timestamp.Time(); ok {
+			position.Timestamp = timestamp
+		}
+		if vehicle.Vehicle != nil {
+			position.VehicleId = vehicle.Vehicle.Id
+			position.Label = vehicle.Vehicle.Label
+		}
+		if vehicle.Trip != nil {
+			position.TripId = vehicle.Trip.TripId
+			position.RouteId = vehicle.Trip.RouteId
+			if vehicle.Trip.DirectionId != nil {
+				position.DirectionId = strconv.Itoa(*vehicle.Trip.DirectionId)
+			}
+		}
+		if position.VehicleId == "" && position.TripId == "" {
+			continue
+		}
+
+		if routeNum, ok := references.RouteNums[position.RouteId]; ok {
+			position.RouteNum = routeNum
+		} else if routeNum, ok = references.TripRouteNums[position.TripId]; ok {
+			position.RouteNum = routeNum
+		} else {
+			position.RouteNum = routeNumFromRouteId(position.RouteId)
+		}
+
+		positions = append(positions, position)
+	}
+
+	return positions
+}
+
+// IngestVehiclePositions takes in the context of the request, a GTFS-R feed and
+// the tracker to keep positions in and adds the positions of the vehicles in
+// the feed along with those inferred for the trips it updates, as of the time
+// of the feed, returning the number of positions found. Cancelled trips are
+// left out of the inferred positions
+func IngestVehiclePositions(ctx context.Context, feed FeedMessage, tracker *VehicleTracker) (int, error) {
+
+	now := time.Now()
+	instant, ok := feed.Header.Timestamp.Time()
+	if !ok {
+		instant = now
+	}
+
+	var routeIds, tripIds []string
+	updates := map[string]FeedTripUpdate{}
+	for _, entity := range feed.Entity {
+		if entity.IsDeleted {
+			continue
+		}
+		if entity.Vehicle != nil && entity.Vehicle.Trip != nil {
+			routeIds = append(routeIds, entity.Vehicle.Trip.RouteId)
+			tripIds = append(tripIds, entity.Vehicle.Trip.TripId)
+		}
+		if entity.TripUpdate != nil && entity.TripUpdate.Trip.TripId != "" &&
+			entity.TripUpdate.Trip.ScheduleRelationship != "CANCELED" {
+			updates[entity.TripUpdate.Trip.TripId] = *entity.TripUpdate
+		}
+	}
+
+	var references feedReferences
+	if len(routeIds) > 0 || len(tripIds) > 0 {
+		var err error
+		references, err = resolveFeedReferences(ctx, routeIds, tripIds, nil)
+		if err != nil {
+			LoggerFromContext(ctx).Warn("could not resolve vehicle routes", "error", err)
+		}
+	}
+	positions := ParseVehiclePositions(feed, references)
+
+	if len(updates) > 0 {
+		updatedTrips := make([]string, 0, len(updates))
+		for tripId := range updates {
+			updatedTrips = append(updatedTrips, tripId)
+		}
+		trips, err := findTripStops(ctx, updatedTrips)
+		if err != nil {
+			return 0, err
+		}
+		for tripId, update := range updates {
+			trip, found := trips[tripId]
+			if !found {
+				continue
+			}
+			if position, ok := InferTripPosition(update, trip, instant); ok {
+				positions = append(positions, position)
+			}
+		}
+	}
+
+	tracker.Update(positions, now)
+	return len(positions), nil
+}
+
+// GetVehicles returns the latest vehicle positions, narrowed down to a route
+// number with the route query parameter and to a bounding box given as
+// minLon,minLat,maxLon,maxLat with the bbox query parameter
+func GetVehicles(c *gin.Context) {
+
+	filter, err := ParseVehicleFilter(c.Query("route"), c.Query("bbox"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid bbox parameter in request: "+err.Error())
+		return
+	}
+
+	c.IndentedJSON(http.StatusOK, vehicleTracker().Positions(filter, time.Now()))
+}
+
+// StreamVehicles streams the vehicle positions as Server-Sent Events, starting
+// with a snapshot event holding every position let through by the route and
+// bbox query parameters, as for GetVehicles, followed by an update event for
+// each change to them. A comment is sent at each heartbeat to keep the
+// connection open, and each write is given the server's write timeout rather
+// than the stream as a whole. Streams that fall behind, can't be written to or
+// are closed on shutdown are ended and the client reconnects for a new snapshot
+func StreamVehicles(c *gin.Context) {
+
+	filter, err := ParseVehicleFilter(c.Query("route"), c.Query("bbox"))
+	if err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid bbox parameter in request: "+err.Error())
+		return
+	}
+
+	updates, unsubscribe := vehicleTracker().Subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	ctx := c.Request.Context()
+	writeTimeout := time.Duration(currentConfig.Server.WriteTimeout)
+	extendWriteDeadline(ctx, writeTimeout)
+
+	_, err = fmt.Fprintf(c.Writer, "retry: %d\n\n", vehicleStreamRetry.Milliseconds())
+	if err == nil {
+		err = writeServerSentEvent(c.Writer, "snapshot", vehicleTracker().Positions(filter, time.Now()))
+	}
+
+	heartbeat := time.NewTicker(time.Duration(currentConfig.Vehicles.StreamHeartbeat))
+	defer heartbeat.Stop()
+
+	for err == nil {
+		select {
+		case <-ctx.Done():
+			return
+		case update, open := <-updates:
+			if !open {
+				return
+			}
+			filtered := update.Filter(filter)
+			if len(filtered.Positions) == 0 && len(filtered.Removed) == 0 {
+				continue
+			}
+			extendWriteDeadline(ctx, writeTimeout)
+			err = writeServerSentEvent(c.Writer, "update", filtered)
+		case <-heartbeat.C:
+			extendWriteDeadline(ctx, writeTimeout)
+			if _, err = io.WriteString(c.Writer, ": heartbeat\n\n"); err == nil {
+				c.Writer.Flush()
+			}
+		}
+	}
+
+	LoggerFromContext(ctx).Info("vehicle stream ended", "error", err)
+}
+
+// writeServerSentEvent writes an event with the data given as JSON to the
+// stream and flushes it, returning the error if it can't be written
+func writeServerSentEvent(writer gin.ResponseWriter, event string, data interface{}) error {
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(writer, "event:%s\ndata:%s\n\n", event, payload); err != nil {
+		return err
+	}
+
+	writer.Flush()
+	return nil
+}
+
+// PostVehicles adds the vehicle positions and trip updates in the GTFS-R feed
+// given as JSON in the request body, as described by IngestVehiclePositions
+func PostVehicles(c *gin.Context) {
+
+	var feed FeedMessage
+	if err := c.ShouldBindJSON(&feed); err != nil {
+		c.IndentedJSON(http.StatusBadRequest, "Invalid GTFS-R feed in request: "+err.Error())
+		return
+	}
+
+	positions, err := IngestVehiclePositions(c.Request.Context(), feed, vehicleTracker())
+	if err != nil {
+		LoggerFromContext(c.Request.Context()).Error("could not ingest vehicle positions", "error", err)
+		c.IndentedJSON(http.StatusInternalServerError, "Vehicle positions could not be ingested")
+		return
+	}
+
+	LoggerFromContext(c.Request.Context()).Info("vehicle positions ingested", "positions", positions)
+	c.IndentedJSON(http.StatusOK, gin.H{"positions": positions})
+}
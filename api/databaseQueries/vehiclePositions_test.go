@@ -0,0 +1,211 @@
+package databaseQueries
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testVehicleFeed holds a vehicle reporting its own position and an update for
+// testTrip, in the NTA GTFS-R JSON format
+const testVehicleFeed = `{
+	"Header": {"GtfsRealtimeVersion": "2.0", "Incrementality": "FULL_DATASET", "Timestamp": "1655283900"},
+	"Entity": [
+		{
+			"Id": "vehicle-1",
+			"Vehicle": {
+				"Trip": {"TripId": "trip-39", "RouteId": "60-39A-b12-1", "DirectionId": 0},
+				"Vehicle": {"Id": "33101", "Label": "SG1"},
+				"Position": {"Latitude": 53.35, "Longitude": -6.26, "Bearing": 180},
+				"Timestamp": "1655283890"
+			}
+		},
+		{
+			"Id": "update-1",
+			"TripUpdate": {
+				"Trip": {"TripId": "trip-46", "RouteId": "60-46A-b12-1", "StartDate": "20220615"},
+				"StopTimeUpdate": [{"StopSequence": 1, "Departure": {"Delay": 0}}]
+			}
+		},
+		{
+			"Id": "update-2",
+			"TripUpdate": {"Trip": {"TripId": "trip-145", "ScheduleRelationship": "CANCELED"}}
+		}
+	]
+}`
+
+// testFindTripStops finds testTrip
+func testFindTripStops(ctx context.Context, tripIds []string) (map[string]tripStops, error) {
+	return map[string]tripStops{"trip-46": testTrip}, nil
+}
+
+func TestVehicleTrackerPrefersReportedPositions(t *testing.T) {
+
+	now := testTripTime(10, 5)
+	tracker := NewVehicleTracker(10 * time.Minute)
+
+	tracker.Update([]VehiclePosition{{TripId: "trip-46", Source: VehicleSourceTripUpdate, Timestamp: now}}, now)
+	if positions := tracker.Positions(VehicleFilter{}, now); len(positions) != 1 || positions[0].Id != "trip:trip-46" {
+		t.Log("Expected the inferred position to be tracked by its trip, got", positions)
+		t.FailNow()
+	}
+
+	tracker.Update([]VehiclePosition{{VehicleId: "33102", TripId: "trip-46",
+		Source: VehicleSourceVehiclePosition, Timestamp: now}}, now)
+	tracker.Update([]VehiclePosition{{TripId: "trip-46", Source: VehicleSourceTripUpdate, Timestamp: now}}, now)
+
+	positions := tracker.Positions(VehicleFilter{}, now)
+	if len(positions) != 1 || positions[0].Id != "33102" {
+		t.Log("Expected only the reported position to be kept, got", positions)
+		t.Fail()
+	}
+}
+
+func TestVehicleTrackerDropsOldPositions(t *testing.T) {
+
+	now := testTripTime(10, 5)
+	tracker := NewVehicleTracker(10 * time.Minute)
+
+	tracker.Update([]VehiclePosition{
+		{VehicleId: "old", Source: VehicleSourceVehiclePosition, Timestamp: now.Add(-11 * time.Minute)},
+		{VehicleId: "new", Source: VehicleSourceVehiclePosition, Timestamp: now},
+	}, now)
+	tracker.Update([]VehiclePosition{
+		{VehicleId: "new", Source: VehicleSourceVehiclePosition, Lat: 1, Timestamp: now.Add(-time.Minute)},
+	}, now)
+
+	positions := tracker.Positions(VehicleFilter{}, now)
+	if len(positions) != 1 || positions[0].Id != "new" || positions[0].Lat != 0 {
+		t.Log("Expected old positions to be dropped and not to replace newer ones, got", positions)
+		t.Fail()
+	}
+}
+
+func TestParseVehicleFilter(t *testing.T) {
+
+	filter, err := ParseVehicleFilter("46a", "-6.30,53.32,-6.22,53.36")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if !filter.Matches(VehiclePosition{RouteNum: "46A", Lat: 53.34, Lon: -6.25}) ||
+		filter.Matches(VehiclePosition{RouteNum: "46A", Lat: 53.40, Lon: -6.25}) ||
+		filter.Matches(VehiclePosition{RouteNum: "39A", Lat: 53.34, Lon: -6.25}) {
+		t.Log("Expected only positions of the route within the box to match")
+		t.Fail()
+	}
+
+	for _, bbox := range []string{"-6.30,53.32,-6.22", "-6.30,53.32,-6.22,north", "-6.22,53.32,-6.30,53.36"} {
+		if _, err = ParseVehicleFilter("", bbox); err == nil {
+			t.Log("Expected an error for the bounding box", bbox)
+			t.Fail()
+		}
+	}
+}
+
+func TestVehicleTrackerSubscribe(t *testing.T) {
+
+	now := testTripTime(10, 5)
+	tracker := NewVehicleTracker(10 * time.Minute)
+	updates, unsubscribe := tracker.Subscribe()
+
+	tracker.Update([]VehiclePosition{
+		{VehicleId: "33101", RouteNum: "39A", Source: VehicleSourceVehiclePosition, Timestamp: now},
+		{VehicleId: "33102", RouteNum: "46A", Source: VehicleSourceVehiclePosition, Timestamp: now},
+	}, now)
+
+	update := (<-updates).Filter(VehicleFilter{RouteNum: "46A"})
+	if len(update.Positions) != 1 || update.Positions[0].Id != "33102" {
+		t.Log("Expected the update to hold the position on route 46A, got", update)
+		t.Fail()
+	}
+
+	unsubscribe()
+	if _, open := <-updates; open {
+		t.Log("Expected the updates to end once unsubscribed")
+		t.Fail()
+	}
+	unsubscribe()
+}
+
+func TestStreamVehiclesEndsOnClose(t *testing.T) {
+
+	previous := vehicleTracker()
+	tracker := NewVehicleTracker(10 * time.Minute)
+	SetVehicleTracker(tracker)
+	defer SetVehicleTracker(previous)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/vehicles/stream", StreamVehicles)
+
+	recorder := httptest.NewRecorder()
+	streamed := make(chan bool)
+	go func() {
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/vehicles/stream", nil))
+		close(streamed)
+	}()
+
+	// Closing the tracker on shutdown ends the stream, as do later subscriptions
+	subscribed := func() bool {
+		tracker.lock.RLock()
+		defer tracker.lock.RUnlock()
+		return len(tracker.subscribers) > 0
+	}
+	for !subscribed() {
+		time.Sleep(time.Millisecond)
+	}
+	CloseVehicleStreams()
+	select {
+	case <-streamed:
+	case <-time.After(time.Second):
+		t.Log("Expected the stream to end once the tracker was closed")
+		t.FailNow()
+	}
+	if !strings.Contains(recorder.Body.String(), "event:snapshot\ndata:[]\n\n") {
+		t.Log("Expected the stream to start with a snapshot, got", recorder.Body.String())
+		t.Fail()
+	}
+	updates, _ := tracker.Subscribe()
+	if _, open := <-updates; open {
+		t.Log("Expected subscriptions to a closed tracker to be ended")
+		t.Fail()
+	}
+}
+
+func TestIngestVehiclePositions(t *testing.T) {
+
+	resolveFeedReferences = testFeedReferences
+	findTripStops = testFindTripStops
+	defer func() {
+		resolveFeedReferences = FindFeedReferences
+		findTripStops = FindTripStops
+	}()
+
+	var feed FeedMessage
+	if err := json.Unmarshal([]byte(testVehicleFeed), &feed); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	feed.Header.Timestamp = FeedTime(testTripTime(10, 5).Unix())
+
+	tracker := NewVehicleTracker(time.Hour * 24 * 365 * 100)
+	found, err := IngestVehiclePositions(context.Background(), feed, tracker)
+	if err != nil || found != 2 {
+		t.Log("Expected a reported and an inferred position, got", found, err)
+		t.FailNow()
+	}
+
+	positions := tracker.Positions(VehicleFilter{}, time.Now())
+	if len(positions) != 2 || positions[0].Id != "33101" || positions[0].RouteNum != "39A" ||
+		positions[0].DirectionId != "0" || positions[1].Id != "trip:trip-46" || positions[1].RouteNum != "46A" {
+		t.Log("Expected the positions of both trips, got", positions)
+		t.Fail()
+	}
+}
@@ -0,0 +1,225 @@
+package databaseQueries
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// cacheKindWeather is the kind of cached result holding the weather readings
+// stored in Mongo
+const cacheKindWeather = "weather"
+
+// ErrNoWeather is returned by a WeatherProvider with no reading close enough
+// to the instant asked about
+var ErrNoWeather = errors.New("no weather reading near the instant")
+
+// WeatherConditions is the weather at an instant, with the temperature in
+// degrees Celsius, the precipitation in millimetres per hour and the wind speed
+// in metres per second. The source is "forecast" or "current"
+type WeatherConditions struct {
+	At            time.Time `json:"at"`
+	Temperature   float64   `json:"temperature"`
+	Precipitation float64   `json:"precipitation"`
+	WindSpeed     float64   `json:"wind_speed"`
+	Source        string    `json:"source"`
+}
+
+// WeatherProvider gives the weather expected at an instant
+type WeatherProvider interface {
+	// WeatherAt returns the weather at the instant, or ErrNoWeather if nothing
+	// is known about it
+	WeatherAt(ctx context.Context, instant time.Time) (WeatherConditions, error)
+}
+
+// owmReading is a reading in the OpenWeatherMap format stored by the weather
+// scrapers, either a single current reading or an entry in the list of a
+// forecast. Rain and snow are keyed by the hours they fell over, "1h" or "3h"
+type owmReading struct {
+	Dt   int64 `bson:"dt"`
+	Main struct {
+		Temp float64 `bson:"temp"`
+	} `bson:"main"`
+	Wind struct {
+		Speed float64 `bson:"speed"`
+	} `bson:"wind"`
+	Rain map[string]float64 `bson:"rain"`
+	Snow map[string]float64 `bson:"snow"`
+}
+
+// owmForecast is the forecast document stored by the forecast scraper, holding
+// a reading for every three hours of the coming days
+type owmForecast struct {
+	List []owmReading `bson:"list"`
+}
+
+// conditions returns the reading as WeatherConditions from the source, with the
+// rain and snow over the longest period given spread out to an hourly rate
+func (reading owmReading) conditions(source string) WeatherConditions {
+
+	conditions := WeatherConditions{
+		At:          time.Unix(reading.Dt, 0).UTC(),
+		Temperature: reading.Main.Temp,
+		WindSpeed:   reading.Wind.Speed,
+		Source:      source,
+	}
+	for _, fallen := range []map[string]float64{reading.Rain, reading.Snow} {
+		if amount, ok := fallen["3h"]; ok {
+			conditions.Precipitation += amount / 3
+		} else if amount, ok := fallen["1h"]; ok {
+			conditions.Precipitation += amount
+		}
+	}
+
+	return conditions
+}
+
+// nearestWeather returns the reading closest to the instant as long as it is no
+// further than maxGap away from it
+func nearestWeather(readings []WeatherConditions, instant time.Time, maxGap time.Duration) (WeatherConditions, bool) {
+
+	var nearest WeatherConditions
+	found := false
+	for _, reading := range readings {
+		gap := time.Duration(math.Abs(float64(reading.At.Sub(instant))))
+		if gap > maxGap {
+			continue
+		}
+		if !found || gap < time.Duration(math.Abs(float64(nearest.At.Sub(instant)))) {
+			nearest, found = reading, true
+		}
+	}
+
+	return nearest, found
+}
+
+// MongoWeatherProvider is a WeatherProvider reading the forecast and current
+// weather collections filled by the weather scrapers. The readings are cached
+// together, so Mongo is read at most once each cache time to live
+type MongoWeatherProvider struct {
+	database string
+	forecast string
+	current  string
+	maxGap   time.Duration
+	cacheTTL time.Duration
+}
+
+// NewMongoWeatherProvider returns a MongoWeatherProvider using the named
+// database and collections, trusting readings up to maxGap from an instant
+func NewMongoWeatherProvider(weatherConfig WeatherConfig) *MongoWeatherProvider {
+	return &MongoWeatherProvider{
+		database: weatherConfig.Database,
+		forecast: weatherConfig.ForecastCollection,
+		current:  weatherConfig.CurrentCollection,
+		maxGap:   time.Duration(weatherConfig.MaxGap),
+		cacheTTL: time.Duration(weatherConfig.CacheTTL),
+	}
+}
+
+// WeatherAt returns the forecast or current reading nearest to the instant
+func (provider *MongoWeatherProvider) WeatherAt(ctx context.Context, instant time.Time) (WeatherConditions, error) {
+
+	var readings []WeatherConditions
+	if !resultCache().GetJSON(cacheKindWeather, provider.database, &readings) {
+		var err error
+		if readings, err = provider.findReadings(ctx); err != nil {
+			return WeatherConditions{}, err
+		}
+		resultCache().SetJSON(cacheKindWeather, provider.database, readings, provider.cacheTTL)
+	}
+
+	conditions, found := nearestWeather(readings, instant, provider.maxGap)
+	if !found {
+		return conditions, ErrNoWeather
+	}
+
+	return conditions, nil
+}
+
+// findReadings returns every reading in the forecast along with the latest
+// current reading
+func (provider *MongoWeatherProvider) findReadings(requestCtx context.Context) ([]WeatherConditions, error) {
+
+	collection, ctx, disconnect, err := openCollection(requestCtx, provider.forecast)
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect()
+	database := collection.Database().Client().Database(provider.database)
+
+	readings := []WeatherConditions{}
+	cursor, err := database.Collection(provider.forecast).Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var forecasts []owmForecast
+	if err = cursor.All(ctx, &forecasts); err != nil {
+		return nil, err
+	}
+	for _, forecast := range forecasts {
+		for _, reading := range forecast.List {
+			readings = append(readings, reading.conditions("forecast"))
+		}
+	}
+
+	cursor, err = database.Collection(provider.current).Find(ctx, bson.D{},
+		options.Find().SetSort(bson.D{{Key: "dt", Value: -1}}).SetLimit(1))
+	if err != nil {
+		return nil, err
+	}
+	var current []owmReading
+	if err = cursor.All(ctx, &current); err != nil {
+		return nil, err
+	}
+	for _, reading := range current {
+		readings = append(readings, reading.conditions("current"))
+	}
+
+	return readings, nil
+}
+
+// noWeatherProvider is the WeatherProvider used when weather is turned off,
+// which knows nothing about the weather
+type noWeatherProvider struct{}
+
+// WeatherAt always returns ErrNoWeather
+func (noWeatherProvider) WeatherAt(ctx context.Context, instant time.Time) (WeatherConditions, error) {
+	return WeatherConditions{}, ErrNoWeather
+}
+
+var sharedWeatherProvider WeatherProvider
+var sharedWeatherProviderOnce sync.Once
+
+// weatherProvider returns the WeatherProvider shared by the whole package,
+// creating it from the weather configuration the first time it is called unless
+// SetWeatherProvider has already been used to provide one
+func weatherProvider() WeatherProvider {
+	sharedWeatherProviderOnce.Do(func() {
+		if sharedWeatherProvider == nil {
+			sharedWeatherProvider = newWeatherProvider(currentConfig.Weather)
+		}
+	})
+	return sharedWeatherProvider
+}
+
+// SetWeatherProvider replaces the WeatherProvider shared by the package
+func SetWeatherProvider(provider WeatherProvider) {
+	sharedWeatherProviderOnce.Do(func() {})
+	sharedWeatherProvider = provider
+}
+
+// newWeatherProvider returns the WeatherProvider named by the configuration
+func newWeatherProvider(weatherConfig WeatherConfig) WeatherProvider {
+
+	if strings.ToLower(weatherConfig.Provider) == "none" {
+		return noWeatherProvider{}
+	}
+
+	return NewMongoWeatherProvider(weatherConfig)
+}
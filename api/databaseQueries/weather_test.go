@@ -0,0 +1,42 @@
+package databaseQueries
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOwmReadingConditions(t *testing.T) {
+
+	var reading owmReading
+	reading.Dt = 1655283600
+	reading.Main.Temp = 16.2
+	reading.Wind.Speed = 4.1
+	reading.Rain = map[string]float64{"3h": 1.5}
+	reading.Snow = map[string]float64{"1h": 0.25}
+
+	conditions := reading.conditions("forecast")
+	if !conditions.At.Equal(time.Unix(1655283600, 0)) || conditions.Temperature != 16.2 ||
+		conditions.WindSpeed != 4.1 || conditions.Precipitation != 0.75 || conditions.Source != "forecast" {
+		t.Log("Expected the rain to be spread over three hours and added to the snow, got", conditions)
+		t.Fail()
+	}
+}
+
+func TestNearestWeather(t *testing.T) {
+
+	noon := time.Date(2022, 6, 15, 12, 0, 0, 0, time.UTC)
+	readings := []WeatherConditions{
+		{At: noon.Add(-3 * time.Hour), Temperature: 12},
+		{At: noon.Add(time.Hour), Temperature: 17},
+		{At: noon.Add(4 * time.Hour), Temperature: 15},
+	}
+
+	if nearest, found := nearestWeather(readings, noon, 3*time.Hour); !found || nearest.Temperature != 17 {
+		t.Log("Expected the reading an hour after noon, got", nearest, found)
+		t.Fail()
+	}
+	if nearest, found := nearestWeather(readings, noon.Add(10*time.Hour), 3*time.Hour); found {
+		t.Log("Expected no reading within three hours of ten at night, got", nearest)
+		t.Fail()
+	}
+}
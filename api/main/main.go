@@ -1,28 +1,176 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"example.com/api/databaseQueries"
 	"github.com/gin-gonic/gin"
-	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-// Main function contains the routed URIs mapped to functions and starts
-// the server engine
+// Main function loads the configuration, contains the routed URIs mapped to
+// functions and runs the server until it receives SIGINT or SIGTERM, at which
+// point in-flight requests are given time to finish before it exits. Run as
+// "api matrix -origins zones.csv [-- configuration flags]" it instead writes a
+// travel time matrix to stdout and exits
 func main() {
 
-	router := gin.Default()
+	logger := databaseQueries.DefaultLogger()
+
+	args := os.Args[1:]
+	var matrixCommand *databaseQueries.MatrixCommand
+	if len(args) > 0 && args[0] == "matrix" {
+		command, configArgs, err := databaseQueries.ParseMatrixCommand(args[1:])
+		if err != nil {
+			logger.Error("invalid matrix command", "error", err)
+			os.Exit(2)
+		}
+		matrixCommand, args = &command, configArgs
+	}
+
+	config, err := databaseQueries.LoadConfig(args, os.LookupEnv)
+	if err != nil {
+		logger.Error("could not load configuration", "error", err)
+		os.Exit(2)
+	}
+	databaseQueries.Configure(config)
+
+	if matrixCommand != nil {
+		runMatrix(*matrixCommand)
+		return
+	}
+
+	router := gin.New()
+	router.Use(gin.Recovery(), databaseQueries.RequestLogger(), databaseQueries.RequestMetrics(),
+		databaseQueries.CORS())
+	if err = router.SetTrustedProxies(config.Server.TrustedProxies); err != nil {
+		logger.Error("invalid trusted proxies", "error", err)
+		os.Exit(2)
+	}
+
+	// Public queries, checked for an api key and rate limited
+	public := router.Group("/", databaseQueries.APIKeyAuth(), databaseQueries.RateLimit())
 
 	// Bus Stop specific queries
-	router.GET("/databases", databaseQueries.GetDatabases)
-	router.GET("/stop/findByAddress/:stopSearch", databaseQueries.GetStopsList)
+	public.GET("/stop/findByAddress/:stopSearch", databaseQueries.GetStopsList)
+	public.GET("/stops/:stopNumber", databaseQueries.GetStopDetail)
 
 	// Bus Route queries
-	router.GET("route/matchingRoute/:origin/:destination/:timeType/:time",
+	public.GET("route/matchingRoute/:origin/:destination/:timeType/:time",
 		databaseQueries.FindMatchingRoute)
-	router.GET("findNearByStopsTest/:coordinates", databaseQueries.FindNearbyStopsAPI)
+	public.GET("findNearByStopsTest/:coordinates", databaseQueries.FindNearbyStopsAPI)
+
+	// Route catalogue queries
+	public.GET("/routes", databaseQueries.GetRoutes)
+	public.GET("/routes/:routeNum", databaseQueries.GetRoute)
+	public.GET("/routes/:routeNum/:direction/stops", databaseQueries.GetRouteStops)
+	public.GET("/routes/:routeNum/:direction/timetable", databaseQueries.GetRouteTimetable)
+	public.GET("/isochrone", databaseQueries.GetIsochrone)
+	public.POST("/matrix", databaseQueries.PostMatrix)
+
+	// Saved journey queries, kept apart by api key and user id
+	public.GET("/me", databaseQueries.GetJourneyProfile)
+	public.DELETE("/me", databaseQueries.DeleteJourneyProfile)
+	public.PUT("/me/places/:name", databaseQueries.PutSavedPlace)
+	public.DELETE("/me/places/:name", databaseQueries.DeleteSavedPlace)
+	public.PUT("/me/commutes/:name", databaseQueries.PutCommute)
+	public.DELETE("/me/commutes/:name", databaseQueries.DeleteCommute)
+	public.GET("/me/plan", databaseQueries.GetJourneyPlan)
+
+	// Service alert queries
+	public.GET("/alerts", databaseQueries.GetAlerts)
+
+	// Vehicle position queries
+	public.GET("/vehicles", databaseQueries.GetVehicles)
+	public.GET("/vehicles/stream", databaseQueries.StreamVehicles)
+
+	// Analytics queries over the delay archive
+	public.GET("/analytics/delays", databaseQueries.GetDelayAnalytics)
+	public.GET("/analytics/reliability", databaseQueries.GetReliabilityAnalytics)
+
+	// Cache queries
+	router.GET("/cache/stats", databaseQueries.GetCacheStats)
+
+	// Operational queries
+	router.GET("/metrics", databaseQueries.GetMetrics)
+	router.GET("/healthz", databaseQueries.GetHealth)
+	router.GET("/readyz", databaseQueries.GetReadiness)
+	router.GET("/realtime/status", databaseQueries.GetRealtimeStatus)
+
+	// Admin queries, only served with the admin token
+	admin := router.Group("/", databaseQueries.AdminAuth())
+	admin.GET("/databases", databaseQueries.GetDatabases)
+	admin.POST("/cache/invalidate", databaseQueries.InvalidateCache)
+	admin.POST("/accessibility/import", databaseQueries.PostTripAccessibilityImport)
+	admin.POST("/alerts", databaseQueries.PostAlerts)
+	admin.POST("/vehicles", databaseQueries.PostVehicles)
+
+	server := &http.Server{
+		Addr:              config.Server.ListenAddress,
+		Handler:           router,
+		ReadTimeout:       time.Duration(config.Server.ReadTimeout),
+		ReadHeaderTimeout: time.Duration(config.Server.ReadHeaderTimeout),
+		WriteTimeout:      time.Duration(config.Server.WriteTimeout),
+		IdleTimeout:       time.Duration(config.Server.IdleTimeout),
+		ConnContext:       databaseQueries.ConnContext,
+	}
+
+	// Streams never finish on their own, so they are ended as shutdown starts
+	server.RegisterOnShutdown(databaseQueries.CloseVehicleStreams)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// The GTFS-R feeds are polled in the background until the api is stopped
+	if _, err = databaseQueries.StartRealtimePoller(ctx, config.Realtime); err != nil {
+		logger.Error("could not start the realtime poller", "error", err)
+		os.Exit(2)
+	}
+
+	// The server runs in its own goroutine so that main can wait for a signal
+	serverErrors := make(chan error, 1)
+	go func() {
+		logger.Info("api listening", "address", server.Addr, "tls", config.Server.TLSEnabled())
+		if config.Server.TLSEnabled() {
+			serverErrors <- server.ListenAndServeTLS(config.Server.TLSCertFile, config.Server.TLSKeyFile)
+		} else {
+			serverErrors <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err = <-serverErrors:
+		logger.Error("server stopped", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down, waiting for in-flight requests to finish",
+		"timeout", time.Duration(config.Server.ShutdownTimeout).String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Server.ShutdownTimeout))
+	defer cancel()
+
+	if err = server.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("in-flight requests did not finish before the shutdown timeout", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("server stopped")
+}
+
+// runMatrix writes the travel time matrix asked for to stdout, stopping early
+// on SIGINT or SIGTERM
+func runMatrix(command databaseQueries.MatrixCommand) {
 
-	err := router.Run("0.0.0.0:8080")
+	logger := databaseQueries.DefaultLogger()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	err := command.Run(ctx, os.Stdout)
+	stop()
 	if err != nil {
-		log.Fatal(err)
+		logger.Error("could not plan the matrix", "error", err)
+		os.Exit(1)
 	}
 }
@@ -2,7 +2,7 @@
 import json
 
 import bson
-from flask import Flask, jsonify
+from flask import Flask, jsonify, request
 import pandas as pd
 import pickle
 from pymongo import MongoClient
@@ -21,25 +21,10 @@ uri = connectionsconfig['uri']
 # flask app into variable
 app = Flask(__name__)
 
-@app.route('/prediction/<line>/<dir_>/<day>/<hour>/<month>/<departure_time>/<date_txt>', methods=['GET', 'POST'])
-def get_prediction(line, dir_, day,hour, month,departure_time,date_txt): #full_date_hour
-# allow prediction model on analytics page to take user inputs as prediction model parameters
-
-# print url parameters 
-    print('line:', line, ', direction:',dir_, ', day:',day,', hour:', hour, ', month:', month, ',      departure_time:', departure_time, ', date_txt:', date_txt)
-
-# change date_txt to ensure it matches the hour in mongo
-    date_split = date_txt.split(" ")
-    time = date_split[1]
-    time_split = time.split(":")
-    time_split[1] = "00"
-    time_split[2] = "00"
-    format_time = time_split[0]+":"+time_split[1]+":"+time_split[2]
-    format_date = date_split[0]+" "+format_time
-
-# open pickle file and load into variable clf
-    with open("/usr/local/dublinbus/data/ml/Pickles/" + f'RF_{line}_Model_dir{dir_}.pkl', 'rb') as pickle_file:
-        clf = pickle.load(pickle_file)
+# read the forecast temperature for the hour from mongo, as the go api did not
+# send one before version 2 of its features
+def forecast_temp(format_date):
+    mongo_temp = None
 
 # Establishing connection
     try:
@@ -81,6 +66,33 @@ def get_prediction(line, dir_, day,hour, month,departure_time,date_txt): #full_d
             mongo_temp = (doc[value])
             # print(mongo_temp)
 
+    return mongo_temp
+
+@app.route('/prediction/<line>/<dir_>/<day>/<hour>/<month>/<departure_time>/<date_txt>', methods=['GET', 'POST'])
+def get_prediction(line, dir_, day,hour, month,departure_time,date_txt): #full_date_hour
+# allow prediction model on analytics page to take user inputs as prediction model parameters
+
+# print url parameters 
+    print('line:', line, ', direction:',dir_, ', day:',day,', hour:', hour, ', month:', month, ',      departure_time:', departure_time, ', date_txt:', date_txt)
+
+# change date_txt to ensure it matches the hour in mongo
+    date_split = date_txt.split(" ")
+    time = date_split[1]
+    time_split = time.split(":")
+    time_split[1] = "00"
+    time_split[2] = "00"
+    format_time = time_split[0]+":"+time_split[1]+":"+time_split[2]
+    format_date = date_split[0]+" "+format_time
+
+# open pickle file and load into variable clf
+    with open("/usr/local/dublinbus/data/ml/Pickles/" + f'RF_{line}_Model_dir{dir_}.pkl', 'rb') as pickle_file:
+        clf = pickle.load(pickle_file)
+
+# the go api sends the temperature with version 2 of its features, so mongo is
+# only read for requests that come without it
+    mongo_temp = request.args.get('temp', type=float)
+    if mongo_temp is None:
+        mongo_temp = forecast_temp(format_date)
 
         # get form values
     direction = f'{dir_}'#from go api
@@ -1,6 +1,5 @@
 #!/bin/bash
 
-nohup python3 -u RealTimeBusDataScraping.py &
+# The GTFS-R feeds are polled by the api, see the realtime section of its configuration
 nohup python3 -u WeatherCurrent.py &
-nohup python3 -u StoreGTFSR.py &
 python3 -u WeatherForecast.py
\ No newline at end of file